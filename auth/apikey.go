@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+const (
+	keyPrefix  = "sk-"
+	hashPrefix = "sha256:"
+)
+
+// APIKey is stored by its hash, the secret is only known to its holder.
+type APIKey struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+	Subject string     `json:"subject"`
+	Tenant  string     `json:"tenant"`
+	Scopes  []string   `json:"scopes,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Static  bool       `json:"static,omitempty"` // from the config, cannot be revoked
+}
+
+func (key *APIKey) Identity() *Identity {
+	return &Identity{
+		Subject: key.Subject,
+		Tenant:  key.Tenant,
+		Scopes:  key.Scopes,
+	}
+}
+
+// HashKey returns the hash identifying the secret in the store.
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new random secret.
+func GenerateKey() (string, error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return keyPrefix + base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+func generateID() (string, error) {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return "key_" + hex.EncodeToString(bs), nil
+}
+
+// KeyStore authenticates API keys, either static ones from the config
+// or managed ones created at runtime and kept in a JSON file.
+type KeyStore struct {
+	path string
+	keys map[string]*APIKey // by hash
+	byID map[string]*APIKey
+
+	sync.RWMutex
+}
+
+// NewKeyStore loads the managed keys at path, if any, next to the static keys.
+// An empty path keeps managed keys in memory only.
+func NewKeyStore(path string, static ...*APIKey) (*KeyStore, error) {
+	store := &KeyStore{
+		path: path,
+		keys: make(map[string]*APIKey),
+		byID: make(map[string]*APIKey),
+	}
+
+	for _, key := range static {
+		key := *key
+		key.Static = true
+
+		if !strings.HasPrefix(key.Hash, hashPrefix) {
+			return nil, fmt.Errorf("api key %s: hash must start with %s", key.ID, hashPrefix)
+		}
+
+		if err := store.add(&key); err != nil {
+			return nil, err
+		}
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+
+		return nil, err
+	}
+
+	var managed []*APIKey
+	if err := json.Unmarshal(bs, &managed); err != nil {
+		return nil, err
+	}
+
+	for _, key := range managed {
+		key.Static = false
+		if err := store.add(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (store *KeyStore) add(key *APIKey) error {
+	if key.ID == "" {
+		return errors.New("api key without id")
+	}
+
+	if _, ok := store.byID[key.ID]; ok {
+		return fmt.Errorf("duplicate api key id: %s", key.ID)
+	}
+
+	if _, ok := store.keys[key.Hash]; ok {
+		return fmt.Errorf("duplicate api key: %s", key.ID)
+	}
+
+	store.keys[key.Hash] = key
+	store.byID[key.ID] = key
+	return nil
+}
+
+func (store *KeyStore) Authenticate(token string) (*Identity, error) {
+	store.RLock()
+	key, ok := store.keys[HashKey(token)]
+	store.RUnlock()
+
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	return key.Identity(), nil
+}
+
+// Create adds a managed key and returns it with its secret,
+// which is not kept and cannot be shown again.
+func (store *KeyStore) Create(name string, subject string, tenant string, scopes []string) (*APIKey, string, error) {
+	if subject == "" {
+		return nil, "", errors.New("subject required")
+	}
+
+	secret, err := GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := generateID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+
+	key := &APIKey{
+		ID:      id,
+		Name:    name,
+		Hash:    HashKey(secret),
+		Subject: subject,
+		Tenant:  tenant,
+		Scopes:  scopes,
+		Created: &now,
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.add(key); err != nil {
+		return nil, "", err
+	}
+
+	if err := store.save(); err != nil {
+		delete(store.keys, key.Hash)
+		delete(store.byID, key.ID)
+		return nil, "", err
+	}
+
+	return key, secret, nil
+}
+
+// List returns the keys of the tenant, ordered by ID and without their hash.
+func (store *KeyStore) List(tenant string) []*APIKey {
+	store.RLock()
+	defer store.RUnlock()
+
+	keys := make([]*APIKey, 0)
+	for _, key := range store.byID {
+		if key.Tenant == tenant {
+			clone := *key
+			clone.Hash = ""
+			keys = append(keys, &clone)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys
+}
+
+// Revoke removes a managed key of the tenant.
+func (store *KeyStore) Revoke(tenant string, id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	key, ok := store.byID[id]
+	if !ok || key.Tenant != tenant {
+		return ErrKeyNotFound
+	}
+
+	if key.Static {
+		return errors.New("static api keys are revoked in the config")
+	}
+
+	delete(store.keys, key.Hash)
+	delete(store.byID, key.ID)
+
+	if err := store.save(); err != nil {
+		store.keys[key.Hash] = key
+		store.byID[key.ID] = key
+		return err
+	}
+
+	return nil
+}
+
+// save writes the managed keys atomically, the caller holds the lock.
+func (store *KeyStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	managed := make([]*APIKey, 0)
+	for _, key := range store.byID {
+		if !key.Static {
+			managed = append(managed, key)
+		}
+	}
+
+	sort.Slice(managed, func(i, j int) bool {
+		return managed[i].ID < managed[j].ID
+	})
+
+	bs, err := json.MarshalIndent(managed, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(store.path), ".apikeys-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), store.path)
+}
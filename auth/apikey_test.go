@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+
+	ci := &APIKey{ID: "ci", Hash: HashKey("sk-static"), Subject: "ci-bot", Tenant: "acme", Scopes: []string{AdminScope}}
+
+	store, err := NewKeyStore(path, ci)
+	require.NoError(err)
+
+	id, err := store.Authenticate("sk-static")
+	require.NoError(err)
+	assert.Equal(&Identity{Subject: "ci-bot", Tenant: "acme", Scopes: []string{AdminScope}}, id)
+
+	_, err = store.Authenticate("sk-unknown")
+	assert.ErrorIs(err, ErrUnauthenticated)
+
+	key, secret, err := store.Create("laptop", "alice", "acme", nil)
+	require.NoError(err)
+
+	bs, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.NotContains(string(bs), secret)
+
+	id, err = store.Authenticate(secret)
+	require.NoError(err)
+	assert.Equal("alice", id.Subject)
+
+	keys := store.List("acme")
+	assert.Len(keys, 2)
+	assert.Empty(store.List("umbrella"))
+
+	for _, k := range keys {
+		assert.Empty(k.Hash)
+	}
+
+	// managed keys survive a restart, static ones come from the config
+	reopened, err := NewKeyStore(path)
+	require.NoError(err)
+
+	_, err = reopened.Authenticate(secret)
+	assert.NoError(err)
+
+	_, err = reopened.Authenticate("sk-static")
+	assert.Error(err)
+
+	// tenants only see their own keys
+	assert.ErrorIs(reopened.Revoke("umbrella", key.ID), ErrKeyNotFound)
+	assert.NoError(reopened.Revoke("acme", key.ID))
+
+	_, err = reopened.Authenticate(secret)
+	assert.Error(err)
+
+	assert.Error(store.Revoke("acme", "ci"))
+
+	_, err = NewKeyStore("", &APIKey{ID: "plain", Hash: "sk-plain"})
+	assert.Error(err)
+}
+
+func TestChain(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewKeyStore("", &APIKey{ID: "ci", Hash: HashKey("sk-static"), Subject: "ci-bot"})
+	assert.NoError(err)
+
+	expired := AuthenticatorFunc(func(token string) (*Identity, error) {
+		return nil, invalidToken("token expired")
+	})
+
+	_, err = Chain(store).Authenticate("a.b.c")
+	assert.True(errors.Is(err, ErrUnauthenticated))
+
+	id, err := Chain(expired, store).Authenticate("sk-static")
+	assert.NoError(err)
+	assert.Equal("ci-bot", id.Subject)
+
+	_, err = Chain(store, expired).Authenticate("a.b.c")
+	assert.ErrorContains(err, "token expired")
+}
@@ -0,0 +1,37 @@
+package auth
+
+// Authenticator maps the bearer token of a request to an identity,
+// failing with ErrUnauthenticated, possibly wrapped with the reason.
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+// Chain tries the authenticators in order, the first accepting the token wins.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+type chain []Authenticator
+
+func (c chain) Authenticate(token string) (*Identity, error) {
+	err := ErrUnauthenticated
+	for _, authenticator := range c {
+		id, e := authenticator.Authenticate(token)
+		if e == nil {
+			return id, nil
+		}
+
+		// keep the reason given by the authenticator recognizing the token
+		if e != ErrUnauthenticated {
+			err = e
+		}
+	}
+
+	return nil, err
+}
+
+type AuthenticatorFunc func(token string) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(token string) (*Identity, error) {
+	return f(token)
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"path/filepath"
+
+	"github.com/mirror520/openai/conf"
+)
+
+// NewAuthenticator returns the authenticators enabled in the config, nil
+// if none is, and the key store when API keys are enabled. Relative files
+// are in the work directory path.
+func NewAuthenticator(cfg conf.Auth, path string) (Authenticator, *KeyStore, error) {
+	var (
+		authenticators []Authenticator
+		keys           *KeyStore
+	)
+
+	if cfg.Keys.Enabled {
+		static := make([]*APIKey, 0, len(cfg.Keys.Static))
+		for _, key := range cfg.Keys.Static {
+			hash := key.Hash
+			if key.Key != "" {
+				hash = HashKey(key.Key)
+			}
+
+			static = append(static, &APIKey{
+				ID:      key.ID,
+				Hash:    hash,
+				Subject: key.Subject,
+				Tenant:  key.Tenant,
+				Scopes:  key.Scopes,
+			})
+		}
+
+		file := cfg.Keys.File
+		if file != "" && !filepath.IsAbs(file) {
+			file = filepath.Join(path, file)
+		}
+
+		store, err := NewKeyStore(file, static...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys = store
+		authenticators = append(authenticators, store)
+	}
+
+	if cfg.JWT.Enabled {
+		jwks := cfg.JWT.JWKS
+		if !filepath.IsAbs(jwks) {
+			jwks = filepath.Join(path, jwks)
+		}
+
+		verifier, err := NewJWTVerifier(JWTOptions{
+			JWKS:         jwks,
+			Issuer:       cfg.JWT.Issuer,
+			Audience:     cfg.JWT.Audience,
+			Leeway:       cfg.JWT.Leeway,
+			SubjectClaim: cfg.JWT.Claims.Subject,
+			TenantClaim:  cfg.JWT.Claims.Tenant,
+			ScopesClaim:  cfg.JWT.Claims.Scopes,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		authenticators = append(authenticators, verifier)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, nil, nil
+	}
+
+	return Chain(authenticators...), keys, nil
+}
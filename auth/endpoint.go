@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+type KeyEndpoints struct {
+	CreateKeyEndpoint endpoint.Endpoint
+	ListKeysEndpoint  endpoint.Endpoint
+	RevokeKeyEndpoint endpoint.Endpoint
+}
+
+func MakeKeyEndpoints(store *KeyStore) *KeyEndpoints {
+	return &KeyEndpoints{
+		CreateKeyEndpoint: CreateKeyEndpoint(store),
+		ListKeysEndpoint:  ListKeysEndpoint(store),
+		RevokeKeyEndpoint: RevokeKeyEndpoint(store),
+	}
+}
+
+// admin returns the caller if it may manage the keys of its tenant.
+func admin(ctx context.Context) (*Identity, error) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	if !id.IsAdmin() {
+		return nil, ErrForbidden
+	}
+
+	return id, nil
+}
+
+// AdminMiddleware restricts the endpoint to admins.
+func AdminMiddleware(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (any, error) {
+		if _, err := admin(ctx); err != nil {
+			return nil, err
+		}
+
+		return next(ctx, request)
+	}
+}
+
+type CreateKeyRequest struct {
+	Name    string   `json:"name"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+// CreatedKey is the only response carrying the secret of a key.
+type CreatedKey struct {
+	*APIKey
+	Secret string `json:"secret"`
+}
+
+func CreateKeyEndpoint(store *KeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*CreateKeyRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		id, err := admin(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		key, secret, err := store.Create(req.Name, req.Subject, id.Tenant, req.Scopes)
+		if err != nil {
+			return nil, err
+		}
+
+		created := *key
+		created.Hash = ""
+
+		return &CreatedKey{&created, secret}, nil
+	}
+}
+
+func ListKeysEndpoint(store *KeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		id, err := admin(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return store.List(id.Tenant), nil
+	}
+}
+
+type RevokeKeyRequest struct {
+	ID string `json:"-"`
+}
+
+func RevokeKeyEndpoint(store *KeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*RevokeKeyRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		id, err := admin(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := store.Revoke(id.Tenant, req.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// AdminScope grants access to every chat of the tenant.
+const AdminScope = "admin"
+
+// Identity is the authenticated caller.
+type Identity struct {
+	Subject string   `json:"subject"`
+	Tenant  string   `json:"tenant"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (id *Identity) IsAdmin() bool {
+	return id.HasScope(AdminScope)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok && id != nil
+}
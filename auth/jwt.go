@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTOptions tell how bearer tokens are verified and mapped to an identity.
+type JWTOptions struct {
+	JWKS     string        // path of the JSON Web Key Set
+	Issuer   string        // expected iss, empty skips the check
+	Audience string        // expected in aud, empty skips the check
+	Leeway   time.Duration // clock skew allowed on exp and nbf
+
+	SubjectClaim string // default "sub"
+	TenantClaim  string // default "tenant"
+	ScopesClaim  string // default "scope", space separated or an array
+}
+
+// JWTVerifier authenticates JWTs signed by one of the keys in a local JWKS
+// file. The file is read again when a token names an unknown key, so keys
+// can be rotated without a restart.
+type JWTVerifier struct {
+	opts JWTOptions
+
+	keys     []*jwk
+	modified time.Time
+
+	sync.Mutex
+}
+
+func NewJWTVerifier(opts JWTOptions) (*JWTVerifier, error) {
+	if opts.JWKS == "" {
+		return nil, errors.New("jwks path required")
+	}
+
+	if opts.SubjectClaim == "" {
+		opts.SubjectClaim = "sub"
+	}
+
+	if opts.TenantClaim == "" {
+		opts.TenantClaim = "tenant"
+	}
+
+	if opts.ScopesClaim == "" {
+		opts.ScopesClaim = "scope"
+	}
+
+	v := &JWTVerifier{opts: opts}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return err
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return errors.New("invalid rsa exponent")
+		}
+
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return errors.New("unsupported curve: " + k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("point not on curve")
+		}
+
+		k.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	default:
+		return errors.New("unsupported key type: " + k.Kty)
+	}
+
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// load reads the JWKS file if it changed, the caller holds the lock
+// unless the verifier is being created.
+func (v *JWTVerifier) load() error {
+	info, err := os.Stat(v.opts.JWKS)
+	if err != nil {
+		return err
+	}
+
+	if !info.ModTime().After(v.modified) {
+		return nil
+	}
+
+	bs, err := os.ReadFile(v.opts.JWKS)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(bs, &set); err != nil {
+		return err
+	}
+
+	keys := make([]*jwk, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if err := k.parse(); err != nil {
+			return fmt.Errorf("jwk %s: %w", k.Kid, err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	v.keys = keys
+	v.modified = info.ModTime()
+	return nil
+}
+
+// candidates returns the keys able to verify the token header.
+func (v *JWTVerifier) candidates(kid string, alg string) []*jwk {
+	v.Lock()
+	defer v.Unlock()
+
+	find := func() []*jwk {
+		keys := make([]*jwk, 0)
+		for _, k := range v.keys {
+			if kid != "" && k.Kid != kid {
+				continue
+			}
+
+			if k.Alg != "" && k.Alg != alg {
+				continue
+			}
+
+			keys = append(keys, k)
+		}
+
+		return keys
+	}
+
+	keys := find()
+	if len(keys) == 0 && kid != "" {
+		if err := v.load(); err == nil {
+			keys = find()
+		}
+	}
+
+	return keys
+}
+
+func invalidToken(reason string) error {
+	return fmt.Errorf("%w: %s", ErrUnauthenticated, reason)
+}
+
+func (v *JWTVerifier) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// not a JWT, maybe an API key
+		return nil, ErrUnauthenticated
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range v.candidates(header.Kid, header.Alg) {
+		if err := verify(header.Alg, k.key, signed, signature); err == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, invalidToken("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+
+	if err := v.validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims[v.opts.SubjectClaim].(string)
+	if subject == "" {
+		return nil, invalidToken("missing " + v.opts.SubjectClaim)
+	}
+
+	tenant, _ := claims[v.opts.TenantClaim].(string)
+
+	return &Identity{
+		Subject: subject,
+		Tenant:  tenant,
+		Scopes:  stringList(claims[v.opts.ScopesClaim]),
+	}, nil
+}
+
+func (v *JWTVerifier) validate(claims map[string]any, now time.Time) error {
+	leeway := v.opts.Leeway
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return invalidToken("missing exp")
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return invalidToken("token expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return invalidToken("token not yet valid")
+		}
+	}
+
+	if v.opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.opts.Issuer {
+			return invalidToken("unexpected issuer")
+		}
+	}
+
+	if v.opts.Audience != "" {
+		found := false
+		for _, aud := range stringList(claims["aud"]) {
+			if aud == v.opts.Audience {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return invalidToken("unexpected audience")
+		}
+	}
+
+	return nil
+}
+
+// stringList reads a claim given either as a space separated string or as an array.
+func stringList(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+
+		return list
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	bs, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bs, v)
+}
+
+func verify(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported alg: " + alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("not an rsa key")
+		}
+
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("not an rsa key")
+		}
+
+		return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+
+	default:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("not an ec key")
+		}
+
+		bits := pub.Curve.Params().BitSize
+		if bits != map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg] {
+			return errors.New("curve does not match alg")
+		}
+
+		size := (bits + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+}
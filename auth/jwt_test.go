@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type jwtTestSuite struct {
+	suite.Suite
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	jwks     string
+	verifier *JWTVerifier
+}
+
+func (suite *jwtTestSuite) SetupSuite() {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().NoError(err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+
+	suite.rsaKey = rsaKey
+	suite.ecKey = ecKey
+}
+
+func (suite *jwtTestSuite) SetupTest() {
+	suite.jwks = filepath.Join(suite.T().TempDir(), "jwks.json")
+	suite.writeJWKS(rsaJWK("rsa-1", &suite.rsaKey.PublicKey), ecJWK("ec-1", &suite.ecKey.PublicKey))
+
+	verifier, err := NewJWTVerifier(JWTOptions{
+		JWKS:     suite.jwks,
+		Issuer:   "https://idp.example.com/",
+		Audience: "openai-proxy",
+		Leeway:   time.Minute,
+	})
+	suite.Require().NoError(err)
+
+	suite.verifier = verifier
+}
+
+func (suite *jwtTestSuite) writeJWKS(keys ...map[string]string) {
+	bs, err := json.Marshal(map[string]any{"keys": keys})
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.WriteFile(suite.jwks, bs, 0644))
+}
+
+func b64(bs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   b64(pub.N.Bytes()),
+		"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(pub.X.FillBytes(make([]byte, 32))),
+		"y":   b64(pub.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func (suite *jwtTestSuite) claims() map[string]any {
+	return map[string]any{
+		"iss":    "https://idp.example.com/",
+		"aud":    []string{"openai-proxy", "other"},
+		"sub":    "alice",
+		"tenant": "acme",
+		"scope":  "chats admin",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (suite *jwtTestSuite) sign(alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	suite.Require().NoError(err)
+
+	payload, err := json.Marshal(claims)
+	suite.Require().NoError(err)
+
+	signed := b64(header) + "." + b64(payload)
+
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+		suite.Require().NoError(err)
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		suite.Require().NoError(err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + b64(signature)
+}
+
+func (suite *jwtTestSuite) TestValidTokens() {
+	for _, token := range []string{
+		suite.sign("RS256", "rsa-1", suite.rsaKey, suite.claims()),
+		suite.sign("ES256", "ec-1", suite.ecKey, suite.claims()),
+	} {
+		id, err := suite.verifier.Authenticate(token)
+		suite.Require().NoError(err)
+		suite.Equal(&Identity{Subject: "alice", Tenant: "acme", Scopes: []string{"chats", "admin"}}, id)
+	}
+}
+
+func (suite *jwtTestSuite) TestInvalidTokens() {
+	expired := suite.claims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	early := suite.claims()
+	early["nbf"] = time.Now().Add(time.Hour).Unix()
+
+	issuer := suite.claims()
+	issuer["iss"] = "https://evil.example.com/"
+
+	audience := suite.claims()
+	audience["aud"] = "other"
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().NoError(err)
+
+	token := suite.sign("RS256", "rsa-1", suite.rsaKey, suite.claims())
+	none := b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + "."
+
+	for name, token := range map[string]string{
+		"expired":       suite.sign("RS256", "rsa-1", suite.rsaKey, expired),
+		"not yet valid": suite.sign("RS256", "rsa-1", suite.rsaKey, early),
+		"issuer":        suite.sign("RS256", "rsa-1", suite.rsaKey, issuer),
+		"audience":      suite.sign("RS256", "rsa-1", suite.rsaKey, audience),
+		"unknown key":   suite.sign("RS256", "rsa-1", other, suite.claims()),
+		"wrong alg":     suite.sign("ES256", "rsa-1", suite.ecKey, suite.claims()),
+		"tampered":      token[:len(token)-4] + "AAAA",
+		"alg none":      none,
+	} {
+		_, err := suite.verifier.Authenticate(token)
+		suite.ErrorIs(err, ErrUnauthenticated, name)
+	}
+}
+
+func (suite *jwtTestSuite) TestKeyRotation() {
+	next, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().NoError(err)
+
+	token := suite.sign("RS256", "rsa-2", next, suite.claims())
+
+	_, err = suite.verifier.Authenticate(token)
+	suite.Error(err)
+
+	// the file is read again for an unknown kid
+	suite.writeJWKS(rsaJWK("rsa-2", &next.PublicKey))
+	later := time.Now().Add(time.Second)
+	suite.Require().NoError(os.Chtimes(suite.jwks, later, later))
+
+	_, err = suite.verifier.Authenticate(token)
+	suite.NoError(err)
+}
+
+func TestJWTTestSuite(t *testing.T) {
+	suite.Run(t, new(jwtTestSuite))
+}
@@ -0,0 +1,147 @@
+package openai
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/dataset"
+)
+
+// chatScoped requests act on an existing chat.
+type chatScoped interface {
+	chatID() chat.ChatID
+}
+
+// RequestChatID returns the chat the request acts on, if any.
+func RequestChatID(request any) (chat.ChatID, bool) {
+	req, ok := request.(chatScoped)
+	if !ok || req.chatID() == (chat.ChatID{}) {
+		return chat.ChatID{}, false
+	}
+
+	return req.chatID(), true
+}
+
+// ownable requests create chats owned by the caller.
+type ownable interface {
+	own(access chat.Access)
+}
+
+// tenantScoped requests select chats among those visible to the caller.
+type tenantScoped interface {
+	scope(tenant string, member string)
+}
+
+// AuthorizingMiddleware checks the identity on the context against the chat
+// of the request. A caller without any role on the chat gets ErrChatNotFound,
+// as if the chat did not exist; one whose role is insufficient gets
+// auth.ErrForbidden. Requests creating chats are owned by the caller, those
+// listing chats are narrowed to the caller's tenant and memberships.
+func AuthorizingMiddleware(chats chat.Repository, perm chat.Permission) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request any) (response any, err error) {
+			id, ok := auth.FromContext(ctx)
+			if !ok {
+				return nil, auth.ErrUnauthenticated
+			}
+
+			member := id.Subject
+			if id.IsAdmin() {
+				member = ""
+			}
+
+			switch req := request.(type) {
+			case chatScoped:
+				if req.chatID() == (chat.ChatID{}) {
+					// a stateless completion
+					break
+				}
+
+				c, err := chats.Find(req.chatID())
+				if err != nil {
+					return nil, err
+				}
+
+				if err := authorize(id, c, perm); err != nil {
+					return nil, err
+				}
+
+			case ownable:
+				req.own(chat.Access{
+					Tenant: id.Tenant,
+					Owner:  id.Subject,
+				})
+
+			case tenantScoped:
+				req.scope(id.Tenant, member)
+
+			case *dataset.Spec:
+				req.Tenant = id.Tenant
+				req.Member = member
+				req.Scoped = true
+			}
+
+			return next(ctx, request)
+		}
+	}
+}
+
+func authorize(id *auth.Identity, c *chat.Chat, perm chat.Permission) error {
+	if c.Tenant != id.Tenant {
+		return chat.ErrChatNotFound
+	}
+
+	role := c.RoleOf(id.Subject)
+	if id.IsAdmin() {
+		role = chat.OwnerRole
+	}
+
+	if role == "" {
+		return chat.ErrChatNotFound
+	}
+
+	if !role.Allows(perm) {
+		return auth.ErrForbidden
+	}
+
+	return nil
+}
+
+// AuthorizedEndpoints wraps every endpoint in an AuthorizingMiddleware
+// requiring the permission of its operation.
+func AuthorizedEndpoints(endpoints *ChatEndpoints, chats chat.Repository) *ChatEndpoints {
+	authorized := func(perm chat.Permission, e endpoint.Endpoint) endpoint.Endpoint {
+		return AuthorizingMiddleware(chats, perm)(e)
+	}
+
+	return &ChatEndpoints{
+		CreateChatEndpoint: authorized(chat.WritePermission, endpoints.CreateChatEndpoint),
+		UpdateChatEndpoint: authorized(chat.WritePermission, endpoints.UpdateChatEndpoint),
+		ChatEndpoint:       authorized(chat.WritePermission, endpoints.ChatEndpoint),
+		ChatStreamEndpoint: authorized(chat.WritePermission, endpoints.ChatStreamEndpoint),
+
+		RegenerateStreamEndpoint: authorized(chat.WritePermission, endpoints.RegenerateStreamEndpoint),
+		CancelChatEndpoint:       authorized(chat.WritePermission, endpoints.CancelChatEndpoint),
+
+		ListChatsEndpoint:    authorized(chat.ReadPermission, endpoints.ListChatsEndpoint),
+		FindChatEndpoint:     authorized(chat.ReadPermission, endpoints.FindChatEndpoint),
+		ListMessagesEndpoint: authorized(chat.ReadPermission, endpoints.ListMessagesEndpoint),
+		DeleteChatEndpoint:   authorized(chat.ManagePermission, endpoints.DeleteChatEndpoint),
+
+		ExportChatEndpoint:  authorized(chat.ReadPermission, endpoints.ExportChatEndpoint),
+		ExportChatsEndpoint: authorized(chat.ReadPermission, endpoints.ExportChatsEndpoint),
+		ImportChatsEndpoint: authorized(chat.WritePermission, endpoints.ImportChatsEndpoint),
+
+		AnnotateChatEndpoint: authorized(chat.WritePermission, endpoints.AnnotateChatEndpoint),
+		ShareChatEndpoint:    authorized(chat.ManagePermission, endpoints.ShareChatEndpoint),
+		BuildDatasetEndpoint: authorized(chat.ReadPermission, endpoints.BuildDatasetEndpoint),
+
+		// stateless unless a chat is given
+		CreateCompletionEndpoint:       authorized(chat.WritePermission, endpoints.CreateCompletionEndpoint),
+		CreateCompletionStreamEndpoint: authorized(chat.WritePermission, endpoints.CreateCompletionStreamEndpoint),
+		ListModelsEndpoint:             authorized(chat.ReadPermission, endpoints.ListModelsEndpoint),
+	}
+}
@@ -0,0 +1,101 @@
+package openai
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/dataset"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestAuthorizingMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	c := chat.NewChat("gpt-3.5-turbo", "", nil)
+	c.Access = chat.Access{Tenant: "acme", Owner: "alice"}
+	c.Share("bob", chat.ViewerRole)
+	assert.NoError(chats.Store(c))
+
+	var received any
+	next := func(ctx context.Context, request any) (any, error) {
+		received = request
+		return nil, nil
+	}
+
+	call := func(id *auth.Identity, perm chat.Permission, request any) error {
+		ctx := context.Background()
+		if id != nil {
+			ctx = auth.NewContext(ctx, id)
+		}
+
+		_, err := AuthorizingMiddleware(chats, perm)(next)(ctx, request)
+		return err
+	}
+
+	alice := &auth.Identity{Subject: "alice", Tenant: "acme"}
+	bob := &auth.Identity{Subject: "bob", Tenant: "acme"}
+	mallory := &auth.Identity{Subject: "mallory", Tenant: "acme"}
+	outsider := &auth.Identity{Subject: "alice", Tenant: "umbrella"}
+	admin := &auth.Identity{Subject: "root", Tenant: "acme", Scopes: []string{auth.AdminScope}}
+
+	find := &FindChatRequest{ID: c.ID}
+	remove := &DeleteChatRequest{ID: c.ID}
+	missing := &FindChatRequest{ID: chat.NewChat("gpt-3.5-turbo", "", nil).ID}
+
+	assert.ErrorIs(call(nil, chat.ReadPermission, find), auth.ErrUnauthenticated)
+
+	assert.NoError(call(alice, chat.ManagePermission, remove))
+	assert.NoError(call(bob, chat.ReadPermission, find))
+	assert.NoError(call(admin, chat.ManagePermission, remove))
+
+	// a known chat with too weak a role
+	assert.ErrorIs(call(bob, chat.ManagePermission, remove), auth.ErrForbidden)
+
+	// strangers cannot tell a foreign chat from a missing one
+	assert.ErrorIs(call(mallory, chat.ReadPermission, find), chat.ErrChatNotFound)
+	assert.ErrorIs(call(outsider, chat.ReadPermission, find), chat.ErrChatNotFound)
+	assert.ErrorIs(call(mallory, chat.ReadPermission, missing), chat.ErrChatNotFound)
+
+	// created chats are owned by the caller
+	assert.NoError(call(bob, chat.WritePermission, &CreateChatRequest{Model: "gpt-4"}))
+	assert.Equal(chat.Access{Tenant: "acme", Owner: "bob"}, received.(*CreateChatRequest).Access)
+
+	// listings are narrowed to the memberships, except for admins
+	assert.NoError(call(bob, chat.ReadPermission, &ExportChatsRequest{}))
+	q, err := received.(*ExportChatsRequest).Query()
+	assert.NoError(err)
+	assert.Equal("acme", q.Tenant)
+	assert.Equal("bob", q.Member)
+
+	assert.NoError(call(admin, chat.ReadPermission, &dataset.Spec{}))
+	assert.Equal("acme", received.(*dataset.Spec).Tenant)
+	assert.Empty(received.(*dataset.Spec).Member)
+
+	// admins without a tenant only list the chats without one
+	mine := chat.NewChat("gpt-3.5-turbo", "", nil)
+	mine.Access = chat.Access{Owner: "root"}
+	assert.NoError(chats.Store(mine))
+
+	tenantless := &auth.Identity{Subject: "root", Scopes: []string{auth.AdminScope}}
+
+	assert.NoError(call(tenantless, chat.ReadPermission, &ListChatsRequest{}))
+	q, err = received.(*ListChatsRequest).Query()
+	assert.NoError(err)
+
+	listed, err := chats.List(q)
+	assert.NoError(err)
+	assert.Len(listed, 1)
+	assert.Equal(mine.ID, listed[0].ID)
+
+	assert.NoError(call(tenantless, chat.ReadPermission, &dataset.Spec{}))
+	listed, err = chats.List(received.(*dataset.Spec).Query())
+	assert.NoError(err)
+	assert.Len(listed, 1)
+}
@@ -0,0 +1,110 @@
+package chat
+
+// MemberRole is the role of a subject on a chat, not to be confused with
+// the Role of a message.
+type MemberRole string
+
+const (
+	OwnerRole        MemberRole = "owner"
+	CollaboratorRole MemberRole = "collaborator"
+	ViewerRole       MemberRole = "viewer"
+)
+
+type Permission int
+
+const (
+	ReadPermission   Permission = iota // find, list and export
+	WritePermission                    // chat, update and annotate
+	ManagePermission                   // delete and share
+)
+
+func ParseMemberRole(s string) (MemberRole, bool) {
+	switch role := MemberRole(s); role {
+	case OwnerRole, CollaboratorRole, ViewerRole:
+		return role, true
+	}
+
+	return "", false
+}
+
+func (role MemberRole) Allows(perm Permission) bool {
+	switch role {
+	case OwnerRole:
+		return true
+	case CollaboratorRole:
+		return perm <= WritePermission
+	case ViewerRole:
+		return perm <= ReadPermission
+	}
+
+	return false
+}
+
+// Access tells which tenant a chat belongs to and who may use it.
+type Access struct {
+	Tenant  string                `json:"tenant,omitempty"`
+	Owner   string                `json:"owner,omitempty"`
+	Members map[string]MemberRole `json:"members,omitempty"` // collaborators and viewers
+}
+
+// RoleOf returns the role of the subject, empty if it has none.
+func (a *Access) RoleOf(subject string) MemberRole {
+	if subject == "" {
+		return ""
+	}
+
+	if a.Owner == subject {
+		return OwnerRole
+	}
+
+	return a.Members[subject]
+}
+
+// Share grants the role to the subject, an empty role revokes it.
+// Granting OwnerRole transfers the ownership, the previous owner stays
+// as a collaborator.
+func (a *Access) Share(subject string, role MemberRole) {
+	if role == "" {
+		delete(a.Members, subject)
+		return
+	}
+
+	if role == OwnerRole {
+		if a.Owner == subject {
+			return
+		}
+
+		delete(a.Members, subject)
+
+		previous := a.Owner
+		a.Owner = subject
+
+		if previous == "" {
+			return
+		}
+
+		subject, role = previous, CollaboratorRole
+	}
+
+	if a.Members == nil {
+		a.Members = make(map[string]MemberRole)
+	}
+
+	a.Members[subject] = role
+}
+
+func (a Access) Clone() Access {
+	clone := Access{
+		Tenant: a.Tenant,
+		Owner:  a.Owner,
+	}
+
+	if a.Members != nil {
+		clone.Members = make(map[string]MemberRole, len(a.Members))
+		for subject, role := range a.Members {
+			clone.Members[subject] = role
+		}
+	}
+
+	return clone
+}
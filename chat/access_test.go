@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessShare(t *testing.T) {
+	assert := assert.New(t)
+
+	a := Access{Tenant: "acme", Owner: "alice"}
+	assert.Equal(OwnerRole, a.RoleOf("alice"))
+	assert.Empty(a.RoleOf("bob"))
+	assert.Empty(a.RoleOf(""))
+
+	a.Share("bob", ViewerRole)
+	assert.Equal(ViewerRole, a.RoleOf("bob"))
+	assert.True(a.RoleOf("bob").Allows(ReadPermission))
+	assert.False(a.RoleOf("bob").Allows(WritePermission))
+
+	a.Share("bob", OwnerRole)
+	assert.Equal(OwnerRole, a.RoleOf("bob"))
+	assert.Equal(CollaboratorRole, a.RoleOf("alice"))
+	assert.True(a.RoleOf("alice").Allows(WritePermission))
+	assert.False(a.RoleOf("alice").Allows(ManagePermission))
+
+	a.Share("alice", "")
+	assert.Empty(a.RoleOf("alice"))
+	assert.Empty(a.Members)
+
+	clone := a.Clone()
+	clone.Share("carol", ViewerRole)
+	assert.Empty(a.RoleOf("carol"))
+}
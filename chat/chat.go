@@ -2,6 +2,8 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 )
@@ -20,6 +22,15 @@ func (id ChatID) String() string {
 	return ulid.ULID(id).String()
 }
 
+// Time returns the creation time encoded in the ULID.
+func (id ChatID) Time() time.Time {
+	return ulid.Time(ulid.ULID(id).Time())
+}
+
+func (id ChatID) Compare(other ChatID) int {
+	return ulid.ULID(id).Compare(ulid.ULID(other))
+}
+
 func (id *ChatID) MarshalJSON() ([]byte, error) {
 	jsonStr := `"` + id.String() + `"`
 	return []byte(jsonStr), nil
@@ -41,12 +52,78 @@ func (id *ChatID) UnmarshalJSON(data []byte) error {
 }
 
 type Chat struct {
-	ID       ChatID
-	Model    string
-	Messages []*Message
+	ID       ChatID     `json:"id"`
+	Version  uint64     `json:"version"` // incremented by every successful Repository.Store
+	Model    string     `json:"model"`
+	Messages []*Message `json:"messages"`
+	Access
+	Annotation
 	*Options
 }
 
+// Annotation carries curation metadata, e.g. for building fine-tuning datasets.
+type Annotation struct {
+	Tags     []string `json:"tags,omitempty"`
+	Rating   *int     `json:"rating,omitempty"`   // feedback rating, 1 (worst) to 5 (best)
+	Template string   `json:"template,omitempty"` // prompt template the chat was created from
+}
+
+func (a Annotation) Clone() Annotation {
+	clone := Annotation{
+		Template: a.Template,
+	}
+
+	if a.Tags != nil {
+		clone.Tags = append([]string{}, a.Tags...)
+	}
+
+	if a.Rating != nil {
+		rating := *a.Rating
+		clone.Rating = &rating
+	}
+
+	return clone
+}
+
+func (a *Annotation) HasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks the rating, if any, is between 1 and 5.
+func (a *Annotation) Validate() error {
+	if a.Rating != nil && (*a.Rating < 1 || *a.Rating > 5) {
+		return errors.New("rating must be between 1 and 5")
+	}
+
+	return nil
+}
+
+func (a *Annotation) Update(newAnnotation *Annotation) error {
+	if newAnnotation.Tags != nil {
+		a.Tags = newAnnotation.Tags
+	}
+
+	if newAnnotation.Rating != nil {
+		if err := newAnnotation.Validate(); err != nil {
+			return err
+		}
+
+		a.Rating = newAnnotation.Rating
+	}
+
+	if newAnnotation.Template != "" {
+		a.Template = newAnnotation.Template
+	}
+
+	return nil
+}
+
 func NewChat(model string, prompt string, opts *Options) *Chat {
 	c := new(Chat)
 	c.ID = ChatID(ulid.Make())
@@ -68,6 +145,30 @@ func (c *Chat) AddMessage(msg *Message) {
 	c.Messages = append(c.Messages, msg)
 }
 
+// Clone returns a deep copy of the chat.
+func (c *Chat) Clone() *Chat {
+	clone := &Chat{
+		ID:       c.ID,
+		Version:  c.Version,
+		Model:    c.Model,
+		Messages: make([]*Message, len(c.Messages)),
+	}
+
+	for i, msg := range c.Messages {
+		m := *msg
+		clone.Messages[i] = &m
+	}
+
+	clone.Access = c.Access.Clone()
+	clone.Annotation = c.Annotation.Clone()
+
+	if c.Options != nil {
+		clone.Options = c.Options.Clone()
+	}
+
+	return clone
+}
+
 func (c *Chat) Request() *Request {
 	req := &Request{
 		Model:    c.Model,
@@ -137,6 +238,40 @@ type Options struct {
 	User *string `json:"user,omitempty"`
 }
 
+func (opts *Options) Clone() *Options {
+	clone := new(Options)
+	clone.Temperature = clonePtr(opts.Temperature)
+	clone.TopP = clonePtr(opts.TopP)
+	clone.N = clonePtr(opts.N)
+	clone.Stream = clonePtr(opts.Stream)
+	clone.MaxTokens = clonePtr(opts.MaxTokens)
+	clone.PresencePenalty = clonePtr(opts.PresencePenalty)
+	clone.FrequencyPenalty = clonePtr(opts.FrequencyPenalty)
+	clone.User = clonePtr(opts.User)
+
+	if opts.Stop != nil {
+		clone.Stop = append([]string{}, opts.Stop...)
+	}
+
+	if opts.LogitBias != nil {
+		clone.LogitBias = make(map[string]int, len(opts.LogitBias))
+		for k, v := range opts.LogitBias {
+			clone.LogitBias[k] = v
+		}
+	}
+
+	return clone
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+
+	v := *p
+	return &v
+}
+
 func (opts *Options) Update(newOpts *Options) error {
 	if newOpts.Temperature != nil {
 		opts.Temperature = newOpts.Temperature
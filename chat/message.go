@@ -12,3 +12,10 @@ type Message struct {
 	Role    Role   `json:"role"`
 	Content string `json:"content"`
 }
+
+// Chunk is a piece of an answer being streamed. A stream ending early sends
+// a last chunk carrying the error instead of content.
+type Chunk struct {
+	Content string
+	Err     error
+}
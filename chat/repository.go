@@ -1,7 +1,137 @@
 package chat
 
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrChatNotFound = errors.New("chat not found")
+	ErrConflict     = errors.New("chat modified concurrently")
+	ErrClosed       = errors.New("repository closed")
+)
+
+// Repository stores chats with optimistic concurrency control:
+// Store fails with ErrConflict unless the chat has the version last stored,
+// and increments the version of the given chat on success.
+// Find and List return copies the caller is free to modify.
+// Stored messages are never rewritten, except by ReplaceLastMessage, which
+// stores the chat like Store with its last message replacing the last one
+// stored, e.g. a regenerated answer.
 type Repository interface {
 	Store(*Chat) error
+	ReplaceLastMessage(*Chat) error
 	Find(ChatID) (*Chat, error)
+	List(*Query) ([]*Chat, error)
+	Delete(ChatID) error
 	Close() error
 }
+
+// Pinger is implemented by the repositories that may become unreachable.
+type Pinger interface {
+	Ping() error
+}
+
+// Query filters the chats returned by Repository.List.
+// Results are ordered by ChatID, i.e. by creation time.
+type Query struct {
+	After  *ChatID   // cursor, only chats created after this one
+	Limit  int       // zero means no limit
+	User   string    // matches Options.User
+	Model  string    // matches Chat.Model
+	Tenant string    // matches Access.Tenant
+	Scoped bool      // matches Tenant even if empty, for callers of a tenant
+	Member string    // has any role on the chat
+	Since  time.Time // inclusive, zero means unbounded
+	Until  time.Time // exclusive, zero means unbounded
+	Text   string    // words all found in one message, see Words
+}
+
+func (q *Query) Match(c *Chat) bool {
+	if q.After != nil && c.ID.Compare(*q.After) <= 0 {
+		return false
+	}
+
+	if q.Model != "" && c.Model != q.Model {
+		return false
+	}
+
+	if (q.Scoped || q.Tenant != "") && c.Tenant != q.Tenant {
+		return false
+	}
+
+	if q.Member != "" && c.RoleOf(q.Member) == "" {
+		return false
+	}
+
+	if q.User != "" {
+		if c.Options == nil || c.User == nil || *c.User != q.User {
+			return false
+		}
+	}
+
+	created := c.ID.Time()
+
+	if !q.Since.IsZero() && created.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && !created.Before(q.Until) {
+		return false
+	}
+
+	if words := Words(q.Text); len(words) > 0 && !hasWords(c.Messages, words) {
+		return false
+	}
+
+	return true
+}
+
+// Words splits the text into lower-case words of letters and digits,
+// as the messages are searched by.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func hasWords(messages []*Message, words []string) bool {
+	for _, msg := range messages {
+		found := make(map[string]bool)
+		for _, word := range Words(msg.Content) {
+			found[word] = true
+		}
+
+		all := true
+		for _, word := range words {
+			if !found[word] {
+				all = false
+				break
+			}
+		}
+
+		if all {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Page struct {
+	Chats []*Chat `json:"chats"`
+	Next  *ChatID `json:"next,omitempty"`
+}
+
+type MessagePage struct {
+	Messages []*Message `json:"messages"`
+	Next     *int       `json:"next,omitempty"`
+}
+
+// Counter is implemented by the repositories counting their chats
+// without listing them.
+type Counter interface {
+	Count() (int, error)
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	user := "alice"
+	c := NewChat("gpt-3.5-turbo", "You are a helpful assistant.", &Options{User: &user})
+
+	assert.True((&Query{}).Match(c))
+	assert.True((&Query{User: "alice", Model: "gpt-3.5-turbo"}).Match(c))
+	assert.False((&Query{User: "bob"}).Match(c))
+	assert.False((&Query{Model: "gpt-4"}).Match(c))
+
+	c.Access = Access{Tenant: "acme", Owner: "alice"}
+	assert.True((&Query{Tenant: "acme", Member: "alice"}).Match(c))
+	assert.False((&Query{Tenant: "umbrella"}).Match(c))
+	assert.False((&Query{Member: "bob"}).Match(c))
+
+	created := c.ID.Time()
+	assert.True((&Query{Since: created, Until: created.Add(time.Second)}).Match(c))
+	assert.False((&Query{Until: created}).Match(c))
+
+	assert.False((&Query{After: &c.ID}).Match(c))
+
+	next := NewChat("gpt-3.5-turbo", "", nil)
+	assert.True((&Query{After: &c.ID}).Match(next))
+
+	// words all found in one message
+	assert.True((&Query{Text: "Helpful, you"}).Match(c))
+	assert.False((&Query{Text: "help"}).Match(c))
+
+	c.AddMessage(&Message{Role: User, Content: "Tell me a joke"})
+	assert.True((&Query{Text: "joke"}).Match(c))
+	assert.False((&Query{Text: "helpful joke"}).Match(c))
+}
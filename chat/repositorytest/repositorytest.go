@@ -0,0 +1,523 @@
+// Package repositorytest provides a conformance suite for chat.Repository
+// implementations.
+//
+//	func TestConformance(t *testing.T) {
+//		repositorytest.Run(t, func(t *testing.T) chat.Repository {
+//			return NewChatRepository()
+//		})
+//	}
+package repositorytest
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/mirror520/openai/chat"
+)
+
+// Factory returns an empty repository, called once per test.
+type Factory func(t *testing.T) chat.Repository
+
+// Run runs the conformance suite against the repositories made by factory.
+func Run(t *testing.T, factory Factory) {
+	suite.Run(t, &repositoryTestSuite{factory: factory})
+}
+
+type repositoryTestSuite struct {
+	suite.Suite
+	factory Factory
+	repo    chat.Repository
+	closed  bool
+}
+
+func (suite *repositoryTestSuite) SetupTest() {
+	suite.repo = suite.factory(suite.T())
+	suite.closed = false
+}
+
+func (suite *repositoryTestSuite) TearDownTest() {
+	if !suite.closed {
+		suite.repo.Close()
+	}
+}
+
+func newChat(model string) *chat.Chat {
+	return chat.NewChat(model, "You are a helpful assistant.", nil)
+}
+
+func chatIDs(chats []*chat.Chat) []chat.ChatID {
+	ids := make([]chat.ChatID, len(chats))
+	for i, c := range chats {
+		ids[i] = c.ID
+	}
+
+	return ids
+}
+
+func (suite *repositoryTestSuite) TestStoreAndFind() {
+	c := newChat("gpt-3.5-turbo")
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+
+	suite.Require().NoError(suite.repo.Store(c))
+	suite.Equal(uint64(1), c.Version)
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+
+	suite.Equal(c.ID, found.ID)
+	suite.Equal(c.Version, found.Version)
+	suite.Equal(c.Model, found.Model)
+	suite.Equal(c.Messages, found.Messages)
+
+	found.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi!"})
+	found.Model = "gpt-4"
+	suite.Require().NoError(suite.repo.Store(found))
+	suite.Equal(uint64(2), found.Version)
+
+	found, err = suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+
+	suite.Equal("gpt-4", found.Model)
+	suite.Len(found.Messages, 3)
+	suite.Equal(chat.Assistant, found.Messages[2].Role)
+}
+
+func (suite *repositoryTestSuite) TestCopyOnRead() {
+	c := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(c))
+
+	// neither the stored nor the found chat is shared
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "not stored"})
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(found.Messages, 1)
+
+	found.Messages[0].Content = "modified"
+	found.AddMessage(&chat.Message{Role: chat.User, Content: "not stored either"})
+
+	again, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(again.Messages, 1)
+	suite.Equal("You are a helpful assistant.", again.Messages[0].Content)
+}
+
+func (suite *repositoryTestSuite) TestNotFound() {
+	c := newChat("gpt-3.5-turbo")
+
+	_, err := suite.repo.Find(c.ID)
+	suite.ErrorIs(err, chat.ErrChatNotFound)
+
+	suite.ErrorIs(suite.repo.Delete(c.ID), chat.ErrChatNotFound)
+
+	suite.Require().NoError(suite.repo.Store(c))
+	suite.Require().NoError(suite.repo.Delete(c.ID))
+
+	_, err = suite.repo.Find(c.ID)
+	suite.ErrorIs(err, chat.ErrChatNotFound)
+
+	chats, err := suite.repo.List(&chat.Query{})
+	suite.Require().NoError(err)
+	suite.Len(chats, 0)
+}
+
+func (suite *repositoryTestSuite) TestConflict() {
+	c := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(c))
+
+	// storing a new chat under an existing ID
+	dup := c.Clone()
+	dup.Version = 0
+	suite.ErrorIs(suite.repo.Store(dup), chat.ErrConflict)
+
+	a, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+
+	b, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "first"})
+	suite.Require().NoError(suite.repo.Store(a))
+
+	b.AddMessage(&chat.Message{Role: chat.User, Content: "second"})
+	suite.ErrorIs(suite.repo.Store(b), chat.ErrConflict)
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(found.Messages, 2)
+	suite.Equal("first", found.Messages[1].Content)
+}
+
+func (suite *repositoryTestSuite) TestReplaceLastMessage() {
+	c := newChat("gpt-3.5-turbo")
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "old answer"})
+
+	// nothing stored to replace yet
+	suite.ErrorIs(suite.repo.ReplaceLastMessage(c), chat.ErrConflict)
+
+	suite.Require().NoError(suite.repo.Store(c))
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+
+	found.Messages[2] = &chat.Message{Role: chat.Assistant, Content: "new answer"}
+	found.Tags = []string{"regenerated"}
+	suite.Require().NoError(suite.repo.ReplaceLastMessage(found))
+	suite.Equal(uint64(2), found.Version)
+
+	found, err = suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(found.Messages, 3)
+	suite.Equal("Hello!", found.Messages[1].Content)
+	suite.Equal("new answer", found.Messages[2].Content)
+	suite.Equal([]string{"regenerated"}, found.Tags)
+
+	// appended after, as usual
+	found.AddMessage(&chat.Message{Role: chat.User, Content: "Thanks!"})
+	suite.Require().NoError(suite.repo.Store(found))
+
+	// the message count must match, as must the version
+	stale := found.Clone()
+	stale.Messages = stale.Messages[:3]
+	suite.ErrorIs(suite.repo.ReplaceLastMessage(stale), chat.ErrConflict)
+
+	stale = found.Clone()
+	stale.Version--
+	suite.ErrorIs(suite.repo.ReplaceLastMessage(stale), chat.ErrConflict)
+
+	found, err = suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(found.Messages, 4)
+	suite.Equal("new answer", found.Messages[2].Content)
+}
+
+func (suite *repositoryTestSuite) TestConcurrentWriters() {
+	c := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(c))
+
+	const writers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// retry on conflict like an optimistic client would
+			for {
+				found, err := suite.repo.Find(c.ID)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				found.AddMessage(&chat.Message{
+					Role:    chat.User,
+					Content: strings.Repeat("x", i+1),
+				})
+
+				err = suite.repo.Store(found)
+				if errors.Is(err, chat.ErrConflict) {
+					continue
+				}
+
+				errs <- err
+				return
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		suite.NoError(err)
+	}
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Len(found.Messages, writers+1)
+	suite.Equal(uint64(writers+1), found.Version)
+
+	seen := make(map[string]bool)
+	for _, msg := range found.Messages[1:] {
+		seen[msg.Content] = true
+	}
+	suite.Len(seen, writers)
+}
+
+func (suite *repositoryTestSuite) TestListOrdering() {
+	ids := make([]chat.ChatID, 0)
+	for i := 0; i < 5; i++ {
+		model := "gpt-3.5-turbo"
+		if i%2 == 1 {
+			model = "gpt-4"
+		}
+
+		c := newChat(model)
+		suite.Require().NoError(suite.repo.Store(c))
+		ids = append(ids, c.ID)
+	}
+
+	// stored in reverse does not change the order
+	for i := len(ids) - 1; i >= 0; i-- {
+		c, err := suite.repo.Find(ids[i])
+		suite.Require().NoError(err)
+		suite.Require().NoError(suite.repo.Store(c))
+	}
+
+	chats, err := suite.repo.List(&chat.Query{})
+	suite.Require().NoError(err)
+	suite.Require().Len(chats, 5)
+	for i, c := range chats {
+		suite.Equal(ids[i], c.ID)
+	}
+
+	chats, err = suite.repo.List(&chat.Query{Limit: 2})
+	suite.Require().NoError(err)
+	suite.Require().Len(chats, 2)
+	suite.Equal(ids[1], chats[1].ID)
+
+	chats, err = suite.repo.List(&chat.Query{After: &ids[1], Limit: 2})
+	suite.Require().NoError(err)
+	suite.Require().Len(chats, 2)
+	suite.Equal(ids[2], chats[0].ID)
+	suite.Equal(ids[3], chats[1].ID)
+
+	chats, err = suite.repo.List(&chat.Query{Model: "gpt-4"})
+	suite.Require().NoError(err)
+	suite.Require().Len(chats, 2)
+	suite.Equal(ids[1], chats[0].ID)
+	suite.Equal(ids[3], chats[1].ID)
+
+	created := ids[0].Time()
+
+	chats, err = suite.repo.List(&chat.Query{Since: created.Add(-time.Second), Until: created.Add(time.Hour)})
+	suite.Require().NoError(err)
+	suite.Len(chats, 5)
+
+	chats, err = suite.repo.List(&chat.Query{Until: created})
+	suite.Require().NoError(err)
+	suite.Len(chats, 0)
+}
+
+func (suite *repositoryTestSuite) TestListText() {
+	a := newChat("gpt-4")
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "How do I reset my password?"})
+	a.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Open the settings."})
+	suite.Require().NoError(suite.repo.Store(a))
+
+	b := newChat("gpt-4")
+	b.AddMessage(&chat.Message{Role: chat.User, Content: "Tell me a joke"})
+	suite.Require().NoError(suite.repo.Store(b))
+
+	list := func(text string) []chat.ChatID {
+		chats, err := suite.repo.List(&chat.Query{Text: text})
+		suite.Require().NoError(err)
+		return chatIDs(chats)
+	}
+
+	suite.Equal([]chat.ChatID{a.ID}, list("password reset"))
+	suite.Equal([]chat.ChatID{a.ID}, list("PASSWORD"))
+	suite.Equal([]chat.ChatID{b.ID}, list("joke"))
+	suite.Equal([]chat.ChatID{a.ID, b.ID}, list("helpful"))
+
+	// the words must be found in one message
+	suite.Empty(list("password settings"))
+	suite.Empty(list("pass"))
+
+	b.Messages[len(b.Messages)-1] = &chat.Message{Role: chat.User, Content: "Tell me a story"}
+	suite.Require().NoError(suite.repo.ReplaceLastMessage(b))
+
+	suite.Empty(list("joke"))
+	suite.Equal([]chat.ChatID{b.ID}, list("story"))
+
+	suite.Require().NoError(suite.repo.Delete(a.ID))
+	suite.Empty(list("password"))
+}
+
+func (suite *repositoryTestSuite) TestLargeChat() {
+	c := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(c))
+
+	for i := 0; i < 1000; i++ {
+		role := chat.User
+		if i%2 == 1 {
+			role = chat.Assistant
+		}
+
+		c.AddMessage(&chat.Message{
+			Role:    role,
+			Content: strings.Repeat("lorem ipsum ", 10) + string(rune('a'+i%26)),
+		})
+	}
+
+	c.AddMessage(&chat.Message{
+		Role:    chat.User,
+		Content: strings.Repeat("🙂 多語言 \"quoted\"\n", 64*1024),
+	})
+
+	suite.Require().NoError(suite.repo.Store(c))
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(found.Messages, 1002)
+	suite.Equal(c.Messages, found.Messages)
+}
+
+func (suite *repositoryTestSuite) TestOptionsPreserved() {
+	temperature := 0.2
+	topP := 0.9
+	n := 2
+	stream := false
+	maxTokens := 256
+	presence := -0.5
+	frequency := 1.5
+	user := "alice"
+
+	opts := &chat.Options{
+		Temperature:      &temperature,
+		TopP:             &topP,
+		N:                &n,
+		Stream:           &stream,
+		Stop:             []string{"\n\n", "END"},
+		MaxTokens:        &maxTokens,
+		PresencePenalty:  &presence,
+		FrequencyPenalty: &frequency,
+		LogitBias:        map[string]int{"50256": -100},
+		User:             &user,
+	}
+
+	rating := 4
+
+	c := chat.NewChat("gpt-3.5-turbo", "prompt", opts)
+	c.Annotation = chat.Annotation{
+		Tags:     []string{"support", "billing"},
+		Rating:   &rating,
+		Template: "support-v1",
+	}
+
+	suite.Require().NoError(suite.repo.Store(c))
+
+	found, err := suite.repo.Find(c.ID)
+	suite.Require().NoError(err)
+	suite.Equal(opts, found.Options)
+	suite.Equal(c.Annotation, found.Annotation)
+
+	chats, err := suite.repo.List(&chat.Query{User: "alice"})
+	suite.Require().NoError(err)
+	suite.Require().Len(chats, 1)
+	suite.Equal(opts, chats[0].Options)
+
+	// no options stay no options
+	bare := chat.NewChat("gpt-3.5-turbo", "prompt", nil)
+	suite.Require().NoError(suite.repo.Store(bare))
+
+	found, err = suite.repo.Find(bare.ID)
+	suite.Require().NoError(err)
+	suite.Nil(found.Options)
+}
+
+func (suite *repositoryTestSuite) TestAccess() {
+	alice := newChat("gpt-3.5-turbo")
+	alice.Access = chat.Access{Tenant: "acme", Owner: "alice"}
+	alice.Share("bob", chat.ViewerRole)
+	suite.Require().NoError(suite.repo.Store(alice))
+
+	carol := newChat("gpt-3.5-turbo")
+	carol.Access = chat.Access{Tenant: "acme", Owner: "carol"}
+	suite.Require().NoError(suite.repo.Store(carol))
+
+	other := newChat("gpt-3.5-turbo")
+	other.Access = chat.Access{Tenant: "umbrella", Owner: "alice"}
+	suite.Require().NoError(suite.repo.Store(other))
+
+	untenanted := newChat("gpt-3.5-turbo")
+	untenanted.Access = chat.Access{Owner: "dave"}
+	suite.Require().NoError(suite.repo.Store(untenanted))
+
+	found, err := suite.repo.Find(alice.ID)
+	suite.Require().NoError(err)
+	suite.Equal(alice.Access, found.Access)
+
+	chats, err := suite.repo.List(&chat.Query{Tenant: "acme"})
+	suite.Require().NoError(err)
+	suite.Equal([]chat.ChatID{alice.ID, carol.ID}, chatIDs(chats))
+
+	chats, err = suite.repo.List(&chat.Query{Tenant: "acme", Member: "bob"})
+	suite.Require().NoError(err)
+	suite.Equal([]chat.ChatID{alice.ID}, chatIDs(chats))
+
+	// a scope without a tenant is not a wildcard
+	chats, err = suite.repo.List(&chat.Query{Scoped: true})
+	suite.Require().NoError(err)
+	suite.Equal([]chat.ChatID{untenanted.ID}, chatIDs(chats))
+
+	// revoking and transferring are stored like any other change
+	found.Share("bob", "")
+	found.Share("carol", chat.OwnerRole)
+	suite.Require().NoError(suite.repo.Store(found))
+
+	chats, err = suite.repo.List(&chat.Query{Tenant: "acme", Member: "bob"})
+	suite.Require().NoError(err)
+	suite.Empty(chats)
+
+	chats, err = suite.repo.List(&chat.Query{Tenant: "acme", Member: "alice"})
+	suite.Require().NoError(err)
+	suite.Equal([]chat.ChatID{alice.ID}, chatIDs(chats))
+	suite.Equal(chat.CollaboratorRole, chats[0].RoleOf("alice"))
+	suite.Equal(chat.OwnerRole, chats[0].RoleOf("carol"))
+}
+
+func (suite *repositoryTestSuite) TestCount() {
+	counter, ok := suite.repo.(chat.Counter)
+	if !ok {
+		suite.T().Skip("not a chat.Counter")
+	}
+
+	n, err := counter.Count()
+	suite.Require().NoError(err)
+	suite.Equal(0, n)
+
+	first := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(first))
+	suite.Require().NoError(suite.repo.Store(newChat("gpt-4")))
+
+	// stored again, counted once
+	suite.Require().NoError(suite.repo.Store(first))
+
+	n, err = counter.Count()
+	suite.Require().NoError(err)
+	suite.Equal(2, n)
+
+	suite.Require().NoError(suite.repo.Delete(first.ID))
+
+	n, err = counter.Count()
+	suite.Require().NoError(err)
+	suite.Equal(1, n)
+}
+
+func (suite *repositoryTestSuite) TestClose() {
+	c := newChat("gpt-3.5-turbo")
+	suite.Require().NoError(suite.repo.Store(c))
+
+	suite.NoError(suite.repo.Close())
+	suite.closed = true
+
+	// fail, but do not panic
+	suite.Error(suite.repo.Store(newChat("gpt-3.5-turbo")))
+
+	_, err := suite.repo.Find(c.ID)
+	suite.Error(err)
+
+	_, err = suite.repo.List(&chat.Query{})
+	suite.Error(err)
+}
@@ -0,0 +1,414 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type Format string
+
+const (
+	// Native JSON, an array of chats including model and options.
+	JSON Format = "json"
+
+	// Human readable transcript, one section per message.
+	Markdown Format = "markdown"
+
+	// OpenAI fine-tuning JSONL, one {"messages": [...]} per line.
+	FineTune Format = "jsonl"
+
+	// ChatGPT data export (conversations.json), import only.
+	ChatGPT Format = "chatgpt"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case JSON, Markdown, FineTune, ChatGPT:
+		return f, nil
+	case "":
+		return JSON, nil
+	case "md":
+		return Markdown, nil
+	}
+
+	return "", errors.New("unsupported format: " + s)
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case Markdown:
+		return "text/markdown; charset=utf-8"
+	case FineTune:
+		return "application/jsonl"
+	}
+
+	return "application/json"
+}
+
+// Export writes the chats to w in the given format.
+func Export(w io.Writer, f Format, chats []*chat.Chat) error {
+	switch f {
+	case JSON:
+		return json.NewEncoder(w).Encode(chats)
+
+	case Markdown:
+		return exportMarkdown(w, chats)
+
+	case FineTune:
+		return exportFineTune(w, chats)
+	}
+
+	return errors.New("export not supported: " + string(f))
+}
+
+// Import reads chats from r in the given format.
+// Every imported chat gets a new ID; chats without a model use the given one.
+func Import(r io.Reader, f Format, model string) ([]*chat.Chat, error) {
+	var (
+		chats []*chat.Chat
+		err   error
+	)
+
+	switch f {
+	case JSON:
+		chats, err = importJSON(r)
+
+	case Markdown:
+		chats, err = importMarkdown(r)
+
+	case FineTune:
+		chats, err = importFineTune(r)
+
+	case ChatGPT:
+		chats, err = importChatGPT(r)
+
+	default:
+		return nil, errors.New("import not supported: " + string(f))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, c := range chats {
+		if err := c.Annotation.Validate(); err != nil {
+			return nil, fmt.Errorf("chat %d: %w", i+1, err)
+		}
+
+		if c.Model == "" {
+			c.Model = model
+		}
+
+		chats[i] = renew(c)
+	}
+
+	return chats, nil
+}
+
+// renew copies the chat under a freshly generated ID.
+func renew(c *chat.Chat) *chat.Chat {
+	fresh := chat.NewChat(c.Model, "", c.Options)
+	fresh.Messages = c.Messages
+	fresh.Annotation = c.Annotation
+	return fresh
+}
+
+func importJSON(r io.Reader) ([]*chat.Chat, error) {
+	var chats []*chat.Chat
+	if err := json.NewDecoder(r).Decode(&chats); err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+func exportMarkdown(w io.Writer, chats []*chat.Chat) error {
+	bw := bufio.NewWriter(w)
+
+	for i, c := range chats {
+		if i > 0 {
+			bw.WriteString("\n---\n\n")
+		}
+
+		fmt.Fprintf(bw, "# Chat %s\n\n", c.ID.String())
+		fmt.Fprintf(bw, "- model: %s\n", c.Model)
+		fmt.Fprintf(bw, "- created: %s\n", c.ID.Time().UTC().Format("2006-01-02T15:04:05Z"))
+
+		for _, msg := range c.Messages {
+			fmt.Fprintf(bw, "\n## %s\n\n%s\n", msg.Role, escapeMarkdown(strings.TrimSpace(msg.Content)))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// escapeMarkdown escapes the lines of a message that would read as a
+// heading or a separator, and those already starting with a backslash.
+func escapeMarkdown(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "\\") || line == "---" {
+			lines[i] = "\\" + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func importMarkdown(r io.Reader) ([]*chat.Chat, error) {
+	var (
+		chats   []*chat.Chat
+		current *chat.Chat
+		msg     *chat.Message
+		content []string
+	)
+
+	flush := func() {
+		if msg != nil {
+			msg.Content = strings.TrimSpace(strings.Join(content, "\n"))
+			current.AddMessage(msg)
+		}
+
+		msg = nil
+		content = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "# "):
+			if current != nil {
+				flush()
+			}
+
+			current = new(chat.Chat)
+			chats = append(chats, current)
+
+		case current == nil:
+			continue
+
+		case msg == nil && strings.HasPrefix(line, "- model: "):
+			current.Model = strings.TrimSpace(strings.TrimPrefix(line, "- model: "))
+
+		case strings.HasPrefix(line, "## "):
+			role := chat.Role(strings.TrimSpace(strings.TrimPrefix(line, "## ")))
+			if !validRole(role) {
+				if msg != nil {
+					// a heading of a message written by hand
+					content = append(content, line)
+					continue
+				}
+
+				return nil, errors.New("invalid role: " + string(role))
+			}
+
+			flush()
+			msg = &chat.Message{Role: role}
+
+		case msg != nil && line == "---":
+			flush()
+
+		case msg != nil:
+			content = append(content, strings.TrimPrefix(line, "\\"))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if current != nil {
+		flush()
+	}
+
+	if len(chats) == 0 {
+		return nil, errors.New("no chats found")
+	}
+
+	return chats, nil
+}
+
+type fineTuneExample struct {
+	Messages []*chat.Message `json:"messages"`
+}
+
+func exportFineTune(w io.Writer, chats []*chat.Chat) error {
+	enc := json.NewEncoder(w)
+
+	for _, c := range chats {
+		if err := enc.Encode(&fineTuneExample{c.Messages}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func importFineTune(r io.Reader) ([]*chat.Chat, error) {
+	chats := make([]*chat.Chat, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var example *fineTuneExample
+		if err := json.Unmarshal(line, &example); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		for _, msg := range example.Messages {
+			if !validRole(msg.Role) {
+				return nil, fmt.Errorf("line %d: invalid role: %s", n, msg.Role)
+			}
+		}
+
+		chats = append(chats, &chat.Chat{
+			Messages: example.Messages,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+type chatGPTConversation struct {
+	Title       string                  `json:"title"`
+	CurrentNode string                  `json:"current_node"`
+	Mapping     map[string]*chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	ID      string `json:"id"`
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			ContentType string `json:"content_type"`
+			Parts       []any  `json:"parts"`
+		} `json:"content"`
+		CreateTime float64 `json:"create_time"`
+		Metadata   struct {
+			ModelSlug string `json:"model_slug"`
+		} `json:"metadata"`
+	} `json:"message"`
+}
+
+func importChatGPT(r io.Reader) ([]*chat.Chat, error) {
+	var conversations []*chatGPTConversation
+	if err := json.NewDecoder(r).Decode(&conversations); err != nil {
+		return nil, err
+	}
+
+	chats := make([]*chat.Chat, 0, len(conversations))
+	for _, conv := range conversations {
+		chats = append(chats, conv.chat())
+	}
+
+	return chats, nil
+}
+
+// chat follows the active branch from the current node back to the root.
+func (conv *chatGPTConversation) chat() *chat.Chat {
+	var nodes []*chatGPTNode
+
+	id := conv.CurrentNode
+	if id == "" {
+		nodes = conv.sortedNodes()
+	}
+
+	visited := make(map[string]bool)
+	for id != "" && !visited[id] {
+		visited[id] = true
+
+		node, ok := conv.Mapping[id]
+		if !ok {
+			break
+		}
+
+		nodes = append([]*chatGPTNode{node}, nodes...)
+		id = node.Parent
+	}
+
+	c := new(chat.Chat)
+	for _, node := range nodes {
+		m := node.Message
+		if m == nil {
+			continue
+		}
+
+		role := chat.Role(m.Author.Role)
+		if !validRole(role) {
+			continue
+		}
+
+		var parts []string
+		for _, part := range m.Content.Parts {
+			if s, ok := part.(string); ok {
+				parts = append(parts, s)
+			}
+		}
+
+		content := strings.Join(parts, "\n")
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+
+		if c.Model == "" && m.Metadata.ModelSlug != "" {
+			c.Model = m.Metadata.ModelSlug
+		}
+
+		c.AddMessage(&chat.Message{
+			Role:    role,
+			Content: content,
+		})
+	}
+
+	return c
+}
+
+// sortedNodes is the fallback for exports without current_node.
+func (conv *chatGPTConversation) sortedNodes() []*chatGPTNode {
+	nodes := make([]*chatGPTNode, 0, len(conv.Mapping))
+	for _, node := range conv.Mapping {
+		if node.Message != nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Message.CreateTime < nodes[j].Message.CreateTime
+	})
+
+	return nodes
+}
+
+func validRole(role chat.Role) bool {
+	switch role {
+	case chat.System, chat.User, chat.Assistant:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,123 @@
+package transcript
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+)
+
+func testChat() *chat.Chat {
+	c := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", nil)
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi.\n\nHow can I help?"})
+
+	rating := 5
+	c.Annotation = chat.Annotation{Tags: []string{"greeting"}, Rating: &rating, Template: "support"}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, f := range []Format{JSON, Markdown, FineTune} {
+		t.Run(string(f), func(t *testing.T) {
+			assert := assert.New(t)
+
+			c := testChat()
+
+			var buf bytes.Buffer
+			if err := Export(&buf, f, []*chat.Chat{c, testChat()}); err != nil {
+				assert.Fail(err.Error())
+				return
+			}
+
+			chats, err := Import(&buf, f, "gpt-4")
+			if err != nil {
+				assert.Fail(err.Error())
+				return
+			}
+
+			assert.Len(chats, 2)
+			assert.NotEqual(c.ID, chats[0].ID)
+			assert.Equal(c.Messages, chats[0].Messages)
+
+			if f == JSON {
+				assert.Equal(c.Annotation, chats[0].Annotation)
+			}
+
+			if f == FineTune {
+				assert.Equal("gpt-4", chats[0].Model)
+			} else {
+				assert.Equal("gpt-3.5-turbo", chats[0].Model)
+			}
+		})
+	}
+}
+
+func TestMarkdownRoundTripHeadings(t *testing.T) {
+	assert := assert.New(t)
+
+	c := chat.NewChat("gpt-4", "", nil)
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "How do I set it up?"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "# Setup\n\n## Step 1\n\nInstall it.\n\n---\n\n## user\n\n\\escaped"})
+
+	var buf bytes.Buffer
+	if err := Export(&buf, Markdown, []*chat.Chat{c}); err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	chats, err := Import(&buf, Markdown, "gpt-3.5-turbo")
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Len(chats, 1)
+	assert.Equal(c.Messages, chats[0].Messages)
+}
+
+func TestImportChatGPT(t *testing.T) {
+	assert := assert.New(t)
+
+	jsonStr := `[
+	  {
+	    "title": "Greeting",
+	    "current_node": "c",
+	    "mapping": {
+	      "root": {"id": "root", "parent": null, "message": null},
+	      "a": {"id": "a", "parent": "root", "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Hello!"]}}},
+	      "b": {"id": "b", "parent": "a", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Old answer"]}}},
+	      "c": {"id": "c", "parent": "a", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Hi!"]}, "metadata": {"model_slug": "gpt-4"}}}
+	    }
+	  }
+	]`
+
+	chats, err := Import(strings.NewReader(jsonStr), ChatGPT, "gpt-3.5-turbo")
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Len(chats, 1)
+	assert.Equal("gpt-4", chats[0].Model)
+	assert.Len(chats[0].Messages, 2)
+	assert.Equal("Hello!", chats[0].Messages[0].Content)
+	assert.Equal("Hi!", chats[0].Messages[1].Content)
+}
+
+func TestExportChatGPTUnsupported(t *testing.T) {
+	err := Export(new(bytes.Buffer), ChatGPT, nil)
+	assert.Error(t, err)
+}
+
+func TestImportInvalidRating(t *testing.T) {
+	assert := assert.New(t)
+
+	data := `[{"model":"gpt-4","messages":[{"role":"user","content":"Hello!"}],"rating":9}]`
+
+	_, err := Import(strings.NewReader(data), JSON, "")
+	assert.ErrorContains(err, "rating must be between 1 and 5")
+}
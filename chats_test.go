@@ -0,0 +1,117 @@
+package openai
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestListChats(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	ids := make([]chat.ChatID, 0)
+	for i := 0; i < DefaultPageLimit+5; i++ {
+		c := chat.NewChat("gpt-3.5-turbo", "", nil)
+		chats.Store(c)
+
+		ids = append(ids, c.ID)
+	}
+
+	svc := NewService(chats, &conf.Config{})
+	ctx := context.Background()
+
+	// one more than a page, the last chat of the page is the cursor
+	page, err := svc.ListChats(ctx, &chat.Query{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Len(page.Chats, DefaultPageLimit)
+	if assert.NotNil(page.Next) {
+		assert.Equal(ids[DefaultPageLimit-1], *page.Next)
+	}
+
+	page, err = svc.ListChats(ctx, &chat.Query{After: page.Next})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Len(page.Chats, 5)
+	assert.Equal(ids[DefaultPageLimit], page.Chats[0].ID)
+	assert.Nil(page.Next)
+
+	// exactly a page, no next page
+	page, err = svc.ListChats(ctx, &chat.Query{Limit: 5, After: &ids[DefaultPageLimit-1]})
+	assert.NoError(err)
+	assert.Len(page.Chats, 5)
+	assert.Nil(page.Next)
+
+	page, err = svc.ListChats(ctx, &chat.Query{Limit: MaxPageLimit + 1})
+	assert.NoError(err)
+	assert.Len(page.Chats, DefaultPageLimit+5)
+	assert.Nil(page.Next)
+}
+
+func TestListMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	// the prompt is the first message
+	c := chat.NewChat("gpt-3.5-turbo", "0", nil)
+	for i := 1; i < MaxPageLimit+10; i++ {
+		c.AddMessage(&chat.Message{Role: chat.User, Content: strconv.Itoa(i)})
+	}
+	chats.Store(c)
+
+	svc := NewService(chats, &conf.Config{})
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		cursor int
+		limit  int
+		first  string
+		count  int
+		next   *int
+	}{
+		{"default limit", 0, 0, "0", DefaultPageLimit, intPtr(DefaultPageLimit)},
+		{"max limit", 0, MaxPageLimit + 1, "0", MaxPageLimit, intPtr(MaxPageLimit)},
+		{"last page", MaxPageLimit, 0, strconv.Itoa(MaxPageLimit), 10, nil},
+		{"past the end", MaxPageLimit + 10, 5, "", 0, nil},
+	}
+
+	for _, tt := range tests {
+		page, err := svc.ListMessages(ctx, c.ID, tt.cursor, tt.limit)
+		if !assert.NoError(err, tt.name) {
+			continue
+		}
+
+		assert.Len(page.Messages, tt.count, tt.name)
+		assert.Equal(tt.next, page.Next, tt.name)
+
+		if tt.count > 0 {
+			assert.Equal(tt.first, page.Messages[0].Content, tt.name)
+		}
+	}
+
+	_, err := svc.ListMessages(ctx, c.ID, -1, 0)
+	assert.Error(err)
+
+	_, err = svc.ListMessages(ctx, chat.NewChat("gpt-3.5-turbo", "", nil).ID, 0, 0)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
+)
+
+var datasetCommand = &cli.Command{
+	Name:  "dataset",
+	Usage: "build a fine-tuning dataset from exported chats",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Usage:    "exported chats, e.g. from GET /chats/export",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the input: json, markdown, jsonl or chatgpt; only json keeps tags, ratings and templates",
+			Value: string(transcript.JSON),
+		},
+		&cli.StringFlag{
+			Name:  "spec",
+			Usage: "dataset spec as JSON file, same as the body of POST /datasets",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "select chats with this tag",
+		},
+		&cli.IntFlag{
+			Name:  "min-rating",
+			Usage: "select chats rated at least this",
+		},
+		&cli.StringSliceFlag{
+			Name:  "template",
+			Usage: "select chats created from this template",
+		},
+		&cli.StringSliceFlag{
+			Name:  "redact",
+			Usage: "redactor to apply: email, phone, credit_card, api_key or ip",
+		},
+		&cli.Float64Flag{
+			Name:  "validation-split",
+			Usage: "fraction of examples held out for validation",
+		},
+		&cli.Int64Flag{
+			Name:  "seed",
+			Usage: "seed of the shuffle before splitting",
+		},
+		&cli.StringFlag{
+			Name:  "base-model",
+			Usage: "base model to be fine-tuned",
+			Value: dataset.DefaultBaseModel,
+		},
+		&cli.IntFlag{
+			Name:  "epochs",
+			Usage: "training epochs, for cost estimates",
+			Value: dataset.DefaultEpochs,
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "output directory",
+			Value: ".",
+		},
+	},
+	Action: buildDataset,
+}
+
+func buildDataset(cli *cli.Context) error {
+	spec := new(dataset.Spec)
+	if path := cli.String("spec"); path != "" {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(bs, spec); err != nil {
+			return err
+		}
+	}
+
+	if cli.IsSet("tag") {
+		spec.Tags = cli.StringSlice("tag")
+	}
+	if cli.IsSet("min-rating") {
+		rating := cli.Int("min-rating")
+		spec.MinRating = &rating
+	}
+	if cli.IsSet("template") {
+		spec.Templates = cli.StringSlice("template")
+	}
+	if cli.IsSet("redact") {
+		spec.Redact = cli.StringSlice("redact")
+	}
+	if cli.IsSet("validation-split") {
+		spec.ValidationSplit = cli.Float64("validation-split")
+	}
+	if cli.IsSet("seed") {
+		spec.Seed = cli.Int64("seed")
+	}
+	if cli.IsSet("base-model") || spec.BaseModel == "" {
+		spec.BaseModel = cli.String("base-model")
+	}
+	if cli.IsSet("epochs") || spec.Epochs == 0 {
+		spec.Epochs = cli.Int("epochs")
+	}
+
+	format, err := transcript.ParseFormat(cli.String("format"))
+	if err != nil {
+		return err
+	}
+
+	// only the native export carries the annotations
+	annotated := len(spec.Tags) > 0 || spec.MinRating != nil || len(spec.Templates) > 0
+	if annotated && format != transcript.JSON {
+		return errors.New("tags, ratings and templates are only kept by json exports")
+	}
+
+	f, err := os.Open(cli.String("input"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chats, err := transcript.Import(f, format, "")
+	if err != nil {
+		return err
+	}
+
+	ds, err := dataset.Build(chats, spec)
+	if err != nil {
+		return err
+	}
+
+	out := cli.String("out")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	splits := []dataset.Split{dataset.TrainSplit}
+	if len(ds.Validation) > 0 {
+		splits = append(splits, dataset.ValidationSplit)
+	}
+
+	for _, split := range splits {
+		if err := writeSplit(ds, split, filepath.Join(out, string(split)+".jsonl")); err != nil {
+			return err
+		}
+	}
+
+	stats := ds.Stats
+	fmt.Printf("selected: %d, train: %d, validation: %d\n", stats.Selected, stats.Train, stats.Validation)
+	for _, reason := range stats.SkipReasons() {
+		fmt.Printf("skipped (%s): %d\n", reason, stats.Skipped[reason])
+	}
+	fmt.Printf("train tokens: %d (max %d, mean %.1f per example)\n", stats.TrainTokens, stats.MaxTokens, stats.MeanTokens)
+	fmt.Printf("estimated cost: $%.4f (%s, %d epochs)\n", stats.EstimatedCost, stats.BaseModel, stats.Epochs)
+
+	return nil
+}
+
+func writeSplit(ds *dataset.Dataset, split dataset.Split, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ds.WriteJSONL(f, split)
+}
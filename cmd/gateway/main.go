@@ -1,58 +1,288 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 
 	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/discovery"
+	"github.com/mirror520/openai/health"
+	"github.com/mirror520/openai/tracing"
 	"github.com/mirror520/openai/transport/http"
 )
 
 func main() {
+	app := &cli.App{
+		Name:  "gateway",
+		Usage: "OpenAI proxy gateway",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "path",
+				Usage:   "work directory",
+				EnvVars: []string{"OPENAI_PATH"},
+			},
+			&cli.IntFlag{
+				Name:    "port",
+				Usage:   "gateway port",
+				Value:   8080,
+				EnvVars: []string{"OPENAI_GATEWAY_PORT"},
+			},
+		},
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadConfig returns the config in the work directory, and the directory.
+func loadConfig(cli *cli.Context) (*conf.Config, string, error) {
+	path := cli.String("path")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, "", err
+		}
+
+		path = homeDir + "/.openai"
+	}
+
+	f, err := os.Open(path + "/config.yaml")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var cfg *conf.Config
+	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, "", err
+	}
+
+	return cfg, path, nil
+}
+
+func run(cli *cli.Context) error {
+	cfg, path, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
 	log, err := zap.NewDevelopment()
 	if err != nil {
-		log.Fatal(err.Error())
-		return
+		return err
 	}
 	defer log.Sync()
 
 	zap.ReplaceGlobals(log)
 
-	// TODO: Service Discovery
+	shutdown, err := tracing.Setup(cfg.Tracing, "openai-gateway")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	instancer, err := newInstancer(cfg.Discovery, path, log)
+	if err != nil {
+		return err
+	}
+	defer instancer.Stop()
+
+	scheme := cfg.Discovery.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	retryMax := cfg.Discovery.Retry.Max
+	if retryMax <= 0 {
+		retryMax = 3
+	}
+
+	retryTimeout := cfg.Discovery.Retry.Timeout
+	if retryTimeout <= 0 {
+		retryTimeout = 5 * time.Minute
+	}
+
+	// the chats live in the memory of their instance
+	affinity := discovery.NewAffinity(instancer, cfg.Discovery.MaxOwners, log)
+	defer affinity.Stop()
+
+	g := cfg.Discovery.Guard
+	guard := discovery.NewGuard(discovery.GuardOptions{
+		Timeout:             g.Timeout,
+		MaxRequests:         g.MaxRequests,
+		ConsecutiveFailures: g.ConsecutiveFailures,
+		OpenTimeout:         g.OpenTimeout,
+		Window:              g.Outliers.Window,
+		MinRequests:         g.Outliers.MinRequests,
+		MaxErrorRate:        g.Outliers.MaxErrorRate,
+		LatencyFactor:       g.Outliers.LatencyFactor,
+		MinLatency:          g.Outliers.MinLatency,
+		EjectionTime:        g.Outliers.EjectionTime,
+		MaxEjectedPercent:   g.Outliers.MaxEjectedPercent,
+	}, log)
+
+	// instances not ready take no requests
+	probing, stopProbing := context.WithCancel(context.Background())
+	defer stopProbing()
+
+	go guard.Probe(probing, http.ReadinessProbe(scheme), g.ProbeInterval)
+
+	balance := func(factory sd.Factory) endpoint.Endpoint {
+		return affinity.Endpoint(guard.Factory(factory), retryMax, retryTimeout)
+	}
+
+	// the requests spanning every chat are answered by any instance sharing
+	// persistence, otherwise merged from all of them, or refused
+	spanning := func(factory sd.Factory, merge discovery.Merge) endpoint.Endpoint {
+		switch {
+		case cfg.Discovery.Shared:
+			return balance(factory)
+
+		case merge != nil:
+			return affinity.FanOut(guard.Factory(factory), merge)
+
+		default:
+			return discovery.Reject(discovery.ErrNotShared)
+		}
+	}
 
 	proxyEndpoints := new(openai.ChatEndpoints)
 	{
-		factory := http.ChatFactory(http.CreateChatEndpoint, "http")
-		endpoint, _, _ := factory("127.0.0.1:80")
-		proxyEndpoints.CreateChatEndpoint = endpoint
+		factory := http.ChatFactory(http.CreateChatEndpoint, scheme)
+		proxyEndpoints.CreateChatEndpoint = balance(factory)
 	}
 
 	// UpdateChat
 	{
-		factory := http.ChatFactory(http.UpdateChatEndpoint, "http")
-		endpoint, _, _ := factory("127.0.0.1:80")
-		proxyEndpoints.UpdateChatEndpoint = endpoint
+		factory := http.ChatFactory(http.UpdateChatEndpoint, scheme)
+		proxyEndpoints.UpdateChatEndpoint = balance(factory)
 	}
 
 	// Chat
 	{
-		factory := http.ChatFactory(http.ChatEndpoint, "http")
-		endpoint, _, _ := factory("127.0.0.1:80")
-		proxyEndpoints.ChatEndpoint = endpoint
+		factory := http.ChatFactory(http.ChatEndpoint, scheme)
+		proxyEndpoints.ChatEndpoint = balance(factory)
 	}
 
 	// ChatStream
 	{
-		factory := http.ChatFactory(http.ChatStreamEndpoint, "http")
-		endpoint, _, _ := factory("127.0.0.1:80")
-		proxyEndpoints.ChatStreamEndpoint = endpoint
+		factory := http.ChatFactory(http.ChatStreamEndpoint, scheme)
+		proxyEndpoints.ChatStreamEndpoint = balance(factory)
+	}
+
+	// RegenerateStream
+	{
+		factory := http.ChatFactory(http.RegenerateStreamEndpoint, scheme)
+		proxyEndpoints.RegenerateStreamEndpoint = balance(factory)
+	}
+
+	// CancelChat
+	{
+		factory := http.ChatFactory(http.CancelChatEndpoint, scheme)
+		proxyEndpoints.CancelChatEndpoint = balance(factory)
+	}
+
+	// ListChats
+	{
+		factory := http.ChatFactory(http.ListChatsEndpoint, scheme)
+		proxyEndpoints.ListChatsEndpoint = spanning(factory, discovery.MergePages)
+	}
+
+	// FindChat
+	{
+		factory := http.ChatFactory(http.FindChatEndpoint, scheme)
+		proxyEndpoints.FindChatEndpoint = balance(factory)
+	}
+
+	// ListMessages
+	{
+		factory := http.ChatFactory(http.ListMessagesEndpoint, scheme)
+		proxyEndpoints.ListMessagesEndpoint = balance(factory)
+	}
+
+	// DeleteChat
+	{
+		factory := http.ChatFactory(http.DeleteChatEndpoint, scheme)
+		proxyEndpoints.DeleteChatEndpoint = balance(factory)
+	}
+
+	// ExportChat
+	{
+		factory := http.ChatFactory(http.ExportChatEndpoint, scheme)
+		proxyEndpoints.ExportChatEndpoint = balance(factory)
+	}
+
+	// ExportChats
+	{
+		factory := http.ChatFactory(http.ExportChatsEndpoint, scheme)
+		proxyEndpoints.ExportChatsEndpoint = spanning(factory, nil)
+	}
+
+	// ImportChats
+	{
+		factory := http.ChatFactory(http.ImportChatsEndpoint, scheme)
+		proxyEndpoints.ImportChatsEndpoint = balance(factory)
+	}
+
+	// AnnotateChat
+	{
+		factory := http.ChatFactory(http.AnnotateChatEndpoint, scheme)
+		proxyEndpoints.AnnotateChatEndpoint = balance(factory)
+	}
+
+	// ShareChat
+	{
+		factory := http.ChatFactory(http.ShareChatEndpoint, scheme)
+		proxyEndpoints.ShareChatEndpoint = balance(factory)
+	}
+
+	// BuildDataset
+	{
+		factory := http.ChatFactory(http.BuildDatasetEndpoint, scheme)
+		proxyEndpoints.BuildDatasetEndpoint = spanning(factory, nil)
+	}
+
+	// CreateCompletion
+	{
+		factory := http.CompatFactory(http.CreateCompletionEndpoint, scheme)
+		proxyEndpoints.CreateCompletionEndpoint = balance(factory)
+	}
+
+	// CreateCompletionStream
+	{
+		factory := http.CompatFactory(http.CreateCompletionStreamEndpoint, scheme)
+		proxyEndpoints.CreateCompletionStreamEndpoint = balance(factory)
+	}
+
+	// ListModels
+	{
+		factory := http.CompatFactory(http.ListModelsEndpoint, scheme)
+		proxyEndpoints.ListModelsEndpoint = balance(factory)
 	}
 
 	// service (internal use)
 	var svc openai.Service // dummy service
 	svc = openai.ProxyingMiddleware(proxyEndpoints)(svc)
 	svc = openai.LoggingMiddleware(log)(svc)
+	if cfg.Tracing.Enabled {
+		svc = openai.TracingMiddleware()(svc)
+	}
 
 	// ---
 
@@ -62,12 +292,111 @@ func main() {
 		UpdateChatEndpoint: openai.UpdateChatEndpoint(svc),
 		ChatEndpoint:       openai.ChatEndpoint(svc),
 		ChatStreamEndpoint: openai.ChatStreamEndpoint(svc),
+
+		RegenerateStreamEndpoint: openai.RegenerateStreamEndpoint(svc),
+		CancelChatEndpoint:       openai.CancelChatEndpoint(svc),
+
+		ListChatsEndpoint:    openai.ListChatsEndpoint(svc),
+		FindChatEndpoint:     openai.FindChatEndpoint(svc),
+		ListMessagesEndpoint: openai.ListMessagesEndpoint(svc),
+		DeleteChatEndpoint:   openai.DeleteChatEndpoint(svc),
+
+		ExportChatEndpoint:  openai.ExportChatEndpoint(svc),
+		ExportChatsEndpoint: openai.ExportChatsEndpoint(svc),
+		ImportChatsEndpoint: openai.ImportChatsEndpoint(svc),
+
+		AnnotateChatEndpoint: openai.AnnotateChatEndpoint(svc),
+		ShareChatEndpoint:    openai.ShareChatEndpoint(svc),
+		BuildDatasetEndpoint: openai.BuildDatasetEndpoint(svc),
+
+		CreateCompletionEndpoint:       openai.CreateCompletionEndpoint(svc),
+		CreateCompletionStreamEndpoint: openai.CreateCompletionStreamEndpoint(svc),
+		ListModelsEndpoint:             openai.ListModelsEndpoint(svc),
+	}
+
+	if cfg.Tracing.Enabled {
+		endpoints = openai.TracedEndpoints(endpoints)
+	}
+
+	// the instances authenticate the callers, the gateway only its admins
+	authenticator, _, err := auth.NewAuthenticator(cfg.Auth, path)
+	if err != nil {
+		return err
 	}
 
 	// transport (external use)
 	r := gin.Default()
+	r.ContextWithFallback = true
 	r.Use(cors.Default())
+	if cfg.Tracing.Enabled {
+		r.Use(http.Trace("openai-gateway"))
+	}
+	r.Use(http.Instrument(http.NewPrometheusHTTPMetrics()))
+	http.HealthRouter(r, health.Check{Name: "instances", Func: guard.Check})
+	http.MetricsRouter(r)
+
+	// the identity headers are only passed on from a trusted proxy
+	if cfg.Auth.TrustHeaders {
+		r.Use(http.TrustedIdentity())
+	}
+
+	r.Use(http.ForwardIdentity())
+
 	http.Router(r.Group("/openai/v1"), endpoints)
+	http.CompatRouter(r.Group("/v1"), endpoints)
+
+	admin := r.Group("/openai/v1/admin")
+	if authenticator != nil {
+		admin.Use(http.Authenticate(authenticator))
+	}
 
-	r.Run()
+	http.GatewayAdminRouter(admin, auth.AdminMiddleware(discovery.BackendsEndpoint(guard)))
+
+	return r.Run(":" + strconv.Itoa(cli.Int("port")))
+}
+
+func newInstancer(cfg conf.Discovery, path string, log *zap.Logger) (sd.Instancer, error) {
+	switch cfg.Driver {
+	case conf.Static, "":
+		if len(cfg.Static) == 0 {
+			return nil, errors.New("no static instances")
+		}
+
+		return sd.FixedInstancer(cfg.Static), nil
+
+	case conf.File:
+		filePath := cfg.File.Path
+		if filePath == "" {
+			filePath = "instances"
+		}
+
+		if !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(path, filePath)
+		}
+
+		return discovery.NewInstancer(discovery.FileSource(filePath, cfg.File.Interval), log), nil
+
+	case conf.Directory:
+		dir := cfg.Directory.Path
+		if dir == "" {
+			dir = "registry"
+		}
+
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(path, dir)
+		}
+
+		return discovery.NewInstancer(discovery.DirectorySource(dir, cfg.Directory.Interval), log), nil
+
+	case conf.DNS:
+		src := discovery.DNSSource(nil, cfg.DNS.Name, cfg.DNS.Port, cfg.DNS.Interval)
+		return discovery.NewInstancer(src, log), nil
+
+	case conf.Consul:
+		src := discovery.ConsulSource(cfg.Consul.Addr, cfg.Consul.Service, cfg.Consul.Tag, cfg.Consul.Token, cfg.Consul.Wait)
+		return discovery.NewInstancer(src, log), nil
+
+	default:
+		return nil, errors.New("unsupported discovery driver")
+	}
 }
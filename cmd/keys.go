@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/encrypted"
+)
+
+var keysCommand = &cli.Command{
+	Name:  "keys",
+	Usage: "manage the keys encrypting stored chats",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "rewrap",
+			Usage:  "wrap every data key with the first master key, to retire the others",
+			Action: rewrapKeys,
+		},
+		{
+			Name:      "rotate",
+			Usage:     "start a new data key for a tenant",
+			ArgsUsage: "[tenant]",
+			Action:    rotateKey,
+		},
+	},
+}
+
+func rewrapKeys(cli *cli.Context) error {
+	cfg, path, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := openKeyring(cfg.Persistent.Encryption, path)
+	if err != nil {
+		return err
+	}
+
+	n, err := keyring.Rewrap()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rewrapped %d data keys\n", n)
+	return nil
+}
+
+func rotateKey(cli *cli.Context) error {
+	cfg, path, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := openKeyring(cfg.Persistent.Encryption, path)
+	if err != nil {
+		return err
+	}
+
+	tenant := cli.Args().First()
+	if tenant == "" {
+		tenant = encrypted.DefaultTenant
+	}
+
+	return keyring.RotateDataKey(tenant)
+}
+
+func openKeyring(cfg conf.Encryption, path string) (*encrypted.Keyring, error) {
+	if len(cfg.MasterKeys) == 0 {
+		return nil, errors.New("no master key configured")
+	}
+
+	masters := make([]*encrypted.MasterKey, 0, len(cfg.MasterKeys))
+	for _, key := range cfg.MasterKeys {
+		var (
+			master *encrypted.MasterKey
+			err    error
+		)
+
+		if key.File != "" {
+			file := key.File
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(path, file)
+			}
+
+			master, err = encrypted.ReadMasterKey(key.ID, file)
+		} else {
+			master, err = encrypted.ParseMasterKey(key.ID, key.Key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("master key %s: %w", key.ID, err)
+		}
+
+		masters = append(masters, master)
+	}
+
+	keyring := cfg.Keyring
+	if keyring == "" {
+		keyring = "keyring.json"
+	}
+
+	if !filepath.IsAbs(keyring) {
+		keyring = filepath.Join(path, keyring)
+	}
+
+	return encrypted.OpenKeyring(keyring, masters...)
+}
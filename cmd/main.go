@@ -1,21 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 
 	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
 	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/health"
+	"github.com/mirror520/openai/persistent/encrypted"
+	"github.com/mirror520/openai/persistent/eventlog"
 	"github.com/mirror520/openai/persistent/inmem"
+	"github.com/mirror520/openai/persistent/redis"
+	"github.com/mirror520/openai/persistent/sqlite"
+	"github.com/mirror520/openai/tracing"
+	"github.com/mirror520/openai/transport/grpc"
 	"github.com/mirror520/openai/transport/http"
 )
 
@@ -35,6 +51,16 @@ func main() {
 				Value:   8080,
 				EnvVars: []string{"OPENAI_PORT"},
 			},
+			&cli.IntFlag{
+				Name:    "grpc-port",
+				Usage:   "gRPC service port, 0 to disable",
+				Value:   9090,
+				EnvVars: []string{"OPENAI_GRPC_PORT"},
+			},
+		},
+		Commands: []*cli.Command{
+			datasetCommand,
+			keysCommand,
 		},
 		Action: run,
 	}
@@ -44,12 +70,13 @@ func main() {
 	}
 }
 
-func run(cli *cli.Context) error {
+// loadConfig returns the config in the work directory, and the directory.
+func loadConfig(cli *cli.Context) (*conf.Config, string, error) {
 	path := cli.String("path")
 	if path == "" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			return err
+			return nil, "", err
 		}
 
 		path = homeDir + "/.openai"
@@ -57,12 +84,21 @@ func run(cli *cli.Context) error {
 
 	f, err := os.Open(path + "/config.yaml")
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 	defer f.Close()
 
 	var cfg *conf.Config
 	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, "", err
+	}
+
+	return cfg, path, nil
+}
+
+func run(cli *cli.Context) error {
+	cfg, path, err := loadConfig(cli)
+	if err != nil {
 		return err
 	}
 
@@ -74,12 +110,40 @@ func run(cli *cli.Context) error {
 
 	zap.ReplaceGlobals(log)
 
-	repo := inmem.NewChatRepository()
+	shutdown, err := tracing.Setup(cfg.Tracing, "openai")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	repo, err := newChatRepository(cfg.Persistent, path)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Persistent.Encryption.Enabled {
+		keyring, err := openKeyring(cfg.Persistent.Encryption, path)
+		if err != nil {
+			repo.Close()
+			return err
+		}
+
+		repo = encrypted.NewChatRepository(repo, keyring, encrypted.ChatTenant)
+	}
 	defer repo.Close()
 
 	// service
 	svc := openai.NewService(repo, cfg)
+	if cfg.Queue.Enabled {
+		svc = openai.QueueingMiddleware(cfg.Queue.MaxLength, cfg.Queue.Timeout)(svc)
+	}
 	svc = openai.LoggingMiddleware(log)(svc)
+	svc = openai.InstrumentingMiddleware(openai.NewPrometheusMetrics())(svc)
+	if cfg.Tracing.Enabled {
+		svc = openai.TracingMiddleware()(svc)
+	}
+
+	prometheus.MustRegister(openai.RepositorySize(repo))
 
 	// endpoint
 	endpoints := &openai.ChatEndpoints{
@@ -87,23 +151,354 @@ func run(cli *cli.Context) error {
 		UpdateChatEndpoint: openai.UpdateChatEndpoint(svc),
 		ChatEndpoint:       openai.ChatEndpoint(svc),
 		ChatStreamEndpoint: openai.ChatStreamEndpoint(svc),
+
+		RegenerateStreamEndpoint: openai.RegenerateStreamEndpoint(svc),
+		CancelChatEndpoint:       openai.CancelChatEndpoint(svc),
+
+		ListChatsEndpoint:    openai.ListChatsEndpoint(svc),
+		FindChatEndpoint:     openai.FindChatEndpoint(svc),
+		ListMessagesEndpoint: openai.ListMessagesEndpoint(svc),
+		DeleteChatEndpoint:   openai.DeleteChatEndpoint(svc),
+
+		ExportChatEndpoint:  openai.ExportChatEndpoint(svc),
+		ExportChatsEndpoint: openai.ExportChatsEndpoint(svc),
+		ImportChatsEndpoint: openai.ImportChatsEndpoint(svc),
+
+		AnnotateChatEndpoint: openai.AnnotateChatEndpoint(svc),
+		ShareChatEndpoint:    openai.ShareChatEndpoint(svc),
+		BuildDatasetEndpoint: openai.BuildDatasetEndpoint(svc),
+
+		CreateCompletionEndpoint:       openai.CreateCompletionEndpoint(svc),
+		CreateCompletionStreamEndpoint: openai.CreateCompletionStreamEndpoint(svc),
+		ListModelsEndpoint:             openai.ListModelsEndpoint(svc),
+	}
+
+	if cfg.Auth.Enabled {
+		endpoints = openai.AuthorizedEndpoints(endpoints, repo)
+	}
+
+	if cfg.Tracing.Enabled {
+		endpoints = openai.TracedEndpoints(endpoints)
+	}
+
+	authenticator, keys, err := auth.NewAuthenticator(cfg.Auth, path)
+	if err != nil {
+		return err
 	}
 
 	// transport
 	r := gin.Default()
+	r.ContextWithFallback = true
 	r.Use(cors.Default())
+	if cfg.Tracing.Enabled {
+		r.Use(http.Trace("openai"))
+	}
+	r.Use(http.Instrument(http.NewPrometheusHTTPMetrics()))
+
+	http.HealthRouter(r, healthChecks(cfg, repo)...)
+	http.MetricsRouter(r)
+
+	if cfg.Auth.TrustHeaders {
+		r.Use(http.TrustedIdentity())
+	}
+
+	if authenticator != nil {
+		r.Use(http.Authenticate(authenticator))
+	}
+
 	http.Router(r.Group("/openai/v1"), endpoints)
+	http.CompatRouter(r.Group("/v1"), endpoints)
+
+	if keys != nil {
+		http.AdminRouter(r.Group("/openai/v1/admin"), auth.MakeKeyEndpoints(keys))
+	}
 
+	// listen before registering, lest the instance be announced
+	// while nothing is served
 	port := cli.Int("port")
-	go r.Run(":" + strconv.Itoa(port))
+	httpLis, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- r.RunListener(httpLis)
+	}()
+
+	meta := make(map[string]string)
+
+	if grpcPort := cli.Int("grpc-port"); grpcPort > 0 {
+		identify := make([]grpc.Identify, 0)
+		if cfg.Auth.TrustHeaders {
+			identify = append(identify, grpc.TrustedIdentity())
+		}
 
-	// TODO: Service Registration
+		if authenticator != nil {
+			identify = append(identify, grpc.Authenticate(authenticator))
+		}
+
+		lis, err := net.Listen("tcp", ":"+strconv.Itoa(grpcPort))
+		if err != nil {
+			return err
+		}
+
+		s := grpc.NewServer(endpoints, identify...)
+		defer s.GracefulStop()
+
+		go func() {
+			errc <- s.Serve(lis)
+		}()
+
+		meta["grpc-port"] = strconv.Itoa(grpcPort)
+	}
+
+	registrar, err := newRegistrar(cfg.Registry, path, port, meta, log)
+	if err != nil {
+		return err
+	}
+
+	if registrar != nil {
+		registrar.Register()
+		defer registrar.Deregister()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	sign := <-quit
-	log.Info(sign.String())
+	select {
+	case sign := <-quit:
+		log.Info(sign.String())
+		return nil
+
+	case err := <-errc:
+		return err
+	}
+}
+
+func newChatRepository(cfg conf.Persistent, path string) (chat.Repository, error) {
+	switch cfg.Driver {
+	case conf.InMem, "":
+		opts := inmem.Options{
+			IdleTTL:         cfg.InMem.IdleTTL,
+			MaxChats:        cfg.InMem.MaxChats,
+			MaxMemory:       cfg.InMem.MaxMemory,
+			JanitorInterval: cfg.InMem.JanitorInterval,
+		}
+
+		if driver := cfg.InMem.Archive; driver != "" {
+			if driver == conf.InMem {
+				return nil, errors.New("cannot archive to inmem")
+			}
+
+			archiveCfg := cfg
+			archiveCfg.Driver = driver
+
+			archive, err := newChatRepository(archiveCfg, path)
+			if err != nil {
+				return nil, err
+			}
+
+			log := zap.L().With(zap.String("persistent", "inmem"))
+
+			opts.OnEvict = inmem.ArchiveTo(archive, func(err error) {
+				log.Error(err.Error(), zap.String("action", "archive"))
+			})
+
+			repo := inmem.NewChatRepositoryWithOptions(opts)
+			return &archivedRepository{repo, archive}, nil
+		}
+
+		return inmem.NewChatRepositoryWithOptions(opts), nil
+
+	case conf.SQLite:
+		dbPath := cfg.SQLite.Path
+		if dbPath == "" {
+			dbPath = "openai.db"
+		}
+
+		if !filepath.IsAbs(dbPath) {
+			dbPath = filepath.Join(path, dbPath)
+		}
+
+		return sqlite.NewChatRepository(dbPath)
+
+	case conf.EventLog:
+		dir := cfg.EventLog.Dir
+		if dir == "" {
+			dir = "events"
+		}
+
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(path, dir)
+		}
+
+		return eventlog.NewChatRepository(dir, eventlog.Options{
+			SegmentSize:   cfg.EventLog.SegmentSize,
+			SnapshotEvery: cfg.EventLog.SnapshotEvery,
+			KeepSnapshots: cfg.EventLog.KeepSnapshots,
+			Sync:          cfg.EventLog.Sync,
+		})
+
+	case conf.Redis:
+		return redis.NewChatRepository(redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+			Prefix:   cfg.Redis.Prefix,
+			TTL:      cfg.Redis.TTL,
+		})
+	}
+
+	return nil, errors.New("unsupported persistent driver: " + string(cfg.Driver))
+}
+
+// archivedRepository keeps the chats evicted from memory in the archive.
+// A chat found only there is taken back into memory, the chats are listed
+// from both, and the archive is closed along with the repository.
+type archivedRepository struct {
+	chat.Repository
+	archive chat.Repository
+}
+
+func (repo *archivedRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	c, err := repo.Repository.Find(id)
+	if !errors.Is(err, chat.ErrChatNotFound) {
+		return c, err
+	}
+
+	c, err = repo.archive.Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// versions are tracked per repository
+	c.Version = 0
+	if err := repo.Repository.Store(c); err != nil && !errors.Is(err, chat.ErrConflict) {
+		return nil, err
+	}
+
+	return repo.Repository.Find(id)
+}
+
+func (repo *archivedRepository) List(q *chat.Query) ([]*chat.Chat, error) {
+	chats, err := repo.Repository.List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	archived, err := repo.archive.List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[chat.ChatID]bool, len(chats))
+	for _, c := range chats {
+		seen[c.ID] = true
+	}
+
+	for _, c := range archived {
+		if !seen[c.ID] {
+			chats = append(chats, c)
+		}
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].ID.Compare(chats[j].ID) < 0
+	})
+
+	if q.Limit > 0 && len(chats) > q.Limit {
+		chats = chats[:q.Limit]
+	}
+
+	return chats, nil
+}
+
+// Delete removes the chat from the archive as well, lest it come back.
+func (repo *archivedRepository) Delete(id chat.ChatID) error {
+	err := repo.Repository.Delete(id)
+	if err != nil && !errors.Is(err, chat.ErrChatNotFound) {
+		return err
+	}
+
+	archiveErr := repo.archive.Delete(id)
+	if errors.Is(archiveErr, chat.ErrChatNotFound) && err == nil {
+		return nil
+	}
+
+	return archiveErr
+}
+
+// Count counts the chats in memory.
+func (repo *archivedRepository) Count() (int, error) {
+	if counter, ok := repo.Repository.(chat.Counter); ok {
+		return counter.Count()
+	}
+
+	chats, err := repo.Repository.List(&chat.Query{})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(chats), nil
+}
+
+func (repo *archivedRepository) Ping() error {
+	for _, r := range []chat.Repository{repo.Repository, repo.archive} {
+		if pinger, ok := r.(chat.Pinger); ok {
+			if err := pinger.Ping(); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
+
+func (repo *archivedRepository) Close() error {
+	err := repo.Repository.Close()
+	if archiveErr := repo.archive.Close(); err == nil {
+		err = archiveErr
+	}
+
+	return err
+}
+
+// healthChecks are the checks of GET /readyz.
+func healthChecks(cfg *conf.Config, repo chat.Repository) []health.Check {
+	checks := []health.Check{
+		health.Config(cfg),
+		health.Repository(repo),
+	}
+
+	deep := cfg.Health.Deep
+	if !deep.Enabled {
+		return checks
+	}
+
+	baseURL := deep.BaseURL
+	if baseURL == "" {
+		baseURL = cfg.BaseURL
+	}
+
+	if baseURL == "" {
+		baseURL = openai.DefaultBaseURL
+	}
+
+	model := deep.Model
+	if model == "" {
+		model = "gpt-3.5-turbo"
+	}
+
+	ttl := deep.TTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+
+	// the gateway routes by /readyz, so a rate limited or failing upstream,
+	// shared by every instance, must not take them all out of rotation
+	upstream := health.Upstream(baseURL, cfg.APIKey, model)
+	upstream.Advisory = true
+
+	return append(checks, health.Cached(upstream, ttl))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestArchivedRepository(t *testing.T) {
+	assert := assert.New(t)
+
+	archive := inmem.NewChatRepository()
+	repo := &archivedRepository{
+		Repository: inmem.NewChatRepositoryWithOptions(inmem.Options{
+			MaxChats: 1,
+			OnEvict:  inmem.ArchiveTo(archive, nil),
+		}),
+		archive: archive,
+	}
+	defer repo.Close()
+
+	a := chat.NewChat("gpt-3.5-turbo", "a", nil)
+	b := chat.NewChat("gpt-3.5-turbo", "b", nil)
+
+	assert.NoError(repo.Store(a))
+	assert.NoError(repo.Store(b)) // a is archived
+
+	n, err := repo.Count()
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	chats, err := repo.List(&chat.Query{})
+	assert.NoError(err)
+	assert.Len(chats, 2)
+
+	found, err := repo.Find(a.ID)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(a.ID, found.ID)
+
+	// taken back into memory, the chat is stored as usual
+	found.Tags = []string{"archived"}
+	assert.NoError(repo.Store(found))
+
+	assert.NoError(repo.Delete(a.ID))
+	assert.NoError(repo.Delete(b.ID))
+
+	_, err = repo.Find(a.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	_, err = repo.Find(b.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	assert.ErrorIs(repo.Delete(a.ID), chat.ErrChatNotFound)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/sd"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/discovery"
+)
+
+// newRegistrar returns the registrar of the config announcing the instance
+// on the port, or nil if registration is disabled.
+func newRegistrar(cfg conf.Registry, path string, port int, meta map[string]string, log *zap.Logger) (sd.Registrar, error) {
+	if cfg.Driver == "" {
+		return nil, nil
+	}
+
+	address := cfg.Address
+	if address == "" {
+		addr, err := localAddress()
+		if err != nil {
+			return nil, err
+		}
+
+		address = addr
+	}
+
+	id := cfg.ID
+	if id == "" {
+		id = fmt.Sprintf("openai-%s-%d", strings.NewReplacer(".", "-", ":", "-").Replace(address), port)
+	}
+
+	instance := discovery.Instance{
+		ID:      id,
+		Address: address,
+		Port:    port,
+		Meta:    make(map[string]string),
+	}
+
+	for k, v := range meta {
+		instance.Meta[k] = v
+	}
+
+	for k, v := range cfg.Meta {
+		instance.Meta[k] = v
+	}
+
+	switch cfg.Driver {
+	case conf.Directory:
+		dir := cfg.Directory.Path
+		if dir == "" {
+			dir = "registry"
+		}
+
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(path, dir)
+		}
+
+		return discovery.DirectoryRegistrar(dir, instance, cfg.TTL, log), nil
+
+	case conf.Consul:
+		service := cfg.Consul.Service
+		if service == "" {
+			service = "openai"
+		}
+
+		return discovery.ConsulRegistrar(cfg.Consul.Addr, service, cfg.Consul.Tags, cfg.Consul.Token, instance, cfg.TTL, log), nil
+
+	default:
+		return nil, errors.New("unsupported registry driver")
+	}
+}
+
+// localAddress returns the first non-loopback address of the host,
+// preferring IPv4.
+func localAddress() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	var fallback string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+
+		if fallback == "" {
+			fallback = ipNet.IP.String()
+		}
+	}
+
+	if fallback == "" {
+		return "", errors.New("no address to announce")
+	}
+
+	return fallback, nil
+}
@@ -0,0 +1,215 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestCreateCompletion(t *testing.T) {
+	assert := assert.New(t)
+
+	var received map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"message":"Incorrect API key provided","type":"invalid_request_error"}}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/models":
+			w.Write([]byte(`{"object":"list","data":[{"id":"gpt-4","object":"model"}]}`))
+
+		case "/v1/chat/completions":
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &received)
+
+			if received["stream"] == true {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n"))
+				w.Write([]byte("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"!\"}}]}\n\n"))
+				w.Write([]byte("data: [DONE]\n\n"))
+				return
+			}
+
+			w.Write([]byte(`{"id":"1","object":"chat.completion","choices":[{"message":{"role":"assistant","content":"Hi!"}}]}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	svc := NewService(chats, &conf.Config{APIKey: "sk-test", BaseURL: upstream.URL + "/v1/"})
+
+	models, err := svc.ListModels(context.Background())
+	assert.NoError(err)
+	assert.JSONEq(`{"object":"list","data":[{"id":"gpt-4","object":"model"}]}`, string(models))
+
+	// the user is the caller, whatever the body says
+	ctx := auth.NewContext(context.Background(), &auth.Identity{Subject: "alice"})
+	body := json.RawMessage(`{"model":"gpt-4","user":"bob","messages":[{"role":"user","content":"Hello"}]}`)
+
+	resp, err := CreateCompletionEndpoint(svc)(ctx, &CompletionRequest{Body: body})
+	assert.NoError(err)
+	assert.Contains(string(resp.(json.RawMessage)), `"content":"Hi!"`)
+	assert.Equal("alice", received["user"])
+	assert.Equal("gpt-4", received["model"])
+
+	events, err := svc.CreateCompletionStream(ctx, json.RawMessage(`{"model":"gpt-4","stream":true}`), chat.ChatID{})
+	assert.NoError(err)
+
+	chunks := make([]string, 0)
+	for data := range events {
+		chunks = append(chunks, string(data))
+	}
+
+	assert.Len(chunks, 2)
+	assert.Contains(chunks[1], `"content":"!"`)
+
+	// upstream errors are kept as they are
+	svc = NewService(chats, &conf.Config{APIKey: "sk-wrong", BaseURL: upstream.URL + "/v1"})
+
+	_, err = svc.CreateCompletion(ctx, body, chat.ChatID{})
+	var upstreamErr *UpstreamError
+	if assert.ErrorAs(err, &upstreamErr) {
+		assert.Equal(http.StatusUnauthorized, upstreamErr.StatusCode)
+		assert.Contains(string(upstreamErr.Body), "Incorrect API key provided")
+	}
+	assert.Contains(err.Error(), "Incorrect API key provided")
+}
+
+func TestCreateCompletionWithChat(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	var received struct {
+		Model       string          `json:"model"`
+		Temperature float64         `json:"temperature"`
+		Messages    []*chat.Message `json:"messages"`
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+
+		if bytes.Contains(body, []byte(`"stream":true`)) {
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"content\":\"Good\"}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"bye\"},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hi!"}}]}`))
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	svc := NewService(chats, &conf.Config{BaseURL: upstream.URL})
+
+	temperature := 0.2
+	id, err := svc.CreateChat(ctx, "gpt-4", "Be brief.", nil, chat.Access{})
+	assert.NoError(err)
+	assert.NoError(svc.UpdateChat(ctx, "", "", json.RawMessage(`{"temperature":0.2}`), id))
+
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"messages":[{"role":"user","content":"Hello"}]}`), id)
+	assert.NoError(err)
+
+	// the stored model and options apply, the history comes first
+	assert.Equal("gpt-4", received.Model)
+	assert.Equal(temperature, received.Temperature)
+	if assert.Len(received.Messages, 2) {
+		assert.Equal("Be brief.", received.Messages[0].Content)
+		assert.Equal("Hello", received.Messages[1].Content)
+	}
+
+	events, err := svc.CreateCompletionStream(ctx, json.RawMessage(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Bye"}]}`), id)
+	assert.NoError(err)
+	for range events {
+	}
+
+	assert.Equal("gpt-4o", received.Model)
+	assert.Len(received.Messages, 4)
+
+	c, err := svc.FindChat(ctx, id)
+	assert.NoError(err)
+	if assert.Len(c.Messages, 5) {
+		assert.Equal("Hi!", c.Messages[2].Content)
+		assert.Equal("Bye", c.Messages[3].Content)
+		assert.Equal(&chat.Message{Role: chat.Assistant, Content: "Goodbye"}, c.Messages[4])
+	}
+
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"messages":[]}`), id)
+	assert.Error(err)
+
+	// a chat keeps a single reply per turn
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"n":2,"messages":[{"role":"user","content":"Hello"}]}`), id)
+	assert.ErrorIs(err, ErrMultipleChoices)
+
+	_, err = svc.CreateCompletionStream(ctx, json.RawMessage(`{"n":2,"stream":true,"messages":[{"role":"user","content":"Hello"}]}`), id)
+	assert.ErrorIs(err, ErrMultipleChoices)
+
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"messages":[{"role":"user","content":"Hello"}]}`), chat.NewChat("gpt-4", "", nil).ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
+
+func TestCreateCompletionStreamCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	gone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+		close(gone)
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	svc := NewService(chats, &conf.Config{BaseURL: upstream.URL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := svc.CreateCompletionStream(ctx, json.RawMessage(`{"model":"gpt-4","stream":true}`), chat.ChatID{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	<-events
+
+	// without a chat to store to, the upstream request ends with the caller
+	cancel()
+
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		assert.Fail("upstream request outlived the caller")
+	}
+
+	for range events {
+	}
+}
@@ -1,5 +1,222 @@
 package conf
 
+import "time"
+
 type Config struct {
-	APIKey string `yaml:"apiKey"`
+	APIKey     string     `yaml:"apiKey"`
+	BaseURL    string     `yaml:"baseURL"` // of the OpenAI API, default https://api.openai.com/v1
+	Persistent Persistent `yaml:"persistent"`
+	Queue      Queue      `yaml:"queue"`
+	Auth       Auth       `yaml:"auth"`
+	Discovery  Discovery  `yaml:"discovery"` // of the gateway
+	Registry   Registry   `yaml:"registry"`
+	Health     Health     `yaml:"health"`
+	Tracing    Tracing    `yaml:"tracing"`
+}
+
+type TraceExporter string
+
+const (
+	OTLP   TraceExporter = "otlp"
+	Stdout TraceExporter = "stdout"
+)
+
+// Tracing exports OpenTelemetry traces, see package tracing.
+type Tracing struct {
+	Enabled     bool          `yaml:"enabled"`
+	Exporter    TraceExporter `yaml:"exporter"`
+	Endpoint    string        `yaml:"endpoint"`    // of the OTLP/HTTP collector, default localhost:4318
+	Insecure    bool          `yaml:"insecure"`    // plain HTTP to the collector
+	SampleRatio *float64      `yaml:"sampleRatio"` // of the traces started here, default 1
+}
+
+// Health configures GET /readyz. The deep check sends a completion of a
+// single token upstream, or to a stand-in, at most once every TTL. Its
+// outcome is reported without failing readiness.
+type Health struct {
+	Deep struct {
+		Enabled bool          `yaml:"enabled"`
+		BaseURL string        `yaml:"baseURL"` // default the baseURL of the service
+		Model   string        `yaml:"model"`   // default gpt-3.5-turbo
+		TTL     time.Duration `yaml:"ttl"`     // default 1m
+	} `yaml:"deep"`
+}
+
+// Auth identifies the callers by API keys, JWTs or the headers of a trusted
+// proxy. Enabled enforces their tenant and role on every chat,
+// see openai.AuthorizingMiddleware.
+type Auth struct {
+	Enabled      bool `yaml:"enabled"`
+	TrustHeaders bool `yaml:"trustHeaders"` // identity from the X-Tenant-ID, X-User-ID and X-Scopes headers
+	Keys         Keys `yaml:"keys"`
+	JWT          JWT  `yaml:"jwt"`
+}
+
+// Keys authenticate API keys, requests then need a key or a JWT.
+type Keys struct {
+	Enabled bool     `yaml:"enabled"`
+	File    string   `yaml:"file"` // keys created through /admin/keys, relative to the work directory
+	Static  []APIKey `yaml:"static"`
+}
+
+type APIKey struct {
+	ID      string   `yaml:"id"`
+	Key     string   `yaml:"key"`  // the secret
+	Hash    string   `yaml:"hash"` // or its hash, "sha256:<hex>"
+	Subject string   `yaml:"subject"`
+	Tenant  string   `yaml:"tenant"`
+	Scopes  []string `yaml:"scopes"`
+}
+
+// JWT authenticates bearer tokens signed by a key of a local JWKS file.
+type JWT struct {
+	Enabled  bool          `yaml:"enabled"`
+	JWKS     string        `yaml:"jwks"` // relative to the work directory
+	Issuer   string        `yaml:"issuer"`
+	Audience string        `yaml:"audience"`
+	Leeway   time.Duration `yaml:"leeway"`
+	Claims   struct {
+		Subject string `yaml:"subject"`
+		Tenant  string `yaml:"tenant"`
+		Scopes  string `yaml:"scopes"`
+	} `yaml:"claims"`
+}
+
+type DiscoveryDriver string
+
+const (
+	Static    DiscoveryDriver = "static"
+	File      DiscoveryDriver = "file"
+	Directory DiscoveryDriver = "directory"
+	DNS       DiscoveryDriver = "dns"
+	Consul    DiscoveryDriver = "consul"
+)
+
+// Discovery finds the service instances behind the gateway, see package discovery.
+type Discovery struct {
+	Driver DiscoveryDriver `yaml:"driver"`
+	Scheme string          `yaml:"scheme"` // of the instances, default http
+	Static []string        `yaml:"static"` // host:port
+	File   struct {
+		Path     string        `yaml:"path"` // relative to the work directory
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"file"`
+	Directory struct {
+		Path     string        `yaml:"path"` // the registry directory, see Registry
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"directory"`
+	DNS struct {
+		Name     string        `yaml:"name"`
+		Port     int           `yaml:"port"` // A and AAAA records with the port, or SRV records if zero
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"dns"`
+	Consul struct {
+		Addr    string        `yaml:"addr"`
+		Service string        `yaml:"service"`
+		Tag     string        `yaml:"tag"`
+		Token   string        `yaml:"token"`
+		Wait    time.Duration `yaml:"wait"`
+	} `yaml:"consul"`
+	Retry struct {
+		Max     int           `yaml:"max"` // attempts on other instances when one is unreachable
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"retry"`
+	Guard     Guard `yaml:"guard"`
+	MaxOwners int   `yaml:"maxOwners"` // of the chats, least recently used are looked for again, see discovery.NewAffinity
+	Shared    bool  `yaml:"shared"`    // the instances share persistence, so any of them lists, exports and builds datasets of all chats
+}
+
+// Guard keeps the gateway off failing instances, see discovery.Guard.
+type Guard struct {
+	Timeout             time.Duration `yaml:"timeout"`     // until an instance answers, 0 waits
+	MaxRequests         int           `yaml:"maxRequests"` // concurrent requests and streams per instance, 0 unbounded
+	ConsecutiveFailures uint32        `yaml:"consecutiveFailures"`
+	OpenTimeout         time.Duration `yaml:"openTimeout"`
+	ProbeInterval       time.Duration `yaml:"probeInterval"` // of GET /readyz of the instances, default 5s
+	Outliers            struct {
+		Window            int           `yaml:"window"`
+		MinRequests       int           `yaml:"minRequests"`
+		MaxErrorRate      float64       `yaml:"maxErrorRate"`  // 0 disables
+		LatencyFactor     float64       `yaml:"latencyFactor"` // of the median instance, 0 disables
+		MinLatency        time.Duration `yaml:"minLatency"`
+		EjectionTime      time.Duration `yaml:"ejectionTime"`
+		MaxEjectedPercent int           `yaml:"maxEjectedPercent"`
+	} `yaml:"outliers"`
+}
+
+// Registry announces the service to the discovery of the gateway,
+// in a registry directory or Consul; an empty driver announces nothing.
+type Registry struct {
+	Driver    DiscoveryDriver   `yaml:"driver"`
+	ID        string            `yaml:"id"`      // default openai-<address>-<port>
+	Address   string            `yaml:"address"` // default the first non-loopback address
+	Meta      map[string]string `yaml:"meta"`
+	TTL       time.Duration     `yaml:"ttl"`
+	Directory struct {
+		Path string `yaml:"path"` // relative to the work directory
+	} `yaml:"directory"`
+	Consul struct {
+		Addr    string   `yaml:"addr"`
+		Service string   `yaml:"service"`
+		Tags    []string `yaml:"tags"`
+		Token   string   `yaml:"token"`
+	} `yaml:"consul"`
+}
+
+// Queue serializes the requests to the same chat, see openai.QueueingMiddleware.
+type Queue struct {
+	Enabled   bool          `yaml:"enabled"`
+	MaxLength int           `yaml:"maxLength"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// Encryption at rest, see persistent/encrypted.
+type Encryption struct {
+	Enabled    bool        `yaml:"enabled"`
+	Keyring    string      `yaml:"keyring"`    // relative to the work directory
+	MasterKeys []MasterKey `yaml:"masterKeys"` // the first wraps new data keys
+}
+
+type MasterKey struct {
+	ID   string `yaml:"id"`
+	Key  string `yaml:"key"`  // base64, 32 bytes
+	File string `yaml:"file"` // or a file holding it
+}
+
+type PersistentDriver string
+
+const (
+	InMem    PersistentDriver = "inmem"
+	SQLite   PersistentDriver = "sqlite"
+	EventLog PersistentDriver = "eventlog"
+	Redis    PersistentDriver = "redis"
+)
+
+type Persistent struct {
+	Driver     PersistentDriver `yaml:"driver"`
+	Encryption Encryption       `yaml:"encryption"`
+	InMem      struct {
+		IdleTTL         time.Duration    `yaml:"idleTTL"`
+		MaxChats        int              `yaml:"maxChats"`
+		MaxMemory       int64            `yaml:"maxMemory"` // bytes
+		JanitorInterval time.Duration    `yaml:"janitorInterval"`
+		Archive         PersistentDriver `yaml:"archive"` // evicted chats are stored there
+	} `yaml:"inmem"`
+	SQLite struct {
+		Path string `yaml:"path"` // relative to the work directory
+	} `yaml:"sqlite"`
+	EventLog struct {
+		Dir           string `yaml:"dir"` // relative to the work directory
+		SegmentSize   int64  `yaml:"segmentSize"`
+		SnapshotEvery int    `yaml:"snapshotEvery"`
+		KeepSnapshots int    `yaml:"keepSnapshots"`
+		Sync          bool   `yaml:"sync"`
+	} `yaml:"eventlog"`
+	Redis struct {
+		Addr     string        `yaml:"addr"`
+		Password string        `yaml:"password"`
+		DB       int           `yaml:"db"`
+		Prefix   string        `yaml:"prefix"`
+		TTL      time.Duration `yaml:"ttl"`
+	} `yaml:"redis"`
 }
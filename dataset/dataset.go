@@ -0,0 +1,209 @@
+package dataset
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type Example struct {
+	Messages []*chat.Message `json:"messages"`
+}
+
+type Stats struct {
+	Selected      int            `json:"selected"`
+	Train         int            `json:"train"`
+	Validation    int            `json:"validation"`
+	Skipped       map[string]int `json:"skipped,omitempty"` // by reason
+	TrainTokens   int            `json:"train_tokens"`
+	MaxTokens     int            `json:"max_tokens"` // of a single example
+	MeanTokens    float64        `json:"mean_tokens"`
+	BaseModel     string         `json:"base_model"`
+	Epochs        int            `json:"epochs"`
+	EstimatedCost float64        `json:"estimated_cost"` // in USD
+}
+
+type Dataset struct {
+	Train      []*Example `json:"train"`
+	Validation []*Example `json:"validation"`
+	Stats      *Stats     `json:"stats"`
+}
+
+type Split string
+
+const (
+	TrainSplit      Split = "train"
+	ValidationSplit Split = "validation"
+)
+
+// Build selects the chats matching the spec, redacts and validates them,
+// and splits the resulting examples into train and validation sets.
+func Build(chats []*chat.Chat, spec *Spec) (*Dataset, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	baseModel := spec.BaseModel
+	if baseModel == "" {
+		baseModel = DefaultBaseModel
+	}
+
+	epochs := spec.Epochs
+	if epochs <= 0 {
+		epochs = DefaultEpochs
+	}
+
+	limits := BaseModels[baseModel]
+
+	stats := &Stats{
+		Skipped:   make(map[string]int),
+		BaseModel: baseModel,
+		Epochs:    epochs,
+	}
+
+	examples := make([]*Example, 0)
+	tokens := make(map[*Example]int)
+
+	for _, c := range chats {
+		if !spec.Match(c) {
+			continue
+		}
+
+		stats.Selected++
+
+		example := &Example{
+			Messages: make([]*chat.Message, 0, len(c.Messages)),
+		}
+
+		for _, msg := range c.Messages {
+			if msg.Role == chat.System && strings.TrimSpace(msg.Content) == "" {
+				// chats created without a prompt
+				continue
+			}
+
+			example.Messages = append(example.Messages, &chat.Message{
+				Role:    msg.Role,
+				Content: redact(msg.Content, spec.Redact),
+			})
+		}
+
+		if err := example.Validate(); err != nil {
+			stats.Skipped[err.Error()]++
+			continue
+		}
+
+		n := CountTokens(example.Messages)
+		if n > limits.MaxTokens {
+			stats.Skipped[ErrTooLong.Error()]++
+			continue
+		}
+
+		tokens[example] = n
+		examples = append(examples, example)
+	}
+
+	if len(examples) == 0 {
+		return nil, errors.New("no valid examples selected")
+	}
+
+	r := rand.New(rand.NewSource(spec.Seed))
+	r.Shuffle(len(examples), func(i, j int) {
+		examples[i], examples[j] = examples[j], examples[i]
+	})
+
+	n := int(float64(len(examples)) * spec.ValidationSplit)
+	if spec.ValidationSplit > 0 && n == 0 && len(examples) > 1 {
+		n = 1
+	}
+
+	ds := &Dataset{
+		Validation: examples[:n],
+		Train:      examples[n:],
+		Stats:      stats,
+	}
+
+	stats.Train = len(ds.Train)
+	stats.Validation = len(ds.Validation)
+
+	for _, example := range ds.Train {
+		stats.TrainTokens += tokens[example]
+	}
+
+	for _, example := range examples {
+		if tokens[example] > stats.MaxTokens {
+			stats.MaxTokens = tokens[example]
+		}
+	}
+
+	stats.MeanTokens = float64(stats.TrainTokens) / float64(stats.Train)
+	stats.EstimatedCost = float64(stats.TrainTokens*epochs) / 1000 * limits.PricePer1KTok
+
+	return ds, nil
+}
+
+var (
+	ErrNoAssistant  = errors.New("no assistant message")
+	ErrEmptyContent = errors.New("empty message content")
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrTooLong      = errors.New("exceeds token limit")
+)
+
+// Validate applies the format checks of the fine-tuning API.
+func (example *Example) Validate() error {
+	hasAssistant := false
+	for _, msg := range example.Messages {
+		switch msg.Role {
+		case chat.System, chat.User:
+		case chat.Assistant:
+			hasAssistant = true
+		default:
+			return ErrInvalidRole
+		}
+
+		if strings.TrimSpace(msg.Content) == "" {
+			return ErrEmptyContent
+		}
+	}
+
+	if !hasAssistant {
+		return ErrNoAssistant
+	}
+
+	return nil
+}
+
+// WriteJSONL writes the examples of the split as fine-tuning JSONL.
+func (ds *Dataset) WriteJSONL(w io.Writer, split Split) error {
+	examples := ds.Train
+	if split == ValidationSplit {
+		examples = ds.Validation
+	}
+
+	enc := json.NewEncoder(w)
+	for _, example := range examples {
+		if err := enc.Encode(example); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SkipReasons returns the skip reasons, most frequent first.
+func (stats *Stats) SkipReasons() []string {
+	reasons := make([]string, 0, len(stats.Skipped))
+	for reason := range stats.Skipped {
+		reasons = append(reasons, reason)
+	}
+
+	sort.Slice(reasons, func(i, j int) bool {
+		return stats.Skipped[reasons[i]] > stats.Skipped[reasons[j]]
+	})
+
+	return reasons
+}
@@ -0,0 +1,92 @@
+package dataset
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+)
+
+func newChat(tag string, rating int, answer string) *chat.Chat {
+	c := chat.NewChat("gpt-3.5-turbo", "You are a support agent.", nil)
+	c.Tags = []string{tag}
+	c.Rating = &rating
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "My email is alice@example.com"})
+	if answer != "" {
+		c.AddMessage(&chat.Message{Role: chat.Assistant, Content: answer})
+	}
+	return c
+}
+
+func TestBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := []*chat.Chat{
+		newChat("support", 5, "Thanks, we will contact you."),
+		newChat("support", 4, "Noted."),
+		newChat("support", 5, ""), // no assistant message
+		newChat("support", 2, "Whatever."),
+		newChat("sales", 5, "Buy more."),
+	}
+
+	minRating := 4
+	spec := &Spec{
+		Tags:            []string{"support"},
+		MinRating:       &minRating,
+		Redact:          []string{"email"},
+		ValidationSplit: 0.5,
+	}
+
+	ds, err := Build(chats, spec)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Equal(3, ds.Stats.Selected)
+	assert.Equal(1, ds.Stats.Train)
+	assert.Equal(1, ds.Stats.Validation)
+	assert.Equal(1, ds.Stats.Skipped[ErrNoAssistant.Error()])
+	assert.Greater(ds.Stats.TrainTokens, 0)
+	assert.Greater(ds.Stats.EstimatedCost, 0.0)
+
+	var buf bytes.Buffer
+	if err := ds.WriteJSONL(&buf, TrainSplit); err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Contains(buf.String(), "[EMAIL]")
+	assert.NotContains(buf.String(), "alice@example.com")
+	assert.Equal(1, strings.Count(buf.String(), "\n"))
+}
+
+func TestBuildWithoutPrompt(t *testing.T) {
+	assert := assert.New(t)
+
+	c := chat.NewChat("gpt-3.5-turbo", "", nil)
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi."})
+
+	ds, err := Build([]*chat.Chat{c}, &Spec{})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Equal(1, ds.Stats.Train)
+	assert.Len(ds.Train[0].Messages, 2)
+	assert.Equal(chat.User, ds.Train[0].Messages[0].Role)
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&Spec{ValidationSplit: 0.9}).Validate())
+	assert.Error((&Spec{Redact: []string{"ssn"}}).Validate())
+	assert.Error((&Spec{BaseModel: "gpt-5"}).Validate())
+	assert.NoError((&Spec{Redact: []string{"email", "phone"}}).Validate())
+}
@@ -0,0 +1,55 @@
+package dataset
+
+import "regexp"
+
+type Redactor struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func (r *Redactor) Redact(s string) string {
+	return r.pattern.ReplaceAllString(s, r.replacement)
+}
+
+// Redactors are the named redactors a Spec can refer to.
+var Redactors = map[string]*Redactor{
+	"email": {
+		regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+		"[EMAIL]",
+	},
+	"phone": {
+		regexp.MustCompile(`\+?\d[\d\-\s().]{7,}\d`),
+		"[PHONE]",
+	},
+	"credit_card": {
+		regexp.MustCompile(`\b(?:\d[ \-]?){13,16}\b`),
+		"[CREDIT_CARD]",
+	},
+	"api_key": {
+		regexp.MustCompile(`\bsk-[A-Za-z0-9]{20,}\b`),
+		"[API_KEY]",
+	},
+	"ip": {
+		regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+		"[IP]",
+	},
+}
+
+// redactOrder applies the more specific patterns first,
+// e.g. credit cards before phone numbers.
+var redactOrder = []string{"email", "api_key", "credit_card", "ip", "phone"}
+
+func redact(s string, names []string) string {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		enabled[name] = true
+	}
+
+	for _, name := range redactOrder {
+		if enabled[name] {
+			s = Redactors[name].Redact(s)
+		}
+	}
+
+	return s
+}
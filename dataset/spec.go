@@ -0,0 +1,123 @@
+package dataset
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirror520/openai/chat"
+)
+
+// Spec describes which chats are selected and how they are turned into examples.
+type Spec struct {
+
+	// Select chats carrying any of these tags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Select chats rated at least this (1 to 5); unrated chats are skipped.
+	MinRating *int `json:"min_rating,omitempty"`
+
+	// Select chats created from any of these prompt templates.
+	Templates []string `json:"templates,omitempty"`
+
+	// Further narrow the selection like GET /chats.
+	User  string    `json:"user,omitempty"`
+	Model string    `json:"model,omitempty"`
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+
+	// Scope of the caller, set by the authorization rather than the request.
+	Tenant string `json:"-"`
+	Member string `json:"-"`
+	Scoped bool   `json:"-"`
+
+	// Redactors applied to every message, see Redactors.
+	Redact []string `json:"redact,omitempty"`
+
+	// Fraction of the examples held out for validation, between 0 and 0.5.
+	ValidationSplit float64 `json:"validation_split,omitempty"`
+
+	// Seed of the shuffle before splitting, making the split reproducible.
+	Seed int64 `json:"seed,omitempty"`
+
+	// Base model to be fine-tuned, used for limits and cost estimates.
+	BaseModel string `json:"base_model,omitempty"`
+
+	// Number of training epochs, used for cost estimates.
+	Epochs int `json:"epochs,omitempty"`
+}
+
+func (spec *Spec) Validate() error {
+	if spec.ValidationSplit < 0 || spec.ValidationSplit > 0.5 {
+		return errors.New("validation split must be between 0 and 0.5")
+	}
+
+	if spec.MinRating != nil && (*spec.MinRating < 1 || *spec.MinRating > 5) {
+		return errors.New("min rating must be between 1 and 5")
+	}
+
+	for _, name := range spec.Redact {
+		if _, ok := Redactors[name]; !ok {
+			return errors.New("unknown redactor: " + name)
+		}
+	}
+
+	if spec.BaseModel != "" {
+		if _, ok := BaseModels[spec.BaseModel]; !ok {
+			return errors.New("unsupported base model: " + spec.BaseModel)
+		}
+	}
+
+	return nil
+}
+
+// Query returns the repository query narrowing the selection.
+func (spec *Spec) Query() *chat.Query {
+	return &chat.Query{
+		User:   spec.User,
+		Model:  spec.Model,
+		Tenant: spec.Tenant,
+		Member: spec.Member,
+		Scoped: spec.Scoped,
+		Since:  spec.Since,
+		Until:  spec.Until,
+	}
+}
+
+// Match reports whether the chat is selected by tag, rating and template.
+func (spec *Spec) Match(c *chat.Chat) bool {
+	if len(spec.Tags) > 0 {
+		found := false
+		for _, tag := range spec.Tags {
+			if c.HasTag(tag) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if spec.MinRating != nil {
+		if c.Rating == nil || *c.Rating < *spec.MinRating {
+			return false
+		}
+	}
+
+	if len(spec.Templates) > 0 {
+		found := false
+		for _, tmpl := range spec.Templates {
+			if c.Template == tmpl {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
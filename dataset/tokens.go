@@ -0,0 +1,59 @@
+package dataset
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type BaseModel struct {
+	MaxTokens     int     // per example
+	PricePer1KTok float64 // training, in USD
+}
+
+var BaseModels = map[string]*BaseModel{
+	"gpt-3.5-turbo": {MaxTokens: 4096, PricePer1KTok: 0.008},
+	"babbage-002":   {MaxTokens: 16384, PricePer1KTok: 0.0004},
+	"davinci-002":   {MaxTokens: 16384, PricePer1KTok: 0.006},
+}
+
+const (
+	DefaultBaseModel = "gpt-3.5-turbo"
+	DefaultEpochs    = 3
+)
+
+// tokensPerMessage is the overhead of the chat format for every message,
+// tokensPerExample the priming of the reply.
+const (
+	tokensPerMessage = 4
+	tokensPerExample = 3
+)
+
+// CountTokens estimates the tokens of the messages without a tokenizer:
+// roughly four characters per token for latin text, one per CJK character.
+func CountTokens(messages []*chat.Message) int {
+	n := tokensPerExample
+	for _, msg := range messages {
+		n += tokensPerMessage + countText(string(msg.Role)) + countText(msg.Content)
+	}
+
+	return n
+}
+
+func countText(s string) int {
+	var latin, wide int
+	for _, r := range s {
+		if r >= utf8.RuneSelf && (unicode.Is(unicode.Han, r) ||
+			unicode.Is(unicode.Hiragana, r) ||
+			unicode.Is(unicode.Katakana, r) ||
+			unicode.Is(unicode.Hangul, r)) {
+			wide++
+			continue
+		}
+
+		latin++
+	}
+
+	return wide + (latin+3)/4
+}
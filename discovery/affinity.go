@@ -0,0 +1,396 @@
+package discovery
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	kitzap "github.com/go-kit/kit/log/zap"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+)
+
+// Affinity routes the requests of a chat to the instance owning it, as
+// chats live in the memory of the instance creating them. Other requests
+// are balanced; the instance answering a CreateChat owns the new chat.
+//
+// A chat without a known owner, e.g. after the gateway restarted, is looked
+// for on the instances in the rendezvous hash order of its ID, and the first
+// instance having it becomes its owner. The chats of an instance leaving are
+// forgotten, and instances joining only take new chats. Only the most
+// recently used owners are kept, the others are looked for again.
+type Affinity struct {
+	instancer sd.Instancer
+	log       *zap.Logger
+	events    chan sd.Event
+	ready     chan struct{}
+	done      chan struct{}
+
+	mu          sync.RWMutex
+	instances   map[string]struct{}
+	owners      map[chat.ChatID]*list.Element // of *ownership in lru
+	lru         *list.List                    // front is the most recently used
+	maxOwners   int
+	caches      []*instanceCache
+	endpointers []sd.Endpointer
+}
+
+// DefaultMaxOwners is the number of owners kept unless told otherwise.
+const DefaultMaxOwners = 100000
+
+type ownership struct {
+	id       chat.ChatID
+	instance string
+}
+
+// NewAffinity keeps up to maxOwners owners, DefaultMaxOwners if zero.
+func NewAffinity(instancer sd.Instancer, maxOwners int, log *zap.Logger) *Affinity {
+	if maxOwners <= 0 {
+		maxOwners = DefaultMaxOwners
+	}
+
+	a := &Affinity{
+		instancer: instancer,
+		log:       log.With(zap.String("component", "affinity")),
+		events:    make(chan sd.Event),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		instances: make(map[string]struct{}),
+		owners:    make(map[chat.ChatID]*list.Element),
+		lru:       list.New(),
+		maxOwners: maxOwners,
+	}
+
+	go a.watch()
+	instancer.Register(a.events)
+	<-a.ready
+
+	return a
+}
+
+func (a *Affinity) watch() {
+	defer close(a.done)
+
+	first := true
+	for event := range a.events {
+		// keep routing to the known instances meanwhile
+		if event.Err == nil {
+			a.update(event.Instances)
+		}
+
+		if first {
+			close(a.ready)
+			first = false
+		}
+	}
+}
+
+func (a *Affinity) update(instances []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		current[instance] = struct{}{}
+	}
+
+	for instance := range a.instances {
+		if _, ok := current[instance]; ok {
+			continue
+		}
+
+		forgotten := 0
+		for id, elem := range a.owners {
+			if elem.Value.(*ownership).instance == instance {
+				a.lru.Remove(elem)
+				delete(a.owners, id)
+				forgotten++
+			}
+		}
+
+		for _, c := range a.caches {
+			c.remove(instance)
+		}
+
+		a.log.Info("instance left", zap.String("instance", instance), zap.Int("chats", forgotten))
+	}
+
+	a.instances = current
+}
+
+// Owner returns the instance owning the chat, if known.
+func (a *Affinity) Owner(id chat.ChatID) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.owner(id)
+}
+
+func (a *Affinity) owner(id chat.ChatID) (string, bool) {
+	elem, ok := a.owners[id]
+	if !ok {
+		return "", false
+	}
+
+	return elem.Value.(*ownership).instance, true
+}
+
+// own records the owner of a chat just answered, evicting the least
+// recently used owners beyond maxOwners.
+func (a *Affinity) own(id chat.ChatID, instance string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.instances[instance]; !ok {
+		return
+	}
+
+	if elem, ok := a.owners[id]; ok {
+		elem.Value.(*ownership).instance = instance
+		a.lru.MoveToFront(elem)
+		return
+	}
+
+	a.owners[id] = a.lru.PushFront(&ownership{id, instance})
+
+	for a.lru.Len() > a.maxOwners {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.owners, oldest.Value.(*ownership).id)
+	}
+}
+
+func (a *Affinity) forget(id chat.ChatID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if elem, ok := a.owners[id]; ok {
+		a.lru.Remove(elem)
+		delete(a.owners, id)
+	}
+}
+
+// candidates returns the instances to look for the chat on, in order:
+// the owner if known, then the others by rendezvous hash.
+func (a *Affinity) candidates(id chat.ChatID) (string, []string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	owner, _ := a.owner(id)
+
+	type scored struct {
+		instance string
+		score    uint64
+	}
+
+	others := make([]scored, 0, len(a.instances))
+	for instance := range a.instances {
+		if instance == owner {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(instance))
+		h.Write(id[:])
+		others = append(others, scored{instance, h.Sum64()})
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		if others[i].score != others[j].score {
+			return others[i].score > others[j].score
+		}
+
+		return others[i].instance < others[j].instance
+	})
+
+	candidates := make([]string, 0, len(others)+1)
+	if owner != "" {
+		candidates = append(candidates, owner)
+	}
+
+	for _, o := range others {
+		candidates = append(candidates, o.instance)
+	}
+
+	return owner, candidates
+}
+
+// Endpoint routes the requests of a chat by affinity, and balances the
+// others as Balance does.
+func (a *Affinity) Endpoint(factory sd.Factory, max int, timeout time.Duration) endpoint.Endpoint {
+	owning := a.owning(factory)
+
+	endpointer := sd.NewEndpointer(a.instancer, owning, kitzap.NewZapSugarLogger(a.log, zapcore.InfoLevel))
+	balanced := Balance(endpointer, max, timeout)
+
+	cache := &instanceCache{
+		factory:   owning,
+		endpoints: make(map[string]endpoint.Endpoint),
+		closers:   make(map[string]io.Closer),
+	}
+
+	a.mu.Lock()
+	a.caches = append(a.caches, cache)
+	a.endpointers = append(a.endpointers, endpointer)
+	a.mu.Unlock()
+
+	return func(ctx context.Context, request any) (any, error) {
+		id, ok := openai.RequestChatID(request)
+		if !ok {
+			return balanced(ctx, request)
+		}
+
+		return a.route(ctx, cache, id, request)
+	}
+}
+
+func (a *Affinity) route(ctx context.Context, cache *instanceCache, id chat.ChatID, request any) (any, error) {
+	owner, candidates := a.candidates(id)
+	if len(candidates) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+
+	var unreachable, notFound error
+
+	for _, instance := range candidates {
+		e, err := cache.endpoint(instance)
+		if err != nil {
+			unreachable = err
+			continue
+		}
+
+		resp, err := e(ctx, request)
+		switch {
+		case err == nil:
+			return resp, nil
+
+		case Unreachable(err):
+			unreachable = err
+
+		// the owner has the last word, unless it is unreachable
+		case errors.Is(err, chat.ErrChatNotFound) && instance != owner:
+			notFound = err
+
+		default:
+			return nil, err
+		}
+	}
+
+	// the chat may well be on the instance not answering
+	if unreachable != nil {
+		return nil, unreachable
+	}
+
+	return nil, notFound
+}
+
+// owning records the owners of the chats from the answers of the instance.
+func (a *Affinity) owning(factory sd.Factory) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		e, closer, err := factory(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return func(ctx context.Context, request any) (any, error) {
+			resp, err := e(ctx, request)
+			if err != nil {
+				return nil, err
+			}
+
+			if req, ok := request.(*openai.DeleteChatRequest); ok {
+				a.forget(req.ID)
+			} else if id, ok := openai.RequestChatID(request); ok {
+				a.own(id, instance)
+			} else if id, ok := resp.(chat.ChatID); ok {
+				a.own(id, instance)
+			}
+
+			return resp, nil
+		}, closer, nil
+	}
+}
+
+func (a *Affinity) Stop() {
+	a.instancer.Deregister(a.events)
+	close(a.events)
+	<-a.done
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, endpointer := range a.endpointers {
+		if c, ok := endpointer.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+
+	for _, c := range a.caches {
+		c.close()
+	}
+}
+
+// instanceCache holds the endpoints of the instances for a factory.
+type instanceCache struct {
+	factory sd.Factory
+
+	mu        sync.Mutex
+	endpoints map[string]endpoint.Endpoint
+	closers   map[string]io.Closer
+}
+
+func (c *instanceCache) endpoint(instance string) (endpoint.Endpoint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.endpoints[instance]; ok {
+		return e, nil
+	}
+
+	e, closer, err := c.factory(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	c.endpoints[instance] = e
+	if closer != nil {
+		c.closers[instance] = closer
+	}
+
+	return e, nil
+}
+
+func (c *instanceCache) remove(instance string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if closer, ok := c.closers[instance]; ok {
+		closer.Close()
+		delete(c.closers, instance)
+	}
+
+	delete(c.endpoints, instance)
+}
+
+func (c *instanceCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+
+	c.endpoints = make(map[string]endpoint.Endpoint)
+	c.closers = make(map[string]io.Closer)
+}
@@ -0,0 +1,352 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+)
+
+// chanSource lists the instances sent on it.
+type chanSource chan []string
+
+func (s chanSource) Instances(ctx context.Context, index uint64) ([]string, uint64, error) {
+	select {
+	case instances := <-s:
+		return instances, index + 1, nil
+	case <-ctx.Done():
+		return nil, index, ctx.Err()
+	}
+}
+
+// backends keep the chats of each instance in memory, as the service does.
+type backends struct {
+	sync.Mutex
+	chats map[string]map[chat.ChatID]bool
+	down  map[string]bool
+	calls map[string]int
+}
+
+func (b *backends) factory(instance string) (endpoint.Endpoint, io.Closer, error) {
+	return func(ctx context.Context, request any) (any, error) {
+		b.Lock()
+		defer b.Unlock()
+
+		b.calls[instance]++
+
+		if b.down[instance] {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+
+		if b.chats[instance] == nil {
+			b.chats[instance] = make(map[chat.ChatID]bool)
+		}
+
+		switch req := request.(type) {
+		case *openai.CreateChatRequest:
+			id := chat.NewChat(req.Model, "", nil).ID
+			b.chats[instance][id] = true
+			return id, nil
+
+		case *openai.ChatRequest:
+			if !b.chats[instance][req.ID] {
+				return nil, chat.ErrChatNotFound
+			}
+
+			return instance, nil
+
+		case *openai.ListChatsRequest:
+			q, _ := req.Query()
+
+			chats := make([]*chat.Chat, 0)
+			for id := range b.chats[instance] {
+				if q.After == nil || id.Compare(*q.After) > 0 {
+					chats = append(chats, &chat.Chat{ID: id})
+				}
+			}
+
+			sort.Slice(chats, func(i, j int) bool {
+				return chats[i].ID.Compare(chats[j].ID) < 0
+			})
+
+			page := &chat.Page{Chats: chats}
+			if len(chats) > q.Limit {
+				page.Chats = chats[:q.Limit]
+				page.Next = &page.Chats[q.Limit-1].ID
+			}
+
+			return page, nil
+
+		case *openai.DeleteChatRequest:
+			if !b.chats[instance][req.ID] {
+				return nil, chat.ErrChatNotFound
+			}
+
+			delete(b.chats[instance], req.ID)
+			return nil, nil
+		}
+
+		return nil, errors.New("unexpected request")
+	}, nil, nil
+}
+
+func TestAffinity(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &backends{
+		chats: make(map[string]map[chat.ChatID]bool),
+		down:  make(map[string]bool),
+		calls: make(map[string]int),
+	}
+
+	src := make(chanSource, 1)
+	src <- []string{"a:80", "b:80", "c:80"}
+
+	instancer := NewInstancer(src, zap.NewNop())
+	defer instancer.Stop()
+
+	affinity := NewAffinity(instancer, 0, zap.NewNop())
+	defer affinity.Stop()
+
+	createChat := affinity.Endpoint(b.factory, 3, time.Second)
+	chatEndpoint := affinity.Endpoint(b.factory, 3, time.Second)
+	deleteChat := affinity.Endpoint(b.factory, 3, time.Second)
+
+	ctx := context.Background()
+
+	// balanced, and owned by the creating instance
+	owners := make(map[chat.ChatID]string)
+	for i := 0; i < 6; i++ {
+		resp, err := createChat(ctx, &openai.CreateChatRequest{Model: "gpt-4"})
+		assert.NoError(err)
+
+		id := resp.(chat.ChatID)
+
+		owner, ok := affinity.Owner(id)
+		assert.True(ok)
+		owners[id] = owner
+	}
+	assert.Equal(map[string]int{"a:80": 2, "b:80": 2, "c:80": 2}, b.calls)
+
+	b.calls = make(map[string]int)
+
+	for id, owner := range owners {
+		for i := 0; i < 3; i++ {
+			instance, err := chatEndpoint(ctx, &openai.ChatRequest{ID: id, Content: "Hi"})
+			assert.NoError(err)
+			assert.Equal(owner, instance)
+		}
+	}
+	assert.Equal(map[string]int{"a:80": 6, "b:80": 6, "c:80": 6}, b.calls)
+
+	// a restarted gateway looks for the owners
+	restarted := NewAffinity(instancer, 0, zap.NewNop())
+	defer restarted.Stop()
+
+	chatEndpoint2 := restarted.Endpoint(b.factory, 3, time.Second)
+
+	for id, owner := range owners {
+		instance, err := chatEndpoint2(ctx, &openai.ChatRequest{ID: id, Content: "Hi"})
+		assert.NoError(err)
+		assert.Equal(owner, instance)
+
+		found, ok := restarted.Owner(id)
+		assert.True(ok)
+		assert.Equal(owner, found)
+	}
+
+	// a chat nobody has
+	missing := chat.NewChat("gpt-4", "", nil).ID
+
+	_, err := chatEndpoint(ctx, &openai.ChatRequest{ID: missing, Content: "Hi"})
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	// deleted chats are forgotten
+	var deleted chat.ChatID
+	for id := range owners {
+		deleted = id
+		break
+	}
+
+	_, err = deleteChat(ctx, &openai.DeleteChatRequest{ID: deleted})
+	assert.NoError(err)
+
+	_, ok := affinity.Owner(deleted)
+	assert.False(ok)
+
+	// an unreachable owner is not mistaken for a missing chat
+	var onC chat.ChatID
+	for id, owner := range owners {
+		if owner == "c:80" && id != deleted {
+			onC = id
+			break
+		}
+	}
+
+	b.Lock()
+	b.down["c:80"] = true
+	b.Unlock()
+
+	_, err = chatEndpoint(ctx, &openai.ChatRequest{ID: onC, Content: "Hi"})
+	assert.True(Unreachable(err))
+
+	// instances leaving take their chats along, joining ones only take new chats
+	src <- []string{"a:80", "b:80", "d:80"}
+
+	assert.Eventually(func() bool {
+		_, ok := affinity.Owner(onC)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	for id, owner := range owners {
+		if id == deleted || owner == "c:80" {
+			continue
+		}
+
+		instance, err := chatEndpoint(ctx, &openai.ChatRequest{ID: id, Content: "Hi"})
+		assert.NoError(err)
+		assert.Equal(owner, instance)
+	}
+
+	assert.Eventually(func() bool {
+		resp, err := createChat(ctx, &openai.CreateChatRequest{Model: "gpt-4"})
+		if err != nil {
+			return false
+		}
+
+		owner, _ := affinity.Owner(resp.(chat.ChatID))
+		return owner == "d:80"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAffinityMaxOwners(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &backends{
+		chats: make(map[string]map[chat.ChatID]bool),
+		down:  make(map[string]bool),
+		calls: make(map[string]int),
+	}
+
+	src := make(chanSource, 1)
+	src <- []string{"a:80", "b:80", "c:80"}
+
+	instancer := NewInstancer(src, zap.NewNop())
+	defer instancer.Stop()
+
+	affinity := NewAffinity(instancer, 2, zap.NewNop())
+	defer affinity.Stop()
+
+	createChat := affinity.Endpoint(b.factory, 3, time.Second)
+	chatEndpoint := affinity.Endpoint(b.factory, 3, time.Second)
+
+	ctx := context.Background()
+
+	ids := make([]chat.ChatID, 0)
+	owners := make(map[chat.ChatID]string)
+	for i := 0; i < 3; i++ {
+		resp, err := createChat(ctx, &openai.CreateChatRequest{Model: "gpt-4"})
+		assert.NoError(err)
+
+		id := resp.(chat.ChatID)
+		ids = append(ids, id)
+		owners[id], _ = affinity.Owner(id)
+	}
+
+	// the least recently used owner is evicted
+	_, ok := affinity.Owner(ids[0])
+	assert.False(ok)
+
+	// and looked for again
+	instance, err := chatEndpoint(ctx, &openai.ChatRequest{ID: ids[0], Content: "Hi"})
+	assert.NoError(err)
+	assert.Equal(owners[ids[0]], instance)
+
+	owner, ok := affinity.Owner(ids[0])
+	assert.True(ok)
+	assert.Equal(owners[ids[0]], owner)
+
+	_, ok = affinity.Owner(ids[1])
+	assert.False(ok)
+
+	_, ok = affinity.Owner(ids[2])
+	assert.True(ok)
+}
+
+func TestAffinityFanOut(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &backends{
+		chats: make(map[string]map[chat.ChatID]bool),
+		down:  make(map[string]bool),
+		calls: make(map[string]int),
+	}
+
+	src := make(chanSource, 1)
+	src <- []string{"a:80", "b:80", "c:80"}
+
+	instancer := NewInstancer(src, zap.NewNop())
+	defer instancer.Stop()
+
+	affinity := NewAffinity(instancer, 0, zap.NewNop())
+	defer affinity.Stop()
+
+	createChat := affinity.Endpoint(b.factory, 3, time.Second)
+	listChats := affinity.FanOut(b.factory, MergePages)
+
+	ctx := context.Background()
+
+	ids := make([]chat.ChatID, 0)
+	for i := 0; i < 7; i++ {
+		resp, err := createChat(ctx, &openai.CreateChatRequest{Model: "gpt-4"})
+		assert.NoError(err)
+		ids = append(ids, resp.(chat.ChatID))
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+
+	// every chat once, in order, whichever instance holds it
+	listed := make([]chat.ChatID, 0)
+	cursor := ""
+	for {
+		resp, err := listChats(ctx, &openai.ListChatsRequest{Cursor: cursor, Limit: 3})
+		if !assert.NoError(err) {
+			return
+		}
+
+		page := resp.(*chat.Page)
+		assert.LessOrEqual(len(page.Chats), 3)
+
+		for _, c := range page.Chats {
+			listed = append(listed, c.ID)
+		}
+
+		if page.Next == nil {
+			break
+		}
+
+		cursor = page.Next.String()
+	}
+	assert.Equal(ids, listed)
+
+	// a partial list would silently miss chats
+	b.Lock()
+	b.down["b:80"] = true
+	b.Unlock()
+
+	_, err := listChats(ctx, &openai.ListChatsRequest{Limit: 3})
+	assert.True(Unreachable(err))
+}
@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+)
+
+// Balance spreads the requests over the endpoints round robin. A request
+// failing to reach its instance is retried on the next one, up to max
+// attempts within timeout; errors answered by an instance are returned
+// as they are.
+func Balance(endpointer sd.Endpointer, max int, timeout time.Duration) endpoint.Endpoint {
+	retry := lb.RetryWithCallback(timeout, lb.NewRoundRobin(endpointer), func(n int, err error) (bool, error) {
+		return n < max && Unreachable(err), nil
+	})
+
+	return func(ctx context.Context, request any) (any, error) {
+		resp, err := retry(ctx, request)
+		if err != nil {
+			var retryErr lb.RetryError
+			if errors.As(err, &retryErr) {
+				return nil, retryErr.Final
+			}
+
+			return nil, err
+		}
+
+		return resp, nil
+	}
+}
+
+// Unreachable reports whether the request failed in the network, or was
+// kept off its instance by a Guard, rather than being answered by it.
+func Unreachable(err error) bool {
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
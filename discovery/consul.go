@@ -0,0 +1,210 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+	"go.uber.org/zap"
+)
+
+// ConsulSource watches the passing instances of a service in Consul
+// with blocking queries on its HTTP API.
+func ConsulSource(addr, service, tag, token string, wait time.Duration) Source {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	if wait <= 0 {
+		wait = 5 * time.Minute
+	}
+
+	return &consulSource{
+		addr:    strings.TrimSuffix(addr, "/"),
+		service: service,
+		tag:     tag,
+		token:   token,
+		wait:    wait,
+		client:  &http.Client{Timeout: wait + wait/16 + 10*time.Second}, // Consul adds up to wait/16 of jitter
+	}
+}
+
+type consulSource struct {
+	addr    string
+	service string
+	tag     string
+	token   string
+	wait    time.Duration
+	client  *http.Client
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (s *consulSource) Instances(ctx context.Context, index uint64) ([]string, uint64, error) {
+	query := url.Values{}
+	query.Set("passing", "1")
+	if s.tag != "" {
+		query.Set("tag", s.tag)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", s.wait.String())
+	}
+
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", s.addr, url.PathEscape(s.service), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, index, err
+	}
+
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("consul: %s", resp.Status)
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || next == 0 {
+		return nil, index, errors.New("consul: invalid X-Consul-Index")
+	}
+
+	// the index went backwards, e.g. Consul was restored from a snapshot
+	if next < index {
+		next = 0
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+
+	instances := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+
+		instances = append(instances, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+
+	return instances, next, nil
+}
+
+// ConsulRegistrar announces the instance as a service of the local Consul
+// agent with a TTL check, heartbeated until Deregister. Consul removes the
+// service itself a minute after the check turns critical.
+func ConsulRegistrar(addr, service string, tags []string, token string, instance Instance, ttl time.Duration, log *zap.Logger) sd.Registrar {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	r := newRegistrar(nil, ttl, log.With(zap.String("instance", instance.ID)))
+	r.announcer = &consulAnnouncer{
+		addr:     strings.TrimSuffix(addr, "/"),
+		service:  service,
+		tags:     tags,
+		token:    token,
+		instance: instance,
+		ttl:      r.ttl,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	return r
+}
+
+type consulAnnouncer struct {
+	addr     string
+	service  string
+	tags     []string
+	token    string
+	instance Instance
+	ttl      time.Duration
+	client   *http.Client
+}
+
+func (a *consulAnnouncer) put(ctx context.Context, path string, body any) error {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, a.addr+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if a.token != "" {
+		req.Header.Set("X-Consul-Token", a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func (a *consulAnnouncer) announce(ctx context.Context) error {
+	return a.put(ctx, "/v1/agent/service/register", map[string]any{
+		"ID":      a.instance.ID,
+		"Name":    a.service,
+		"Tags":    a.tags,
+		"Address": a.instance.Address,
+		"Port":    a.instance.Port,
+		"Meta":    a.instance.Meta,
+		"Check": map[string]any{
+			"Status":                         "passing", // or passing queries miss it until the first heartbeat
+			"TTL":                            a.ttl.String(),
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	})
+}
+
+// heartbeat passes the check Consul made along with the service.
+func (a *consulAnnouncer) heartbeat(ctx context.Context) error {
+	return a.put(ctx, "/v1/agent/check/pass/service:"+url.PathEscape(a.instance.ID), nil)
+}
+
+func (a *consulAnnouncer) withdraw(ctx context.Context) error {
+	return a.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(a.instance.ID), nil)
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeConsul serves /v1/health/service/openai with blocking queries.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]any
+	changed chan struct{}
+}
+
+func (c *fakeConsul) set(instances ...[2]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make([]map[string]any, len(instances))
+	for i, instance := range instances {
+		c.entries[i] = map[string]any{
+			"Node":    map[string]any{"Address": "10.0.0.99"},
+			"Service": map[string]any{"Address": instance[0], "Port": instance[1]},
+		}
+	}
+
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/openai" || r.URL.Query().Get("passing") != "1" ||
+		r.Header.Get("X-Consul-Token") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait >= index {
+		select {
+		case <-changed:
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(w).Encode(c.entries)
+}
+
+func TestConsulInstancer(t *testing.T) {
+	assert := assert.New(t)
+
+	consul := &fakeConsul{changed: make(chan struct{})}
+	consul.set([2]any{"10.0.0.1", 8080})
+
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	src := ConsulSource(server.URL, "openai", "", "secret", 50*time.Millisecond)
+
+	instancer := NewInstancer(src, zap.NewNop())
+	defer instancer.Stop()
+
+	assert.Equal(sd.Event{Instances: []string{"10.0.0.1:8080"}}, instancer.State())
+
+	events := make(chan sd.Event, 8)
+	instancer.Register(events)
+	defer instancer.Deregister(events)
+
+	assert.Equal([]string{"10.0.0.1:8080"}, (<-events).Instances)
+
+	// the node address stands for an empty service address
+	consul.set([2]any{"10.0.0.1", 8080}, [2]any{"", 8081})
+
+	select {
+	case event := <-events:
+		assert.Equal([]string{"10.0.0.1:8080", "10.0.0.99:8081"}, event.Instances)
+	case <-time.After(time.Second):
+		assert.Fail("no change")
+	}
+
+	consul.set([2]any{"", 8081})
+
+	select {
+	case event := <-events:
+		assert.Equal([]string{"10.0.0.99:8081"}, event.Instances)
+	case <-time.After(time.Second):
+		assert.Fail("no change")
+	}
+
+	// timed out queries change nothing
+	select {
+	case event := <-events:
+		assert.Fail("unexpected change", event)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
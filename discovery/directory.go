@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+	"go.uber.org/zap"
+)
+
+// A registry directory shared by the instances, e.g. on a network volume,
+// holds a JSON entry per instance, refreshed until the instance leaves.
+type directoryEntry struct {
+	Instance
+	Expires time.Time `json:"expires"`
+}
+
+// DirectoryRegistrar announces the instance in the registry directory;
+// its entry expires after ttl unless heartbeated.
+func DirectoryRegistrar(dir string, instance Instance, ttl time.Duration, log *zap.Logger) sd.Registrar {
+	r := newRegistrar(nil, ttl, log.With(zap.String("instance", instance.ID)))
+	r.announcer = &directoryAnnouncer{dir, instance, r.ttl}
+	return r
+}
+
+type directoryAnnouncer struct {
+	dir      string
+	instance Instance
+	ttl      time.Duration
+}
+
+func (a *directoryAnnouncer) path() string {
+	return filepath.Join(a.dir, a.instance.ID+".json")
+}
+
+func (a *directoryAnnouncer) announce(ctx context.Context) error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+
+	return a.heartbeat(ctx)
+}
+
+func (a *directoryAnnouncer) heartbeat(ctx context.Context) error {
+	entry := directoryEntry{a.instance, time.Now().Add(a.ttl)}
+
+	bs, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	// readers never see a partial entry
+	tmp := a.path() + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.path())
+}
+
+func (a *directoryAnnouncer) withdraw(ctx context.Context) error {
+	err := os.Remove(a.path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// DirectorySource lists the unexpired instances of the registry directory
+// every interval.
+func DirectorySource(dir string, interval time.Duration) Source {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &directorySource{dir, interval}
+}
+
+type directorySource struct {
+	dir      string
+	interval time.Duration
+}
+
+func (s *directorySource) Instances(ctx context.Context, index uint64) ([]string, uint64, error) {
+	if index > 0 {
+		if err := sleep(ctx, s.interval); err != nil {
+			return nil, index, err
+		}
+	}
+
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, index + 1, nil
+		}
+
+		return nil, index, err
+	}
+
+	now := time.Now()
+	instances := make([]string, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		bs, err := os.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			continue // withdrawn meanwhile
+		}
+
+		var entry directoryEntry
+		if err := json.Unmarshal(bs, &entry); err != nil || entry.Expires.Before(now) {
+			continue
+		}
+
+		instances = append(instances, entry.HostPort())
+	}
+
+	return instances, index + 1, nil
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSSource resolves the instances every interval, from the SRV records
+// of name when port is zero, or else from its A and AAAA records.
+func DNSSource(resolver Resolver, name string, port int, interval time.Duration) Source {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &dnsSource{resolver, name, port, interval}
+}
+
+type dnsSource struct {
+	resolver Resolver
+	name     string
+	port     int
+	interval time.Duration
+}
+
+func (s *dnsSource) Instances(ctx context.Context, index uint64) ([]string, uint64, error) {
+	if index > 0 {
+		if err := sleep(ctx, s.interval); err != nil {
+			return nil, index, err
+		}
+	}
+
+	if s.port == 0 {
+		_, records, err := s.resolver.LookupSRV(ctx, "", "", s.name)
+		if err != nil {
+			return nil, index, err
+		}
+
+		instances := make([]string, len(records))
+		for i, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			instances[i] = net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+		}
+
+		return instances, index + 1, nil
+	}
+
+	addrs, err := s.resolver.LookupHost(ctx, s.name)
+	if err != nil {
+		return nil, index, err
+	}
+
+	instances := make([]string, len(addrs))
+	for i, addr := range addrs {
+		instances[i] = net.JoinHostPort(addr, strconv.Itoa(s.port))
+	}
+
+	return instances, index + 1, nil
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+)
+
+// ErrNotShared is returned for the requests spanning the chats of every
+// instance that cannot be merged, unless the instances share persistence.
+var ErrNotShared = errors.New("chats live on separate instances")
+
+// Merge combines the answers of every instance to the request.
+type Merge func(request any, responses []any) (any, error)
+
+// FanOut sends the request to every instance and merges their answers,
+// for the requests spanning the chats of all instances. It fails unless
+// every instance answers, as a partial answer would silently miss chats.
+func (a *Affinity) FanOut(factory sd.Factory, merge Merge) endpoint.Endpoint {
+	cache := &instanceCache{
+		factory:   factory,
+		endpoints: make(map[string]endpoint.Endpoint),
+		closers:   make(map[string]io.Closer),
+	}
+
+	a.mu.Lock()
+	a.caches = append(a.caches, cache)
+	a.mu.Unlock()
+
+	return func(ctx context.Context, request any) (any, error) {
+		a.mu.RLock()
+		instances := make([]string, 0, len(a.instances))
+		for instance := range a.instances {
+			instances = append(instances, instance)
+		}
+		a.mu.RUnlock()
+
+		if len(instances) == 0 {
+			return nil, lb.ErrNoEndpoints
+		}
+
+		sort.Strings(instances)
+
+		responses := make([]any, len(instances))
+		errs := make([]error, len(instances))
+
+		var wg sync.WaitGroup
+		for i, instance := range instances {
+			wg.Add(1)
+
+			go func(i int, instance string) {
+				defer wg.Done()
+
+				e, err := cache.endpoint(instance)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				responses[i], errs[i] = e(ctx, request)
+			}(i, instance)
+		}
+
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return merge(request, responses)
+	}
+}
+
+// MergePages merges the pages of ListChats in the order of the chat IDs,
+// as every instance pages them.
+func MergePages(request any, responses []any) (any, error) {
+	req, ok := request.(*openai.ListChatsRequest)
+	if !ok {
+		return nil, errors.New("invalid request")
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = openai.DefaultPageLimit
+	}
+
+	if limit > openai.MaxPageLimit {
+		limit = openai.MaxPageLimit
+	}
+
+	more := false
+	seen := make(map[chat.ChatID]struct{})
+	chats := make([]*chat.Chat, 0)
+
+	for _, resp := range responses {
+		page, ok := resp.(*chat.Page)
+		if !ok {
+			return nil, errors.New("invalid response")
+		}
+
+		if page.Next != nil {
+			more = true
+		}
+
+		for _, c := range page.Chats {
+			if _, ok := seen[c.ID]; ok {
+				continue
+			}
+
+			seen[c.ID] = struct{}{}
+			chats = append(chats, c)
+		}
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].ID.Compare(chats[j].ID) < 0
+	})
+
+	page := &chat.Page{
+		Chats: chats,
+	}
+
+	if len(chats) > limit {
+		page.Chats = chats[:limit]
+		more = true
+	}
+
+	if more && len(page.Chats) > 0 {
+		next := page.Chats[len(page.Chats)-1].ID
+		page.Next = &next
+	}
+
+	return page, nil
+}
+
+// Reject answers the requests with the error, without calling any instance.
+func Reject(err error) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (any, error) {
+		return nil, err
+	}
+}
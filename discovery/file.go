@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileSource reads the instances from a file, one host:port per line,
+// every interval. Blank lines and lines starting with # are skipped,
+// and a missing file lists no instances.
+func FileSource(path string, interval time.Duration) Source {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &fileSource{path, interval}
+}
+
+type fileSource struct {
+	path     string
+	interval time.Duration
+}
+
+func (s *fileSource) Instances(ctx context.Context, index uint64) ([]string, uint64, error) {
+	if index > 0 {
+		if err := sleep(ctx, s.interval); err != nil {
+			return nil, index, err
+		}
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, index + 1, nil
+		}
+
+		return nil, index, err
+	}
+	defer f.Close()
+
+	instances := make([]string, 0)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		instances = append(instances, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, index, err
+	}
+
+	return instances, index + 1, nil
+}
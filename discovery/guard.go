@@ -0,0 +1,624 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/sony/gobreaker"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/openai/chat"
+)
+
+var (
+	// ErrUnavailable is returned without calling an instance that is
+	// ejected, behind an open breaker or a full bulkhead; the request may
+	// go to another instance.
+	ErrUnavailable = errors.New("instance unavailable")
+
+	// ErrTimeout is returned when an instance does not answer in time;
+	// the request may have been served, so it is not retried.
+	ErrTimeout = errors.New("instance timed out")
+)
+
+type GuardOptions struct {
+	Timeout     time.Duration // until an instance answers, or the first chunk of a stream; 0 waits
+	MaxRequests int           // concurrent requests and streams per instance; 0 unbounded
+
+	// the breaker opens after consecutive failures, and half-opens after OpenTimeout
+	ConsecutiveFailures uint32
+	OpenTimeout         time.Duration
+
+	// an instance is ejected, for EjectionTime times its ejections, when its
+	// error rate or mean latency over the last Window requests makes it an
+	// outlier, unless MaxEjectedPercent of the instances already are
+	Window            int
+	MinRequests       int
+	MaxErrorRate      float64       // 0 disables
+	LatencyFactor     float64       // of the median mean latency of the instances, 0 disables
+	MinLatency        time.Duration // never an outlier below
+	EjectionTime      time.Duration
+	MaxEjectedPercent int
+}
+
+// Guard keeps the gateway off failing instances. Every instance gets a
+// circuit breaker, a bulkhead bounding its concurrent requests, and is
+// ejected for a while when an outlier. Only failures to get an answer
+// count, errors answered by an instance do not.
+type Guard struct {
+	opts GuardOptions
+	log  *zap.Logger
+
+	mu       sync.Mutex
+	backends map[string]*backend
+}
+
+func NewGuard(opts GuardOptions, log *zap.Logger) *Guard {
+	if opts.ConsecutiveFailures == 0 {
+		opts.ConsecutiveFailures = 5
+	}
+
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = 50
+	}
+
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 10
+	}
+
+	if opts.EjectionTime <= 0 {
+		opts.EjectionTime = 30 * time.Second
+	}
+
+	if opts.MaxEjectedPercent <= 0 {
+		opts.MaxEjectedPercent = 50
+	}
+
+	return &Guard{
+		opts:     opts,
+		log:      log.With(zap.String("component", "guard")),
+		backends: make(map[string]*backend),
+	}
+}
+
+// failed reports whether the instance failed to answer.
+func failed(err error) bool {
+	return err != nil && !errors.Is(err, ErrUnavailable) &&
+		(Unreachable(err) || errors.Is(err, ErrTimeout))
+}
+
+// Factory guards the endpoints of the factory; the endpoints of an instance
+// share its guard across factories.
+func (g *Guard) Factory(factory sd.Factory) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		e, closer, err := factory(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b := g.acquire(instance)
+
+		guarded := endpoint.Chain(
+			b.outlier,
+			b.breaker,
+			b.bulkhead,
+		)(b.timeout(e))
+
+		return guarded, &release{g, instance, closer}, nil
+	}
+}
+
+func (g *Guard) acquire(instance string) *backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	b, ok := g.backends[instance]
+	if !ok {
+		b = newBackend(g, instance)
+		g.backends[instance] = b
+	}
+
+	b.refs++
+	return b
+}
+
+// release forgets the instance once none of its endpoints is left.
+type release struct {
+	g        *Guard
+	instance string
+	closer   io.Closer
+}
+
+func (r *release) Close() error {
+	r.g.mu.Lock()
+	if b, ok := r.g.backends[r.instance]; ok {
+		if b.refs--; b.refs == 0 {
+			delete(r.g.backends, r.instance)
+		}
+	}
+	r.g.mu.Unlock()
+
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+
+	return nil
+}
+
+type outcome struct {
+	failed  bool
+	latency time.Duration
+}
+
+type backend struct {
+	g        *Guard
+	instance string
+	cb       *gobreaker.CircuitBreaker
+	slots    chan struct{}
+	refs     int // guarded by g.mu
+
+	mu        sync.Mutex
+	window    []outcome
+	next      int
+	ejections int
+	until     time.Time
+	unready   error // of the last readiness probe
+}
+
+func newBackend(g *Guard, instance string) *backend {
+	b := &backend{
+		g:        g,
+		instance: instance,
+		window:   make([]outcome, 0, g.opts.Window),
+	}
+
+	if g.opts.MaxRequests > 0 {
+		b.slots = make(chan struct{}, g.opts.MaxRequests)
+	}
+
+	b.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        instance,
+		MaxRequests: 1,
+		Timeout:     g.opts.OpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= g.opts.ConsecutiveFailures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			g.log.Warn("breaker state changed",
+				zap.String("instance", name),
+				zap.String("from", from.String()),
+				zap.String("to", to.String()),
+			)
+		},
+		IsSuccessful: func(err error) bool {
+			return !failed(err)
+		},
+	})
+
+	return b
+}
+
+func (b *backend) unavailable(reason string) error {
+	return fmt.Errorf("%w: %s %s", ErrUnavailable, b.instance, reason)
+}
+
+// outlier rejects the requests while the instance is ejected or not ready,
+// and detects outliers from the outcomes of the others.
+func (b *backend) outlier(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (any, error) {
+		b.mu.Lock()
+		ejected := time.Now().Before(b.until)
+		unready := b.unready
+		b.mu.Unlock()
+
+		if ejected {
+			return nil, b.unavailable("ejected")
+		}
+
+		if unready != nil {
+			return nil, b.unavailable("not ready")
+		}
+
+		start := time.Now()
+
+		resp, err := next(ctx, request)
+		if !errors.Is(err, ErrUnavailable) {
+			b.g.observe(b, outcome{failed(err), time.Since(start)})
+		}
+
+		return resp, err
+	}
+}
+
+func (b *backend) breaker(next endpoint.Endpoint) endpoint.Endpoint {
+	next = circuitbreaker.Gobreaker(b.cb)(next)
+
+	return func(ctx context.Context, request any) (any, error) {
+		resp, err := next(ctx, request)
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			return nil, b.unavailable(err.Error())
+		}
+
+		return resp, err
+	}
+}
+
+// bulkhead holds a slot of the instance until the answer, or until the
+// end of a streamed one.
+func (b *backend) bulkhead(next endpoint.Endpoint) endpoint.Endpoint {
+	if b.slots == nil {
+		return next
+	}
+
+	return func(ctx context.Context, request any) (any, error) {
+		select {
+		case b.slots <- struct{}{}:
+		default:
+			return nil, b.unavailable("bulkhead full")
+		}
+
+		resp, err := next(ctx, request)
+		if err != nil {
+			<-b.slots
+			return resp, err
+		}
+
+		release := func() { <-b.slots }
+
+		switch stream := resp.(type) {
+		case <-chan chat.Chunk:
+			return relayStream(stream, release), nil
+
+		case <-chan json.RawMessage:
+			return relayStream(stream, release), nil
+		}
+
+		release()
+		return resp, nil
+	}
+}
+
+// relayStream relays the stream, calling done once it ran out.
+func relayStream[T any](stream <-chan T, done func()) <-chan T {
+	relayed := make(chan T)
+
+	go func() {
+		defer done()
+		defer close(relayed)
+
+		for v := range stream {
+			relayed <- v
+		}
+	}()
+
+	return relayed
+}
+
+// drainStream runs out a stream nobody reads anymore.
+func drainStream(resp any) {
+	switch stream := resp.(type) {
+	case <-chan chat.Chunk:
+		for range stream {
+		}
+
+	case <-chan json.RawMessage:
+		for range stream {
+		}
+	}
+}
+
+func (b *backend) timeout(next endpoint.Endpoint) endpoint.Endpoint {
+	timeout := b.g.opts.Timeout
+	if timeout <= 0 {
+		return next
+	}
+
+	type result struct {
+		resp any
+		err  error
+	}
+
+	return func(ctx context.Context, request any) (any, error) {
+		done := make(chan result, 1)
+
+		go func() {
+			resp, err := next(ctx, request)
+			done <- result{resp, err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case r := <-done:
+			return r.resp, r.err
+
+		case <-timer.C:
+			// a late stream still has to run out
+			go func() {
+				r := <-done
+				drainStream(r.resp)
+			}()
+
+			return nil, fmt.Errorf("%w: %s after %s", ErrTimeout, b.instance, timeout)
+		}
+	}
+}
+
+// stats returns the error rate and mean latency over the window.
+func (b *backend) stats() (int, float64, time.Duration) {
+	n := len(b.window)
+	if n == 0 {
+		return 0, 0, 0
+	}
+
+	var failures int
+	var latency time.Duration
+	for _, o := range b.window {
+		if o.failed {
+			failures++
+		}
+		latency += o.latency
+	}
+
+	return n, float64(failures) / float64(n), latency / time.Duration(n)
+}
+
+func (g *Guard) observe(b *backend, o outcome) {
+	b.mu.Lock()
+	if len(b.window) < cap(b.window) {
+		b.window = append(b.window, o)
+	} else {
+		b.window[b.next] = o
+		b.next = (b.next + 1) % len(b.window)
+	}
+
+	n, errorRate, latency := b.stats()
+	b.mu.Unlock()
+
+	if n < g.opts.MinRequests {
+		return
+	}
+
+	reason := ""
+	if g.opts.MaxErrorRate > 0 && errorRate > g.opts.MaxErrorRate {
+		reason = fmt.Sprintf("error rate %.2f", errorRate)
+	} else if g.opts.LatencyFactor > 0 && latency > g.opts.MinLatency {
+		if median, ok := g.medianLatency(); ok && float64(latency) > g.opts.LatencyFactor*float64(median) {
+			reason = fmt.Sprintf("latency %s, median %s", latency, median)
+		}
+	}
+
+	if reason == "" {
+		// a full window without being an outlier forgives past ejections
+		b.mu.Lock()
+		if n == cap(b.window) {
+			b.ejections = 0
+		}
+		b.mu.Unlock()
+
+		return
+	}
+
+	g.eject(b, reason)
+}
+
+// medianLatency returns the median of the mean latencies of the instances
+// with enough requests.
+func (g *Guard) medianLatency() (time.Duration, bool) {
+	g.mu.Lock()
+	backends := make([]*backend, 0, len(g.backends))
+	for _, b := range g.backends {
+		backends = append(backends, b)
+	}
+	g.mu.Unlock()
+
+	latencies := make([]time.Duration, 0, len(backends))
+	for _, b := range backends {
+		b.mu.Lock()
+		n, _, latency := b.stats()
+		b.mu.Unlock()
+
+		if n >= g.opts.MinRequests {
+			latencies = append(latencies, latency)
+		}
+	}
+
+	// an outlier needs others to compare with
+	if len(latencies) < 3 {
+		return 0, false
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2], true
+}
+
+func (g *Guard) eject(b *backend, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+
+	ejected := 0
+	for _, other := range g.backends {
+		other.mu.Lock()
+		if now.Before(other.until) {
+			ejected++
+		}
+		other.mu.Unlock()
+	}
+
+	if (ejected+1)*100 > g.opts.MaxEjectedPercent*len(g.backends) {
+		g.log.Warn("outlier not ejected", zap.String("instance", b.instance),
+			zap.String("reason", reason), zap.Int("ejected", ejected))
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Before(b.until) {
+		return
+	}
+
+	if b.ejections < 10 {
+		b.ejections++
+	}
+
+	b.until = now.Add(time.Duration(b.ejections) * g.opts.EjectionTime)
+	b.window = b.window[:0]
+	b.next = 0
+
+	g.log.Warn("outlier ejected", zap.String("instance", b.instance),
+		zap.String("reason", reason), zap.Time("until", b.until))
+}
+
+// Probe asks the instances whether they are ready every interval, until
+// the context is done. Instances are taken as ready until probed.
+func (g *Guard) Probe(ctx context.Context, probe func(ctx context.Context, instance string) error, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		g.mu.Lock()
+		backends := make([]*backend, 0, len(g.backends))
+		for _, b := range g.backends {
+			backends = append(backends, b)
+		}
+		g.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, b := range backends {
+			wg.Add(1)
+
+			go func(b *backend) {
+				defer wg.Done()
+
+				c, cancel := context.WithTimeout(ctx, interval)
+				defer cancel()
+
+				err := probe(c, b.instance)
+				if ctx.Err() != nil {
+					return
+				}
+
+				b.mu.Lock()
+				changed := (err == nil) != (b.unready == nil)
+				b.unready = err
+				b.mu.Unlock()
+
+				if !changed {
+					return
+				}
+
+				if err != nil {
+					g.log.Warn("instance not ready", zap.String("instance", b.instance), zap.Error(err))
+				} else {
+					g.log.Info("instance ready", zap.String("instance", b.instance))
+				}
+			}(b)
+		}
+
+		wg.Wait()
+	}
+}
+
+// Check is ready while any instance may take requests.
+func (g *Guard) Check(ctx context.Context) error {
+	for _, state := range g.States() {
+		if state.Ready && state.EjectedUntil == nil && state.Breaker != gobreaker.StateOpen.String() {
+			return nil
+		}
+	}
+
+	return errors.New("no instance available")
+}
+
+// BackendState is the state of the guard of an instance.
+type BackendState struct {
+	Instance            string     `json:"instance"`
+	Ready               bool       `json:"ready"`
+	NotReady            string     `json:"notReady,omitempty"` // why
+	Breaker             string     `json:"breaker"`            // closed, half-open or open
+	ConsecutiveFailures uint32     `json:"consecutiveFailures"`
+	Active              int        `json:"active"` // requests and streams, if bounded
+	Requests            int        `json:"requests"`
+	ErrorRate           float64    `json:"errorRate"`
+	MeanLatencyMs       int64      `json:"meanLatencyMs"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// States returns the state of every instance, by instance.
+func (g *Guard) States() []BackendState {
+	g.mu.Lock()
+	backends := make([]*backend, 0, len(g.backends))
+	for _, b := range g.backends {
+		backends = append(backends, b)
+	}
+	g.mu.Unlock()
+
+	now := time.Now()
+
+	states := make([]BackendState, 0, len(backends))
+	for _, b := range backends {
+		state := BackendState{
+			Instance:            b.instance,
+			Breaker:             b.cb.State().String(),
+			ConsecutiveFailures: b.cb.Counts().ConsecutiveFailures,
+			Active:              len(b.slots),
+		}
+
+		b.mu.Lock()
+		state.Ready = b.unready == nil
+		if b.unready != nil {
+			state.NotReady = b.unready.Error()
+		}
+
+		n, errorRate, latency := b.stats()
+		state.Requests = n
+		state.ErrorRate = errorRate
+		state.MeanLatencyMs = latency.Milliseconds()
+		state.Ejections = b.ejections
+		if now.Before(b.until) {
+			until := b.until
+			state.EjectedUntil = &until
+		}
+		b.mu.Unlock()
+
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Instance < states[j].Instance })
+	return states
+}
+
+// BackendsEndpoint lists the states of the instances.
+func BackendsEndpoint(g *Guard) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (any, error) {
+		return g.States(), nil
+	}
+}
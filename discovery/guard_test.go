@@ -0,0 +1,353 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/openai/chat"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// behave answers every request of an instance with its behaviour.
+func behave(behaviours map[string]endpoint.Endpoint) func(string) (endpoint.Endpoint, io.Closer, error) {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		return behaviours[instance], nil, nil
+	}
+}
+
+func TestGuardBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	err := error(chat.ErrChatNotFound)
+
+	guard := NewGuard(GuardOptions{ConsecutiveFailures: 3, OpenTimeout: 50 * time.Millisecond}, zap.NewNop())
+
+	e, closer, _ := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": func(ctx context.Context, request any) (any, error) {
+			calls++
+			return nil, err
+		},
+	}))("a:80")
+
+	ctx := context.Background()
+
+	// answered errors never trip the breaker
+	for i := 0; i < 5; i++ {
+		_, err := e(ctx, nil)
+		assert.ErrorIs(err, chat.ErrChatNotFound)
+	}
+
+	err = errRefused
+	for i := 0; i < 3; i++ {
+		_, err := e(ctx, nil)
+		assert.True(Unreachable(err))
+		assert.False(errors.Is(err, ErrUnavailable))
+	}
+
+	// open
+	_, err = e(ctx, nil)
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.Equal(8, calls)
+	assert.Equal("open", guard.States()[0].Breaker)
+
+	// half-open lets a request through, closing on success
+	time.Sleep(60 * time.Millisecond)
+	err = nil
+
+	_, err = e(ctx, nil)
+	assert.NoError(err)
+	assert.Equal(9, calls)
+	assert.Equal("closed", guard.States()[0].Breaker)
+
+	// forgotten with its endpoints
+	closer.Close()
+	assert.Empty(guard.States())
+}
+
+func TestGuardBulkhead(t *testing.T) {
+	assert := assert.New(t)
+
+	guard := NewGuard(GuardOptions{MaxRequests: 1}, zap.NewNop())
+
+	e, _, _ := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": func(ctx context.Context, request any) (any, error) {
+			stream := make(chan chat.Chunk, 2)
+			stream <- chat.Chunk{Content: "Hel"}
+			stream <- chat.Chunk{Content: "lo"}
+			close(stream)
+			return (<-chan chat.Chunk)(stream), nil
+		},
+	}))("a:80")
+
+	ctx := context.Background()
+
+	resp, err := e(ctx, nil)
+	assert.NoError(err)
+	assert.Equal(1, guard.States()[0].Active)
+
+	// the stream holds its slot
+	_, err = e(ctx, nil)
+	assert.ErrorIs(err, ErrUnavailable)
+
+	content := ""
+	for chunk := range resp.(<-chan chat.Chunk) {
+		content += chunk.Content
+	}
+	assert.Equal("Hello", content)
+
+	assert.Eventually(func() bool {
+		return guard.States()[0].Active == 0
+	}, time.Second, time.Millisecond)
+
+	resp, err = e(ctx, nil)
+	assert.NoError(err)
+	for range resp.(<-chan chat.Chunk) {
+	}
+
+	// rejections are not failures of the instance
+	assert.Equal("closed", guard.States()[0].Breaker)
+	assert.Equal(float64(0), guard.States()[0].ErrorRate)
+}
+
+func TestGuardBulkheadCompletionStream(t *testing.T) {
+	assert := assert.New(t)
+
+	guard := NewGuard(GuardOptions{MaxRequests: 1}, zap.NewNop())
+
+	e, _, _ := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": func(ctx context.Context, request any) (any, error) {
+			events := make(chan json.RawMessage, 2)
+			events <- json.RawMessage(`{"id":"1"}`)
+			events <- json.RawMessage(`{"id":"2"}`)
+			close(events)
+			return (<-chan json.RawMessage)(events), nil
+		},
+	}))("a:80")
+
+	ctx := context.Background()
+
+	resp, err := e(ctx, nil)
+	assert.NoError(err)
+
+	// the completion stream holds its slot as well
+	_, err = e(ctx, nil)
+	assert.ErrorIs(err, ErrUnavailable)
+
+	count := 0
+	for range resp.(<-chan json.RawMessage) {
+		count++
+	}
+	assert.Equal(2, count)
+
+	assert.Eventually(func() bool {
+		return guard.States()[0].Active == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestGuardTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	guard := NewGuard(GuardOptions{Timeout: 20 * time.Millisecond, ConsecutiveFailures: 2}, zap.NewNop())
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	e, _, _ := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": func(ctx context.Context, request any) (any, error) {
+			<-hang
+			return nil, nil
+		},
+	}))("a:80")
+
+	for i := 0; i < 2; i++ {
+		_, err := e(context.Background(), nil)
+		assert.ErrorIs(err, ErrTimeout)
+		assert.False(Unreachable(err))
+	}
+
+	_, err := e(context.Background(), nil)
+	assert.ErrorIs(err, ErrUnavailable)
+}
+
+func TestGuardTimeoutDrainsLateStream(t *testing.T) {
+	assert := assert.New(t)
+
+	guard := NewGuard(GuardOptions{Timeout: 20 * time.Millisecond, MaxRequests: 1}, zap.NewNop())
+
+	late := make(chan struct{})
+	events := make(chan json.RawMessage)
+
+	e, _, _ := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": func(ctx context.Context, request any) (any, error) {
+			<-late
+			return (<-chan json.RawMessage)(events), nil
+		},
+	}))("a:80")
+
+	_, err := e(context.Background(), nil)
+	assert.ErrorIs(err, ErrTimeout)
+
+	close(late)
+
+	// the stream arriving after the timeout is run out, releasing its slot
+	events <- json.RawMessage(`{"id":"1"}`)
+	close(events)
+
+	assert.Eventually(func() bool {
+		return guard.States()[0].Active == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestGuardOutliers(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := GuardOptions{
+		ConsecutiveFailures: 100,
+		MinRequests:         4,
+		Window:              4,
+		MaxErrorRate:        0.5,
+		LatencyFactor:       3,
+		MinLatency:          5 * time.Millisecond,
+		EjectionTime:        time.Minute,
+		MaxEjectedPercent:   50,
+	}
+
+	ok := func(ctx context.Context, request any) (any, error) {
+		return "ok", nil
+	}
+
+	guard := NewGuard(opts, zap.NewNop())
+	factory := guard.Factory(behave(map[string]endpoint.Endpoint{
+		"a:80": ok,
+		"b:80": ok,
+		"c:80": func(ctx context.Context, request any) (any, error) {
+			time.Sleep(20 * time.Millisecond)
+			return "ok", nil
+		},
+		"d:80": func(ctx context.Context, request any) (any, error) {
+			return nil, errRefused
+		},
+	}))
+
+	endpoints := make(map[string]endpoint.Endpoint)
+	for _, instance := range []string{"a:80", "b:80", "c:80", "d:80"} {
+		endpoints[instance], _, _ = factory(instance)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		for _, instance := range []string{"a:80", "b:80", "c:80", "d:80"} {
+			endpoints[instance](ctx, nil)
+		}
+	}
+
+	states := make(map[string]BackendState)
+	for _, state := range guard.States() {
+		states[state.Instance] = state
+	}
+
+	// by error rate
+	assert.NotNil(states["d:80"].EjectedUntil)
+	_, err := endpoints["d:80"](ctx, nil)
+	assert.ErrorIs(err, ErrUnavailable)
+
+	// by latency
+	assert.NotNil(states["c:80"].EjectedUntil)
+	assert.Equal(1, states["c:80"].Ejections)
+
+	assert.Nil(states["a:80"].EjectedUntil)
+	assert.Nil(states["b:80"].EjectedUntil)
+
+	// never more than half of the instances
+	guard = NewGuard(opts, zap.NewNop())
+	factory = guard.Factory(behave(map[string]endpoint.Endpoint{
+		"d:80": func(ctx context.Context, request any) (any, error) {
+			return nil, errRefused
+		},
+	}))
+
+	e, _, _ := factory("d:80")
+	for i := 0; i < 4; i++ {
+		e(ctx, nil)
+	}
+
+	assert.Nil(guard.States()[0].EjectedUntil)
+}
+
+func TestGuardProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	guard := NewGuard(GuardOptions{}, zap.NewNop())
+
+	ok := func(ctx context.Context, request any) (any, error) {
+		return "ok", nil
+	}
+
+	factory := guard.Factory(behave(map[string]endpoint.Endpoint{"a:80": ok, "b:80": ok}))
+	a, _, _ := factory("a:80")
+	factory("b:80")
+
+	// ready until probed
+	_, err := a(context.Background(), nil)
+	assert.NoError(err)
+	assert.NoError(guard.Check(context.Background()))
+
+	ready := map[string]bool{"a:80": false, "b:80": true}
+	var mu sync.Mutex
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go guard.Probe(ctx, func(ctx context.Context, instance string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !ready[instance] {
+			return errors.New("503 Service Unavailable")
+		}
+
+		return nil
+	}, 10*time.Millisecond)
+
+	assert.Eventually(func() bool {
+		_, err := a(context.Background(), nil)
+		return errors.Is(err, ErrUnavailable)
+	}, time.Second, 5*time.Millisecond)
+
+	for _, state := range guard.States() {
+		assert.Equal(state.Instance == "b:80", state.Ready)
+	}
+	assert.NoError(guard.Check(context.Background()))
+
+	mu.Lock()
+	ready["b:80"] = false
+	mu.Unlock()
+
+	assert.Eventually(func() bool {
+		return guard.Check(context.Background()) != nil
+	}, time.Second, 5*time.Millisecond)
+
+	// rejections are not failures of the instance
+	assert.Equal("closed", guard.States()[0].Breaker)
+
+	mu.Lock()
+	ready["a:80"] = true
+	mu.Unlock()
+
+	assert.Eventually(func() bool {
+		_, err := a(context.Background(), nil)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+}
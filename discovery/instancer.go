@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+	"go.uber.org/zap"
+)
+
+// Source lists the instances of a service as host:port. Instances returns
+// at once for index zero; otherwise it blocks until the list may have
+// changed since index, and returns the list with its new index.
+type Source interface {
+	Instances(ctx context.Context, index uint64) ([]string, uint64, error)
+}
+
+// Instancer watches a Source and broadcasts its changes to the registered
+// endpointers, as the instancers of go-kit do.
+type Instancer struct {
+	src    Source
+	log    *zap.Logger
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.RWMutex
+	state    sd.Event
+	registry map[chan<- sd.Event]struct{}
+}
+
+// NewInstancer lists the instances once before returning, then watches
+// the source until stopped.
+func NewInstancer(src Source, log *zap.Logger) *Instancer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	i := &Instancer{
+		src:      src,
+		log:      log.With(zap.String("component", "discovery")),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		registry: make(map[chan<- sd.Event]struct{}),
+	}
+
+	instances, index, err := src.Instances(ctx, 0)
+	if err != nil {
+		i.log.Warn("list instances failed", zap.Error(err))
+		i.update(sd.Event{Err: err})
+	} else {
+		i.update(sd.Event{Instances: instances})
+	}
+
+	go i.watch(ctx, index)
+
+	return i
+}
+
+func (i *Instancer) watch(ctx context.Context, index uint64) {
+	defer close(i.done)
+
+	backoff := time.Second
+
+	for {
+		instances, next, err := i.src.Instances(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			i.log.Warn("watch instances failed", zap.Error(err), zap.Duration("backoff", backoff))
+			i.update(sd.Event{Err: err})
+
+			if sleep(ctx, backoff) != nil {
+				return
+			}
+
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+
+			continue
+		}
+
+		backoff = time.Second
+		index = next
+		i.update(sd.Event{Instances: instances})
+	}
+}
+
+func (i *Instancer) update(event sd.Event) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	sort.Strings(event.Instances)
+	if reflect.DeepEqual(i.state, event) {
+		return
+	}
+
+	if event.Err == nil {
+		i.log.Info("instances changed", zap.Strings("instances", event.Instances))
+	}
+
+	i.state = event
+	for ch := range i.registry {
+		ch <- copyEvent(event)
+	}
+}
+
+// State returns the current instances, or the error of the last lookup.
+func (i *Instancer) State() sd.Event {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return copyEvent(i.state)
+}
+
+func (i *Instancer) Register(ch chan<- sd.Event) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.registry[ch] = struct{}{}
+	ch <- copyEvent(i.state)
+}
+
+func (i *Instancer) Deregister(ch chan<- sd.Event) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.registry, ch)
+}
+
+func (i *Instancer) Stop() {
+	i.cancel()
+	<-i.done
+}
+
+func copyEvent(event sd.Event) sd.Event {
+	if event.Instances != nil {
+		event.Instances = append([]string(nil), event.Instances...)
+	}
+
+	return event
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
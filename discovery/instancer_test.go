@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// instanceFactory answers every request with the instance.
+func instanceFactory(instance string) (endpoint.Endpoint, io.Closer, error) {
+	return func(ctx context.Context, request any) (any, error) {
+		return instance, nil
+	}, nil, nil
+}
+
+func TestFileInstancer(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "instances")
+
+	instancer := NewInstancer(FileSource(path, 10*time.Millisecond), zap.NewNop())
+	defer instancer.Stop()
+
+	assert.Empty(instancer.State().Instances)
+
+	endpointer := sd.NewEndpointer(instancer, instanceFactory, log.NewNopLogger())
+	defer endpointer.Close()
+
+	balanced := Balance(endpointer, 3, time.Second)
+
+	_, err := balanced(context.Background(), nil)
+	assert.ErrorIs(err, lb.ErrNoEndpoints)
+
+	err = os.WriteFile(path, []byte("# instances\n10.0.0.1:8080\n\n10.0.0.2:8080\n"), 0644)
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		endpoints, _ := endpointer.Endpoints()
+		return len(endpoints) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	served := make(map[any]int)
+	for i := 0; i < 4; i++ {
+		instance, err := balanced(context.Background(), nil)
+		assert.NoError(err)
+		served[instance]++
+	}
+	assert.Equal(map[any]int{"10.0.0.1:8080": 2, "10.0.0.2:8080": 2}, served)
+
+	// removed live
+	err = os.WriteFile(path, []byte("10.0.0.2:8080\n"), 0644)
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		endpoints, _ := endpointer.Endpoints()
+		return len(endpoints) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	instance, err := balanced(context.Background(), nil)
+	assert.NoError(err)
+	assert.Equal("10.0.0.2:8080", instance)
+}
+
+func TestBalanceRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	errAnswered := errors.New("answered")
+
+	attempts := make(map[string]int)
+	factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		return func(ctx context.Context, request any) (any, error) {
+			attempts[instance]++
+
+			switch instance {
+			case "down:80":
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			case "failing:80":
+				return nil, errAnswered
+			}
+
+			return instance, nil
+		}, nil, nil
+	}
+
+	// an unreachable instance is skipped
+	endpointer := sd.NewEndpointer(sd.FixedInstancer{"down:80", "up:80"}, factory, log.NewNopLogger())
+	balanced := Balance(endpointer, 3, time.Second)
+
+	for i := 0; i < 4; i++ {
+		instance, err := balanced(context.Background(), nil)
+		assert.NoError(err)
+		assert.Equal("up:80", instance)
+	}
+	assert.Equal(4, attempts["down:80"])
+
+	// but not an answered error, which is returned unwrapped
+	endpointer = sd.NewEndpointer(sd.FixedInstancer{"failing:80", "up:80"}, factory, log.NewNopLogger())
+	balanced = Balance(endpointer, 3, time.Second)
+
+	_, err := balanced(context.Background(), nil)
+	assert.ErrorIs(err, errAnswered)
+	assert.Equal(1, attempts["failing:80"])
+}
+
+type fakeResolver struct {
+	srv   []*net.SRV
+	hosts []string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srv, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.hosts, nil
+}
+
+func TestDNSSource(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := &fakeResolver{
+		srv: []*net.SRV{
+			{Target: "a.openai.service.", Port: 8080},
+			{Target: "b.openai.service.", Port: 8081},
+		},
+		hosts: []string{"10.0.0.1", "fd00::1"},
+	}
+
+	instances, index, err := DNSSource(resolver, "_http._tcp.openai.service", 0, time.Second).Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Equal(uint64(1), index)
+	assert.Equal([]string{"a.openai.service:8080", "b.openai.service:8081"}, instances)
+
+	instances, _, err = DNSSource(resolver, "openai.service", 8080, time.Second).Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Equal([]string{"10.0.0.1:8080", "[fd00::1]:8080"}, instances)
+}
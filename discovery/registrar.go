@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Instance is what a registrar announces of the running service.
+type Instance struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+func (i Instance) HostPort() string {
+	return net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+// announcer is the part of a registrar that differs between backends.
+type announcer interface {
+	announce(ctx context.Context) error
+	heartbeat(ctx context.Context) error
+	withdraw(ctx context.Context) error
+}
+
+// registrar announces the instance on Register and heartbeats it every
+// ttl/3, announcing it again when a heartbeat fails, until Deregister.
+// It implements sd.Registrar.
+type registrar struct {
+	announcer
+	ttl time.Duration
+	log *zap.Logger
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newRegistrar(a announcer, ttl time.Duration, log *zap.Logger) *registrar {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+
+	return &registrar{
+		announcer: a,
+		ttl:       ttl,
+		log:       log.With(zap.String("component", "registrar")),
+	}
+}
+
+func (r *registrar) Register() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	if err := r.announce(ctx); err != nil {
+		r.log.Error("announce failed", zap.Error(err))
+	} else {
+		r.log.Info("instance announced")
+	}
+
+	go r.beat(ctx, r.done)
+}
+
+func (r *registrar) beat(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			err := r.heartbeat(ctx)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+
+			r.log.Warn("heartbeat failed", zap.Error(err))
+
+			// e.g. the registry lost the instance
+			if err := r.announce(ctx); err != nil && ctx.Err() == nil {
+				r.log.Error("announce failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (r *registrar) Deregister() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel == nil {
+		return
+	}
+
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.withdraw(ctx); err != nil {
+		r.log.Error("withdraw failed", zap.Error(err))
+		return
+	}
+
+	r.log.Info("instance withdrawn")
+}
@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDirectoryRegistrar(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(t.TempDir(), "registry")
+	src := DirectorySource(dir, 10*time.Millisecond)
+
+	instances, _, err := src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Empty(instances)
+
+	a := DirectoryRegistrar(dir, Instance{ID: "a", Address: "10.0.0.1", Port: 8080}, 60*time.Millisecond, zap.NewNop())
+	b := DirectoryRegistrar(dir, Instance{ID: "b", Address: "fd00::2", Port: 8080}, time.Minute, zap.NewNop())
+
+	a.Register()
+	b.Register()
+
+	instances, _, err = src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"10.0.0.1:8080", "[fd00::2]:8080"}, instances)
+
+	// heartbeats keep a past its ttl
+	time.Sleep(150 * time.Millisecond)
+
+	instances, _, err = src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Len(instances, 2)
+
+	b.Deregister()
+
+	instances, _, err = src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Equal([]string{"10.0.0.1:8080"}, instances)
+
+	// a crashed instance expires
+	entry := directoryEntry{Instance{ID: "c", Address: "10.0.0.3", Port: 8080}, time.Now().Add(-time.Second)}
+	bs, _ := json.Marshal(&entry)
+	assert.NoError(os.WriteFile(filepath.Join(dir, "c.json"), bs, 0644))
+
+	instances, _, err = src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Equal([]string{"10.0.0.1:8080"}, instances)
+
+	a.Deregister()
+
+	instances, _, err = src.Instances(context.Background(), 0)
+	assert.NoError(err)
+	assert.Empty(instances)
+}
+
+// consulAgent stubs the service endpoints of the agent API.
+type consulAgent struct {
+	mu       sync.Mutex
+	services map[string]map[string]any
+	passes   int
+}
+
+func (c *consulAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.Method != http.MethodPut || r.Header.Get("X-Consul-Token") != "secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/v1/agent/service/register":
+		var service map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		c.services[service["ID"].(string)] = service
+
+	case filepath.Dir(path) == "/v1/agent/check/pass":
+		id := filepath.Base(path)[len("service:"):]
+		if _, ok := c.services[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		c.passes++
+
+	case filepath.Dir(path) == "/v1/agent/service/deregister":
+		delete(c.services, filepath.Base(path))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (c *consulAgent) service(id string) map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.services[id]
+}
+
+func TestConsulRegistrar(t *testing.T) {
+	assert := assert.New(t)
+
+	agent := &consulAgent{services: make(map[string]map[string]any)}
+
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	instance := Instance{
+		ID:      "openai-10-0-0-1-8080",
+		Address: "10.0.0.1",
+		Port:    8080,
+		Meta:    map[string]string{"grpc-port": "9090"},
+	}
+
+	r := ConsulRegistrar(server.URL, "openai", []string{"v1"}, "secret", instance, 60*time.Millisecond, zap.NewNop())
+	r.Register()
+
+	service := agent.service(instance.ID)
+	assert.Equal("openai", service["Name"])
+	assert.Equal("10.0.0.1", service["Address"])
+	assert.Equal(float64(8080), service["Port"])
+	assert.Equal(map[string]any{"grpc-port": "9090"}, service["Meta"])
+	assert.Equal("60ms", service["Check"].(map[string]any)["TTL"])
+	assert.Equal("passing", service["Check"].(map[string]any)["Status"])
+
+	assert.Eventually(func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return agent.passes >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the agent lost the service, e.g. restarted without its data
+	agent.mu.Lock()
+	delete(agent.services, instance.ID)
+	agent.mu.Unlock()
+
+	assert.Eventually(func() bool {
+		return agent.service(instance.ID) != nil
+	}, time.Second, 10*time.Millisecond)
+
+	r.Deregister()
+	assert.Nil(agent.service(instance.ID))
+}
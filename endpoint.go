@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 
+	"github.com/mirror520/openai/auth"
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
 )
 
 type ChatEndpoints struct {
@@ -15,12 +19,37 @@ type ChatEndpoints struct {
 	UpdateChatEndpoint endpoint.Endpoint
 	ChatEndpoint       endpoint.Endpoint
 	ChatStreamEndpoint endpoint.Endpoint
+
+	RegenerateStreamEndpoint endpoint.Endpoint
+	CancelChatEndpoint       endpoint.Endpoint
+
+	ListChatsEndpoint    endpoint.Endpoint
+	FindChatEndpoint     endpoint.Endpoint
+	ListMessagesEndpoint endpoint.Endpoint
+	DeleteChatEndpoint   endpoint.Endpoint
+
+	ExportChatEndpoint  endpoint.Endpoint
+	ExportChatsEndpoint endpoint.Endpoint
+	ImportChatsEndpoint endpoint.Endpoint
+
+	AnnotateChatEndpoint endpoint.Endpoint
+	ShareChatEndpoint    endpoint.Endpoint
+	BuildDatasetEndpoint endpoint.Endpoint
+
+	CreateCompletionEndpoint       endpoint.Endpoint
+	CreateCompletionStreamEndpoint endpoint.Endpoint
+	ListModelsEndpoint             endpoint.Endpoint
 }
 
 type CreateChatRequest struct {
 	Model   string          `json:"model"`
 	Prompt  string          `json:"prompt"`
 	Options json.RawMessage `json:"options"`
+	Access  chat.Access     `json:"-"`
+}
+
+func (req *CreateChatRequest) own(access chat.Access) {
+	req.Access = access
 }
 
 func CreateChatEndpoint(svc Service) endpoint.Endpoint {
@@ -30,7 +59,12 @@ func CreateChatEndpoint(svc Service) endpoint.Endpoint {
 			return nil, errors.New("invalid request")
 		}
 
-		id, err := svc.CreateChat(req.Model, req.Prompt, req.Options)
+		opts, err := withUser(ctx, req.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := svc.CreateChat(ctx, req.Model, req.Prompt, opts, req.Access)
 		if err != nil {
 			return nil, err
 		}
@@ -39,6 +73,35 @@ func CreateChatEndpoint(svc Service) endpoint.Endpoint {
 	}
 }
 
+// withUser sets the user option to the authenticated caller,
+// who cannot speak for anybody else.
+func withUser(ctx context.Context, rawOpts json.RawMessage) (json.RawMessage, error) {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		return rawOpts, nil
+	}
+
+	var opts map[string]json.RawMessage
+	if rawOpts != nil {
+		if err := json.Unmarshal(rawOpts, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts == nil {
+		opts = make(map[string]json.RawMessage)
+	}
+
+	user, err := json.Marshal(id.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	opts["user"] = user
+
+	return json.Marshal(opts)
+}
+
 type UpdateChatRequest struct {
 	ID      chat.ChatID     `json:"-"`
 	Model   string          `json:"model"`
@@ -46,6 +109,10 @@ type UpdateChatRequest struct {
 	Options json.RawMessage `json:"options"`
 }
 
+func (req *UpdateChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
 func UpdateChatEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request any) (response any, err error) {
 		req, ok := request.(*UpdateChatRequest)
@@ -53,7 +120,15 @@ func UpdateChatEndpoint(svc Service) endpoint.Endpoint {
 			return nil, errors.New("invalid request")
 		}
 
-		if err := svc.UpdateChat(req.Model, req.Prompt, req.Options, req.ID); err != nil {
+		opts := req.Options
+		if opts != nil {
+			opts, err = withUser(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := svc.UpdateChat(ctx, req.Model, req.Prompt, opts, req.ID); err != nil {
 			return nil, err
 		}
 
@@ -66,6 +141,10 @@ type ChatRequest struct {
 	Content string      `json:"content"`
 }
 
+func (req *ChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
 func ChatEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request any) (response any, err error) {
 		req, ok := request.(*ChatRequest)
@@ -73,7 +152,7 @@ func ChatEndpoint(svc Service) endpoint.Endpoint {
 			return nil, errors.New("invalid request")
 		}
 
-		return svc.Chat(req.Content, req.ID)
+		return svc.Chat(ctx, req.Content, req.ID)
 	}
 }
 
@@ -84,6 +163,344 @@ func ChatStreamEndpoint(svc Service) endpoint.Endpoint {
 			return nil, errors.New("invalid request")
 		}
 
-		return svc.ChatStream(req.Content, req.ID)
+		return svc.ChatStream(ctx, req.Content, req.ID)
+	}
+}
+
+type RegenerateRequest struct {
+	ID chat.ChatID `json:"-"`
+}
+
+func (req *RegenerateRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func RegenerateStreamEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*RegenerateRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.RegenerateStream(ctx, req.ID)
+	}
+}
+
+type CancelChatRequest struct {
+	ID chat.ChatID `json:"-"`
+}
+
+func (req *CancelChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func CancelChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*CancelChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		if err := svc.CancelChat(ctx, req.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+type ListChatsRequest struct {
+	Cursor string    `form:"cursor"`
+	Limit  int       `form:"limit"`
+	User   string    `form:"user"`
+	Model  string    `form:"model"`
+	Since  time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until  time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Text   string    `form:"q"`
+	Tenant string    `form:"-"`
+	Member string    `form:"-"`
+	Scoped bool      `form:"-"`
+}
+
+func (req *ListChatsRequest) scope(tenant string, member string) {
+	req.Tenant = tenant
+	req.Member = member
+	req.Scoped = true
+}
+
+func (req *ListChatsRequest) Query() (*chat.Query, error) {
+	q := &chat.Query{
+		Limit:  req.Limit,
+		User:   req.User,
+		Model:  req.Model,
+		Tenant: req.Tenant,
+		Member: req.Member,
+		Scoped: req.Scoped,
+		Since:  req.Since,
+		Until:  req.Until,
+		Text:   req.Text,
+	}
+
+	if req.Cursor != "" {
+		after, err := chat.ParseID(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		q.After = &after
+	}
+
+	return q, nil
+}
+
+func ListChatsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ListChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		q, err := req.Query()
+		if err != nil {
+			return nil, err
+		}
+
+		return svc.ListChats(ctx, q)
+	}
+}
+
+type FindChatRequest struct {
+	ID chat.ChatID `json:"-"`
+}
+
+func (req *FindChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func FindChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*FindChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.FindChat(ctx, req.ID)
+	}
+}
+
+type ListMessagesRequest struct {
+	ID     chat.ChatID `json:"-" form:"-"`
+	Cursor int         `form:"cursor"`
+	Limit  int         `form:"limit"`
+}
+
+func (req *ListMessagesRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func ListMessagesEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ListMessagesRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.ListMessages(ctx, req.ID, req.Cursor, req.Limit)
+	}
+}
+
+type DeleteChatRequest struct {
+	ID chat.ChatID `json:"-"`
+}
+
+func (req *DeleteChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func DeleteChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*DeleteChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		if err := svc.DeleteChat(ctx, req.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+type ExportChatRequest struct {
+	ID     chat.ChatID       `json:"-" form:"-"`
+	Format transcript.Format `form:"format"`
+}
+
+func (req *ExportChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func ExportChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ExportChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.ExportChat(ctx, req.ID, req.Format)
+	}
+}
+
+type ExportChatsRequest struct {
+	ListChatsRequest
+	Format transcript.Format `form:"format"`
+}
+
+func ExportChatsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ExportChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		q, err := req.Query()
+		if err != nil {
+			return nil, err
+		}
+
+		return svc.ExportChats(ctx, q, req.Format)
+	}
+}
+
+type ImportChatsRequest struct {
+	Format transcript.Format `form:"format"`
+	Model  string            `form:"model"`
+	Data   []byte            `form:"-"`
+	Access chat.Access       `form:"-"`
+}
+
+func (req *ImportChatsRequest) own(access chat.Access) {
+	req.Access = access
+}
+
+func ImportChatsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ImportChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.ImportChats(ctx, req.Data, req.Format, req.Model, req.Access)
+	}
+}
+
+type AnnotateChatRequest struct {
+	ID chat.ChatID `json:"-"`
+	chat.Annotation
+}
+
+func (req *AnnotateChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func AnnotateChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*AnnotateChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		if err := svc.AnnotateChat(ctx, &req.Annotation, req.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+type ShareChatRequest struct {
+	ID      chat.ChatID     `json:"-"`
+	Subject string          `json:"-"`
+	Role    chat.MemberRole `json:"role"` // empty revokes
+}
+
+func (req *ShareChatRequest) chatID() chat.ChatID {
+	return req.ID
+}
+
+func ShareChatEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*ShareChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		if err := svc.ShareChat(ctx, req.Subject, req.Role, req.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+func BuildDatasetEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		spec, ok := request.(*dataset.Spec)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		return svc.BuildDataset(ctx, spec)
+	}
+}
+
+// CompletionRequest is a chat completion request of the OpenAI API,
+// forwarded as it is apart from the user. A ChatID continues a stored chat.
+type CompletionRequest struct {
+	Body   json.RawMessage
+	ChatID chat.ChatID
+	Stream bool
+}
+
+func (req *CompletionRequest) chatID() chat.ChatID {
+	return req.ChatID
+}
+
+func CreateCompletionEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*CompletionRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		body, err := withUser(ctx, req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return svc.CreateCompletion(ctx, body, req.ChatID)
+	}
+}
+
+func CreateCompletionStreamEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*CompletionRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		body, err := withUser(ctx, req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return svc.CreateCompletionStream(ctx, body, req.ChatID)
+	}
+}
+
+func ListModelsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (response any, err error) {
+		return svc.ListModels(ctx)
 	}
 }
@@ -0,0 +1,91 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+)
+
+// Repository checks that the repository is reachable, if it may not be.
+func Repository(repo chat.Repository) Check {
+	return Check{
+		Name: "repository",
+		Func: func(ctx context.Context) error {
+			if pinger, ok := repo.(chat.Pinger); ok {
+				return pinger.Ping()
+			}
+
+			return nil
+		},
+	}
+}
+
+// Config checks that the config holds what the service needs upstream.
+func Config(cfg *conf.Config) Check {
+	return Check{
+		Name: "config",
+		Func: func(ctx context.Context) error {
+			if cfg == nil {
+				return errors.New("config not loaded")
+			}
+
+			if cfg.APIKey == "" {
+				return errors.New("apiKey not configured")
+			}
+
+			return nil
+		},
+	}
+}
+
+// Upstream sends a completion of a single token to the OpenAI API,
+// or to a stand-in serving the same API.
+func Upstream(baseURL, apiKey, model string) Check {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return Check{
+		Name: "upstream",
+		Func: func(ctx context.Context) error {
+			bs, err := json.Marshal(map[string]any{
+				"model": model,
+				"messages": []map[string]string{
+					{"role": "user", "content": "ping"},
+				},
+				"max_tokens": 1,
+			})
+			if err != nil {
+				return err
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/chat/completions", bytes.NewReader(bs))
+			if err != nil {
+				return err
+			}
+
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("upstream: %s", resp.Status)
+			}
+
+			return nil
+		},
+	}
+}
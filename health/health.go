@@ -0,0 +1,93 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency of the service works. The outcome
+// of an advisory check is reported but never fails readiness.
+type Check struct {
+	Name     string
+	Func     func(ctx context.Context) error
+	Advisory bool
+}
+
+// Report is the outcome of the checks, "ok" or the error of each.
+type Report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Run runs the checks concurrently.
+func Run(ctx context.Context, checks ...Check) Report {
+	report := Report{
+		Ready:  true,
+		Checks: make(map[string]string, len(checks)),
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	for _, check := range checks {
+		wg.Add(1)
+
+		go func(check Check) {
+			defer wg.Done()
+
+			status := "ok"
+			if err := check.Func(ctx); err != nil {
+				status = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			report.Checks[check.Name] = status
+			if status != "ok" && !check.Advisory {
+				report.Ready = false
+			}
+		}(check)
+	}
+
+	wg.Wait()
+
+	return report
+}
+
+// Cached runs the check at most once every ttl, answering the last result
+// meanwhile; meant for the checks too costly to run on every probe.
+// A run cut short by the probe's own deadline or cancellation is not cached.
+func Cached(check Check, ttl time.Duration) Check {
+	var (
+		mu      sync.Mutex
+		err     error
+		checked time.Time
+	)
+
+	return Check{
+		Name:     check.Name,
+		Advisory: check.Advisory,
+		Func: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !checked.IsZero() && time.Since(checked) < ttl {
+				return err
+			}
+
+			result := check.Func(ctx)
+			if ctx.Err() != nil {
+				return result
+			}
+
+			err = result
+			checked = time.Now()
+
+			return err
+		},
+	}
+}
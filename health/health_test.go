@@ -0,0 +1,83 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := Check{Name: "ok", Func: func(ctx context.Context) error { return nil }}
+	down := Check{Name: "down", Func: func(ctx context.Context) error { return errors.New("connection refused") }}
+
+	report := Run(context.Background(), ok)
+	assert.True(report.Ready)
+	assert.Equal(map[string]string{"ok": "ok"}, report.Checks)
+
+	report = Run(context.Background(), ok, down)
+	assert.False(report.Ready)
+	assert.Equal(map[string]string{"ok": "ok", "down": "connection refused"}, report.Checks)
+
+	down.Advisory = true
+
+	report = Run(context.Background(), ok, down)
+	assert.True(report.Ready)
+	assert.Equal(map[string]string{"ok": "ok", "down": "connection refused"}, report.Checks)
+}
+
+func TestCachedUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests []map[string]any
+	status := http.StatusOK
+
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/chat/completions", r.URL.Path)
+		assert.Equal("Bearer sk-test", r.Header.Get("Authorization"))
+
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+
+		w.WriteHeader(status)
+	}))
+	defer standIn.Close()
+
+	check := Cached(Upstream(standIn.URL+"/v1/", "sk-test", "gpt-4"), 50*time.Millisecond)
+	assert.Equal("upstream", check.Name)
+
+	ctx := context.Background()
+	assert.NoError(check.Func(ctx))
+
+	// answered from the cache meanwhile
+	status = http.StatusUnauthorized
+	assert.NoError(check.Func(ctx))
+	assert.Len(requests, 1)
+	assert.Equal("gpt-4", requests[0]["model"])
+	assert.Equal(float64(1), requests[0]["max_tokens"])
+
+	time.Sleep(60 * time.Millisecond)
+
+	err := check.Func(ctx)
+	assert.ErrorContains(err, "401")
+	assert.Len(requests, 2)
+
+	time.Sleep(60 * time.Millisecond)
+
+	// a probe giving up is not the upstream failing
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	assert.Error(check.Func(cancelled))
+
+	status = http.StatusOK
+	assert.NoError(check.Func(ctx))
+}
@@ -0,0 +1,579 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
+)
+
+// Metrics are observed by InstrumentingMiddleware.
+type Metrics struct {
+	Requests       metrics.Counter   // method, model, status
+	Duration       metrics.Histogram // method, model, status; seconds, until streams start
+	FirstToken     metrics.Histogram // method, model; seconds
+	TokenRate      metrics.Histogram // method, model; tokens per second after the first
+	Tokens         metrics.Counter   // model, kind: prompt or completion
+	EstimateTokens metrics.Counter   // model, kind: prompt or completion
+	UpstreamErrors metrics.Counter   // method, model, category
+	ActiveStreams  metrics.Gauge     // method, model
+}
+
+// NewPrometheusMetrics registers the metrics with the default registerer.
+func NewPrometheusMetrics() *Metrics {
+	return &Metrics{
+		Requests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "openai",
+			Name:      "requests_total",
+			Help:      "Requests to the service.",
+		}, []string{"method", "model", "status"}),
+		Duration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "openai",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests, of streams until they start.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.005, 2, 15),
+		}, []string{"method", "model", "status"}),
+		FirstToken: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "openai",
+			Name:      "stream_first_token_seconds",
+			Help:      "Time to the first token of the streams.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"method", "model"}),
+		TokenRate: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "openai",
+			Name:      "stream_tokens_per_second",
+			Help:      "Tokens per second of the streams, after the first.",
+			Buckets:   stdprometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"method", "model"}),
+		Tokens: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "openai",
+			Name:      "tokens_total",
+			Help:      "Prompt and completion tokens, as reported upstream.",
+		}, []string{"model", "kind"}),
+		EstimateTokens: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "openai",
+			Name:      "estimated_tokens_total",
+			Help:      "Prompt and completion tokens of the chat streams, estimated as upstream reports none.",
+		}, []string{"model", "kind"}),
+		UpstreamErrors: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "openai",
+			Name:      "upstream_errors_total",
+			Help:      "Failed calls to the OpenAI API, by category.",
+		}, []string{"method", "model", "category"}),
+		ActiveStreams: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "openai",
+			Name:      "active_streams",
+			Help:      "Streams being answered.",
+		}, []string{"method", "model"}),
+	}
+}
+
+// RepositorySize is a gauge of the chats in the repository, counted on
+// every scrape.
+func RepositorySize(chats chat.Repository) stdprometheus.Collector {
+	return stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+		Namespace: "openai",
+		Name:      "repository_chats",
+		Help:      "Chats in the repository.",
+	}, func() float64 {
+		if counter, ok := chats.(chat.Counter); ok {
+			n, err := counter.Count()
+			if err != nil {
+				return math.NaN()
+			}
+
+			return float64(n)
+		}
+
+		all, err := chats.List(&chat.Query{})
+		if err != nil {
+			return math.NaN()
+		}
+
+		return float64(len(all))
+	})
+}
+
+// KnownModels are labeled as they are, along with their dated snapshots,
+// e.g. gpt-4-0613 as gpt-4. The others are labeled OtherModel, as models
+// come from the callers and would make the series unbounded.
+var KnownModels = []string{
+	"gpt-3.5-turbo", "gpt-3.5-turbo-16k", "gpt-3.5-turbo-instruct",
+	"gpt-4", "gpt-4-32k", "gpt-4-turbo", "gpt-4o", "gpt-4o-mini",
+}
+
+const OtherModel = "other"
+
+// modelLabel returns the label of the model, empty if there is none.
+func modelLabel(model string) string {
+	if model == "" {
+		return ""
+	}
+
+	for _, known := range KnownModels {
+		if model == known {
+			return known
+		}
+
+		snapshot := strings.TrimPrefix(model, known+"-")
+		if snapshot != model && strings.Trim(snapshot, "0123456789-") == "" {
+			return known
+		}
+	}
+
+	return OtherModel
+}
+
+// InstrumentingMiddleware observes the requests, labeled by the model of
+// the request or its chat, see KnownModels. Tokens are counted as the
+// service reports them from upstream; those of the chat streams, reported
+// by none, are estimated apart, as one token per chunk or per four
+// characters.
+func InstrumentingMiddleware(m *Metrics) ServiceMiddleware {
+	return func(next Service) Service {
+		return &instrumentingMiddleware{m, next}
+	}
+}
+
+type instrumentingMiddleware struct {
+	m    *Metrics
+	next Service
+}
+
+// report is filled in by the service along a request, with the model of
+// the chat it loads and what upstream reports.
+type report struct {
+	sync.Mutex
+	model  string
+	usage  *chat.Usage
+	prompt int // estimated, of the chat streams
+}
+
+type reportKey struct{}
+
+func withReport(ctx context.Context) (context.Context, *report) {
+	r := new(report)
+	return context.WithValue(ctx, reportKey{}, r), r
+}
+
+func reportFrom(ctx context.Context) *report {
+	r, _ := ctx.Value(reportKey{}).(*report)
+	return r
+}
+
+// reportChat reports the model of the chat of the request.
+func reportChat(ctx context.Context, c *chat.Chat) {
+	if r := reportFrom(ctx); r != nil {
+		r.Lock()
+		r.model = c.Model
+		r.Unlock()
+	}
+}
+
+// reportUsage reports the usage upstream answered with.
+func reportUsage(ctx context.Context, usage *chat.Usage) {
+	if r := reportFrom(ctx); r != nil && usage != nil {
+		r.Lock()
+		r.usage = usage
+		r.Unlock()
+	}
+}
+
+// reportPrompt reports the prompt of a chat stream, as upstream reports
+// no usage for streams.
+func reportPrompt(ctx context.Context, prompt *chat.Chat) {
+	if r := reportFrom(ctx); r != nil {
+		tokens := estimateTokens(history(prompt)...)
+
+		r.Lock()
+		r.prompt = tokens
+		r.Unlock()
+	}
+}
+
+func (r *report) get() (string, *chat.Usage, int) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.model, r.usage, r.prompt
+}
+
+func (mw *instrumentingMiddleware) observe(method string, model string, begin time.Time, err error) {
+	model = modelLabel(model)
+
+	status := "ok"
+	if err != nil {
+		status = "error"
+
+		if category, ok := upstreamCategory(err); ok {
+			mw.m.UpstreamErrors.With("method", method, "model", model, "category", category).Add(1)
+		}
+	}
+
+	mw.m.Requests.With("method", method, "model", model, "status", status).Add(1)
+	mw.m.Duration.With("method", method, "model", model, "status", status).Observe(time.Since(begin).Seconds())
+}
+
+// chunk counts a token per chunk of the answers, and the upstream errors
+// ending them early.
+func (mw *instrumentingMiddleware) chunk(method string, model string) func(chat.Chunk) int {
+	model = modelLabel(model)
+
+	return func(chunk chat.Chunk) int {
+		if chunk.Err == nil {
+			return 1
+		}
+
+		if category, ok := upstreamCategory(chunk.Err); ok {
+			mw.m.UpstreamErrors.With("method", method, "model", model, "category", category).Add(1)
+		}
+
+		return 0
+	}
+}
+
+func (mw *instrumentingMiddleware) tokens(model string, usage *chat.Usage) {
+	if usage != nil {
+		count(mw.m.Tokens, model, usage.PromptTokens, usage.CompletionTokens)
+	}
+}
+
+func count(counter metrics.Counter, model string, prompt int, completion int) {
+	model = modelLabel(model)
+
+	if prompt > 0 {
+		counter.With("model", model, "kind", "prompt").Add(float64(prompt))
+	}
+
+	if completion > 0 {
+		counter.With("model", model, "kind", "completion").Add(float64(completion))
+	}
+}
+
+// upstreamCategory classifies the failed calls to the OpenAI API.
+func upstreamCategory(err error) (string, bool) {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		switch code := upstream.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "auth", true
+		case code == http.StatusTooManyRequests:
+			return "rate_limit", true
+		case code >= 500:
+			return "server", true
+		default:
+			return "invalid_request", true
+		}
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return "timeout", true
+		}
+
+		return "network", true
+	}
+
+	return "", false
+}
+
+// estimateTokens is about four characters per token.
+func estimateTokens(messages ...string) int {
+	n := 0
+	for _, msg := range messages {
+		n += (utf8.RuneCountInString(msg) + 3) / 4
+	}
+
+	return n
+}
+
+func history(c *chat.Chat) []string {
+	contents := make([]string, 0, len(c.Messages))
+	for _, msg := range c.Messages {
+		contents = append(contents, msg.Content)
+	}
+
+	return contents
+}
+
+// relay passes the chunks of a stream on, observing the time to the first
+// one and the rate of the tokens after it; done gets the tokens streamed.
+func relay[T any](mw *instrumentingMiddleware, method string, model string, begin time.Time, chunks <-chan T, tokens func(T) int, done func(completion int)) <-chan T {
+	model = modelLabel(model)
+
+	active := mw.m.ActiveStreams.With("method", method, "model", model)
+	active.Add(1)
+
+	relayed := make(chan T, 1)
+
+	go func() {
+		defer close(relayed)
+		defer active.Add(-1)
+
+		var first time.Time
+		completion := 0
+
+		for chunk := range chunks {
+			if first.IsZero() {
+				first = time.Now()
+				mw.m.FirstToken.With("method", method, "model", model).Observe(first.Sub(begin).Seconds())
+			}
+
+			completion += tokens(chunk)
+			relayed <- chunk
+		}
+
+		if elapsed := time.Since(first).Seconds(); completion > 1 && elapsed > 0 {
+			mw.m.TokenRate.With("method", method, "model", model).Observe(float64(completion-1) / elapsed)
+		}
+
+		done(completion)
+	}()
+
+	return relayed
+}
+
+func (mw *instrumentingMiddleware) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (id chat.ChatID, err error) {
+	defer func(begin time.Time) {
+		mw.observe("create_chat", model, begin, err)
+	}(time.Now())
+
+	return mw.next.CreateChat(ctx, model, prompt, rawOpts, access)
+}
+
+func (mw *instrumentingMiddleware) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) (err error) {
+	defer func(begin time.Time) {
+		mw.observe("update_chat", model, begin, err)
+	}(time.Now())
+
+	return mw.next.UpdateChat(ctx, model, prompt, rawOpts, id)
+}
+
+func (mw *instrumentingMiddleware) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
+	begin := time.Now()
+	ctx, r := withReport(ctx)
+
+	answer, err := mw.next.Chat(ctx, content, id)
+
+	model, usage, _ := r.get()
+	mw.observe("chat", model, begin, err)
+
+	if err == nil {
+		mw.tokens(model, usage)
+	}
+
+	return answer, err
+}
+
+func (mw *instrumentingMiddleware) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
+	return mw.chatStream(ctx, "chat_stream", func(ctx context.Context) (<-chan chat.Chunk, error) {
+		return mw.next.ChatStream(ctx, content, id)
+	})
+}
+
+func (mw *instrumentingMiddleware) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	return mw.chatStream(ctx, "regenerate_stream", func(ctx context.Context) (<-chan chat.Chunk, error) {
+		return mw.next.RegenerateStream(ctx, id)
+	})
+}
+
+func (mw *instrumentingMiddleware) chatStream(ctx context.Context, method string, next func(context.Context) (<-chan chat.Chunk, error)) (<-chan chat.Chunk, error) {
+	begin := time.Now()
+	ctx, r := withReport(ctx)
+
+	chunks, err := next(ctx)
+
+	model, _, prompt := r.get()
+	mw.observe(method, model, begin, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return relay(mw, method, model, begin, chunks, mw.chunk(method, model), func(completion int) {
+		count(mw.m.EstimateTokens, model, prompt, completion)
+	}), nil
+}
+
+func (mw *instrumentingMiddleware) CancelChat(ctx context.Context, id chat.ChatID) (err error) {
+	defer func(begin time.Time) {
+		mw.observe("cancel_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.CancelChat(ctx, id)
+}
+
+func (mw *instrumentingMiddleware) ListChats(ctx context.Context, query *chat.Query) (page *chat.Page, err error) {
+	defer func(begin time.Time) {
+		mw.observe("list_chats", query.Model, begin, err)
+	}(time.Now())
+
+	return mw.next.ListChats(ctx, query)
+}
+
+func (mw *instrumentingMiddleware) FindChat(ctx context.Context, id chat.ChatID) (c *chat.Chat, err error) {
+	defer func(begin time.Time) {
+		mw.observe("find_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.FindChat(ctx, id)
+}
+
+func (mw *instrumentingMiddleware) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (page *chat.MessagePage, err error) {
+	defer func(begin time.Time) {
+		mw.observe("list_messages", "", begin, err)
+	}(time.Now())
+
+	return mw.next.ListMessages(ctx, id, cursor, limit)
+}
+
+func (mw *instrumentingMiddleware) DeleteChat(ctx context.Context, id chat.ChatID) (err error) {
+	defer func(begin time.Time) {
+		mw.observe("delete_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.DeleteChat(ctx, id)
+}
+
+func (mw *instrumentingMiddleware) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) (data []byte, err error) {
+	defer func(begin time.Time) {
+		mw.observe("export_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.ExportChat(ctx, id, format)
+}
+
+func (mw *instrumentingMiddleware) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) (data []byte, err error) {
+	defer func(begin time.Time) {
+		mw.observe("export_chats", query.Model, begin, err)
+	}(time.Now())
+
+	return mw.next.ExportChats(ctx, query, format)
+}
+
+func (mw *instrumentingMiddleware) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) (ids []chat.ChatID, err error) {
+	defer func(begin time.Time) {
+		mw.observe("import_chats", model, begin, err)
+	}(time.Now())
+
+	return mw.next.ImportChats(ctx, data, format, model, access)
+}
+
+func (mw *instrumentingMiddleware) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) (err error) {
+	defer func(begin time.Time) {
+		mw.observe("annotate_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.AnnotateChat(ctx, annotation, id)
+}
+
+func (mw *instrumentingMiddleware) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) (err error) {
+	defer func(begin time.Time) {
+		mw.observe("share_chat", "", begin, err)
+	}(time.Now())
+
+	return mw.next.ShareChat(ctx, subject, role, id)
+}
+
+func (mw *instrumentingMiddleware) BuildDataset(ctx context.Context, spec *dataset.Spec) (ds *dataset.Dataset, err error) {
+	defer func(begin time.Time) {
+		mw.observe("build_dataset", "", begin, err)
+	}(time.Now())
+
+	return mw.next.BuildDataset(ctx, spec)
+}
+
+// requestModel returns the model of the request body, if any.
+func requestModel(body json.RawMessage) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+func (mw *instrumentingMiddleware) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error) {
+	begin := time.Now()
+	ctx, r := withReport(ctx)
+
+	data, err := mw.next.CreateCompletion(ctx, body, id)
+
+	model, usage, _ := r.get()
+	if m := requestModel(body); m != "" {
+		model = m
+	}
+
+	mw.observe("create_completion", model, begin, err)
+
+	if err == nil {
+		mw.tokens(model, usage)
+	}
+
+	return data, err
+}
+
+func (mw *instrumentingMiddleware) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	begin := time.Now()
+	ctx, r := withReport(ctx)
+
+	events, err := mw.next.CreateCompletionStream(ctx, body, id)
+
+	model, _, _ := r.get()
+	if m := requestModel(body); m != "" {
+		model = m
+	}
+
+	mw.observe("create_completion_stream", model, begin, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last chunk reports the usage if the request asks for it
+	var usage *chat.Usage
+
+	tokens := func(event json.RawMessage) int {
+		var chunk *chat.Response
+		if err := json.Unmarshal(event, &chunk); err != nil || chunk == nil {
+			return 0
+		}
+
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil && choice.Delta.Content != "" {
+				return 1
+			}
+		}
+
+		return 0
+	}
+
+	return relay(mw, "create_completion_stream", model, begin, events, tokens, func(int) {
+		mw.tokens(model, usage)
+	}), nil
+}
+
+func (mw *instrumentingMiddleware) ListModels(ctx context.Context) (data json.RawMessage, err error) {
+	defer func(begin time.Time) {
+		mw.observe("list_models", "", begin, err)
+	}(time.Now())
+
+	return mw.next.ListModels(ctx)
+}
@@ -0,0 +1,161 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+// testMetrics are registered with their own registry.
+type testMetrics struct {
+	requests       *prometheus.CounterVec
+	firstToken     *prometheus.HistogramVec
+	tokenRate      *prometheus.HistogramVec
+	tokens         *prometheus.CounterVec
+	estimateTokens *prometheus.CounterVec
+	upstreamErrors *prometheus.CounterVec
+	activeStreams  *prometheus.GaugeVec
+}
+
+func newTestMetrics() (*Metrics, *testMetrics) {
+	t := &testMetrics{
+		requests:       prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"method", "model", "status"}),
+		firstToken:     prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "first_token"}, []string{"method", "model"}),
+		tokenRate:      prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "token_rate"}, []string{"method", "model"}),
+		tokens:         prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokens"}, []string{"model", "kind"}),
+		estimateTokens: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "estimated_tokens"}, []string{"model", "kind"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_errors"}, []string{"method", "model", "category"}),
+		activeStreams:  prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "active_streams"}, []string{"method", "model"}),
+	}
+
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"method", "model", "status"})
+
+	return &Metrics{
+		Requests:       kitprometheus.NewCounter(t.requests),
+		Duration:       kitprometheus.NewHistogram(duration),
+		FirstToken:     kitprometheus.NewHistogram(t.firstToken),
+		TokenRate:      kitprometheus.NewHistogram(t.tokenRate),
+		Tokens:         kitprometheus.NewCounter(t.tokens),
+		EstimateTokens: kitprometheus.NewCounter(t.estimateTokens),
+		UpstreamErrors: kitprometheus.NewCounter(t.upstreamErrors),
+		ActiveStreams:  kitprometheus.NewGauge(t.activeStreams),
+	}, t
+}
+
+func TestInstrumentingMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+
+		if req["model"] == "gpt-limited" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Rate limit reached","type":"requests"}}`))
+			return
+		}
+
+		if req["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hello"}}],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`))
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	metrics, m := newTestMetrics()
+
+	svc := NewService(chats, &conf.Config{BaseURL: upstream.URL})
+	svc = InstrumentingMiddleware(metrics)(svc)
+
+	id, err := svc.CreateChat(ctx, "gpt-4", "", nil, chat.Access{})
+	assert.NoError(err)
+	assert.Equal(float64(1), testutil.ToFloat64(m.requests.WithLabelValues("create_chat", "gpt-4", "ok")))
+
+	// labeled by the model of the chat, tokens as reported upstream
+	_, err = svc.Chat(ctx, "12345678", id)
+	assert.NoError(err)
+	assert.Equal(float64(1), testutil.ToFloat64(m.requests.WithLabelValues("chat", "gpt-4", "ok")))
+	assert.Equal(float64(9), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-4", "prompt")))
+	assert.Equal(float64(3), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-4", "completion")))
+
+	stream, err := svc.ChatStream(ctx, "Hi", id)
+	assert.NoError(err)
+	assert.Equal(float64(1), testutil.ToFloat64(m.activeStreams.WithLabelValues("chat_stream", "gpt-4")))
+
+	content := ""
+	for chunk := range stream {
+		content += chunk.Content
+	}
+	assert.Equal("Hello", content)
+
+	assert.Equal(float64(0), testutil.ToFloat64(m.activeStreams.WithLabelValues("chat_stream", "gpt-4")))
+	assert.Equal(1, testutil.CollectAndCount(m.firstToken))
+	assert.Equal(1, testutil.CollectAndCount(m.tokenRate))
+
+	// streams report no usage, their tokens are estimated apart
+	assert.Equal(float64(3), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-4", "completion")))
+	assert.Equal(float64(5), testutil.ToFloat64(m.estimateTokens.WithLabelValues("gpt-4", "prompt")))
+	assert.Equal(float64(2), testutil.ToFloat64(m.estimateTokens.WithLabelValues("gpt-4", "completion")))
+
+	// tokens as reported upstream
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"Hi"}]}`), chat.ChatID{})
+	assert.NoError(err)
+	assert.Equal(float64(9), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-3.5-turbo", "prompt")))
+	assert.Equal(float64(3), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-3.5-turbo", "completion")))
+
+	events, err := svc.CreateCompletionStream(ctx, json.RawMessage(`{"model":"gpt-3.5-turbo","stream":true,"messages":[{"role":"user","content":"Hi"}]}`), chat.ChatID{})
+	assert.NoError(err)
+	for range events {
+	}
+	assert.Equal(float64(3), testutil.ToFloat64(m.tokens.WithLabelValues("gpt-3.5-turbo", "completion")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.requests.WithLabelValues("create_completion_stream", "gpt-3.5-turbo", "ok")))
+
+	// upstream errors by category
+	_, err = svc.CreateCompletion(ctx, json.RawMessage(`{"model":"gpt-limited","messages":[{"role":"user","content":"Hi"}]}`), chat.ChatID{})
+	assert.Error(err)
+	assert.Equal(float64(1), testutil.ToFloat64(m.requests.WithLabelValues("create_completion", OtherModel, "error")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.upstreamErrors.WithLabelValues("create_completion", OtherModel, "rate_limit")))
+
+	// but not the errors of the service
+	_, err = svc.FindChat(ctx, chat.NewChat("gpt-4", "", nil).ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+	assert.Equal(1, testutil.CollectAndCount(m.upstreamErrors))
+
+	size := RepositorySize(chats)
+	assert.Equal(float64(1), testutil.ToFloat64(size))
+
+	svc.CreateChat(ctx, "gpt-4", "", nil, chat.Access{})
+	assert.Equal(float64(2), testutil.ToFloat64(size))
+
+	// unknown models share a label, snapshots are labeled as their model
+	svc.CreateChat(ctx, "gpt-4-0613", "", nil, chat.Access{})
+	svc.CreateChat(ctx, "gpt-4-\u0000", "", nil, chat.Access{})
+	svc.CreateChat(ctx, "my-model", "", nil, chat.Access{})
+	assert.Equal(float64(3), testutil.ToFloat64(m.requests.WithLabelValues("create_chat", "gpt-4", "ok")))
+	assert.Equal(float64(2), testutil.ToFloat64(m.requests.WithLabelValues("create_chat", OtherModel, "ok")))
+}
@@ -1,11 +1,14 @@
 package openai
 
 import (
+	"context"
 	"encoding/json"
 
 	"go.uber.org/zap"
 
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
 )
 
 func LoggingMiddleware(log *zap.Logger) ServiceMiddleware {
@@ -22,12 +25,12 @@ type loggingMiddleware struct {
 	next Service
 }
 
-func (mw *loggingMiddleware) CreateChat(model string, prompt string, rawOpts json.RawMessage) (chat.ChatID, error) {
+func (mw *loggingMiddleware) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (chat.ChatID, error) {
 	log := mw.log.With(
 		zap.String("action", "create_chat"),
 	)
 
-	id, err := mw.next.CreateChat(model, prompt, rawOpts)
+	id, err := mw.next.CreateChat(ctx, model, prompt, rawOpts, access)
 	if err != nil {
 		log.Error(err.Error())
 		return chat.ChatID{}, err
@@ -37,13 +40,13 @@ func (mw *loggingMiddleware) CreateChat(model string, prompt string, rawOpts jso
 	return id, nil
 }
 
-func (mw *loggingMiddleware) UpdateChat(model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
+func (mw *loggingMiddleware) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
 	log := mw.log.With(
 		zap.String("action", "update_chat"),
 		zap.String("chat_id", id.String()),
 	)
 
-	err := mw.next.UpdateChat(model, prompt, rawOpts, id)
+	err := mw.next.UpdateChat(ctx, model, prompt, rawOpts, id)
 	if err != nil {
 		log.Error(err.Error())
 		return err
@@ -53,14 +56,14 @@ func (mw *loggingMiddleware) UpdateChat(model string, prompt string, rawOpts jso
 	return nil
 }
 
-func (mw *loggingMiddleware) Chat(content string, id chat.ChatID) (string, error) {
+func (mw *loggingMiddleware) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
 	log := mw.log.With(
 		zap.String("action", "chat"),
 		zap.String("chat_id", id.String()),
 		zap.String("ask", content),
 	)
 
-	answer, err := mw.next.Chat(content, id)
+	answer, err := mw.next.Chat(ctx, content, id)
 	if err != nil {
 		log.Error(err.Error())
 		return "", err
@@ -69,14 +72,14 @@ func (mw *loggingMiddleware) Chat(content string, id chat.ChatID) (string, error
 	return answer, nil
 }
 
-func (mw *loggingMiddleware) ChatStream(content string, id chat.ChatID) (<-chan string, error) {
+func (mw *loggingMiddleware) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
 	log := mw.log.With(
 		zap.String("action", "chat_stream"),
 		zap.String("chat_id", id.String()),
 		zap.String("ask", content),
 	)
 
-	stream, err := mw.next.ChatStream(content, id)
+	stream, err := mw.next.ChatStream(ctx, content, id)
 	if err != nil {
 		log.Error(err.Error())
 		return nil, err
@@ -85,3 +88,264 @@ func (mw *loggingMiddleware) ChatStream(content string, id chat.ChatID) (<-chan
 	log.Info("get stream")
 	return stream, nil
 }
+
+func (mw *loggingMiddleware) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	log := mw.log.With(
+		zap.String("action", "regenerate_stream"),
+		zap.String("chat_id", id.String()),
+	)
+
+	stream, err := mw.next.RegenerateStream(ctx, id)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("get stream")
+	return stream, nil
+}
+
+func (mw *loggingMiddleware) CancelChat(ctx context.Context, id chat.ChatID) error {
+	log := mw.log.With(
+		zap.String("action", "cancel_chat"),
+		zap.String("chat_id", id.String()),
+	)
+
+	err := mw.next.CancelChat(ctx, id)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+
+	log.Info("done")
+	return nil
+}
+
+func (mw *loggingMiddleware) ListChats(ctx context.Context, query *chat.Query) (*chat.Page, error) {
+	log := mw.log.With(
+		zap.String("action", "list_chats"),
+	)
+
+	page, err := mw.next.ListChats(ctx, query)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done", zap.Int("count", len(page.Chats)))
+	return page, nil
+}
+
+func (mw *loggingMiddleware) FindChat(ctx context.Context, id chat.ChatID) (*chat.Chat, error) {
+	log := mw.log.With(
+		zap.String("action", "find_chat"),
+		zap.String("chat_id", id.String()),
+	)
+
+	c, err := mw.next.FindChat(ctx, id)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done")
+	return c, nil
+}
+
+func (mw *loggingMiddleware) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (*chat.MessagePage, error) {
+	log := mw.log.With(
+		zap.String("action", "list_messages"),
+		zap.String("chat_id", id.String()),
+		zap.Int("cursor", cursor),
+	)
+
+	page, err := mw.next.ListMessages(ctx, id, cursor, limit)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done", zap.Int("count", len(page.Messages)))
+	return page, nil
+}
+
+func (mw *loggingMiddleware) DeleteChat(ctx context.Context, id chat.ChatID) error {
+	log := mw.log.With(
+		zap.String("action", "delete_chat"),
+		zap.String("chat_id", id.String()),
+	)
+
+	err := mw.next.DeleteChat(ctx, id)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+
+	log.Info("done")
+	return nil
+}
+
+func (mw *loggingMiddleware) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) ([]byte, error) {
+	log := mw.log.With(
+		zap.String("action", "export_chat"),
+		zap.String("chat_id", id.String()),
+		zap.String("format", string(format)),
+	)
+
+	data, err := mw.next.ExportChat(ctx, id, format)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done", zap.Int("size", len(data)))
+	return data, nil
+}
+
+func (mw *loggingMiddleware) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) ([]byte, error) {
+	log := mw.log.With(
+		zap.String("action", "export_chats"),
+		zap.String("format", string(format)),
+	)
+
+	data, err := mw.next.ExportChats(ctx, query, format)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done", zap.Int("size", len(data)))
+	return data, nil
+}
+
+func (mw *loggingMiddleware) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) ([]chat.ChatID, error) {
+	log := mw.log.With(
+		zap.String("action", "import_chats"),
+		zap.String("format", string(format)),
+		zap.Int("size", len(data)),
+	)
+
+	ids, err := mw.next.ImportChats(ctx, data, format, model, access)
+	if err != nil {
+		log.Error(err.Error(), zap.Int("imported", len(ids)))
+		return ids, err
+	}
+
+	log.Info("done", zap.Int("imported", len(ids)))
+	return ids, nil
+}
+
+func (mw *loggingMiddleware) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) error {
+	log := mw.log.With(
+		zap.String("action", "annotate_chat"),
+		zap.String("chat_id", id.String()),
+	)
+
+	err := mw.next.AnnotateChat(ctx, annotation, id)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+
+	log.Info("done")
+	return nil
+}
+
+func (mw *loggingMiddleware) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) error {
+	log := mw.log.With(
+		zap.String("action", "share_chat"),
+		zap.String("chat_id", id.String()),
+		zap.String("subject", subject),
+		zap.String("role", string(role)),
+	)
+
+	err := mw.next.ShareChat(ctx, subject, role, id)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+
+	log.Info("done")
+	return nil
+}
+
+func (mw *loggingMiddleware) BuildDataset(ctx context.Context, spec *dataset.Spec) (*dataset.Dataset, error) {
+	log := mw.log.With(
+		zap.String("action", "build_dataset"),
+	)
+
+	ds, err := mw.next.BuildDataset(ctx, spec)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done",
+		zap.Int("train", ds.Stats.Train),
+		zap.Int("validation", ds.Stats.Validation),
+		zap.Int("train_tokens", ds.Stats.TrainTokens),
+	)
+	return ds, nil
+}
+
+func (mw *loggingMiddleware) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error) {
+	log := mw.log.With(
+		zap.String("action", "create_completion"),
+		zap.String("model", completionModel(body)),
+	)
+
+	if id != (chat.ChatID{}) {
+		log = log.With(zap.String("chat_id", id.String()))
+	}
+
+	data, err := mw.next.CreateCompletion(ctx, body, id)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("done")
+	return data, nil
+}
+
+func (mw *loggingMiddleware) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	log := mw.log.With(
+		zap.String("action", "create_completion_stream"),
+		zap.String("model", completionModel(body)),
+	)
+
+	if id != (chat.ChatID{}) {
+		log = log.With(zap.String("chat_id", id.String()))
+	}
+
+	events, err := mw.next.CreateCompletionStream(ctx, body, id)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (mw *loggingMiddleware) ListModels(ctx context.Context) (json.RawMessage, error) {
+	log := mw.log.With(
+		zap.String("action", "list_models"),
+	)
+
+	data, err := mw.next.ListModels(ctx)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func completionModel(body json.RawMessage) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+
+	json.Unmarshal(body, &req)
+	return req.Model
+}
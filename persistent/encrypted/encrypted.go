@@ -0,0 +1,331 @@
+package encrypted
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/mirror520/openai/chat"
+)
+
+// TenantFunc returns the tenant whose data key encrypts the chat.
+type TenantFunc func(c *chat.Chat) string
+
+const DefaultTenant = "default"
+
+// ChatTenant gives every tenant of chat.Access its own data key.
+func ChatTenant(c *chat.Chat) string {
+	if c.Tenant == "" {
+		return DefaultTenant
+	}
+
+	return c.Tenant
+}
+
+const (
+	prefix   = "enc:v2:"
+	prefixV1 = "enc:v1:" // the data key itself, bound to the chat and field only; still read
+)
+
+// NewChatRepository encrypts message contents and the free-text options
+// (user and stop sequences) before they reach the next repository.
+// Sampling parameters are stored in clear.
+//
+// Values are sealed with AES-GCM under a subkey of the tenant's data key,
+// bound to the chat, the field and, for messages, their index and role.
+// The nonce is derived from the plaintext with another subkey, so an
+// unchanged value keeps its ciphertext and append-only backends see no
+// rewrite, while equal values elsewhere in the chat cannot be linked.
+// Values stored before encryption was enabled are read as they are.
+func NewChatRepository(next chat.Repository, keyring *Keyring, tenant TenantFunc) chat.Repository {
+	if tenant == nil {
+		tenant = func(*chat.Chat) string { return DefaultTenant }
+	}
+
+	return &chatRepository{next, keyring, tenant}
+}
+
+type chatRepository struct {
+	next    chat.Repository
+	keyring *Keyring
+	tenant  TenantFunc
+}
+
+func (repo *chatRepository) Store(c *chat.Chat) error {
+	return repo.store(c, repo.next.Store)
+}
+
+func (repo *chatRepository) ReplaceLastMessage(c *chat.Chat) error {
+	return repo.store(c, repo.next.ReplaceLastMessage)
+}
+
+func (repo *chatRepository) store(c *chat.Chat, store func(*chat.Chat) error) error {
+	key, err := repo.keyring.current(repo.tenant(c))
+	if err != nil {
+		return err
+	}
+
+	sealed, err := encryptChat(key, c)
+	if err != nil {
+		return err
+	}
+
+	if err := store(sealed); err != nil {
+		return err
+	}
+
+	c.Version = sealed.Version
+	return nil
+}
+
+func (repo *chatRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	c, err := repo.next.Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.decryptChat(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (repo *chatRepository) List(q *chat.Query) ([]*chat.Chat, error) {
+	// the user and the messages are encrypted, filter after decryption
+	if q.User != "" || q.Text != "" {
+		unfiltered := *q
+		unfiltered.User = ""
+		unfiltered.Text = ""
+		unfiltered.Limit = 0
+
+		chats, err := repo.list(&unfiltered)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]*chat.Chat, 0)
+		for _, c := range chats {
+			if !q.Match(c) {
+				continue
+			}
+
+			result = append(result, c)
+			if q.Limit > 0 && len(result) >= q.Limit {
+				break
+			}
+		}
+
+		return result, nil
+	}
+
+	return repo.list(q)
+}
+
+func (repo *chatRepository) list(q *chat.Query) ([]*chat.Chat, error) {
+	chats, err := repo.next.List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range chats {
+		if err := repo.decryptChat(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return chats, nil
+}
+
+func (repo *chatRepository) Delete(id chat.ChatID) error {
+	return repo.next.Delete(id)
+}
+
+func (repo *chatRepository) Count() (int, error) {
+	if counter, ok := repo.next.(chat.Counter); ok {
+		return counter.Count()
+	}
+
+	chats, err := repo.next.List(&chat.Query{})
+	return len(chats), err
+}
+
+func (repo *chatRepository) Ping() error {
+	if pinger, ok := repo.next.(chat.Pinger); ok {
+		return pinger.Ping()
+	}
+
+	return nil
+}
+
+func (repo *chatRepository) Close() error {
+	return repo.next.Close()
+}
+
+func encryptChat(key *dataKey, c *chat.Chat) (*chat.Chat, error) {
+	sealed := c.Clone()
+
+	for i, msg := range sealed.Messages {
+		ct, err := encrypt(key, additionalData(c.ID, messageField(i, msg)...), msg.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Content = ct
+	}
+
+	if opts := sealed.Options; opts != nil {
+		if opts.User != nil {
+			ct, err := encrypt(key, additionalData(c.ID, "user"), *opts.User)
+			if err != nil {
+				return nil, err
+			}
+
+			opts.User = &ct
+		}
+
+		for i, stop := range opts.Stop {
+			ct, err := encrypt(key, additionalData(c.ID, "stop", strconv.Itoa(i)), stop)
+			if err != nil {
+				return nil, err
+			}
+
+			opts.Stop[i] = ct
+		}
+	}
+
+	return sealed, nil
+}
+
+func (repo *chatRepository) decryptChat(c *chat.Chat) error {
+	for i, msg := range c.Messages {
+		pt, err := repo.decrypt(c.ID, messageField(i, msg), msg.Content)
+		if err != nil {
+			return err
+		}
+
+		msg.Content = pt
+	}
+
+	if opts := c.Options; opts != nil {
+		if opts.User != nil {
+			pt, err := repo.decrypt(c.ID, []string{"user"}, *opts.User)
+			if err != nil {
+				return err
+			}
+
+			opts.User = &pt
+		}
+
+		for i, stop := range opts.Stop {
+			pt, err := repo.decrypt(c.ID, []string{"stop", strconv.Itoa(i)}, stop)
+			if err != nil {
+				return err
+			}
+
+			opts.Stop[i] = pt
+		}
+	}
+
+	return nil
+}
+
+// subkeys derives the keys sealing the values and their nonces from the
+// data key, never used as it is.
+func subkeys(key *dataKey) (sealing []byte, nonce []byte, err error) {
+	sealing, nonce = make([]byte, 32), make([]byte, 32)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.plain, nil, []byte(prefix+"seal")), sealing); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.plain, nil, []byte(prefix+"nonce")), nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return sealing, nonce, nil
+}
+
+// encrypt returns "enc:v2:<key id>:<base64 nonce and ciphertext>".
+func encrypt(key *dataKey, aad []byte, plaintext string) (string, error) {
+	sealing, nonceKey, err := subkeys(key)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(sealing)
+	if err != nil {
+		return "", err
+	}
+
+	// synthetic nonce, unique per distinct plaintext and place
+	mac := hmac.New(sha256.New, nonceKey)
+	binary.Write(mac, binary.BigEndian, uint64(len(aad)))
+	mac.Write(aad)
+	mac.Write([]byte(plaintext))
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), aad)
+	return prefix + key.ID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens the value of the field of the chat, as encrypt seals it
+// or as it was sealed before, with the first part of the field only.
+func (repo *chatRepository) decrypt(id chat.ChatID, field []string, value string) (string, error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(value, prefix):
+		rest = value[len(prefix):]
+	case strings.HasPrefix(value, prefixV1):
+		rest = value[len(prefixV1):]
+	default:
+		return value, nil // stored in clear
+	}
+
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return "", errors.New("malformed ciphertext")
+	}
+
+	key, err := repo.keyring.key(rest[:i])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(rest[i+1:])
+	if err != nil {
+		return "", err
+	}
+
+	sealing, aad := key.plain, additionalData(id, field[0])
+	if strings.HasPrefix(value, prefix) {
+		if sealing, _, err = subkeys(key); err != nil {
+			return "", err
+		}
+
+		aad = additionalData(id, field...)
+	}
+
+	plaintext, err := open(sealing, sealed, aad)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// messageField places the message in the chat.
+func messageField(i int, msg *chat.Message) []string {
+	return []string{"message", strconv.Itoa(i), string(msg.Role)}
+}
+
+func additionalData(id chat.ChatID, field ...string) []byte {
+	return []byte(id.String() + "/" + strings.Join(field, "/"))
+}
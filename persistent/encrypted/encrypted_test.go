@@ -0,0 +1,238 @@
+package encrypted
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/repositorytest"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func newMasterKey(id string) *MasterKey {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &MasterKey{id, key}
+}
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	master := newMasterKey("m1")
+
+	keyring, err := OpenKeyring(path, master)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	inner := inmem.NewChatRepository()
+	repo := NewChatRepository(inner, keyring, nil)
+
+	user := "alice"
+	c := chat.NewChat("gpt-3.5-turbo", "secret prompt", &chat.Options{User: &user, Stop: []string{"END"}})
+	assert.NoError(repo.Store(c))
+
+	raw, _ := inner.Find(c.ID)
+	assert.True(strings.HasPrefix(raw.Messages[0].Content, prefix))
+	assert.NotContains(*raw.User, "alice")
+	assert.NotContains(raw.Stop[0], "END")
+
+	// unchanged values keep their ciphertext
+	found, _ := repo.Find(c.ID)
+	assert.NoError(repo.Store(found))
+
+	again, _ := inner.Find(c.ID)
+	assert.Equal(raw.Messages[0].Content, again.Messages[0].Content)
+
+	// a new master key rewraps the data keys, the data is left as it is
+	keyring, err = OpenKeyring(path, newMasterKey("m2"), master)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	n, err := keyring.Rewrap()
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	keyring, err = OpenKeyring(path, newMasterKey("m3"))
+	assert.NoError(err)
+	_, err = NewChatRepository(inner, keyring, nil).Find(c.ID)
+	assert.Error(err) // wrong master key
+}
+
+func TestMessagePlaces(t *testing.T) {
+	assert := assert.New(t)
+
+	keyring, err := OpenKeyring(filepath.Join(t.TempDir(), "keyring.json"), newMasterKey("m1"))
+	assert.NoError(err)
+
+	inner := inmem.NewChatRepository()
+	repo := NewChatRepository(inner, keyring, nil)
+
+	c := chat.NewChat("gpt-4", "prompt", nil)
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "yes"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "no"})
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "yes"})
+	assert.NoError(repo.Store(c))
+
+	// equal messages cannot be linked
+	raw, _ := inner.Find(c.ID)
+	assert.NotEqual(raw.Messages[1].Content, raw.Messages[3].Content)
+
+	// each tampering starts from the stored chat
+	tamper := func(f func(raw *chat.Chat)) error {
+		raw := raw.Clone()
+		f(raw)
+		raw.Version = 0
+		inner.Delete(c.ID)
+		assert.NoError(inner.Store(raw))
+
+		_, err := repo.Find(c.ID)
+		return err
+	}
+
+	// messages can be neither reordered, duplicated nor given another role
+	assert.Error(tamper(func(raw *chat.Chat) {
+		raw.Messages[1], raw.Messages[2] = raw.Messages[2], raw.Messages[1]
+	}))
+
+	assert.Error(tamper(func(raw *chat.Chat) {
+		raw.Messages[3].Content = raw.Messages[1].Content
+	}))
+
+	assert.Error(tamper(func(raw *chat.Chat) {
+		raw.Messages[2].Role = chat.User
+	}))
+
+	// values sealed by the first version are still read
+	key, err := keyring.current(DefaultTenant)
+	assert.NoError(err)
+
+	sealed, err := seal(key.plain, []byte("legacy"), additionalData(c.ID, "message"))
+	assert.NoError(err)
+
+	assert.NoError(tamper(func(raw *chat.Chat) {
+		raw.Messages = raw.Messages[:1]
+		raw.Messages[0].Content = prefixV1 + key.ID + ":" + base64.StdEncoding.EncodeToString(sealed)
+	}))
+
+	found, err := repo.Find(c.ID)
+	assert.NoError(err)
+	assert.Equal("legacy", found.Messages[0].Content)
+}
+
+func TestRewrap(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	m1, m2 := newMasterKey("m1"), newMasterKey("m2")
+
+	keyring, _ := OpenKeyring(path, m1)
+	inner := inmem.NewChatRepository()
+
+	c := chat.NewChat("gpt-3.5-turbo", "secret prompt", nil)
+	assert.NoError(NewChatRepository(inner, keyring, nil).Store(c))
+
+	keyring, _ = OpenKeyring(path, m2, m1)
+	_, err := keyring.Rewrap()
+	assert.NoError(err)
+
+	// m1 retired
+	keyring, _ = OpenKeyring(path, m2)
+
+	found, err := NewChatRepository(inner, keyring, nil).Find(c.ID)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Equal("secret prompt", found.Messages[0].Content)
+
+	// a rotated data key encrypts new writes, old data stays readable
+	assert.NoError(keyring.RotateDataKey(DefaultTenant))
+
+	repo := NewChatRepository(inner, keyring, nil)
+	found.AddMessage(&chat.Message{Role: chat.User, Content: "hello"})
+	assert.NoError(repo.Store(found))
+
+	found, err = repo.Find(c.ID)
+	assert.NoError(err)
+	assert.Equal("secret prompt", found.Messages[0].Content)
+	assert.Equal("hello", found.Messages[1].Content)
+}
+
+func TestSharedKeyring(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	m1, m2 := newMasterKey("m1"), newMasterKey("m2")
+
+	// two instances of a shared repository
+	kr1, _ := OpenKeyring(path, m1)
+	kr2, _ := OpenKeyring(path, m1)
+
+	inner := inmem.NewChatRepository()
+	repo1 := NewChatRepository(inner, kr1, ChatTenant)
+	repo2 := NewChatRepository(inner, kr2, ChatTenant)
+
+	acme := chat.NewChat("gpt-4", "acme prompt", nil)
+	acme.Tenant = "acme"
+	assert.NoError(repo1.Store(acme))
+
+	umbrella := chat.NewChat("gpt-4", "umbrella prompt", nil)
+	umbrella.Tenant = "umbrella"
+	assert.NoError(repo2.Store(umbrella))
+
+	// neither key is lost, and each instance reads the chats of the other
+	found, err := repo2.Find(acme.ID)
+	assert.NoError(err)
+	assert.Equal("acme prompt", found.Messages[0].Content)
+
+	reopened, _ := OpenKeyring(path, m1)
+	for _, c := range []*chat.Chat{acme, umbrella} {
+		_, err := NewChatRepository(inner, reopened, ChatTenant).Find(c.ID)
+		assert.NoError(err)
+	}
+
+	// a tenant keeps the data key started by another instance
+	again := chat.NewChat("gpt-4", "acme again", nil)
+	again.Tenant = "acme"
+	assert.NoError(repo2.Store(again))
+
+	raw1, _ := inner.Find(acme.ID)
+	raw2, _ := inner.Find(again.ID)
+	assert.Equal(strings.Split(raw1.Messages[0].Content, ":")[2], strings.Split(raw2.Messages[0].Content, ":")[2])
+
+	// a rewrap by the keys command is not undone by a running instance
+	cli, _ := OpenKeyring(path, m2, m1)
+	n, err := cli.Rewrap()
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	assert.NoError(kr1.RotateDataKey("umbrella"))
+
+	retired, _ := OpenKeyring(path, m2)
+	for _, c := range []*chat.Chat{acme, umbrella, again} {
+		_, err := NewChatRepository(inner, retired, ChatTenant).Find(c.ID)
+		assert.NoError(err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) chat.Repository {
+		keyring, err := OpenKeyring(filepath.Join(t.TempDir(), "keyring.json"), newMasterKey("m1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return NewChatRepository(inmem.NewChatRepository(), keyring, nil)
+	})
+}
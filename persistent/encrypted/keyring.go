@@ -0,0 +1,376 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MasterKey wraps the data keys, it is never stored next to them.
+type MasterKey struct {
+	ID  string
+	Key []byte // 32 bytes, AES-256
+}
+
+// ParseMasterKey decodes a base64 encoded 32 byte key.
+func ParseMasterKey(id string, encoded string) (*MasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+
+	return &MasterKey{id, key}, nil
+}
+
+// ReadMasterKey reads a base64 encoded key from a file.
+func ReadMasterKey(id string, path string) (*MasterKey, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMasterKey(id, string(bs))
+}
+
+type dataKey struct {
+	ID       string    `json:"id"`
+	Tenant   string    `json:"tenant"`
+	MasterID string    `json:"master_id"`
+	Wrapped  []byte    `json:"wrapped"`
+	Created  time.Time `json:"created"`
+
+	plain []byte
+}
+
+type keyringFile struct {
+	Keys   []*dataKey        `json:"keys"`
+	Active map[string]string `json:"active"` // tenant to key ID
+}
+
+// Keyring holds the per-tenant data keys, wrapped by master keys,
+// in a JSON file. The processes sharing the file, the instances of a
+// shared repository as well as the keys command, take a file lock and
+// merge the file before every save, so none undoes the changes of another.
+type Keyring struct {
+	path    string
+	masters map[string]*MasterKey
+	primary *MasterKey
+
+	keys   map[string]*dataKey
+	active map[string]string
+
+	sync.Mutex
+}
+
+// OpenKeyring loads the keyring at path, creating it on first use.
+// New data keys are wrapped by the first master key, the others are only
+// used to unwrap keys not yet rewrapped.
+func OpenKeyring(path string, masters ...*MasterKey) (*Keyring, error) {
+	if len(masters) == 0 {
+		return nil, errors.New("no master key")
+	}
+
+	kr := &Keyring{
+		path:    path,
+		masters: make(map[string]*MasterKey),
+		primary: masters[0],
+		keys:    make(map[string]*dataKey),
+		active:  make(map[string]string),
+	}
+
+	for _, master := range masters {
+		if len(master.Key) != 32 {
+			return nil, errors.New("master key must be 32 bytes: " + master.ID)
+		}
+
+		kr.masters[master.ID] = master
+	}
+
+	if err := kr.reload(); err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// reload merges the file into the keyring, the file having the last word
+// as other processes may have changed it. Unwrapped keys stay unwrapped.
+func (kr *Keyring) reload() error {
+	bs, err := os.ReadFile(kr.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var f keyringFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return err
+	}
+
+	for _, key := range f.Keys {
+		if known, ok := kr.keys[key.ID]; ok {
+			key.plain = known.plain
+		}
+
+		kr.keys[key.ID] = key
+	}
+
+	for tenant, id := range f.Active {
+		kr.active[tenant] = id
+	}
+
+	return nil
+}
+
+// current returns the active data key of the tenant, creating one if needed.
+func (kr *Keyring) current(tenant string) (*dataKey, error) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	if id, ok := kr.active[tenant]; ok {
+		return kr.unwrap(id)
+	}
+
+	return kr.generate(tenant, true)
+}
+
+// key returns the data key with the given ID.
+func (kr *Keyring) key(id string) (*dataKey, error) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	return kr.unwrap(id)
+}
+
+func (kr *Keyring) unwrap(id string) (*dataKey, error) {
+	key, ok := kr.keys[id]
+	if !ok {
+		// created by another process since
+		if err := kr.reload(); err != nil {
+			return nil, err
+		}
+
+		if key, ok = kr.keys[id]; !ok {
+			return nil, errors.New("unknown data key: " + id)
+		}
+	}
+
+	if key.plain != nil {
+		return key, nil
+	}
+
+	master, ok := kr.masters[key.MasterID]
+	if !ok {
+		return nil, errors.New("unknown master key: " + key.MasterID)
+	}
+
+	plain, err := open(master.Key, key.Wrapped, []byte(key.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	key.plain = plain
+	return key, nil
+}
+
+// generate starts a new data key for the tenant, unless reuse and another
+// process started one meanwhile.
+func (kr *Keyring) generate(tenant string, reuse bool) (*dataKey, error) {
+	unlock, err := lockFile(kr.path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := kr.reload(); err != nil {
+		return nil, err
+	}
+
+	previous, rotated := kr.active[tenant]
+	if rotated && reuse {
+		return kr.unwrap(previous)
+	}
+
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, err
+	}
+
+	key := &dataKey{
+		ID:       tenant + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		Tenant:   tenant,
+		MasterID: kr.primary.ID,
+		Created:  time.Now(),
+		plain:    plain,
+	}
+
+	wrapped, err := seal(kr.primary.Key, plain, []byte(key.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	key.Wrapped = wrapped
+
+	kr.keys[key.ID] = key
+	kr.active[tenant] = key.ID
+
+	if err := kr.save(); err != nil {
+		delete(kr.keys, key.ID)
+		if rotated {
+			kr.active[tenant] = previous
+		} else {
+			delete(kr.active, tenant)
+		}
+
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// RotateDataKey starts a new data key for the tenant. Later writes use it,
+// data written before stays readable with the previous keys.
+func (kr *Keyring) RotateDataKey(tenant string) error {
+	kr.Lock()
+	defer kr.Unlock()
+
+	_, err := kr.generate(tenant, false)
+	return err
+}
+
+// Rewrap wraps every data key with the primary master key,
+// so older master keys can be retired. Stored data is not touched.
+func (kr *Keyring) Rewrap() (int, error) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	unlock, err := lockFile(kr.path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if err := kr.reload(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for id, key := range kr.keys {
+		if key.MasterID == kr.primary.ID {
+			continue
+		}
+
+		if _, err := kr.unwrap(id); err != nil {
+			return n, err
+		}
+
+		wrapped, err := seal(kr.primary.Key, key.plain, []byte(key.ID))
+		if err != nil {
+			return n, err
+		}
+
+		key.Wrapped = wrapped
+		key.MasterID = kr.primary.ID
+		n++
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, kr.save()
+}
+
+// save writes the keyring atomically, holding the file lock.
+func (kr *Keyring) save() error {
+	f := keyringFile{
+		Keys:   make([]*dataKey, 0, len(kr.keys)),
+		Active: kr.active,
+	}
+
+	for _, key := range kr.keys {
+		f.Keys = append(f.Keys, key)
+	}
+
+	bs, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(kr.path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), kr.path)
+}
+
+func seal(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key []byte, sealed []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,34 @@
+//go:build !unix
+
+package encrypted
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFile creates the file as a lock, waiting for it to be removed by
+// another process for up to ten seconds. A lock left by a process that
+// died has to be removed by hand.
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("keyring locked: " + path)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,284 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type EventType string
+
+const (
+	ChatCreated       EventType = "chat_created"
+	ChatUpdated       EventType = "chat_updated" // model or options
+	AnnotationUpdated EventType = "annotation_updated"
+	AccessUpdated     EventType = "access_updated" // tenant, owner or members
+	MessageAppended   EventType = "message_appended"
+	MessageReplaced   EventType = "message_replaced" // the last one, e.g. regenerated
+	ChatDeleted       EventType = "chat_deleted"
+)
+
+type Event struct {
+	Seq     uint64          `json:"seq"`
+	Version uint64          `json:"version,omitempty"` // of the chat after the store
+	Type    EventType       `json:"type"`
+	ChatID  chat.ChatID     `json:"chat_id"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type chatCreated struct {
+	Model      string          `json:"model"`
+	Options    *chat.Options   `json:"options,omitempty"`
+	Annotation chat.Annotation `json:"annotation"`
+	Access     chat.Access     `json:"access"`
+}
+
+type chatUpdated struct {
+	Model   string        `json:"model"`
+	Options *chat.Options `json:"options,omitempty"`
+}
+
+func newEvent(typ EventType, id chat.ChatID, data any) (*Event, error) {
+	e := &Event{
+		Type:   typ,
+		ChatID: id,
+	}
+
+	if data != nil {
+		bs, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Data = bs
+	}
+
+	return e, nil
+}
+
+// diff derives the events turning the old state of a chat into the new one,
+// old is nil for a chat not stored yet.
+func diff(old *chat.Chat, c *chat.Chat) ([]*Event, error) {
+	events := make([]*Event, 0)
+
+	var stored int
+	if old == nil {
+		e, err := newEvent(ChatCreated, c.ID, &chatCreated{
+			Model:      c.Model,
+			Options:    c.Options,
+			Annotation: c.Annotation,
+			Access:     c.Access,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+
+	} else {
+		if len(c.Messages) < len(old.Messages) {
+			return nil, errors.New("messages are append-only")
+		}
+
+		stored = len(old.Messages)
+
+		changed, err := optionsChanged(old, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed || old.Model != c.Model {
+			e, err := newEvent(ChatUpdated, c.ID, &chatUpdated{
+				Model:   c.Model,
+				Options: c.Options,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, e)
+		}
+
+		changed, err = jsonChanged(old.Annotation, c.Annotation)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			e, err := newEvent(AnnotationUpdated, c.ID, c.Annotation)
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, e)
+		}
+
+		changed, err = jsonChanged(old.Access, c.Access)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			e, err := newEvent(AccessUpdated, c.ID, c.Access)
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, e)
+		}
+	}
+
+	for _, msg := range c.Messages[stored:] {
+		e, err := newEvent(MessageAppended, c.ID, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// diffReplaced is diff for a chat whose last message replaces the last one
+// stored.
+func diffReplaced(old *chat.Chat, c *chat.Chat) ([]*Event, error) {
+	if old == nil || len(c.Messages) == 0 || len(old.Messages) != len(c.Messages) {
+		return nil, chat.ErrConflict
+	}
+
+	last := len(c.Messages) - 1
+
+	// the other changes as if the last message were unchanged
+	unreplaced := *c
+	unreplaced.Messages = append(c.Messages[:last:last], old.Messages[last])
+
+	events, err := diff(old, &unreplaced)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newEvent(MessageReplaced, c.ID, c.Messages[last])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(events, e), nil
+}
+
+func optionsChanged(old *chat.Chat, c *chat.Chat) (bool, error) {
+	if (old.Options == nil) != (c.Options == nil) {
+		return true, nil
+	}
+
+	if old.Options == nil {
+		return false, nil
+	}
+
+	return jsonChanged(old.Options, c.Options)
+}
+
+func jsonChanged(a, b any) (bool, error) {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+
+	return string(x) != string(y), nil
+}
+
+// apply folds the event into the state.
+func apply(chats map[chat.ChatID]*chat.Chat, e *Event) error {
+	switch e.Type {
+	case ChatCreated:
+		var data chatCreated
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return err
+		}
+
+		chats[e.ChatID] = &chat.Chat{
+			ID:         e.ChatID,
+			Version:    e.Version,
+			Model:      data.Model,
+			Messages:   make([]*chat.Message, 0),
+			Access:     data.Access,
+			Annotation: data.Annotation,
+			Options:    data.Options,
+		}
+
+		return nil
+
+	case ChatDeleted:
+		delete(chats, e.ChatID)
+		return nil
+	}
+
+	c, ok := chats[e.ChatID]
+	if !ok {
+		return errors.New("event for unknown chat: " + e.ChatID.String())
+	}
+
+	if e.Version > 0 {
+		c.Version = e.Version
+	}
+
+	switch e.Type {
+	case ChatUpdated:
+		var data chatUpdated
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return err
+		}
+
+		c.Model = data.Model
+		c.Options = data.Options
+
+	case AnnotationUpdated:
+		var annotation chat.Annotation
+		if err := json.Unmarshal(e.Data, &annotation); err != nil {
+			return err
+		}
+
+		c.Annotation = annotation
+
+	case AccessUpdated:
+		var access chat.Access
+		if err := json.Unmarshal(e.Data, &access); err != nil {
+			return err
+		}
+
+		c.Access = access
+
+	case MessageAppended:
+		var msg *chat.Message
+		if err := json.Unmarshal(e.Data, &msg); err != nil {
+			return err
+		}
+
+		c.AddMessage(msg)
+
+	case MessageReplaced:
+		var msg *chat.Message
+		if err := json.Unmarshal(e.Data, &msg); err != nil {
+			return err
+		}
+
+		if len(c.Messages) == 0 {
+			return errors.New("no message to replace: " + e.ChatID.String())
+		}
+
+		c.Messages[len(c.Messages)-1] = msg
+
+	default:
+		return errors.New("unknown event type: " + string(e.Type))
+	}
+
+	return nil
+}
@@ -0,0 +1,687 @@
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type Options struct {
+	SegmentSize   int64 // bytes before a new segment is started, default 8 MiB
+	SnapshotEvery int   // events between snapshots, default 1000
+	KeepSnapshots int   // snapshots kept by compaction, default 2
+	Sync          bool  // fsync every write
+}
+
+const (
+	DefaultSegmentSize   = 8 << 20
+	DefaultSnapshotEvery = 1000
+	DefaultKeepSnapshots = 2
+)
+
+// ErrCompacted is returned by At for times before the oldest snapshot
+// once the segments preceding it have been compacted.
+var ErrCompacted = errors.New("history compacted")
+
+// NewChatRepository opens the event log in dir and rebuilds the state by
+// replaying it on top of the latest snapshot.
+func NewChatRepository(dir string, opts Options) (*ChatRepository, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+
+	if opts.SnapshotEvery <= 0 {
+		opts.SnapshotEvery = DefaultSnapshotEvery
+	}
+
+	if opts.KeepSnapshots <= 0 {
+		opts.KeepSnapshots = DefaultKeepSnapshots
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	repo := &ChatRepository{
+		dir:   dir,
+		opts:  opts,
+		chats: make(map[chat.ChatID]*chat.Chat),
+	}
+
+	if err := repo.recover(); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// ChatRepository is a chat.Repository recording every change as an event
+// in a segmented JSONL log.
+type ChatRepository struct {
+	dir  string
+	opts Options
+
+	chats map[chat.ChatID]*chat.Chat
+	seq   uint64    // of the last event
+	last  time.Time // of the last event
+
+	segment     *os.File
+	segmentSize int64
+	sinceSnap   int
+
+	sync.RWMutex
+}
+
+func (repo *ChatRepository) Store(c *chat.Chat) error {
+	return repo.store(c, false)
+}
+
+// ReplaceLastMessage records the new last message as MessageReplaced.
+func (repo *ChatRepository) ReplaceLastMessage(c *chat.Chat) error {
+	return repo.store(c, true)
+}
+
+func (repo *ChatRepository) store(c *chat.Chat, replace bool) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if repo.segment == nil {
+		return chat.ErrClosed
+	}
+
+	old, ok := repo.chats[c.ID]
+	if (!ok && c.Version != 0) || (ok && old.Version != c.Version) {
+		return chat.ErrConflict
+	}
+
+	var (
+		events []*Event
+		err    error
+	)
+
+	if replace {
+		events, err = diffReplaced(old, c)
+	} else {
+		events, err = diff(old, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	version := c.Version + 1
+	for _, e := range events {
+		e.Version = version
+	}
+
+	if err := repo.append(events); err != nil {
+		return err
+	}
+
+	c.Version = version
+	return nil
+}
+
+func (repo *ChatRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	if repo.segment == nil {
+		return nil, chat.ErrClosed
+	}
+
+	c, ok := repo.chats[id]
+	if !ok {
+		return nil, chat.ErrChatNotFound
+	}
+
+	return c.Clone(), nil
+}
+
+func (repo *ChatRepository) List(q *chat.Query) ([]*chat.Chat, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	if repo.segment == nil {
+		return nil, chat.ErrClosed
+	}
+
+	return list(repo.chats, q), nil
+}
+
+func (repo *ChatRepository) Count() (int, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	if repo.segment == nil {
+		return 0, chat.ErrClosed
+	}
+
+	return len(repo.chats), nil
+}
+
+func (repo *ChatRepository) Delete(id chat.ChatID) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if _, ok := repo.chats[id]; !ok {
+		return chat.ErrChatNotFound
+	}
+
+	e, err := newEvent(ChatDeleted, id, nil)
+	if err != nil {
+		return err
+	}
+
+	return repo.append([]*Event{e})
+}
+
+func (repo *ChatRepository) Close() error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if repo.segment == nil {
+		return nil
+	}
+
+	err := repo.segment.Close()
+	repo.segment = nil
+	repo.chats = make(map[chat.ChatID]*chat.Chat)
+	return err
+}
+
+// History returns every event recorded for the chat, oldest first.
+// Events of compacted segments are no longer available.
+func (repo *ChatRepository) History(id chat.ChatID) ([]*Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	events := make([]*Event, 0)
+
+	err := repo.replay(0, func(e *Event) error {
+		if e.ChatID == id {
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// At reconstructs the chats as they were at the given time.
+func (repo *ChatRepository) At(t time.Time) ([]*chat.Chat, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	chats := make(map[chat.ChatID]*chat.Chat)
+	var from uint64
+
+	snaps, err := repo.snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(snaps) - 1; i >= 0; i-- {
+		snap, err := readSnapshot(snaps[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if snap.Time.After(t) {
+			continue
+		}
+
+		for _, c := range snap.Chats {
+			chats[c.ID] = c
+		}
+
+		from = snap.Seq
+		break
+	}
+
+	segments, err := repo.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) > 0 && segments[0].first > from+1 {
+		return nil, ErrCompacted
+	}
+
+	err = repo.replay(from, func(e *Event) error {
+		if e.Time.After(t) {
+			return errStop
+		}
+		return apply(chats, e)
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+
+	return list(chats, &chat.Query{}), nil
+}
+
+var errStop = errors.New("stop")
+
+func list(chats map[chat.ChatID]*chat.Chat, q *chat.Query) []*chat.Chat {
+	result := make([]*chat.Chat, 0)
+	for _, c := range chats {
+		if q.Match(c) {
+			result = append(result, c.Clone())
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID.Compare(result[j].ID) < 0
+	})
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+
+	return result
+}
+
+// append writes the events to the log and applies them to the state.
+func (repo *ChatRepository) append(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if repo.segment == nil {
+		return chat.ErrClosed
+	}
+
+	now := time.Now()
+
+	seq := repo.seq
+	for _, e := range events {
+		seq++
+		e.Seq = seq
+		e.Time = now
+	}
+
+	// the events of a store share one line, so a crash mid-write
+	// leaves an unterminated line that recover drops as a whole
+	var record any = events
+	if len(events) == 1 {
+		record = events[0]
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+
+	n, err := repo.segment.Write(buf.Bytes())
+	repo.segmentSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if repo.opts.Sync {
+		if err := repo.segment.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range events {
+		if err := apply(repo.chats, e); err != nil {
+			return err
+		}
+	}
+
+	repo.seq = seq
+	repo.last = now
+	repo.sinceSnap += len(events)
+
+	if repo.sinceSnap >= repo.opts.SnapshotEvery {
+		return repo.snapshot()
+	}
+
+	if repo.segmentSize >= repo.opts.SegmentSize {
+		return repo.rotate()
+	}
+
+	return nil
+}
+
+type segment struct {
+	path  string
+	first uint64 // seq of the first event
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("segment-%016d.jsonl", first)
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("snapshot-%016d.json", seq)
+}
+
+func (repo *ChatRepository) segments() ([]*segment, error) {
+	paths, err := filepath.Glob(filepath.Join(repo.dir, "segment-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+
+	segments := make([]*segment, 0, len(paths))
+	for _, path := range paths {
+		var first uint64
+		name := filepath.Base(path)
+		if _, err := fmt.Sscanf(name, "segment-%016d.jsonl", &first); err != nil {
+			return nil, fmt.Errorf("invalid segment %s: %w", name, err)
+		}
+
+		segments = append(segments, &segment{path, first})
+	}
+
+	return segments, nil
+}
+
+func (repo *ChatRepository) snapshots() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(repo.dir, "snapshot-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// replay calls fn for every logged event after the given seq.
+func (repo *ChatRepository) replay(after uint64, fn func(*Event) error) error {
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].first <= after+1 {
+			continue // fully covered
+		}
+
+		if _, err := readSegment(seg.path, func(e *Event) error {
+			if e.Seq <= after {
+				return nil
+			}
+			return fn(e)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSegment returns the offset after the last complete line,
+// which holds a single event or the batch of one store.
+func readSegment(path string, fn func(*Event) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// an unterminated line is a torn write
+			return offset, nil
+		}
+
+		if err != nil {
+			return offset, err
+		}
+
+		var events []*Event
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(line, &events)
+		} else {
+			var e *Event
+			err = json.Unmarshal(line, &e)
+			events = []*Event{e}
+		}
+		if err != nil {
+			return offset, fmt.Errorf("%s at offset %d: %w", filepath.Base(path), offset, err)
+		}
+
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return offset, err
+			}
+		}
+
+		offset += int64(len(line))
+	}
+}
+
+type snapshot struct {
+	Seq   uint64       `json:"seq"`
+	Time  time.Time    `json:"time"` // of the last event included
+	Chats []*chat.Chat `json:"chats"`
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snap *snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func (repo *ChatRepository) recover() error {
+	snaps, err := repo.snapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(snaps) > 0 {
+		snap, err := readSnapshot(snaps[len(snaps)-1])
+		if err != nil {
+			return err
+		}
+
+		for _, c := range snap.Chats {
+			repo.chats[c.ID] = c
+		}
+
+		repo.seq = snap.Seq
+		repo.last = snap.Time
+	}
+
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].first <= repo.seq+1 {
+			continue
+		}
+
+		offset, err := readSegment(seg.path, func(e *Event) error {
+			if e.Seq <= repo.seq {
+				return nil
+			}
+
+			if e.Seq != repo.seq+1 {
+				return fmt.Errorf("missing events %d to %d", repo.seq+1, e.Seq-1)
+			}
+
+			if err := apply(repo.chats, e); err != nil {
+				return err
+			}
+
+			repo.seq = e.Seq
+			repo.last = e.Time
+			repo.sinceSnap++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// drop a torn write at the tail of the last segment
+		if i == len(segments)-1 {
+			if err := os.Truncate(seg.path, offset); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(segments) == 0 {
+		return repo.rotate()
+	}
+
+	last := segments[len(segments)-1]
+
+	f, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	repo.segment = f
+	repo.segmentSize = info.Size()
+	return nil
+}
+
+// rotate starts a new segment with the next event.
+func (repo *ChatRepository) rotate() error {
+	path := filepath.Join(repo.dir, segmentName(repo.seq+1))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if repo.segment != nil {
+		repo.segment.Close()
+	}
+
+	repo.segment = f
+	repo.segmentSize = 0
+	return nil
+}
+
+// snapshot writes the current state, starts a new segment and compacts.
+func (repo *ChatRepository) snapshot() error {
+	snap := &snapshot{
+		Seq:   repo.seq,
+		Time:  repo.last,
+		Chats: list(repo.chats, &chat.Query{}),
+	}
+
+	path := filepath.Join(repo.dir, snapshotName(snap.Seq))
+
+	tmp, err := os.CreateTemp(repo.dir, "snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	repo.sinceSnap = 0
+
+	if err := repo.rotate(); err != nil {
+		return err
+	}
+
+	return repo.compact()
+}
+
+// compact removes all but the latest snapshots
+// and the segments preceding the oldest snapshot kept.
+func (repo *ChatRepository) compact() error {
+	snaps, err := repo.snapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(snaps) <= repo.opts.KeepSnapshots {
+		return nil
+	}
+
+	for _, path := range snaps[:len(snaps)-repo.opts.KeepSnapshots] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	oldest := snaps[len(snaps)-repo.opts.KeepSnapshots]
+
+	var seq uint64
+	if _, err := fmt.Sscanf(filepath.Base(oldest), "snapshot-%016d.json", &seq); err != nil {
+		return err
+	}
+
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if i+1 >= len(segments) || segments[i+1].first > seq+1 {
+			break
+		}
+
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package eventlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/repositorytest"
+)
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+
+	repo, err := NewChatRepository(dir, Options{})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	c := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", new(chat.Options))
+	assert.NoError(repo.Store(c))
+
+	c, _ = repo.Find(c.ID)
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	assert.NoError(repo.Store(c))
+
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	c, _ = repo.Find(c.ID)
+	c.Model = "gpt-4"
+	assert.NoError(repo.Store(c))
+
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi!"})
+	assert.NoError(repo.Store(c))
+
+	c.Messages[2] = &chat.Message{Role: chat.Assistant, Content: "Hey!"}
+	assert.NoError(repo.ReplaceLastMessage(c))
+
+	history, err := repo.History(c.ID)
+	assert.NoError(err)
+	assert.Len(history, 6)
+	assert.Equal(ChatCreated, history[0].Type)
+	assert.Equal(MessageAppended, history[2].Type)
+	assert.Equal(ChatUpdated, history[3].Type)
+	assert.Equal(MessageReplaced, history[5].Type)
+
+	// point-in-time reconstruction
+	chats, err := repo.At(before)
+	assert.NoError(err)
+	assert.Len(chats, 1)
+	assert.Equal("gpt-3.5-turbo", chats[0].Model)
+
+	assert.NoError(repo.Close())
+
+	// simulate a torn write
+	f, _ := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"seq":7,"type":"mess`)
+	f.Close()
+
+	repo, err = NewChatRepository(dir, Options{})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	defer repo.Close()
+
+	found, err := repo.Find(c.ID)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Equal("gpt-4", found.Model)
+	assert.Len(found.Messages, 3)
+	assert.Equal("Hey!", found.Messages[2].Content)
+
+	assert.NoError(repo.Delete(c.ID))
+	_, err = repo.Find(c.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
+
+func TestTornStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+
+	repo, err := NewChatRepository(dir, Options{})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	c := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", new(chat.Options))
+	assert.NoError(repo.Store(c))
+
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	c.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi!"})
+	assert.NoError(repo.Store(c))
+
+	assert.NoError(repo.Close())
+
+	path := filepath.Join(dir, segmentName(1))
+	data, _ := os.ReadFile(path)
+	assert.Equal(2, bytes.Count(data, []byte("\n")), "one line per store")
+
+	// the process dies after the first event of the second store
+	second := bytes.IndexByte(data, '\n') + 1
+	cut := second + bytes.Index(data[second:], []byte("},{")) + 1
+	assert.NoError(os.Truncate(path, int64(cut)))
+
+	repo, err = NewChatRepository(dir, Options{})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	defer repo.Close()
+
+	found, err := repo.Find(c.ID)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Len(found.Messages, 1)
+	assert.Equal(uint64(1), found.Version)
+}
+
+func TestSnapshotAndCompaction(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+
+	repo, err := NewChatRepository(dir, Options{SnapshotEvery: 3, KeepSnapshots: 1})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	start := time.Now()
+
+	ids := make([]chat.ChatID, 0)
+	for i := 0; i < 10; i++ {
+		c := chat.NewChat("gpt-3.5-turbo", "prompt", nil)
+		assert.NoError(repo.Store(c)) // two events each
+		ids = append(ids, c.ID)
+	}
+
+	snaps, _ := repo.snapshots()
+	assert.Len(snaps, 1)
+
+	segments, _ := repo.segments()
+	assert.Len(segments, 1)
+
+	_, err = repo.At(start)
+	assert.ErrorIs(err, ErrCompacted)
+
+	assert.NoError(repo.Close())
+
+	repo, err = NewChatRepository(dir, Options{SnapshotEvery: 3, KeepSnapshots: 1})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	defer repo.Close()
+
+	chats, err := repo.List(&chat.Query{})
+	assert.NoError(err)
+	assert.Len(chats, 10)
+	assert.Equal(ids[9], chats[9].ID)
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) chat.Repository {
+		repo, err := NewChatRepository(t.TempDir(), Options{SnapshotEvery: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return repo
+	})
+}
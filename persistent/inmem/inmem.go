@@ -1,43 +1,377 @@
 package inmem
 
 import (
-	"errors"
+	"container/list"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/mirror520/openai/chat"
 )
 
+type EvictReason string
+
+const (
+	Expired  EvictReason = "expired"  // idle longer than IdleTTL
+	Capacity EvictReason = "capacity" // more than MaxChats
+	Memory   EvictReason = "memory"   // more than MaxMemory
+)
+
+// EvictFunc is called, outside of any lock, for every evicted chat.
+type EvictFunc func(c *chat.Chat, reason EvictReason)
+
+type Options struct {
+	IdleTTL         time.Duration // since the last store or find, zero means forever
+	MaxChats        int           // least recently used are evicted first, zero means unbounded
+	MaxMemory       int64         // estimated bytes, zero means unbounded
+	JanitorInterval time.Duration // between sweeps for idle chats, default IdleTTL / 2
+	OnEvict         EvictFunc
+}
+
+// ArchiveTo returns an EvictFunc storing evicted chats in another repository.
+// Versions are tracked per repository, so the chat is stored on top of
+// the version already archived, if any.
+func ArchiveTo(repo chat.Repository, onError func(error)) EvictFunc {
+	return func(c *chat.Chat, reason EvictReason) {
+		archived := c.Clone()
+		archived.Version = 0
+
+		if old, err := repo.Find(c.ID); err == nil {
+			archived.Version = old.Version
+		}
+
+		if err := repo.Store(archived); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
 func NewChatRepository() chat.Repository {
-	return &chatRepository{
-		chats: make(map[chat.ChatID]*chat.Chat),
+	return NewChatRepositoryWithOptions(Options{})
+}
+
+func NewChatRepositoryWithOptions(opts Options) chat.Repository {
+	repo := &chatRepository{
+		chats: make(map[chat.ChatID]*entry),
+		lru:   list.New(),
+		opts:  opts,
+		now:   time.Now,
+	}
+
+	if opts.IdleTTL > 0 {
+		interval := opts.JanitorInterval
+		if interval <= 0 {
+			interval = opts.IdleTTL / 2
+		}
+
+		repo.done = make(chan struct{})
+		go repo.janitor(interval, repo.done)
 	}
+
+	return repo
+}
+
+type entry struct {
+	chat     *chat.Chat
+	elem     *list.Element // in lru, front is the most recently used
+	accessed time.Time
+	size     int64
+}
+
+type eviction struct {
+	chat   *chat.Chat
+	reason EvictReason
 }
 
 type chatRepository struct {
-	chats map[chat.ChatID]*chat.Chat
+	chats  map[chat.ChatID]*entry
+	lru    *list.List
+	memory int64
+	opts   Options
+	now    func() time.Time
+	done   chan struct{}
 	sync.RWMutex
 }
 
 func (repo *chatRepository) Store(c *chat.Chat) error {
+	return repo.store(c, false)
+}
+
+func (repo *chatRepository) ReplaceLastMessage(c *chat.Chat) error {
+	return repo.store(c, true)
+}
+
+func (repo *chatRepository) store(c *chat.Chat, replace bool) error {
 	repo.Lock()
-	repo.chats[c.ID] = c
+
+	if repo.chats == nil {
+		repo.Unlock()
+		return chat.ErrClosed
+	}
+
+	e, ok := repo.chats[c.ID]
+	if (!ok && c.Version != 0) || (ok && e.chat.Version != c.Version) {
+		repo.Unlock()
+		return chat.ErrConflict
+	}
+
+	if replace && (!ok || len(c.Messages) == 0 || len(e.chat.Messages) != len(c.Messages)) {
+		repo.Unlock()
+		return chat.ErrConflict
+	}
+
+	c.Version++
+	stored := c.Clone()
+
+	if !ok {
+		e = new(entry)
+		e.elem = repo.lru.PushFront(c.ID)
+		repo.chats[c.ID] = e
+	} else {
+		repo.lru.MoveToFront(e.elem)
+	}
+
+	size := estimate(stored)
+	repo.memory += size - e.size
+
+	e.chat = stored
+	e.size = size
+	e.accessed = repo.now()
+
+	evicted := repo.shrink(c.ID)
 	repo.Unlock()
+
+	repo.notify(evicted)
 	return nil
 }
 
 func (repo *chatRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	repo.Lock()
+
+	if repo.chats == nil {
+		repo.Unlock()
+		return nil, chat.ErrClosed
+	}
+
+	e, ok := repo.chats[id]
+	if !ok {
+		repo.Unlock()
+		return nil, chat.ErrChatNotFound
+	}
+
+	if repo.expired(e) {
+		repo.remove(id, e)
+		repo.Unlock()
+
+		repo.notify([]*eviction{{e.chat, Expired}})
+		return nil, chat.ErrChatNotFound
+	}
+
+	repo.lru.MoveToFront(e.elem)
+	e.accessed = repo.now()
+
+	c := e.chat.Clone()
+	repo.Unlock()
+
+	return c, nil
+}
+
+func (repo *chatRepository) List(q *chat.Query) ([]*chat.Chat, error) {
 	repo.RLock()
 	defer repo.RUnlock()
 
-	c, ok := repo.chats[id]
+	if repo.chats == nil {
+		return nil, chat.ErrClosed
+	}
+
+	chats := make([]*chat.Chat, 0)
+	for _, e := range repo.chats {
+		if !repo.expired(e) && q.Match(e.chat) {
+			chats = append(chats, e.chat)
+		}
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].ID.Compare(chats[j].ID) < 0
+	})
+
+	if q.Limit > 0 && len(chats) > q.Limit {
+		chats = chats[:q.Limit]
+	}
+
+	for i, c := range chats {
+		chats[i] = c.Clone()
+	}
+
+	return chats, nil
+}
+
+func (repo *chatRepository) Count() (int, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	if repo.chats == nil {
+		return 0, chat.ErrClosed
+	}
+
+	n := 0
+	for _, e := range repo.chats {
+		if !repo.expired(e) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (repo *chatRepository) Delete(id chat.ChatID) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if repo.chats == nil {
+		return chat.ErrClosed
+	}
+
+	e, ok := repo.chats[id]
 	if !ok {
-		return nil, errors.New("chat not found")
+		return chat.ErrChatNotFound
 	}
 
-	return c, nil
+	repo.remove(id, e)
+	return nil
 }
 
 func (repo *chatRepository) Close() error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if repo.done != nil {
+		close(repo.done)
+		repo.done = nil
+	}
+
 	repo.chats = nil
+	repo.lru.Init()
+	repo.memory = 0
 	return nil
 }
+
+func (repo *chatRepository) expired(e *entry) bool {
+	ttl := repo.opts.IdleTTL
+	return ttl > 0 && repo.now().Sub(e.accessed) > ttl
+}
+
+func (repo *chatRepository) remove(id chat.ChatID, e *entry) {
+	repo.lru.Remove(e.elem)
+	repo.memory -= e.size
+	delete(repo.chats, id)
+}
+
+// shrink evicts the least recently used chats until the bounds are met,
+// sparing the chat just stored.
+func (repo *chatRepository) shrink(spare chat.ChatID) []*eviction {
+	evicted := make([]*eviction, 0)
+
+	for elem := repo.lru.Back(); elem != nil; {
+		var reason EvictReason
+		switch {
+		case repo.opts.MaxChats > 0 && len(repo.chats) > repo.opts.MaxChats:
+			reason = Capacity
+		case repo.opts.MaxMemory > 0 && repo.memory > repo.opts.MaxMemory:
+			reason = Memory
+		default:
+			return evicted
+		}
+
+		prev := elem.Prev()
+
+		id := elem.Value.(chat.ChatID)
+		if id != spare {
+			e := repo.chats[id]
+			repo.remove(id, e)
+			evicted = append(evicted, &eviction{e.chat, reason})
+		}
+
+		elem = prev
+	}
+
+	return evicted
+}
+
+func (repo *chatRepository) sweep() {
+	repo.Lock()
+
+	evicted := make([]*eviction, 0)
+	for elem := repo.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+
+		id := elem.Value.(chat.ChatID)
+		e := repo.chats[id]
+		if !repo.expired(e) {
+			break // the rest has been accessed more recently
+		}
+
+		repo.remove(id, e)
+		evicted = append(evicted, &eviction{e.chat, Expired})
+
+		elem = prev
+	}
+
+	repo.Unlock()
+
+	repo.notify(evicted)
+}
+
+func (repo *chatRepository) janitor(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			repo.sweep()
+		}
+	}
+}
+
+func (repo *chatRepository) notify(evicted []*eviction) {
+	if repo.opts.OnEvict == nil {
+		return
+	}
+
+	for _, ev := range evicted {
+		repo.opts.OnEvict(ev.chat, ev.reason)
+	}
+}
+
+// estimate approximates the bytes held by the chat.
+func estimate(c *chat.Chat) int64 {
+	const (
+		chatOverhead    = 256
+		messageOverhead = 64
+	)
+
+	size := int64(chatOverhead + len(c.Model) + len(c.Template))
+	for _, msg := range c.Messages {
+		size += int64(messageOverhead + len(msg.Role) + len(msg.Content))
+	}
+
+	for _, tag := range c.Tags {
+		size += int64(16 + len(tag))
+	}
+
+	if c.Options != nil {
+		size += 128
+		for _, stop := range c.Stop {
+			size += int64(16 + len(stop))
+		}
+
+		for token := range c.LogitBias {
+			size += int64(24 + len(token))
+		}
+	}
+
+	return size
+}
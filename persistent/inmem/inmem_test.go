@@ -0,0 +1,133 @@
+package inmem
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/repositorytest"
+)
+
+func TestCapacityEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	evicted := make(map[chat.ChatID]EvictReason)
+	repo := NewChatRepositoryWithOptions(Options{
+		MaxChats: 2,
+		OnEvict: func(c *chat.Chat, reason EvictReason) {
+			evicted[c.ID] = reason
+		},
+	})
+	defer repo.Close()
+
+	a := chat.NewChat("gpt-3.5-turbo", "a", nil)
+	b := chat.NewChat("gpt-3.5-turbo", "b", nil)
+	c := chat.NewChat("gpt-3.5-turbo", "c", nil)
+
+	repo.Store(a)
+	repo.Store(b)
+	repo.Find(a.ID) // b is now the least recently used
+	repo.Store(c)
+
+	assert.Equal(map[chat.ChatID]EvictReason{b.ID: Capacity}, evicted)
+
+	_, err := repo.Find(b.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	_, err = repo.Find(a.ID)
+	assert.NoError(err)
+}
+
+func TestMemoryEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	count := 0
+	repo := NewChatRepositoryWithOptions(Options{
+		MaxMemory: 4096,
+		OnEvict: func(c *chat.Chat, reason EvictReason) {
+			assert.Equal(Memory, reason)
+			count++
+		},
+	})
+	defer repo.Close()
+
+	for i := 0; i < 4; i++ {
+		repo.Store(chat.NewChat("gpt-3.5-turbo", strings.Repeat("x", 1500), nil))
+	}
+
+	chats, _ := repo.List(&chat.Query{})
+	assert.Len(chats, 2)
+	assert.Equal(2, count)
+}
+
+func TestIdleExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	archive := NewChatRepository()
+
+	repo := NewChatRepositoryWithOptions(Options{
+		IdleTTL:         time.Minute,
+		JanitorInterval: time.Hour,
+		OnEvict:         ArchiveTo(archive, nil),
+	}).(*chatRepository)
+	defer repo.Close()
+
+	now := time.Now()
+	repo.now = func() time.Time { return now }
+
+	a := chat.NewChat("gpt-3.5-turbo", "a", nil)
+	b := chat.NewChat("gpt-3.5-turbo", "b", nil)
+	repo.Store(a)
+
+	now = now.Add(45 * time.Second)
+	repo.Store(b)
+
+	now = now.Add(30 * time.Second)
+	repo.sweep()
+
+	_, err := repo.Find(a.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	_, err = repo.Find(b.ID)
+	assert.NoError(err)
+
+	_, err = archive.Find(a.ID)
+	assert.NoError(err)
+}
+
+func TestCopyOnReadAndVersioning(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := NewChatRepository()
+	defer repo.Close()
+
+	c := chat.NewChat("gpt-3.5-turbo", "prompt", nil)
+	assert.NoError(repo.Store(c))
+	assert.Equal(uint64(1), c.Version)
+
+	a, _ := repo.Find(c.ID)
+	b, _ := repo.Find(c.ID)
+
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "first"})
+
+	stored, _ := repo.Find(c.ID)
+	assert.Len(stored.Messages, 1)
+
+	assert.NoError(repo.Store(a))
+
+	b.AddMessage(&chat.Message{Role: chat.User, Content: "second"})
+	assert.ErrorIs(repo.Store(b), chat.ErrConflict)
+
+	stored, _ = repo.Find(c.ID)
+	assert.Equal(uint64(2), stored.Version)
+	assert.Equal("first", stored.Messages[1].Content)
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) chat.Repository {
+		return NewChatRepository()
+	})
+}
@@ -0,0 +1,370 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mirror520/openai/chat"
+)
+
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string        // of every key, default "openai:"
+	TTL      time.Duration // since the last store, zero means no expiry
+}
+
+const DefaultPrefix = "openai:"
+
+// NewChatRepository stores chats as hashes, their messages as lists,
+// and indexes them in a sorted set ordered by ID.
+func NewChatRepository(opts Options) (chat.Repository, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &chatRepository{
+		client: client,
+		prefix: opts.Prefix,
+		ttl:    opts.TTL,
+	}, nil
+}
+
+type chatRepository struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func (repo *chatRepository) chatKey(id string) string {
+	return repo.prefix + "chat:" + id
+}
+
+func (repo *chatRepository) messagesKey(id string) string {
+	return repo.prefix + "chat:" + id + ":messages"
+}
+
+func (repo *chatRepository) indexKey() string {
+	return repo.prefix + "chats"
+}
+
+// storeScript appends the new messages, or replaces the last one, only if
+// the chat still has the expected version and message count, then updates
+// the hash, the expiry and the index.
+//
+// KEYS: chat, messages, index
+// ARGV: id, expected length, ttl in ms, model, user, options, annotation, expected version, access, replace, messages...
+var storeScript = redis.NewScript(`
+local version = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if version ~= tonumber(ARGV[8]) then
+	return redis.error_reply('CONFLICT')
+end
+
+if redis.call('LLEN', KEYS[2]) ~= tonumber(ARGV[2]) then
+	return redis.error_reply('CONFLICT')
+end
+
+if ARGV[10] == '1' then
+	redis.call('LSET', KEYS[2], -1, ARGV[11])
+else
+	for i = 11, #ARGV do
+		redis.call('RPUSH', KEYS[2], ARGV[i])
+	end
+end
+
+redis.call('HSET', KEYS[1], 'version', version + 1,
+	'model', ARGV[4], 'user', ARGV[5], 'options', ARGV[6], 'annotation', ARGV[7], 'access', ARGV[9])
+
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+
+redis.call('ZADD', KEYS[3], 0, ARGV[1])
+return redis.status_reply('OK')
+`)
+
+func (repo *chatRepository) Store(c *chat.Chat) error {
+	return repo.store(c, false)
+}
+
+func (repo *chatRepository) ReplaceLastMessage(c *chat.Chat) error {
+	return repo.store(c, true)
+}
+
+func (repo *chatRepository) store(c *chat.Chat, replace bool) error {
+	ctx := context.Background()
+	id := c.ID.String()
+
+	stored, err := repo.client.LLen(ctx, repo.messagesKey(id)).Result()
+	if err != nil {
+		return err
+	}
+
+	if int(stored) > len(c.Messages) || (replace && (stored == 0 || int(stored) != len(c.Messages))) {
+		return chat.ErrConflict
+	}
+
+	var options string
+	if c.Options != nil {
+		bs, err := json.Marshal(c.Options)
+		if err != nil {
+			return err
+		}
+
+		options = string(bs)
+	}
+
+	var user string
+	if c.Options != nil && c.User != nil {
+		user = *c.User
+	}
+
+	annotation, err := json.Marshal(c.Annotation)
+	if err != nil {
+		return err
+	}
+
+	access, err := json.Marshal(c.Access)
+	if err != nil {
+		return err
+	}
+
+	mode, added := "0", c.Messages[stored:]
+	if replace {
+		mode, added = "1", c.Messages[stored-1:]
+	}
+
+	args := []any{id, stored, repo.ttl.Milliseconds(), c.Model, user, options, string(annotation), c.Version, string(access), mode}
+	for _, msg := range added {
+		bs, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		args = append(args, string(bs))
+	}
+
+	keys := []string{repo.chatKey(id), repo.messagesKey(id), repo.indexKey()}
+
+	err = storeScript.Run(ctx, repo.client, keys, args...).Err()
+	if err != nil {
+		if strings.Contains(err.Error(), "CONFLICT") {
+			return chat.ErrConflict
+		}
+
+		return err
+	}
+
+	c.Version++
+	return nil
+}
+
+func (repo *chatRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	ctx := context.Background()
+
+	c, err := repo.find(ctx, id.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, chat.ErrChatNotFound
+	}
+
+	return c, nil
+}
+
+// find returns nil for an unknown or expired chat.
+func (repo *chatRepository) find(ctx context.Context, id string) (*chat.Chat, error) {
+	var (
+		fields   *redis.MapStringStringCmd
+		messages *redis.StringSliceCmd
+	)
+
+	_, err := repo.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, repo.chatKey(id))
+		messages = pipe.LRange(ctx, repo.messagesKey(id), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := fields.Val()
+	if len(hash) == 0 {
+		return nil, nil
+	}
+
+	chatID, err := chat.ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := strconv.ParseUint(hash["version"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chat.Chat{
+		ID:       chatID,
+		Version:  version,
+		Model:    hash["model"],
+		Messages: make([]*chat.Message, 0, len(messages.Val())),
+	}
+
+	if opts := hash["options"]; opts != "" {
+		if err := json.Unmarshal([]byte(opts), &c.Options); err != nil {
+			return nil, err
+		}
+	}
+
+	if annotation := hash["annotation"]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &c.Annotation); err != nil {
+			return nil, err
+		}
+	}
+
+	if access := hash["access"]; access != "" {
+		if err := json.Unmarshal([]byte(access), &c.Access); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, raw := range messages.Val() {
+		var msg *chat.Message
+		if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+			return nil, err
+		}
+
+		c.Messages = append(c.Messages, msg)
+	}
+
+	return c, nil
+}
+
+// listBatch is the number of index entries fetched at once while listing.
+const listBatch = 100
+
+func (repo *chatRepository) List(q *chat.Query) ([]*chat.Chat, error) {
+	ctx := context.Background()
+
+	min := "-"
+	if q.After != nil {
+		min = "(" + q.After.String()
+	}
+
+	if !q.Since.IsZero() {
+		since := "[" + timeBound(q.Since)
+		if q.After == nil || since > min[1:] {
+			min = since
+		}
+	}
+
+	max := "+"
+	if !q.Until.IsZero() {
+		max = "(" + timeBound(q.Until)
+	}
+
+	chats := make([]*chat.Chat, 0)
+	for {
+		ids, err := repo.client.ZRangeByLex(ctx, repo.indexKey(), &redis.ZRangeBy{
+			Min:   min,
+			Max:   max,
+			Count: listBatch,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			c, err := repo.find(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+
+			if c == nil {
+				// expired, drop it from the index
+				repo.client.ZRem(ctx, repo.indexKey(), id)
+				continue
+			}
+
+			if !q.Match(c) {
+				continue
+			}
+
+			chats = append(chats, c)
+			if q.Limit > 0 && len(chats) >= q.Limit {
+				return chats, nil
+			}
+		}
+
+		if len(ids) < listBatch {
+			return chats, nil
+		}
+
+		min = "(" + ids[len(ids)-1]
+	}
+}
+
+// timeBound is the smallest ID created at t.
+func timeBound(t time.Time) string {
+	var id ulid.ULID
+	id.SetTime(ulid.Timestamp(t))
+	return id.String()
+}
+
+func (repo *chatRepository) Delete(id chat.ChatID) error {
+	ctx := context.Background()
+	key := id.String()
+
+	var deleted *redis.IntCmd
+	_, err := repo.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, repo.chatKey(key))
+		pipe.Del(ctx, repo.messagesKey(key))
+		pipe.ZRem(ctx, repo.indexKey(), key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if deleted.Val() == 0 {
+		return chat.ErrChatNotFound
+	}
+
+	return nil
+}
+
+// Count includes the expired chats not yet pruned from the index by List.
+func (repo *chatRepository) Count() (int, error) {
+	n, err := repo.client.ZCard(context.Background(), repo.indexKey()).Result()
+	return int(n), err
+}
+
+func (repo *chatRepository) Ping() error {
+	return repo.client.Ping(context.Background()).Err()
+}
+
+func (repo *chatRepository) Close() error {
+	return repo.client.Close()
+}
@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/repositorytest"
+)
+
+type redisTestSuite struct {
+	suite.Suite
+	server *miniredis.Miniredis
+	repo   chat.Repository
+}
+
+func (suite *redisTestSuite) SetupTest() {
+	suite.server = miniredis.RunT(suite.T())
+
+	repo, err := NewChatRepository(Options{
+		Addr: suite.server.Addr(),
+		TTL:  time.Hour,
+	})
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+
+	suite.repo = repo
+}
+
+func (suite *redisTestSuite) TearDownTest() {
+	suite.repo.Close()
+}
+
+func (suite *redisTestSuite) TestStoreAndFind() {
+	user := "alice"
+	c := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", &chat.Options{User: &user})
+	c.Tags = []string{"support"}
+
+	suite.NoError(suite.repo.Store(c))
+
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	suite.NoError(suite.repo.Store(c))
+
+	found, err := suite.repo.Find(c.ID)
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+
+	suite.Equal(c.Model, found.Model)
+	suite.Equal(c.Messages, found.Messages)
+	suite.Equal("alice", *found.User)
+	suite.Equal([]string{"support"}, found.Tags)
+
+	key := DefaultPrefix + "chat:" + c.ID.String() + ":messages"
+	suite.True(suite.server.Exists(key))
+	suite.Equal(time.Hour, suite.server.TTL(key))
+}
+
+func (suite *redisTestSuite) TestConflict() {
+	c := chat.NewChat("gpt-3.5-turbo", "prompt", nil)
+	suite.NoError(suite.repo.Store(c))
+
+	a, _ := suite.repo.Find(c.ID)
+	b, _ := suite.repo.Find(c.ID)
+
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "first"})
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "first again"})
+	suite.NoError(suite.repo.Store(a))
+
+	b.AddMessage(&chat.Message{Role: chat.User, Content: "second"})
+	suite.ErrorIs(suite.repo.Store(b), chat.ErrConflict)
+}
+
+func (suite *redisTestSuite) TestExpiry() {
+	c := chat.NewChat("gpt-3.5-turbo", "prompt", nil)
+	suite.NoError(suite.repo.Store(c))
+
+	suite.server.FastForward(2 * time.Hour)
+
+	_, err := suite.repo.Find(c.ID)
+	suite.ErrorIs(err, chat.ErrChatNotFound)
+
+	chats, err := suite.repo.List(&chat.Query{})
+	suite.NoError(err)
+	suite.Len(chats, 0)
+
+	members, _ := suite.server.ZMembers(DefaultPrefix + "chats")
+	suite.Len(members, 0)
+}
+
+func (suite *redisTestSuite) TestList() {
+	ids := make([]chat.ChatID, 0)
+	for i := 0; i < 5; i++ {
+		model := "gpt-3.5-turbo"
+		if i%2 == 1 {
+			model = "gpt-4"
+		}
+
+		c := chat.NewChat(model, "prompt", nil)
+		suite.NoError(suite.repo.Store(c))
+		ids = append(ids, c.ID)
+	}
+
+	chats, err := suite.repo.List(&chat.Query{Limit: 2})
+	suite.NoError(err)
+	suite.Len(chats, 2)
+	suite.Equal(ids[0], chats[0].ID)
+
+	chats, err = suite.repo.List(&chat.Query{After: &ids[1], Model: "gpt-3.5-turbo"})
+	suite.NoError(err)
+	suite.Len(chats, 2)
+	suite.Equal(ids[2], chats[0].ID)
+	suite.Equal(ids[4], chats[1].ID)
+
+	suite.NoError(suite.repo.Delete(ids[0]))
+	suite.ErrorIs(suite.repo.Delete(ids[0]), chat.ErrChatNotFound)
+}
+
+func TestRedisTestSuite(t *testing.T) {
+	suite.Run(t, new(redisTestSuite))
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) chat.Repository {
+		server := miniredis.RunT(t)
+
+		repo, err := NewChatRepository(Options{Addr: server.Addr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return repo
+	})
+}
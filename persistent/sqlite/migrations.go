@@ -0,0 +1,115 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, the schema version is kept in PRAGMA user_version.
+// Never edit a released migration, append a new one instead.
+var migrations = []string{
+	// 1: chats and messages
+	`CREATE TABLE chats (
+		id         TEXT PRIMARY KEY,
+		model      TEXT NOT NULL,
+		user       TEXT NOT NULL DEFAULT '',
+		options    TEXT,
+		rating     INTEGER,
+		template   TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX idx_chats_user ON chats (user, id);
+	CREATE INDEX idx_chats_model ON chats (model, id);
+	CREATE INDEX idx_chats_created_at ON chats (created_at);
+
+	CREATE TABLE messages (
+		chat_id TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+		seq     INTEGER NOT NULL,
+		role    TEXT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (chat_id, seq)
+	);
+
+	CREATE TABLE chat_tags (
+		chat_id TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+		tag     TEXT NOT NULL,
+		PRIMARY KEY (chat_id, tag)
+	);
+
+	CREATE INDEX idx_chat_tags_tag ON chat_tags (tag, chat_id);`,
+
+	// 2: optimistic versioning
+	`ALTER TABLE chats ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+
+	// 3: tenants, owners and members
+	`ALTER TABLE chats ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chats ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX idx_chats_tenant ON chats (tenant, id);
+	CREATE INDEX idx_chats_owner ON chats (owner, id);
+
+	CREATE TABLE chat_members (
+		chat_id TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+		subject TEXT NOT NULL,
+		role    TEXT NOT NULL,
+		PRIMARY KEY (chat_id, subject)
+	);
+
+	CREATE INDEX idx_chat_members_subject ON chat_members (subject, chat_id);`,
+
+	// 4: full-text index of the messages, kept in sync by triggers
+	`CREATE VIRTUAL TABLE messages_fts USING fts4 (content="messages", content, tokenize=unicode61);
+
+	CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (docid, content) VALUES (new.rowid, new.content);
+	END;
+
+	CREATE TRIGGER messages_fts_before_update BEFORE UPDATE ON messages BEGIN
+		DELETE FROM messages_fts WHERE docid = old.rowid;
+	END;
+
+	CREATE TRIGGER messages_fts_after_update AFTER UPDATE ON messages BEGIN
+		INSERT INTO messages_fts (docid, content) VALUES (new.rowid, new.content);
+	END;
+
+	CREATE TRIGGER messages_fts_delete BEFORE DELETE ON messages BEGIN
+		DELETE FROM messages_fts WHERE docid = old.rowid;
+	END;
+
+	INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');`,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
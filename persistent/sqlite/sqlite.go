@@ -0,0 +1,466 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/mirror520/openai/chat"
+)
+
+// NewChatRepository opens, and migrates if needed, the database at path.
+func NewChatRepository(path string) (chat.Repository, error) {
+	dsn := "file:" + path + "?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000"
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows a single writer, serialize in the pool
+	// instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &chatRepository{db}, nil
+}
+
+type chatRepository struct {
+	db *sql.DB
+}
+
+// Store upserts the chat and appends the messages not stored yet.
+// Messages are append-only, stored messages are never rewritten.
+func (repo *chatRepository) Store(c *chat.Chat) error {
+	return repo.store(c, false)
+}
+
+// ReplaceLastMessage updates the chat and rewrites its last message.
+func (repo *chatRepository) ReplaceLastMessage(c *chat.Chat) error {
+	return repo.store(c, true)
+}
+
+func (repo *chatRepository) store(c *chat.Chat, replace bool) error {
+	if replace && (c.Version == 0 || len(c.Messages) == 0) {
+		return chat.ErrConflict
+	}
+
+	var options []byte
+	if c.Options != nil {
+		bs, err := json.Marshal(c.Options)
+		if err != nil {
+			return err
+		}
+
+		options = bs
+	}
+
+	var user string
+	if c.Options != nil && c.User != nil {
+		user = *c.User
+	}
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := c.ID.String()
+	version := c.Version + 1
+
+	var result sql.Result
+	if c.Version == 0 {
+		result, err = tx.Exec(`
+			INSERT INTO chats (id, version, model, user, options, rating, template, tenant, owner, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING`,
+			id, version, c.Model, user, options, c.Rating, c.Template, c.Tenant, c.Owner, c.ID.Time().UnixMilli(),
+		)
+	} else {
+		result, err = tx.Exec(`
+			UPDATE chats SET
+				version = ?, model = ?, user = ?, options = ?, rating = ?, template = ?, tenant = ?, owner = ?
+			WHERE id = ? AND version = ?`,
+			version, c.Model, user, options, c.Rating, c.Template, c.Tenant, c.Owner, id, c.Version,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return chat.ErrConflict
+	}
+
+	var stored int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM messages WHERE chat_id = ?`, id).Scan(&stored)
+	if err != nil {
+		return err
+	}
+
+	if stored > len(c.Messages) || (replace && stored != len(c.Messages)) {
+		return chat.ErrConflict
+	}
+
+	if replace {
+		seq := stored - 1
+		msg := c.Messages[seq]
+
+		_, err := tx.Exec(`UPDATE messages SET role = ?, content = ? WHERE chat_id = ? AND seq = ?`,
+			msg.Role, msg.Content, id, seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stored < len(c.Messages) {
+		stmt, err := tx.Prepare(`INSERT INTO messages (chat_id, seq, role, content) VALUES (?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for seq := stored; seq < len(c.Messages); seq++ {
+			msg := c.Messages[seq]
+			if _, err := stmt.Exec(id, seq, msg.Role, msg.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM chat_tags WHERE chat_id = ?`, id); err != nil {
+		return err
+	}
+
+	for _, tag := range c.Tags {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO chat_tags (chat_id, tag) VALUES (?, ?)`, id, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM chat_members WHERE chat_id = ?`, id); err != nil {
+		return err
+	}
+
+	for subject, role := range c.Members {
+		_, err := tx.Exec(`INSERT INTO chat_members (chat_id, subject, role) VALUES (?, ?, ?)`, id, subject, role)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.Version = version
+	return nil
+}
+
+func (repo *chatRepository) Find(id chat.ChatID) (*chat.Chat, error) {
+	row := repo.db.QueryRow(`
+		SELECT id, version, model, options, rating, template, tenant, owner
+		FROM chats WHERE id = ?`,
+		id.String(),
+	)
+
+	c, err := scanChat(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, chat.ErrChatNotFound
+		}
+
+		return nil, err
+	}
+
+	if err := repo.load(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (repo *chatRepository) List(q *chat.Query) ([]*chat.Chat, error) {
+	var (
+		where []string
+		args  []any
+	)
+
+	if q.After != nil {
+		where = append(where, "id > ?")
+		args = append(args, q.After.String())
+	}
+
+	if q.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, q.User)
+	}
+
+	if q.Model != "" {
+		where = append(where, "model = ?")
+		args = append(args, q.Model)
+	}
+
+	if q.Scoped || q.Tenant != "" {
+		where = append(where, "tenant = ?")
+		args = append(args, q.Tenant)
+	}
+
+	if q.Member != "" {
+		where = append(where, "(owner = ? OR id IN (SELECT chat_id FROM chat_members WHERE subject = ?))")
+		args = append(args, q.Member, q.Member)
+	}
+
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UnixMilli())
+	}
+
+	if !q.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.Until.UnixMilli())
+	}
+
+	if words := chat.Words(q.Text); len(words) > 0 {
+		where = append(where, `id IN (SELECT chat_id FROM messages WHERE rowid IN (
+			SELECT docid FROM messages_fts WHERE messages_fts MATCH ?))`)
+		args = append(args, matchWords(words))
+	}
+
+	query := `SELECT id, version, model, options, rating, template, tenant, owner FROM chats`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	query += " ORDER BY id"
+
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := repo.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := make([]*chat.Chat, 0)
+	for rows.Next() {
+		c, err := scanChat(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		chats = append(chats, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := repo.load(chats...); err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// matchWords is the full-text query of the words, each quoted so that
+// none is taken for an operator.
+func matchWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = `"` + word + `"`
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func (repo *chatRepository) Delete(id chat.ChatID) error {
+	result, err := repo.db.Exec(`DELETE FROM chats WHERE id = ?`, id.String())
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return chat.ErrChatNotFound
+	}
+
+	return nil
+}
+
+func (repo *chatRepository) Count() (int, error) {
+	var n int
+	if err := repo.db.QueryRow(`SELECT COUNT(*) FROM chats`).Scan(&n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (repo *chatRepository) Ping() error {
+	return repo.db.Ping()
+}
+
+func (repo *chatRepository) Close() error {
+	return repo.db.Close()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChat(row scanner) (*chat.Chat, error) {
+	var (
+		id       string
+		options  []byte
+		rating   sql.NullInt64
+		template string
+	)
+
+	c := new(chat.Chat)
+	if err := row.Scan(&id, &c.Version, &c.Model, &options, &rating, &template, &c.Tenant, &c.Owner); err != nil {
+		return nil, err
+	}
+
+	chatID, err := chat.ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ID = chatID
+	c.Template = template
+
+	if rating.Valid {
+		r := int(rating.Int64)
+		c.Rating = &r
+	}
+
+	if options != nil {
+		if err := json.Unmarshal(options, &c.Options); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// loadBatch bounds the chats loaded by a query, below the limit of the
+// parameters of a statement.
+const loadBatch = 500
+
+// load fills in the messages, tags and members of the chats, with a query
+// of each per batch of chats.
+func (repo *chatRepository) load(chats ...*chat.Chat) error {
+	for len(chats) > 0 {
+		n := len(chats)
+		if n > loadBatch {
+			n = loadBatch
+		}
+
+		if err := repo.loadBatch(chats[:n]); err != nil {
+			return err
+		}
+
+		chats = chats[n:]
+	}
+
+	return nil
+}
+
+func (repo *chatRepository) loadBatch(chats []*chat.Chat) error {
+	byID := make(map[string]*chat.Chat, len(chats))
+	args := make([]any, 0, len(chats))
+	for _, c := range chats {
+		id := c.ID.String()
+		byID[id] = c
+		args = append(args, id)
+
+		c.Messages = make([]*chat.Message, 0)
+	}
+
+	in := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(chats)), ", ") + ")"
+
+	rows, err := repo.db.Query(`SELECT chat_id, role, content FROM messages WHERE chat_id IN `+in+` ORDER BY chat_id, seq`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		msg := new(chat.Message)
+		if err := rows.Scan(&id, &msg.Role, &msg.Content); err != nil {
+			return err
+		}
+
+		c := byID[id]
+		c.Messages = append(c.Messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tags, err := repo.db.Query(`SELECT chat_id, tag FROM chat_tags WHERE chat_id IN `+in+` ORDER BY rowid`, args...)
+	if err != nil {
+		return err
+	}
+	defer tags.Close()
+
+	for tags.Next() {
+		var id, tag string
+		if err := tags.Scan(&id, &tag); err != nil {
+			return err
+		}
+
+		c := byID[id]
+		c.Tags = append(c.Tags, tag)
+	}
+
+	if err := tags.Err(); err != nil {
+		return err
+	}
+
+	members, err := repo.db.Query(`SELECT chat_id, subject, role FROM chat_members WHERE chat_id IN `+in, args...)
+	if err != nil {
+		return err
+	}
+	defer members.Close()
+
+	for members.Next() {
+		var (
+			id      string
+			subject string
+			role    chat.MemberRole
+		)
+
+		if err := members.Scan(&id, &subject, &role); err != nil {
+			return err
+		}
+
+		byID[id].Share(subject, role)
+	}
+
+	return members.Err()
+}
@@ -0,0 +1,123 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/repositorytest"
+)
+
+func TestChatRepository(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "openai.db")
+
+	repo, err := NewChatRepository(path)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	user := "alice"
+	c := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", &chat.Options{User: &user})
+	c.Tags = []string{"support", "billing"}
+
+	assert.NoError(repo.Store(c))
+
+	c.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	assert.NoError(repo.Store(c))
+
+	found, err := repo.Find(c.ID)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Equal(c.ID, found.ID)
+	assert.Equal(c.Messages, found.Messages)
+	assert.Equal("alice", *found.User)
+	assert.Equal([]string{"support", "billing"}, found.Tags)
+
+	// reopen, migrations must be idempotent
+	assert.NoError(repo.Close())
+
+	repo, err = NewChatRepository(path)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	defer repo.Close()
+
+	chats, err := repo.List(&chat.Query{User: "alice"})
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	assert.Len(chats, 1)
+	assert.Len(chats[0].Messages, 2)
+
+	chats, err = repo.List(&chat.Query{User: "bob"})
+	assert.NoError(err)
+	assert.Len(chats, 0)
+
+	assert.NoError(repo.Delete(c.ID))
+	assert.ErrorIs(repo.Delete(c.ID), chat.ErrChatNotFound)
+
+	_, err = repo.Find(c.ID)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
+
+func TestIndexStoredMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "openai.db")
+
+	// a database of the schema before the full-text index
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	for _, migration := range migrations[:3] {
+		_, err := db.Exec(migration)
+		assert.NoError(err)
+	}
+
+	c := chat.NewChat("gpt-4", "", nil)
+	_, err = db.Exec(`PRAGMA user_version = 3;
+		INSERT INTO chats (id, model, created_at) VALUES (?, 'gpt-4', 0);
+		INSERT INTO messages (chat_id, seq, role, content) VALUES (?, 0, 'user', 'Where is my invoice?');`,
+		c.ID.String(), c.ID.String())
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	repo, err := NewChatRepository(path)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	defer repo.Close()
+
+	chats, err := repo.List(&chat.Query{Text: "invoice"})
+	assert.NoError(err)
+	if assert.Len(chats, 1) {
+		assert.Equal(c.ID, chats[0].ID)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) chat.Repository {
+		repo, err := NewChatRepository(filepath.Join(t.TempDir(), "openai.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return repo
+	})
+}
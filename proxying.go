@@ -6,6 +6,8 @@ import (
 	"errors"
 
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
 )
 
 func ProxyingMiddleware(endpoints *ChatEndpoints) ServiceMiddleware {
@@ -18,14 +20,15 @@ type proxyingMiddleware struct {
 	*ChatEndpoints
 }
 
-func (mw *proxyingMiddleware) CreateChat(model string, prompt string, rawOpts json.RawMessage) (chat.ChatID, error) {
+func (mw *proxyingMiddleware) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (chat.ChatID, error) {
 	req := &CreateChatRequest{
 		Model:   model,
 		Prompt:  prompt,
 		Options: rawOpts,
+		Access:  access,
 	}
 
-	resp, err := mw.CreateChatEndpoint(context.Background(), req)
+	resp, err := mw.CreateChatEndpoint(ctx, req)
 	if err != nil {
 		return chat.ChatID{}, err
 	}
@@ -38,7 +41,7 @@ func (mw *proxyingMiddleware) CreateChat(model string, prompt string, rawOpts js
 	return id, nil
 }
 
-func (mw *proxyingMiddleware) UpdateChat(model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
+func (mw *proxyingMiddleware) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
 	req := &UpdateChatRequest{
 		ID:      id,
 		Model:   model,
@@ -46,7 +49,7 @@ func (mw *proxyingMiddleware) UpdateChat(model string, prompt string, rawOpts js
 		Options: rawOpts,
 	}
 
-	_, err := mw.UpdateChatEndpoint(context.Background(), req)
+	_, err := mw.UpdateChatEndpoint(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -54,13 +57,13 @@ func (mw *proxyingMiddleware) UpdateChat(model string, prompt string, rawOpts js
 	return nil
 }
 
-func (mw *proxyingMiddleware) Chat(content string, id chat.ChatID) (string, error) {
+func (mw *proxyingMiddleware) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
 	req := &ChatRequest{
 		ID:      id,
 		Content: content,
 	}
 
-	resp, err := mw.ChatEndpoint(context.Background(), req)
+	resp, err := mw.ChatEndpoint(ctx, req)
 	if err != nil {
 		return "", err
 	}
@@ -73,21 +76,294 @@ func (mw *proxyingMiddleware) Chat(content string, id chat.ChatID) (string, erro
 	return answer, nil
 }
 
-func (mw *proxyingMiddleware) ChatStream(content string, id chat.ChatID) (<-chan string, error) {
+func (mw *proxyingMiddleware) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
 	req := &ChatRequest{
 		ID:      id,
 		Content: content,
 	}
 
-	resp, err := mw.ChatStreamEndpoint(context.Background(), req)
+	resp, err := mw.ChatStreamEndpoint(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, ok := resp.(<-chan string)
+	stream, ok := resp.(<-chan chat.Chunk)
 	if !ok {
 		return nil, errors.New("invalid response")
 	}
 
 	return stream, nil
 }
+
+func (mw *proxyingMiddleware) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	req := &RegenerateRequest{
+		ID: id,
+	}
+
+	resp, err := mw.RegenerateStreamEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, ok := resp.(<-chan chat.Chunk)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return stream, nil
+}
+
+func (mw *proxyingMiddleware) CancelChat(ctx context.Context, id chat.ChatID) error {
+	req := &CancelChatRequest{
+		ID: id,
+	}
+
+	_, err := mw.CancelChatEndpoint(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mw *proxyingMiddleware) ListChats(ctx context.Context, query *chat.Query) (*chat.Page, error) {
+	req := &ListChatsRequest{
+		Limit: query.Limit,
+		User:  query.User,
+		Model: query.Model,
+		Since: query.Since,
+		Until: query.Until,
+	}
+
+	if query.After != nil {
+		req.Cursor = query.After.String()
+	}
+
+	resp, err := mw.ListChatsEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	page, ok := resp.(*chat.Page)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return page, nil
+}
+
+func (mw *proxyingMiddleware) FindChat(ctx context.Context, id chat.ChatID) (*chat.Chat, error) {
+	req := &FindChatRequest{
+		ID: id,
+	}
+
+	resp, err := mw.FindChatEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := resp.(*chat.Chat)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return c, nil
+}
+
+func (mw *proxyingMiddleware) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (*chat.MessagePage, error) {
+	req := &ListMessagesRequest{
+		ID:     id,
+		Cursor: cursor,
+		Limit:  limit,
+	}
+
+	resp, err := mw.ListMessagesEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	page, ok := resp.(*chat.MessagePage)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return page, nil
+}
+
+func (mw *proxyingMiddleware) DeleteChat(ctx context.Context, id chat.ChatID) error {
+	req := &DeleteChatRequest{
+		ID: id,
+	}
+
+	_, err := mw.DeleteChatEndpoint(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mw *proxyingMiddleware) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) ([]byte, error) {
+	req := &ExportChatRequest{
+		ID:     id,
+		Format: format,
+	}
+
+	resp, err := mw.ExportChatEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resp.([]byte)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return data, nil
+}
+
+func (mw *proxyingMiddleware) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) ([]byte, error) {
+	req := &ExportChatsRequest{
+		ListChatsRequest: ListChatsRequest{
+			Limit: query.Limit,
+			User:  query.User,
+			Model: query.Model,
+			Since: query.Since,
+			Until: query.Until,
+		},
+		Format: format,
+	}
+
+	if query.After != nil {
+		req.Cursor = query.After.String()
+	}
+
+	resp, err := mw.ExportChatsEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resp.([]byte)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return data, nil
+}
+
+func (mw *proxyingMiddleware) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) ([]chat.ChatID, error) {
+	req := &ImportChatsRequest{
+		Format: format,
+		Model:  model,
+		Data:   data,
+		Access: access,
+	}
+
+	resp, err := mw.ImportChatsEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, ok := resp.([]chat.ChatID)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return ids, nil
+}
+
+func (mw *proxyingMiddleware) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) error {
+	req := &AnnotateChatRequest{
+		ID:         id,
+		Annotation: *annotation,
+	}
+
+	_, err := mw.AnnotateChatEndpoint(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mw *proxyingMiddleware) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) error {
+	req := &ShareChatRequest{
+		ID:      id,
+		Subject: subject,
+		Role:    role,
+	}
+
+	_, err := mw.ShareChatEndpoint(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mw *proxyingMiddleware) BuildDataset(ctx context.Context, spec *dataset.Spec) (*dataset.Dataset, error) {
+	resp, err := mw.BuildDatasetEndpoint(context.Background(), spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, ok := resp.(*dataset.Dataset)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return ds, nil
+}
+
+func (mw *proxyingMiddleware) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error) {
+	req := &CompletionRequest{
+		Body:   body,
+		ChatID: id,
+	}
+
+	resp, err := mw.CreateCompletionEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resp.(json.RawMessage)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return data, nil
+}
+
+func (mw *proxyingMiddleware) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	req := &CompletionRequest{
+		Body:   body,
+		ChatID: id,
+		Stream: true,
+	}
+
+	resp, err := mw.CreateCompletionStreamEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	events, ok := resp.(<-chan json.RawMessage)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return events, nil
+}
+
+func (mw *proxyingMiddleware) ListModels(ctx context.Context) (json.RawMessage, error) {
+	resp, err := mw.ListModelsEndpoint(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := resp.(json.RawMessage)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return data, nil
+}
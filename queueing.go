@@ -0,0 +1,298 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
+)
+
+var (
+	ErrQueueFull    = errors.New("too many pending requests for this chat")
+	ErrQueueTimeout = errors.New("timed out waiting for the previous request of this chat")
+)
+
+// QueueingMiddleware runs the requests modifying a chat one at a time,
+// in arrival order. A stream holds its chat until it is drained,
+// so the next request sees the streamed answer in the history.
+//
+// At most maxLength requests wait per chat, each for at most timeout;
+// zero means unbounded.
+func QueueingMiddleware(maxLength int, timeout time.Duration) ServiceMiddleware {
+	return func(next Service) Service {
+		return &queueingMiddleware{
+			queues:    make(map[chat.ChatID]*queue),
+			maxLength: maxLength,
+			timeout:   timeout,
+			next:      next,
+		}
+	}
+}
+
+type queue struct {
+	waiters []chan struct{}
+}
+
+type queueingMiddleware struct {
+	queues    map[chat.ChatID]*queue
+	maxLength int
+	timeout   time.Duration
+	next      Service
+	sync.Mutex
+}
+
+// acquire blocks until the request is at the head of the chat's queue,
+// or gives up its place once ctx is done.
+func (mw *queueingMiddleware) acquire(ctx context.Context, id chat.ChatID) error {
+	mw.Lock()
+
+	q, busy := mw.queues[id]
+	if !busy {
+		mw.queues[id] = new(queue)
+		mw.Unlock()
+		return nil
+	}
+
+	if mw.maxLength > 0 && len(q.waiters) >= mw.maxLength {
+		mw.Unlock()
+		return ErrQueueFull
+	}
+
+	turn := make(chan struct{})
+	q.waiters = append(q.waiters, turn)
+	mw.Unlock()
+
+	var timeout <-chan time.Time
+	if mw.timeout > 0 {
+		timer := time.NewTimer(mw.timeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var err error
+
+	select {
+	case <-turn:
+		return nil
+
+	case <-timeout:
+		err = ErrQueueTimeout
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mw.Lock()
+	defer mw.Unlock()
+
+	for i, waiter := range q.waiters {
+		if waiter == turn {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return err
+		}
+	}
+
+	// handed over while giving up, pass it on
+	mw.handover(id, q)
+	return err
+}
+
+func (mw *queueingMiddleware) release(id chat.ChatID) {
+	mw.Lock()
+	defer mw.Unlock()
+
+	if q, ok := mw.queues[id]; ok {
+		mw.handover(id, q)
+	}
+}
+
+// handover wakes the next waiter, or frees the chat if there is none.
+func (mw *queueingMiddleware) handover(id chat.ChatID, q *queue) {
+	if len(q.waiters) == 0 {
+		delete(mw.queues, id)
+		return
+	}
+
+	next := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(next)
+}
+
+func (mw *queueingMiddleware) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (chat.ChatID, error) {
+	return mw.next.CreateChat(ctx, model, prompt, rawOpts, access)
+}
+
+func (mw *queueingMiddleware) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
+	if err := mw.acquire(ctx, id); err != nil {
+		return err
+	}
+	defer mw.release(id)
+
+	return mw.next.UpdateChat(ctx, model, prompt, rawOpts, id)
+}
+
+func (mw *queueingMiddleware) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
+	if err := mw.acquire(ctx, id); err != nil {
+		return "", err
+	}
+	defer mw.release(id)
+
+	return mw.next.Chat(ctx, content, id)
+}
+
+func (mw *queueingMiddleware) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
+	if err := mw.acquire(ctx, id); err != nil {
+		return nil, err
+	}
+
+	stream, err := mw.next.ChatStream(ctx, content, id)
+	if err != nil {
+		mw.release(id)
+		return nil, err
+	}
+
+	data := make(chan chat.Chunk, 1)
+
+	go func() {
+		defer mw.release(id)
+		defer close(data)
+
+		for chunk := range stream {
+			data <- chunk
+		}
+	}()
+
+	return data, nil
+}
+
+func (mw *queueingMiddleware) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	if err := mw.acquire(ctx, id); err != nil {
+		return nil, err
+	}
+
+	stream, err := mw.next.RegenerateStream(ctx, id)
+	if err != nil {
+		mw.release(id)
+		return nil, err
+	}
+
+	data := make(chan chat.Chunk, 1)
+
+	go func() {
+		defer mw.release(id)
+		defer close(data)
+
+		for chunk := range stream {
+			data <- chunk
+		}
+	}()
+
+	return data, nil
+}
+
+// CancelChat is not queued, it has to reach the stream holding the chat.
+func (mw *queueingMiddleware) CancelChat(ctx context.Context, id chat.ChatID) error {
+	return mw.next.CancelChat(ctx, id)
+}
+
+func (mw *queueingMiddleware) ListChats(ctx context.Context, query *chat.Query) (*chat.Page, error) {
+	return mw.next.ListChats(ctx, query)
+}
+
+func (mw *queueingMiddleware) FindChat(ctx context.Context, id chat.ChatID) (*chat.Chat, error) {
+	return mw.next.FindChat(ctx, id)
+}
+
+func (mw *queueingMiddleware) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (*chat.MessagePage, error) {
+	return mw.next.ListMessages(ctx, id, cursor, limit)
+}
+
+func (mw *queueingMiddleware) DeleteChat(ctx context.Context, id chat.ChatID) error {
+	return mw.next.DeleteChat(ctx, id)
+}
+
+func (mw *queueingMiddleware) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) ([]byte, error) {
+	return mw.next.ExportChat(ctx, id, format)
+}
+
+func (mw *queueingMiddleware) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) ([]byte, error) {
+	return mw.next.ExportChats(ctx, query, format)
+}
+
+func (mw *queueingMiddleware) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) ([]chat.ChatID, error) {
+	return mw.next.ImportChats(ctx, data, format, model, access)
+}
+
+func (mw *queueingMiddleware) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) error {
+	if err := mw.acquire(ctx, id); err != nil {
+		return err
+	}
+	defer mw.release(id)
+
+	return mw.next.AnnotateChat(ctx, annotation, id)
+}
+
+func (mw *queueingMiddleware) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) error {
+	if err := mw.acquire(ctx, id); err != nil {
+		return err
+	}
+	defer mw.release(id)
+
+	return mw.next.ShareChat(ctx, subject, role, id)
+}
+
+func (mw *queueingMiddleware) BuildDataset(ctx context.Context, spec *dataset.Spec) (*dataset.Dataset, error) {
+	return mw.next.BuildDataset(ctx, spec)
+}
+
+func (mw *queueingMiddleware) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error) {
+	if id == (chat.ChatID{}) {
+		return mw.next.CreateCompletion(ctx, body, id)
+	}
+
+	if err := mw.acquire(ctx, id); err != nil {
+		return nil, err
+	}
+	defer mw.release(id)
+
+	return mw.next.CreateCompletion(ctx, body, id)
+}
+
+func (mw *queueingMiddleware) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	if id == (chat.ChatID{}) {
+		return mw.next.CreateCompletionStream(ctx, body, id)
+	}
+
+	if err := mw.acquire(ctx, id); err != nil {
+		return nil, err
+	}
+
+	events, err := mw.next.CreateCompletionStream(ctx, body, id)
+	if err != nil {
+		mw.release(id)
+		return nil, err
+	}
+
+	data := make(chan json.RawMessage, 1)
+
+	go func() {
+		defer mw.release(id)
+		defer close(data)
+
+		for event := range events {
+			data <- event
+		}
+	}()
+
+	return data, nil
+}
+
+func (mw *queueingMiddleware) ListModels(ctx context.Context) (json.RawMessage, error) {
+	return mw.next.ListModels(ctx)
+}
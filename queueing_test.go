@@ -0,0 +1,154 @@
+package openai
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/chat"
+)
+
+// recordingService appends every content to a shared history,
+// taking a while to answer like the upstream does.
+type recordingService struct {
+	Service
+	history []string
+	sync.Mutex
+}
+
+func (svc *recordingService) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
+	svc.Lock()
+	n := len(svc.history)
+	svc.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	svc.Lock()
+	defer svc.Unlock()
+
+	if len(svc.history) != n {
+		return "", chat.ErrConflict
+	}
+
+	svc.history = append(svc.history, content)
+	return content, nil
+}
+
+func (svc *recordingService) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
+	data := make(chan chat.Chunk)
+
+	go func() {
+		defer close(data)
+
+		answer, _ := svc.Chat(ctx, content, id)
+		data <- chat.Chunk{Content: answer}
+	}()
+
+	return data, nil
+}
+
+func TestQueueingMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	next := new(recordingService)
+	svc := QueueingMiddleware(0, time.Second)(next)
+
+	id := chat.ChatID{}
+
+	stream, err := svc.ChatStream(ctx, "first", id)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		_, err := svc.Chat(ctx, "second", id)
+		assert.NoError(err)
+	}()
+
+	for range stream {
+	}
+
+	wg.Wait()
+
+	assert.Equal([]string{"first", "second"}, next.history)
+}
+
+func TestQueueingMiddlewareBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	next := new(recordingService)
+	svc := QueueingMiddleware(1, 10*time.Millisecond)(next)
+
+	id := chat.ChatID{}
+
+	stream, err := svc.ChatStream(ctx, "first", id)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := svc.Chat(ctx, "second", id)
+		done <- err
+	}()
+
+	time.Sleep(time.Millisecond)
+
+	_, err = svc.Chat(ctx, "third", id)
+	assert.ErrorIs(err, ErrQueueFull)
+
+	assert.ErrorIs(<-done, ErrQueueTimeout)
+
+	for range stream {
+	}
+
+	// the chat is free again
+	_, err = svc.Chat(ctx, "fourth", id)
+	assert.NoError(err)
+	assert.Equal([]string{"first", "fourth"}, next.history)
+}
+
+func TestQueueingMiddlewareCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	next := new(recordingService)
+	svc := QueueingMiddleware(1, time.Minute)(next)
+
+	id := chat.ChatID{}
+
+	stream, err := svc.ChatStream(ctx, "first", id)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	// a caller going away gives up its place in the queue
+	canceled, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+
+	_, err = svc.Chat(canceled, "second", id)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	_, err = svc.Chat(ctx, "third", id)
+	assert.NoError(err)
+
+	for range stream {
+	}
+
+	assert.Equal([]string{"first", "third"}, next.history)
+}
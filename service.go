@@ -3,43 +3,120 @@ package openai
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
 
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
 	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/dataset"
 )
 
 type Service interface {
-	CreateChat(model string, prompt string, rawOpts json.RawMessage) (chat.ChatID, error)
-	UpdateChat(model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error
-	Chat(content string, id chat.ChatID) (string, error)
-	ChatStream(content string, id chat.ChatID) (<-chan string, error)
+	CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (chat.ChatID, error)
+	UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error
+	Chat(ctx context.Context, content string, id chat.ChatID) (string, error)
+	ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error)
+	RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error)
+	CancelChat(ctx context.Context, id chat.ChatID) error
+	ListChats(ctx context.Context, query *chat.Query) (*chat.Page, error)
+	FindChat(ctx context.Context, id chat.ChatID) (*chat.Chat, error)
+	ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (*chat.MessagePage, error)
+	DeleteChat(ctx context.Context, id chat.ChatID) error
+	ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) ([]byte, error)
+	ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) ([]byte, error)
+	ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) ([]chat.ChatID, error)
+	AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) error
+	ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) error
+	BuildDataset(ctx context.Context, spec *dataset.Spec) (*dataset.Dataset, error)
+
+	// wire-compatible with the OpenAI API, stateless unless a chat is given
+	CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error)
+	CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error)
+	ListModels(ctx context.Context) (json.RawMessage, error)
+}
+
+// DefaultBaseURL is the OpenAI API, unless conf.Config.BaseURL says otherwise.
+const DefaultBaseURL = "https://api.openai.com/v1"
+
+// UpstreamError is a failed response of the OpenAI API, kept as it is
+// so compatible clients see the original error.
+type UpstreamError struct {
+	StatusCode int
+	Body       json.RawMessage
+}
+
+func (e *UpstreamError) Error() string {
+	var failed *chat.Response
+	if err := json.Unmarshal(e.Body, &failed); err == nil && failed.Error != nil {
+		return failed.Err().Error()
+	}
+
+	return http.StatusText(e.StatusCode)
+}
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageLimit
+	}
+
+	if limit > MaxPageLimit {
+		return MaxPageLimit
+	}
+
+	return limit
 }
 
 type ServiceMiddleware func(Service) Service
 
 func NewService(chats chat.Repository, cfg *conf.Config) Service {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
 	return &service{
 		log: zap.L().With(
 			zap.String("service", "openai"),
 		),
-		chats:  chats,
-		apiKey: cfg.APIKey,
+		chats:       chats,
+		client:      &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		apiKey:      cfg.APIKey,
+		baseURL:     baseURL,
+		generations: make(map[chat.ChatID]*generation),
 	}
 }
 
 type service struct {
-	log    *zap.Logger
-	chats  chat.Repository
-	apiKey string
+	log     *zap.Logger
+	chats   chat.Repository
+	client  *http.Client // traced
+	apiKey  string
+	baseURL string
+
+	generations map[chat.ChatID]*generation // answers being streamed
+	sync.Mutex
 }
 
-func (svc *service) CreateChat(model string, prompt string, rawOpts json.RawMessage) (chat.ChatID, error) {
+// generation is an answer being streamed, which CancelChat stops.
+type generation struct {
+	cancel context.CancelFunc
+}
+
+func (svc *service) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (chat.ChatID, error) {
 	var opts *chat.Options
 	if rawOpts != nil {
 		err := json.Unmarshal(rawOpts, &opts)
@@ -49,16 +126,17 @@ func (svc *service) CreateChat(model string, prompt string, rawOpts json.RawMess
 	}
 
 	c := chat.NewChat(model, prompt, opts)
+	c.Access = access
 
-	if err := svc.chats.Store(c); err != nil {
+	if err := svc.repo(ctx).Store(c); err != nil {
 		return chat.ChatID{}, err
 	}
 
 	return c.ID, nil
 }
 
-func (svc *service) UpdateChat(model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
-	c, err := svc.chats.Find(id)
+func (svc *service) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) error {
+	c, err := svc.repo(ctx).Find(id)
 	if err != nil {
 		return err
 	}
@@ -81,24 +159,31 @@ func (svc *service) UpdateChat(model string, prompt string, rawOpts json.RawMess
 			return err
 		}
 
+		if c.Options == nil {
+			c.Options = new(chat.Options)
+		}
+
 		if err := c.Options.Update(opts); err != nil {
 			return err
 		}
 	}
 
-	if err := svc.chats.Store(c); err != nil {
+	if err := svc.repo(ctx).Store(c); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (svc *service) Chat(content string, id chat.ChatID) (string, error) {
-	c, err := svc.chats.Find(id)
+func (svc *service) Chat(ctx context.Context, content string, id chat.ChatID) (string, error) {
+	c, err := svc.repo(ctx).Find(id)
 	if err != nil {
 		return "", err
 	}
 
+	traceChat(ctx, c)
+	reportChat(ctx, c)
+
 	c.AddMessage(&chat.Message{
 		Role:    chat.User,
 		Content: content,
@@ -109,7 +194,7 @@ func (svc *service) Chat(content string, id chat.ChatID) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(bs))
+	req, err := http.NewRequestWithContext(detached(ctx), "POST", svc.baseURL+"/chat/completions", bytes.NewBuffer(bs))
 	if err != nil {
 		return "", err
 	}
@@ -117,50 +202,115 @@ func (svc *service) Chat(content string, id chat.ChatID) (string, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+svc.apiKey)
 
-	client := new(http.Client)
-
-	resp, err := client.Do(req)
+	resp, err := svc.client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	var result *chat.Response
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
 		return "", err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", result.Err()
+		return "", &UpstreamError{resp.StatusCode, data}
+	}
+
+	var result *chat.Response
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
 	}
 
 	if len(result.Choices) == 0 {
 		return "", errors.New("empty choices")
 	}
 
-	for _, choice := range result.Choices {
-		c.AddMessage(choice.Message)
-	}
+	traceUsage(ctx, result.Usage)
+	reportUsage(ctx, result.Usage)
+
+	c.AddMessage(result.Choices[0].Message)
 
-	if err := svc.chats.Store(c); err != nil {
+	if err := svc.repo(ctx).Store(c); err != nil {
 		return "", err
 	}
 
 	return result.Choices[0].Message.Content, nil
 }
 
-func (svc *service) ChatStream(content string, id chat.ChatID) (<-chan string, error) {
-	c, err := svc.chats.Find(id)
+func (svc *service) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
+	c, err := svc.repo(ctx).Find(id)
 	if err != nil {
 		return nil, err
 	}
 
+	traceChat(ctx, c)
+	reportChat(ctx, c)
+
 	c.AddMessage(&chat.Message{
 		Role:    chat.User,
 		Content: content,
 	})
 
-	reqMsg := c.Request()
+	return svc.answerStream(ctx, c, false)
+}
+
+// RegenerateStream streams a new answer replacing the last one of the chat,
+// or answers the last message if it has no answer yet. The last answer is
+// kept if the new one is canceled before any content.
+func (svc *service) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	traceChat(ctx, c)
+	reportChat(ctx, c)
+
+	n := len(c.Messages)
+	replace := n > 0 && c.Messages[n-1].Role == chat.Assistant
+	if replace {
+		n--
+	}
+
+	if n == 0 || c.Messages[n-1].Role != chat.User {
+		return nil, errors.New("no message to answer")
+	}
+
+	return svc.answerStream(ctx, c, replace)
+}
+
+// CancelChat stops the answer being streamed for the chat, if any.
+// What was streamed so far is kept as the answer.
+func (svc *service) CancelChat(ctx context.Context, id chat.ChatID) error {
+	if _, err := svc.repo(ctx).Find(id); err != nil {
+		return err
+	}
+
+	svc.Lock()
+	g, ok := svc.generations[id]
+	svc.Unlock()
+
+	if ok {
+		g.cancel()
+	}
+
+	return nil
+}
+
+// answerStream streams the answer to the chat, replacing its last message
+// if replace is set.
+func (svc *service) answerStream(ctx context.Context, c *chat.Chat, replace bool) (<-chan chat.Chunk, error) {
+	prompt := c
+	if replace {
+		unanswered := *c
+		unanswered.Messages = c.Messages[:len(c.Messages)-1]
+		prompt = &unanswered
+	}
+
+	reportPrompt(ctx, prompt)
+
+	reqMsg := prompt.Request()
 	reqMsg.Stream = new(bool)
 	*reqMsg.Stream = true
 
@@ -169,53 +319,567 @@ func (svc *service) ChatStream(content string, id chat.ChatID) (<-chan string, e
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(bs))
+	ctx, cancel := context.WithCancel(detached(ctx))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", svc.baseURL+"/chat/completions", bytes.NewBuffer(bs))
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+svc.apiKey)
 
-	client := new(http.Client)
+	resp, err := svc.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, &UpstreamError{resp.StatusCode, data}
+	}
+
+	g := &generation{cancel}
+
+	svc.Lock()
+	svc.generations[c.ID] = g
+	svc.Unlock()
+
+	data := make(chan chat.Chunk, 1)
+
+	go func() {
+		defer func() {
+			svc.Lock()
+			if svc.generations[c.ID] == g {
+				delete(svc.generations, c.ID)
+			}
+			svc.Unlock()
+
+			cancel()
+		}()
+
+		svc.stream(ctx, c, replace, resp.Body, data)
+	}()
+
+	return data, nil
+}
+
+func (svc *service) ListChats(ctx context.Context, query *chat.Query) (*chat.Page, error) {
+	q := *query
+	q.Limit = pageLimit(query.Limit)
+
+	// fetch one extra chat to know whether there is a next page
+	limit := q.Limit
+	q.Limit++
+
+	chats, err := svc.repo(ctx).List(&q)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &chat.Page{
+		Chats: chats,
+	}
+
+	if len(chats) > limit {
+		page.Chats = chats[:limit]
+
+		next := page.Chats[limit-1].ID
+		page.Next = &next
+	}
+
+	return page, nil
+}
+
+func (svc *service) FindChat(ctx context.Context, id chat.ChatID) (*chat.Chat, error) {
+	return svc.repo(ctx).Find(id)
+}
+
+func (svc *service) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (*chat.MessagePage, error) {
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor < 0 {
+		return nil, errors.New("invalid cursor")
+	}
+
+	limit = pageLimit(limit)
+
+	page := &chat.MessagePage{
+		Messages: make([]*chat.Message, 0),
+	}
+
+	total := len(c.Messages)
+	if cursor >= total {
+		return page, nil
+	}
+
+	end := cursor + limit
+	if end < total {
+		page.Next = &end
+	} else {
+		end = total
+	}
+
+	page.Messages = c.Messages[cursor:end]
+
+	return page, nil
+}
+
+func (svc *service) DeleteChat(ctx context.Context, id chat.ChatID) error {
+	return svc.repo(ctx).Delete(id)
+}
+
+func (svc *service) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) ([]byte, error) {
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := transcript.Export(&buf, format, []*chat.Chat{c}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (svc *service) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) ([]byte, error) {
+	chats, err := svc.repo(ctx).List(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := transcript.Export(&buf, format, chats); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (svc *service) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) ([]chat.ChatID, error) {
+	chats, err := transcript.Import(bytes.NewReader(data), format, model)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]chat.ChatID, 0, len(chats))
+	for _, c := range chats {
+		c.Access = access.Clone()
+
+		if err := svc.repo(ctx).Store(c); err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, c.ID)
+	}
+
+	return ids, nil
+}
 
-	resp, err := client.Do(req)
+func (svc *service) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) error {
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Annotation.Update(annotation); err != nil {
+		return err
+	}
+
+	return svc.repo(ctx).Store(c)
+}
+
+func (svc *service) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) error {
+	if subject == "" {
+		return errors.New("subject required")
+	}
+
+	if role != "" {
+		if _, ok := chat.ParseMemberRole(string(role)); !ok {
+			return errors.New("invalid role: " + string(role))
+		}
+	}
+
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return err
+	}
+
+	if role == "" && c.Owner == subject {
+		return errors.New("cannot revoke the owner, transfer the ownership first")
+	}
+
+	c.Share(subject, role)
+
+	return svc.repo(ctx).Store(c)
+}
+
+func (svc *service) BuildDataset(ctx context.Context, spec *dataset.Spec) (*dataset.Dataset, error) {
+	chats, err := svc.repo(ctx).List(spec.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	return dataset.Build(chats, spec)
+}
+
+// CreateCompletion forwards the request as it is. Given a chat, the stored
+// history is sent ahead of the messages of the request, which are then
+// appended to the chat along with the reply.
+func (svc *service) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (json.RawMessage, error) {
+	if id == (chat.ChatID{}) {
+		return svc.complete(ctx, body)
+	}
+
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	traceChat(ctx, c)
+	reportChat(ctx, c)
+
+	body, turn, err := withHistory(c, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reply is stored even if the caller goes away
+	data, err := svc.complete(detached(ctx), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *chat.Response
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result.Choices) == 0 {
+		return nil, errors.New("empty choices")
+	}
+
+	for _, msg := range turn {
+		c.AddMessage(msg)
+	}
+
+	c.AddMessage(result.Choices[0].Message)
+
+	if err := svc.repo(ctx).Store(c); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (svc *service) complete(ctx context.Context, body json.RawMessage) (json.RawMessage, error) {
+	traceModel(ctx, body)
+
+	resp, err := svc.upstream(ctx, "POST", "/chat/completions", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{resp.StatusCode, data}
+	}
+
+	var result *chat.Response
+	if err := json.Unmarshal(data, &result); err == nil && result != nil {
+		traceUsage(ctx, result.Usage)
+		reportUsage(ctx, result.Usage)
+	}
+
+	return data, nil
+}
+
+// CreateCompletionStream forwards the data of the server-sent events,
+// closing the channel at [DONE]. Given a chat, the streamed reply is
+// appended once it is finished.
+func (svc *service) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	if id == (chat.ChatID{}) {
+		return svc.completeStream(ctx, body)
+	}
+
+	c, err := svc.repo(ctx).Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	traceChat(ctx, c)
+	reportChat(ctx, c)
+
+	body, turn, err := withHistory(c, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reply is stored even if the caller goes away
+	events, err := svc.completeStream(detached(ctx), body)
+	if err != nil {
+		return nil, err
+	}
+
+	log := svc.log.With(
+		zap.String("action", "create_completion_stream"),
+		zap.String("chat_id", id.String()),
+	)
+
+	data := make(chan json.RawMessage, 1)
+
+	go func() {
+		defer close(data)
+
+		msg := &chat.Message{Role: chat.Assistant}
+		finished := false
+
+		for event := range events {
+			data <- event
+
+			var chunk *chat.Response
+			if err := json.Unmarshal(event, &chunk); err != nil || len(chunk.Choices) == 0 {
+				continue
+			}
+
+			choice := chunk.Choices[0]
+			if choice.Delta != nil {
+				if choice.Delta.Role != "" {
+					msg.Role = choice.Delta.Role
+				}
+
+				msg.Content += choice.Delta.Content
+			}
+
+			if choice.FinishReason != nil {
+				finished = true
+			}
+		}
+
+		if !finished {
+			log.Error("stream interrupted, reply not stored")
+			return
+		}
+
+		for _, m := range turn {
+			c.AddMessage(m)
+		}
+		c.AddMessage(msg)
+
+		if err := svc.repo(ctx).Store(c); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	return data, nil
+}
+
+func (svc *service) completeStream(ctx context.Context, body json.RawMessage) (<-chan json.RawMessage, error) {
+	traceModel(ctx, body)
+
+	resp, err := svc.upstream(ctx, "POST", "/chat/completions", body)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var failedResult *chat.Response
-		if err := json.NewDecoder(resp.Body).Decode(&failedResult); err != nil {
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
 			return nil, err
 		}
 
-		return nil, failedResult.Err()
+		return nil, &UpstreamError{resp.StatusCode, data}
+	}
+
+	events := make(chan json.RawMessage, 1)
+
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if !bytes.HasPrefix(line, []byte("data:")) {
+				continue
+			}
+
+			data := bytes.TrimSpace(line[len("data:"):])
+			if string(data) == "[DONE]" {
+				return
+			}
+
+			select {
+			case events <- append(json.RawMessage(nil), data...):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			svc.log.Error(err.Error(), zap.String("action", "create_completion_stream"))
+		}
+	}()
+
+	return events, nil
+}
+
+func (svc *service) ListModels(ctx context.Context) (json.RawMessage, error) {
+	resp, err := svc.upstream(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	data := make(chan string, 1)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
 
-	go svc.stream(c, resp.Body, data)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{resp.StatusCode, data}
+	}
 
 	return data, nil
 }
 
-func (svc *service) stream(ctx *chat.Chat, reader io.ReadCloser, data chan<- string) error {
+// ErrMultipleChoices is returned for completions of a chat asking for more
+// than one choice, as a chat keeps a single reply per turn.
+var ErrMultipleChoices = errors.New("n must be 1 to store the reply to a chat")
+
+// withHistory prepends the messages of the chat to those of the request,
+// which are returned as the new turn. The model and options of the chat
+// apply unless the request sets them.
+func withHistory(c *chat.Chat, body json.RawMessage) (json.RawMessage, []*chat.Message, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, err
+	}
+
+	var turn []*chat.Message
+	if raw, ok := req["messages"]; ok {
+		if err := json.Unmarshal(raw, &turn); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(turn) == 0 {
+		return nil, nil, errors.New("messages required")
+	}
+
+	if raw, ok := req["n"]; ok {
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, nil, err
+		}
+
+		if n > 1 {
+			return nil, nil, ErrMultipleChoices
+		}
+	}
+
+	defaults := c.Request()
+	defaults.Stream = nil
+	defaults.Messages = append(append([]*chat.Message{}, c.Messages...), turn...)
+
+	bs, err := json.Marshal(defaults)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var history map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &history); err != nil {
+		return nil, nil, err
+	}
+
+	for key, value := range history {
+		if _, ok := req[key]; !ok || key == "messages" {
+			req[key] = value
+		}
+	}
+
+	bs, err = json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bs, turn, nil
+}
+
+// upstream ends with ctx; the callers storing the answer to a chat
+// detach it first.
+func (svc *service) upstream(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, svc.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+svc.apiKey)
+
+	return svc.client.Do(req)
+}
+
+// stream sends the content deltas of the server-sent events and adds the
+// answer to the chat once done. A canceled answer is kept as it is so far,
+// a failed one ends the stream with a chunk carrying the error.
+func (svc *service) stream(ctx context.Context, c *chat.Chat, replace bool, reader io.ReadCloser, data chan<- chat.Chunk) (err error) {
 	log := svc.log.With(
 		zap.String("action", "chat_stream"),
-		zap.String("chat_id", ctx.ID.String()),
+		zap.String("chat_id", c.ID.String()),
 	)
 
 	defer reader.Close()
-	defer close(data)
+	defer func() {
+		if err != nil {
+			data <- chat.Chunk{Err: err}
+		}
+
+		close(data)
+	}()
 
-	msg := new(chat.Message)
+	msg := &chat.Message{Role: chat.Assistant}
 
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+
+		line = bytes.TrimSpace(line[len("data:"):])
+		if string(line) == "[DONE]" {
+			break
+		}
+
 		var chunk *chat.Response
 
-		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+		if err := json.Unmarshal(line, &chunk); err != nil {
 			log.Error(err.Error())
 			return err
 		}
@@ -228,40 +892,56 @@ func (svc *service) stream(ctx *chat.Chat, reader io.ReadCloser, data chan<- str
 
 		choice := chunk.Choices[0]
 
+		if delta := choice.Delta; delta != nil {
+			if delta.Role != "" {
+				msg.Role = delta.Role
+			}
+
+			if delta.Content != "" {
+				msg.Content += delta.Content
+				data <- chat.Chunk{Content: delta.Content}
+
+				log.Debug("chunk", zap.String("content", delta.Content))
+			}
+		}
+
 		finish := choice.FinishReason
 		if finish != nil && *finish == chat.Stop {
 			log.Info("done")
 			break
 		}
+	}
 
-		if choice.Delta.Role != "" {
-			msg.Role = choice.Delta.Role
-
-			log.Debug("chunk",
-				zap.String("role", string(choice.Delta.Role)),
-			)
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() == nil {
+			log.Error(err.Error())
+			return err
 		}
 
-		if choice.Delta.Content != "" {
-			data <- msg.Content
+		log.Info("canceled")
+	}
+
+	if replace {
+		if msg.Content == "" {
+			// keep the last answer
+			return nil
+		}
 
-			msg.Content += choice.Delta.Content
+		c.Messages[len(c.Messages)-1] = msg
 
-			log.Debug("chunk",
-				zap.String("content", choice.Delta.Content),
-				zap.String("full_content", msg.Content),
-			)
+		if err := svc.repo(ctx).ReplaceLastMessage(c); err != nil {
+			log.Error(err.Error())
+			return err
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		log.Error(err.Error())
-		return err
+		return nil
 	}
 
-	ctx.AddMessage(msg)
+	if msg.Content != "" {
+		c.AddMessage(msg)
+	}
 
-	if err := svc.chats.Store(ctx); err != nil {
+	if err := svc.repo(ctx).Store(c); err != nil {
 		log.Error(err.Error())
 		return err
 	}
@@ -0,0 +1,394 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/endpoint"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
+)
+
+// TracerName is the instrumentation name of the spans of the service.
+const TracerName = "github.com/mirror520/openai"
+
+// Span attributes, after the semantic conventions of generative AI.
+const (
+	ChatIDKey         = attribute.Key("chat.id")
+	ModelKey          = attribute.Key("gen_ai.request.model")
+	InputTokensKey    = attribute.Key("gen_ai.usage.input_tokens")
+	OutputTokensKey   = attribute.Key("gen_ai.usage.output_tokens")
+	StreamedChunksKey = attribute.Key("openai.stream.chunks")
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// detached keeps the span and the report of ctx but not its cancellation,
+// for the calls upstream whose answers are stored even if the caller goes
+// away.
+func detached(ctx context.Context) context.Context {
+	detached := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+	if r := reportFrom(ctx); r != nil {
+		detached = context.WithValue(detached, reportKey{}, r)
+	}
+
+	return detached
+}
+
+// traceChat labels the current span with the chat and its model.
+func traceChat(ctx context.Context, c *chat.Chat) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		ChatIDKey.String(c.ID.String()),
+		ModelKey.String(c.Model),
+	)
+}
+
+// traceUsage labels the current span with the usage reported upstream.
+func traceUsage(ctx context.Context, usage *chat.Usage) {
+	if usage == nil {
+		return
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		InputTokensKey.Int(usage.PromptTokens),
+		OutputTokensKey.Int(usage.CompletionTokens),
+	)
+}
+
+// traceModel labels the current span with the model of the request body.
+func traceModel(ctx context.Context, body json.RawMessage) {
+	var req struct {
+		Model string `json:"model"`
+	}
+
+	if err := json.Unmarshal(body, &req); err == nil && req.Model != "" {
+		trace.SpanFromContext(ctx).SetAttributes(ModelKey.String(req.Model))
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// TracingEndpoint spans the calls of the endpoint.
+func TracingEndpoint(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request any) (response any, err error) {
+			ctx, span := tracer().Start(ctx, "endpoint/"+name)
+			defer func() { endSpan(span, err) }()
+
+			if id, ok := RequestChatID(request); ok {
+				span.SetAttributes(ChatIDKey.String(id.String()))
+			}
+
+			return next(ctx, request)
+		}
+	}
+}
+
+// TracedEndpoints spans the calls of the endpoints.
+func TracedEndpoints(endpoints *ChatEndpoints) *ChatEndpoints {
+	traced := func(name string, e endpoint.Endpoint) endpoint.Endpoint {
+		if e == nil {
+			return nil
+		}
+
+		return TracingEndpoint(name)(e)
+	}
+
+	return &ChatEndpoints{
+		CreateChatEndpoint: traced("CreateChat", endpoints.CreateChatEndpoint),
+		UpdateChatEndpoint: traced("UpdateChat", endpoints.UpdateChatEndpoint),
+		ChatEndpoint:       traced("Chat", endpoints.ChatEndpoint),
+		ChatStreamEndpoint: traced("ChatStream", endpoints.ChatStreamEndpoint),
+
+		RegenerateStreamEndpoint: traced("RegenerateStream", endpoints.RegenerateStreamEndpoint),
+		CancelChatEndpoint:       traced("CancelChat", endpoints.CancelChatEndpoint),
+
+		ListChatsEndpoint:    traced("ListChats", endpoints.ListChatsEndpoint),
+		FindChatEndpoint:     traced("FindChat", endpoints.FindChatEndpoint),
+		ListMessagesEndpoint: traced("ListMessages", endpoints.ListMessagesEndpoint),
+		DeleteChatEndpoint:   traced("DeleteChat", endpoints.DeleteChatEndpoint),
+
+		ExportChatEndpoint:  traced("ExportChat", endpoints.ExportChatEndpoint),
+		ExportChatsEndpoint: traced("ExportChats", endpoints.ExportChatsEndpoint),
+		ImportChatsEndpoint: traced("ImportChats", endpoints.ImportChatsEndpoint),
+
+		AnnotateChatEndpoint: traced("AnnotateChat", endpoints.AnnotateChatEndpoint),
+		ShareChatEndpoint:    traced("ShareChat", endpoints.ShareChatEndpoint),
+		BuildDatasetEndpoint: traced("BuildDataset", endpoints.BuildDatasetEndpoint),
+
+		CreateCompletionEndpoint:       traced("CreateCompletion", endpoints.CreateCompletionEndpoint),
+		CreateCompletionStreamEndpoint: traced("CreateCompletionStream", endpoints.CreateCompletionStreamEndpoint),
+		ListModelsEndpoint:             traced("ListModels", endpoints.ListModelsEndpoint),
+	}
+}
+
+// TracingMiddleware spans the calls of the service, until the end of the
+// streams. The service labels the spans with the chat, its model and the
+// usage reported upstream.
+func TracingMiddleware() ServiceMiddleware {
+	return func(next Service) Service {
+		return &tracingMiddleware{next}
+	}
+}
+
+type tracingMiddleware struct {
+	next Service
+}
+
+func (mw *tracingMiddleware) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "openai.Service/"+method, trace.WithAttributes(attrs...))
+}
+
+// traceStream ends the span once the stream is drained, with the error
+// of the answers ending early.
+func traceStream[T any](span trace.Span, stream <-chan T) <-chan T {
+	relayed := make(chan T, 1)
+
+	go func() {
+		defer close(relayed)
+
+		var err error
+		chunks := 0
+		for chunk := range stream {
+			if c, ok := any(chunk).(chat.Chunk); ok && c.Err != nil {
+				err = c.Err
+			} else {
+				chunks++
+			}
+
+			relayed <- chunk
+		}
+
+		span.SetAttributes(StreamedChunksKey.Int(chunks))
+		endSpan(span, err)
+	}()
+
+	return relayed
+}
+
+func (mw *tracingMiddleware) CreateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, access chat.Access) (id chat.ChatID, err error) {
+	ctx, span := mw.start(ctx, "CreateChat", ModelKey.String(model))
+	defer func() {
+		span.SetAttributes(ChatIDKey.String(id.String()))
+		endSpan(span, err)
+	}()
+
+	return mw.next.CreateChat(ctx, model, prompt, rawOpts, access)
+}
+
+func (mw *tracingMiddleware) UpdateChat(ctx context.Context, model string, prompt string, rawOpts json.RawMessage, id chat.ChatID) (err error) {
+	ctx, span := mw.start(ctx, "UpdateChat", ChatIDKey.String(id.String()), ModelKey.String(model))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.UpdateChat(ctx, model, prompt, rawOpts, id)
+}
+
+func (mw *tracingMiddleware) Chat(ctx context.Context, content string, id chat.ChatID) (answer string, err error) {
+	ctx, span := mw.start(ctx, "Chat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.Chat(ctx, content, id)
+}
+
+func (mw *tracingMiddleware) ChatStream(ctx context.Context, content string, id chat.ChatID) (<-chan chat.Chunk, error) {
+	ctx, span := mw.start(ctx, "ChatStream", ChatIDKey.String(id.String()))
+
+	stream, err := mw.next.ChatStream(ctx, content, id)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return traceStream(span, stream), nil
+}
+
+func (mw *tracingMiddleware) RegenerateStream(ctx context.Context, id chat.ChatID) (<-chan chat.Chunk, error) {
+	ctx, span := mw.start(ctx, "RegenerateStream", ChatIDKey.String(id.String()))
+
+	stream, err := mw.next.RegenerateStream(ctx, id)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return traceStream(span, stream), nil
+}
+
+func (mw *tracingMiddleware) CancelChat(ctx context.Context, id chat.ChatID) (err error) {
+	ctx, span := mw.start(ctx, "CancelChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.CancelChat(ctx, id)
+}
+
+func (mw *tracingMiddleware) ListChats(ctx context.Context, query *chat.Query) (page *chat.Page, err error) {
+	ctx, span := mw.start(ctx, "ListChats")
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ListChats(ctx, query)
+}
+
+func (mw *tracingMiddleware) FindChat(ctx context.Context, id chat.ChatID) (c *chat.Chat, err error) {
+	ctx, span := mw.start(ctx, "FindChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.FindChat(ctx, id)
+}
+
+func (mw *tracingMiddleware) ListMessages(ctx context.Context, id chat.ChatID, cursor int, limit int) (page *chat.MessagePage, err error) {
+	ctx, span := mw.start(ctx, "ListMessages", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ListMessages(ctx, id, cursor, limit)
+}
+
+func (mw *tracingMiddleware) DeleteChat(ctx context.Context, id chat.ChatID) (err error) {
+	ctx, span := mw.start(ctx, "DeleteChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.DeleteChat(ctx, id)
+}
+
+func (mw *tracingMiddleware) ExportChat(ctx context.Context, id chat.ChatID, format transcript.Format) (data []byte, err error) {
+	ctx, span := mw.start(ctx, "ExportChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ExportChat(ctx, id, format)
+}
+
+func (mw *tracingMiddleware) ExportChats(ctx context.Context, query *chat.Query, format transcript.Format) (data []byte, err error) {
+	ctx, span := mw.start(ctx, "ExportChats")
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ExportChats(ctx, query, format)
+}
+
+func (mw *tracingMiddleware) ImportChats(ctx context.Context, data []byte, format transcript.Format, model string, access chat.Access) (ids []chat.ChatID, err error) {
+	ctx, span := mw.start(ctx, "ImportChats", ModelKey.String(model))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ImportChats(ctx, data, format, model, access)
+}
+
+func (mw *tracingMiddleware) AnnotateChat(ctx context.Context, annotation *chat.Annotation, id chat.ChatID) (err error) {
+	ctx, span := mw.start(ctx, "AnnotateChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.AnnotateChat(ctx, annotation, id)
+}
+
+func (mw *tracingMiddleware) ShareChat(ctx context.Context, subject string, role chat.MemberRole, id chat.ChatID) (err error) {
+	ctx, span := mw.start(ctx, "ShareChat", ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ShareChat(ctx, subject, role, id)
+}
+
+func (mw *tracingMiddleware) BuildDataset(ctx context.Context, spec *dataset.Spec) (ds *dataset.Dataset, err error) {
+	ctx, span := mw.start(ctx, "BuildDataset")
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.BuildDataset(ctx, spec)
+}
+
+func (mw *tracingMiddleware) CreateCompletion(ctx context.Context, body json.RawMessage, id chat.ChatID) (data json.RawMessage, err error) {
+	ctx, span := mw.start(ctx, "CreateCompletion")
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.CreateCompletion(ctx, body, id)
+}
+
+func (mw *tracingMiddleware) CreateCompletionStream(ctx context.Context, body json.RawMessage, id chat.ChatID) (<-chan json.RawMessage, error) {
+	ctx, span := mw.start(ctx, "CreateCompletionStream")
+
+	events, err := mw.next.CreateCompletionStream(ctx, body, id)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return traceStream(span, events), nil
+}
+
+func (mw *tracingMiddleware) ListModels(ctx context.Context) (data json.RawMessage, err error) {
+	ctx, span := mw.start(ctx, "ListModels")
+	defer func() { endSpan(span, err) }()
+
+	return mw.next.ListModels(ctx)
+}
+
+// tracedRepository spans the calls to the repository within ctx.
+type tracedRepository struct {
+	ctx  context.Context
+	next chat.Repository
+}
+
+func (svc *service) repo(ctx context.Context) chat.Repository {
+	return &tracedRepository{ctx, svc.chats}
+}
+
+func (repo *tracedRepository) start(method string) trace.Span {
+	_, span := tracer().Start(repo.ctx, "chat.Repository/"+method, trace.WithSpanKind(trace.SpanKindClient))
+	return span
+}
+
+func (repo *tracedRepository) Store(c *chat.Chat) (err error) {
+	span := repo.start("Store")
+	span.SetAttributes(ChatIDKey.String(c.ID.String()))
+	defer func() { endSpan(span, err) }()
+
+	return repo.next.Store(c)
+}
+
+func (repo *tracedRepository) ReplaceLastMessage(c *chat.Chat) (err error) {
+	span := repo.start("ReplaceLastMessage")
+	span.SetAttributes(ChatIDKey.String(c.ID.String()))
+	defer func() { endSpan(span, err) }()
+
+	return repo.next.ReplaceLastMessage(c)
+}
+
+func (repo *tracedRepository) Find(id chat.ChatID) (c *chat.Chat, err error) {
+	span := repo.start("Find")
+	span.SetAttributes(ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return repo.next.Find(id)
+}
+
+func (repo *tracedRepository) List(q *chat.Query) (chats []*chat.Chat, err error) {
+	span := repo.start("List")
+	defer func() {
+		span.SetAttributes(attribute.Int("chats", len(chats)))
+		endSpan(span, err)
+	}()
+
+	return repo.next.List(q)
+}
+
+func (repo *tracedRepository) Delete(id chat.ChatID) (err error) {
+	span := repo.start("Delete")
+	span.SetAttributes(ChatIDKey.String(id.String()))
+	defer func() { endSpan(span, err) }()
+
+	return repo.next.Delete(id)
+}
+
+func (repo *tracedRepository) Close() error {
+	return repo.next.Close()
+}
@@ -0,0 +1,122 @@
+package openai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func spanNamed(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+
+	return tracetest.SpanStub{}, false
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hello"}}],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`))
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	svc := NewService(chats, &conf.Config{BaseURL: upstream.URL})
+	svc = TracingMiddleware()(svc)
+
+	id, err := svc.CreateChat(context.Background(), "gpt-4", "", nil, chat.Access{})
+	assert.NoError(err)
+
+	exporter.Reset()
+
+	endpoints := TracedEndpoints(&ChatEndpoints{
+		ChatEndpoint: ChatEndpoint(svc),
+	})
+	assert.Nil(endpoints.ChatStreamEndpoint)
+
+	_, err = endpoints.ChatEndpoint(context.Background(), &ChatRequest{ID: id, Content: "Hi"})
+	assert.NoError(err)
+
+	spans := exporter.GetSpans()
+
+	endpoint, ok := spanNamed(spans, "endpoint/Chat")
+	assert.True(ok)
+	assert.Equal(id.String(), spanAttribute(endpoint, ChatIDKey).AsString())
+
+	service, ok := spanNamed(spans, "openai.Service/Chat")
+	assert.True(ok)
+	assert.Equal(endpoint.SpanContext.SpanID(), service.Parent.SpanID())
+	assert.Equal(id.String(), spanAttribute(service, ChatIDKey).AsString())
+	assert.Equal("gpt-4", spanAttribute(service, ModelKey).AsString())
+	assert.Equal(int64(9), spanAttribute(service, InputTokensKey).AsInt64())
+	assert.Equal(int64(3), spanAttribute(service, OutputTokensKey).AsInt64())
+
+	find, ok := spanNamed(spans, "chat.Repository/Find")
+	assert.True(ok)
+	assert.Equal(service.SpanContext.SpanID(), find.Parent.SpanID())
+	assert.Equal(trace.SpanKindClient, find.SpanKind)
+
+	_, ok = spanNamed(spans, "chat.Repository/Store")
+	assert.True(ok)
+
+	// the call upstream, propagated
+	call, ok := spanNamed(spans, "HTTP POST")
+	assert.True(ok)
+	assert.Equal(service.SpanContext.SpanID(), call.Parent.SpanID())
+	assert.Contains(traceparent, endpoint.SpanContext.TraceID().String())
+	assert.Contains(traceparent, call.SpanContext.SpanID().String())
+
+	// streams spanned until drained
+	exporter.Reset()
+
+	stream, err := svc.CreateCompletionStream(context.Background(), []byte(`{"model":"gpt-3.5-turbo","stream":true}`), chat.ChatID{})
+	assert.NoError(err)
+
+	_, ok = spanNamed(exporter.GetSpans(), "openai.Service/CreateCompletionStream")
+	assert.False(ok)
+
+	for range stream {
+	}
+
+	completion, ok := spanNamed(exporter.GetSpans(), "openai.Service/CreateCompletionStream")
+	assert.True(ok)
+	assert.Equal("gpt-3.5-turbo", spanAttribute(completion, ModelKey).AsString())
+}
@@ -0,0 +1,231 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/transport/grpc/pb"
+)
+
+const serviceName = "openai.v1.Chats"
+
+type MakeEndpoint func(conn *grpc.ClientConn) endpoint.Endpoint
+
+// ChatFactory dials the instance, without TLS unless the options say
+// otherwise. The connection is closed along with the endpoint.
+func ChatFactory(makeEndpoint MakeEndpoint, opts ...grpc.DialOption) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		dialOpts := append([]grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}, opts...)
+
+		conn, err := grpc.Dial(instance, dialOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return makeEndpoint(conn), conn, nil
+	}
+}
+
+// WithToken authenticates every call with the bearer token.
+func WithToken(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(bearerToken(token))
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// responseError restores domain errors from the status code where possible.
+func responseError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	switch st.Code() {
+	case codes.Unauthenticated:
+		return auth.ErrUnauthenticated
+	case codes.PermissionDenied:
+		return auth.ErrForbidden
+	case codes.NotFound:
+		return chat.ErrChatNotFound
+	case codes.Aborted:
+		return chat.ErrConflict
+	case codes.ResourceExhausted:
+		return openai.ErrQueueFull
+	case codes.Unavailable:
+		if st.Message() == openai.ErrQueueTimeout.Error() {
+			return openai.ErrQueueTimeout
+		}
+	}
+
+	return errors.New(st.Message())
+}
+
+// restoreErrors converts the status errors of the endpoint.
+func restoreErrors(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request any) (any, error) {
+		resp, err := next(ctx, request)
+		if err != nil {
+			return nil, responseError(err)
+		}
+
+		return resp, nil
+	}
+}
+
+func CreateChatEndpoint(conn *grpc.ClientConn) endpoint.Endpoint {
+	return restoreErrors(grpctransport.NewClient(
+		conn, serviceName, "CreateChat",
+		encodeCreateChatRequest,
+		decodeCreateChatResponse,
+		pb.CreateChatReply{},
+	).Endpoint())
+}
+
+func UpdateChatEndpoint(conn *grpc.ClientConn) endpoint.Endpoint {
+	return restoreErrors(grpctransport.NewClient(
+		conn, serviceName, "UpdateChat",
+		encodeUpdateChatRequest,
+		decodeUpdateChatResponse,
+		pb.UpdateChatReply{},
+	).Endpoint())
+}
+
+func ChatEndpoint(conn *grpc.ClientConn) endpoint.Endpoint {
+	return restoreErrors(grpctransport.NewClient(
+		conn, serviceName, "Chat",
+		encodeChatRequest,
+		decodeChatResponse,
+		pb.ChatReply{},
+	).Endpoint())
+}
+
+func ChatStreamEndpoint(conn *grpc.ClientConn) endpoint.Endpoint {
+	client := pb.NewChatsClient(conn)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, err := encodeChatRequest(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		// the stream outlives the request
+		ctx, cancel := context.WithCancel(context.Background())
+
+		stream, err := client.ChatStream(ctx, req.(*pb.ChatRequest))
+		if err != nil {
+			cancel()
+			return nil, responseError(err)
+		}
+
+		// errors come with the first message
+		first, err := stream.Recv()
+		if err != nil && err != io.EOF {
+			cancel()
+			return nil, responseError(err)
+		}
+
+		data := make(chan chat.Chunk, 1)
+
+		go func() {
+			defer cancel()
+			defer close(data)
+
+			if first == nil {
+				return
+			}
+
+			data <- chat.Chunk{Content: first.Content}
+
+			for {
+				reply, err := stream.Recv()
+				if err == io.EOF {
+					return
+				}
+
+				if err != nil {
+					data <- chat.Chunk{Err: responseError(err)}
+					return
+				}
+
+				data <- chat.Chunk{Content: reply.Content}
+			}
+		}()
+
+		return (<-chan chat.Chunk)(data), nil
+	}
+}
+
+func encodeCreateChatRequest(_ context.Context, request any) (any, error) {
+	req, ok := request.(*openai.CreateChatRequest)
+	if !ok {
+		return nil, errors.New("invalid request")
+	}
+
+	return &pb.CreateChatRequest{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Options: req.Options,
+	}, nil
+}
+
+func decodeCreateChatResponse(_ context.Context, response any) (any, error) {
+	reply := response.(*pb.CreateChatReply)
+	return chat.ParseID(reply.Id)
+}
+
+func encodeUpdateChatRequest(_ context.Context, request any) (any, error) {
+	req, ok := request.(*openai.UpdateChatRequest)
+	if !ok {
+		return nil, errors.New("invalid request")
+	}
+
+	return &pb.UpdateChatRequest{
+		Id:      req.ID.String(),
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Options: req.Options,
+	}, nil
+}
+
+func decodeUpdateChatResponse(_ context.Context, _ any) (any, error) {
+	return nil, nil
+}
+
+func encodeChatRequest(_ context.Context, request any) (any, error) {
+	req, ok := request.(*openai.ChatRequest)
+	if !ok {
+		return nil, errors.New("invalid request")
+	}
+
+	return &pb.ChatRequest{
+		Id:      req.ID.String(),
+		Content: req.Content,
+	}, nil
+}
+
+func decodeChatResponse(_ context.Context, response any) (any, error) {
+	reply := response.(*pb.ChatReply)
+	return reply.Content, nil
+}
@@ -0,0 +1,129 @@
+package grpc
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirror520/openai/auth"
+)
+
+// Metadata keys, as the headers of the HTTP transport.
+const (
+	TenantKey  = "x-tenant-id"
+	SubjectKey = "x-user-id"
+	ScopesKey  = "x-scopes" // comma separated
+	APIKeyKey  = "x-api-key"
+)
+
+// Identify puts the identity of a call on its context, from the metadata.
+type Identify func(ctx context.Context, md metadata.MD) (context.Context, error)
+
+// TrustedIdentity takes the caller from the metadata set by an authenticating
+// proxy in front of the service; never expose such a service directly.
+func TrustedIdentity() Identify {
+	return func(ctx context.Context, md metadata.MD) (context.Context, error) {
+		subject := first(md, SubjectKey)
+		if subject == "" {
+			return ctx, nil
+		}
+
+		id := &auth.Identity{
+			Subject: subject,
+			Tenant:  first(md, TenantKey),
+		}
+
+		for _, scope := range strings.Split(first(md, ScopesKey), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				id.Scopes = append(id.Scopes, scope)
+			}
+		}
+
+		return auth.NewContext(ctx, id), nil
+	}
+}
+
+// Authenticate requires a token accepted by the authenticator, as a bearer
+// token in authorization or in x-api-key, unless an identity was already
+// taken from trusted metadata.
+func Authenticate(authenticator auth.Authenticator) Identify {
+	return func(ctx context.Context, md metadata.MD) (context.Context, error) {
+		if _, ok := auth.FromContext(ctx); ok {
+			return ctx, nil
+		}
+
+		token := first(md, APIKeyKey)
+		if header := first(md, "authorization"); token == "" && len(header) > 7 {
+			if strings.EqualFold(header[:7], "Bearer ") {
+				token = strings.TrimSpace(header[7:])
+			}
+		}
+
+		if token == "" {
+			return nil, status.Error(codes.Unauthenticated, auth.ErrUnauthenticated.Error())
+		}
+
+		id, err := authenticator.Authenticate(token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		return auth.NewContext(ctx, id), nil
+	}
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+func identified(ctx context.Context, identify []Identify) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, id := range identify {
+		var err error
+		if ctx, err = id(ctx, md); err != nil {
+			return nil, err
+		}
+	}
+
+	return ctx, nil
+}
+
+func UnaryInterceptor(identify ...Identify) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := identified(ctx, identify)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func StreamInterceptor(identify ...Identify) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := identified(ss.Context(), identify)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &identifiedStream{ss, ctx})
+	}
+}
+
+type identifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identifiedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,250 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: chat.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Chats_CreateChat_FullMethodName = "/openai.v1.Chats/CreateChat"
+	Chats_UpdateChat_FullMethodName = "/openai.v1.Chats/UpdateChat"
+	Chats_Chat_FullMethodName       = "/openai.v1.Chats/Chat"
+	Chats_ChatStream_FullMethodName = "/openai.v1.Chats/ChatStream"
+)
+
+// ChatsClient is the client API for Chats service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChatsClient interface {
+	CreateChat(ctx context.Context, in *CreateChatRequest, opts ...grpc.CallOption) (*CreateChatReply, error)
+	UpdateChat(ctx context.Context, in *UpdateChatRequest, opts ...grpc.CallOption) (*UpdateChatReply, error)
+	Chat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatReply, error)
+	// ChatStream streams the answer as it is generated.
+	ChatStream(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (Chats_ChatStreamClient, error)
+}
+
+type chatsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChatsClient(cc grpc.ClientConnInterface) ChatsClient {
+	return &chatsClient{cc}
+}
+
+func (c *chatsClient) CreateChat(ctx context.Context, in *CreateChatRequest, opts ...grpc.CallOption) (*CreateChatReply, error) {
+	out := new(CreateChatReply)
+	err := c.cc.Invoke(ctx, Chats_CreateChat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatsClient) UpdateChat(ctx context.Context, in *UpdateChatRequest, opts ...grpc.CallOption) (*UpdateChatReply, error) {
+	out := new(UpdateChatReply)
+	err := c.cc.Invoke(ctx, Chats_UpdateChat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatsClient) Chat(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatReply, error) {
+	out := new(ChatReply)
+	err := c.cc.Invoke(ctx, Chats_Chat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatsClient) ChatStream(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (Chats_ChatStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Chats_ServiceDesc.Streams[0], Chats_ChatStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chatsChatStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Chats_ChatStreamClient interface {
+	Recv() (*ChatStreamReply, error)
+	grpc.ClientStream
+}
+
+type chatsChatStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *chatsChatStreamClient) Recv() (*ChatStreamReply, error) {
+	m := new(ChatStreamReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ChatsServer is the server API for Chats service.
+// All implementations must embed UnimplementedChatsServer
+// for forward compatibility
+type ChatsServer interface {
+	CreateChat(context.Context, *CreateChatRequest) (*CreateChatReply, error)
+	UpdateChat(context.Context, *UpdateChatRequest) (*UpdateChatReply, error)
+	Chat(context.Context, *ChatRequest) (*ChatReply, error)
+	// ChatStream streams the answer as it is generated.
+	ChatStream(*ChatRequest, Chats_ChatStreamServer) error
+	mustEmbedUnimplementedChatsServer()
+}
+
+// UnimplementedChatsServer must be embedded to have forward compatible implementations.
+type UnimplementedChatsServer struct {
+}
+
+func (UnimplementedChatsServer) CreateChat(context.Context, *CreateChatRequest) (*CreateChatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateChat not implemented")
+}
+func (UnimplementedChatsServer) UpdateChat(context.Context, *UpdateChatRequest) (*UpdateChatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateChat not implemented")
+}
+func (UnimplementedChatsServer) Chat(context.Context, *ChatRequest) (*ChatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Chat not implemented")
+}
+func (UnimplementedChatsServer) ChatStream(*ChatRequest, Chats_ChatStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ChatStream not implemented")
+}
+func (UnimplementedChatsServer) mustEmbedUnimplementedChatsServer() {}
+
+// UnsafeChatsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChatsServer will
+// result in compilation errors.
+type UnsafeChatsServer interface {
+	mustEmbedUnimplementedChatsServer()
+}
+
+func RegisterChatsServer(s grpc.ServiceRegistrar, srv ChatsServer) {
+	s.RegisterService(&Chats_ServiceDesc, srv)
+}
+
+func _Chats_CreateChat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateChatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatsServer).CreateChat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Chats_CreateChat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatsServer).CreateChat(ctx, req.(*CreateChatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chats_UpdateChat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateChatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatsServer).UpdateChat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Chats_UpdateChat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatsServer).UpdateChat(ctx, req.(*UpdateChatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chats_Chat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatsServer).Chat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Chats_Chat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatsServer).Chat(ctx, req.(*ChatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chats_ChatStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChatRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChatsServer).ChatStream(m, &chatsChatStreamServer{stream})
+}
+
+type Chats_ChatStreamServer interface {
+	Send(*ChatStreamReply) error
+	grpc.ServerStream
+}
+
+type chatsChatStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *chatsChatStreamServer) Send(m *ChatStreamReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Chats_ServiceDesc is the grpc.ServiceDesc for Chats service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Chats_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "openai.v1.Chats",
+	HandlerType: (*ChatsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateChat",
+			Handler:    _Chats_CreateChat_Handler,
+		},
+		{
+			MethodName: "UpdateChat",
+			Handler:    _Chats_UpdateChat_Handler,
+		},
+		{
+			MethodName: "Chat",
+			Handler:    _Chats_Chat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ChatStream",
+			Handler:       _Chats_ChatStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "chat.proto",
+}
@@ -0,0 +1,234 @@
+package grpc
+
+//go:generate protoc -I pb --go_out=pb --go_opt=paths=source_relative --go-grpc_out=pb --go-grpc_opt=paths=source_relative pb/chat.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/transport/grpc/pb"
+)
+
+// NewServer returns a gRPC server serving the chat endpoints,
+// identifying every call in order with the given functions.
+func NewServer(endpoints *openai.ChatEndpoints, identify ...Identify) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryInterceptor(identify...)),
+		grpc.StreamInterceptor(StreamInterceptor(identify...)),
+	)
+
+	pb.RegisterChatsServer(s, NewChatsServer(endpoints))
+	return s
+}
+
+// NewChatsServer serves the unary RPCs with go-kit's gRPC transport;
+// ChatStream is served directly, as go-kit has no streaming support.
+func NewChatsServer(endpoints *openai.ChatEndpoints) pb.ChatsServer {
+	return &chatsServer{
+		createChat: grpctransport.NewServer(
+			endpoints.CreateChatEndpoint,
+			decodeCreateChatRequest,
+			encodeCreateChatResponse,
+		),
+		updateChat: grpctransport.NewServer(
+			endpoints.UpdateChatEndpoint,
+			decodeUpdateChatRequest,
+			encodeUpdateChatResponse,
+		),
+		chat: grpctransport.NewServer(
+			endpoints.ChatEndpoint,
+			decodeChatRequest,
+			encodeChatResponse,
+		),
+		endpoints: endpoints,
+	}
+}
+
+type chatsServer struct {
+	pb.UnimplementedChatsServer
+
+	createChat grpctransport.Handler
+	updateChat grpctransport.Handler
+	chat       grpctransport.Handler
+	endpoints  *openai.ChatEndpoints
+}
+
+func (s *chatsServer) CreateChat(ctx context.Context, req *pb.CreateChatRequest) (*pb.CreateChatReply, error) {
+	_, resp, err := s.createChat.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return resp.(*pb.CreateChatReply), nil
+}
+
+func (s *chatsServer) UpdateChat(ctx context.Context, req *pb.UpdateChatRequest) (*pb.UpdateChatReply, error) {
+	_, resp, err := s.updateChat.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return resp.(*pb.UpdateChatReply), nil
+}
+
+func (s *chatsServer) Chat(ctx context.Context, req *pb.ChatRequest) (*pb.ChatReply, error) {
+	_, resp, err := s.chat.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return resp.(*pb.ChatReply), nil
+}
+
+func (s *chatsServer) ChatStream(req *pb.ChatRequest, stream pb.Chats_ChatStreamServer) error {
+	ctx := stream.Context()
+
+	request, err := decodeChatRequest(ctx, req)
+	if err != nil {
+		return errorStatus(err)
+	}
+
+	resp, err := s.endpoints.ChatStreamEndpoint(ctx, request)
+	if err != nil {
+		return errorStatus(err)
+	}
+
+	answer, ok := resp.(<-chan chat.Chunk)
+	if !ok {
+		return status.Error(codes.Internal, "invalid stream")
+	}
+
+	for chunk := range answer {
+		if chunk.Err != nil {
+			return errorStatus(chunk.Err)
+		}
+
+		if err := stream.Send(&pb.ChatStreamReply{Content: chunk.Content}); err != nil {
+			// the client is gone, stop the answer and let it run out
+			if cancel := s.endpoints.CancelChatEndpoint; cancel != nil {
+				cancel(ctx, &openai.CancelChatRequest{ID: request.(*openai.ChatRequest).ID})
+			}
+
+			for range answer {
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errorStatus maps domain errors to gRPC status codes.
+func errorStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code := codes.Unknown
+
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		code = codes.Unauthenticated
+	case errors.Is(err, auth.ErrForbidden):
+		code = codes.PermissionDenied
+	case errors.Is(err, chat.ErrChatNotFound), errors.Is(err, auth.ErrKeyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, chat.ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, openai.ErrQueueFull):
+		code = codes.ResourceExhausted
+	case errors.Is(err, openai.ErrQueueTimeout):
+		code = codes.Unavailable
+	}
+
+	return status.Error(code, err.Error())
+}
+
+func parseID(id string) (chat.ChatID, error) {
+	chatID, err := chat.ParseID(id)
+	if err != nil {
+		return chat.ChatID{}, status.Error(codes.InvalidArgument, "invalid chat id: "+err.Error())
+	}
+
+	return chatID, nil
+}
+
+func rawOptions(options []byte) json.RawMessage {
+	if len(options) == 0 {
+		return nil
+	}
+
+	return json.RawMessage(options)
+}
+
+func decodeCreateChatRequest(_ context.Context, request any) (any, error) {
+	req := request.(*pb.CreateChatRequest)
+
+	return &openai.CreateChatRequest{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Options: rawOptions(req.Options),
+	}, nil
+}
+
+func encodeCreateChatResponse(_ context.Context, response any) (any, error) {
+	id, ok := response.(*chat.ChatID)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return &pb.CreateChatReply{Id: id.String()}, nil
+}
+
+func decodeUpdateChatRequest(_ context.Context, request any) (any, error) {
+	req := request.(*pb.UpdateChatRequest)
+
+	id, err := parseID(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openai.UpdateChatRequest{
+		ID:      id,
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Options: rawOptions(req.Options),
+	}, nil
+}
+
+func encodeUpdateChatResponse(_ context.Context, _ any) (any, error) {
+	return &pb.UpdateChatReply{}, nil
+}
+
+func decodeChatRequest(_ context.Context, request any) (any, error) {
+	req := request.(*pb.ChatRequest)
+
+	id, err := parseID(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openai.ChatRequest{
+		ID:      id,
+		Content: req.Content,
+	}, nil
+}
+
+func encodeChatResponse(_ context.Context, response any) (any, error) {
+	content, ok := response.(string)
+	if !ok {
+		return nil, errors.New("invalid response")
+	}
+
+	return &pb.ChatReply{Content: content}, nil
+}
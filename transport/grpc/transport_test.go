@@ -0,0 +1,133 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestChatsServer(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream":true`) {
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hello!"}}]}`))
+			return
+		}
+
+		for _, word := range []string{"Hel", "lo", "!"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\n", word)
+		}
+
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	svc := openai.NewService(chats, &conf.Config{BaseURL: upstream.URL})
+
+	endpoints := &openai.ChatEndpoints{
+		CreateChatEndpoint: openai.CreateChatEndpoint(svc),
+		UpdateChatEndpoint: openai.UpdateChatEndpoint(svc),
+		ChatEndpoint:       openai.ChatEndpoint(svc),
+		ChatStreamEndpoint: openai.ChatStreamEndpoint(svc),
+		CancelChatEndpoint: openai.CancelChatEndpoint(svc),
+	}
+
+	keys, err := auth.NewKeyStore("", &auth.APIKey{
+		ID:      "key_1",
+		Hash:    auth.HashKey("sk-test"),
+		Subject: "alice",
+		Tenant:  "acme",
+	})
+	assert.NoError(err)
+
+	lis := bufconn.Listen(1 << 20)
+
+	s := NewServer(openai.AuthorizedEndpoints(endpoints, chats), Authenticate(keys))
+	defer s.Stop()
+
+	go s.Serve(lis)
+
+	dial := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+
+	client := func(makeEndpoint MakeEndpoint, opts ...grpc.DialOption) endpoint.Endpoint {
+		e, closer, err := ChatFactory(makeEndpoint, append(opts, dial)...)("bufnet")
+		assert.NoError(err)
+		t.Cleanup(func() { closer.Close() })
+
+		return e
+	}
+
+	ctx := context.Background()
+	token := WithToken("sk-test")
+
+	// unauthenticated
+	_, err = client(CreateChatEndpoint)(ctx, &openai.CreateChatRequest{Model: "gpt-4"})
+	assert.ErrorIs(err, auth.ErrUnauthenticated)
+
+	resp, err := client(CreateChatEndpoint, token)(ctx, &openai.CreateChatRequest{
+		Model:   "gpt-4",
+		Prompt:  "Be brief.",
+		Options: []byte(`{"temperature":0.2}`),
+	})
+	assert.NoError(err)
+
+	id := resp.(chat.ChatID)
+
+	c, err := chats.Find(id)
+	assert.NoError(err)
+	assert.Equal("alice", c.Owner)
+	assert.Equal(0.2, *c.Temperature)
+
+	_, err = client(UpdateChatEndpoint, token)(ctx, &openai.UpdateChatRequest{ID: id, Model: "gpt-4o"})
+	assert.NoError(err)
+
+	answer, err := client(ChatEndpoint, token)(ctx, &openai.ChatRequest{ID: id, Content: "Hi"})
+	assert.NoError(err)
+	assert.Equal("Hello!", answer)
+
+	resp, err = client(ChatStreamEndpoint, token)(ctx, &openai.ChatRequest{ID: id, Content: "Hi again"})
+	assert.NoError(err)
+
+	parts := make([]string, 0)
+	for chunk := range resp.(<-chan chat.Chunk) {
+		parts = append(parts, chunk.Content)
+	}
+	assert.Equal([]string{"Hel", "lo", "!"}, parts)
+
+	c, err = chats.Find(id)
+	assert.NoError(err)
+	assert.Equal("gpt-4o", c.Model)
+	assert.Len(c.Messages, 5)
+
+	// domain errors survive the hop
+	missing := chat.NewChat("gpt-4", "", nil).ID
+
+	_, err = client(ChatEndpoint, token)(ctx, &openai.ChatRequest{ID: missing, Content: "Hi"})
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	_, err = client(ChatStreamEndpoint, token)(ctx, &openai.ChatRequest{ID: missing, Content: "Hi"})
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/model"
+)
+
+// AdminRouter serves the management of the API keys of the caller's tenant,
+// restricted to admins.
+func AdminRouter(route *gin.RouterGroup, endpoints *auth.KeyEndpoints) {
+	// POST /keys
+	route.POST("/keys", CreateKeyHandler(endpoints.CreateKeyEndpoint))
+
+	// GET /keys
+	route.GET("/keys", ListKeysHandler(endpoints.ListKeysEndpoint))
+
+	// DELETE /keys/:id
+	route.DELETE("/keys/:id", RevokeKeyHandler(endpoints.RevokeKeyEndpoint))
+}
+
+// GatewayAdminRouter serves the state of the instances behind the gateway,
+// restricted to admins.
+func GatewayAdminRouter(route *gin.RouterGroup, backendsEndpoint endpoint.Endpoint) {
+	// GET /backends
+	route.GET("/backends", ListBackendsHandler(backendsEndpoint))
+}
+
+func ListBackendsHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resp, err := endpoint(ctx, nil)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("backends listed")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func CreateKeyHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(auth.CreateKeyRequest)
+		if err := ctx.ShouldBind(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("key created")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func ListKeysHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resp, err := endpoint(ctx, nil)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("keys listed")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func RevokeKeyHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := &auth.RevokeKeyRequest{
+			ID: ctx.Param("id"),
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("key revoked")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
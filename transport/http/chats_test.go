@@ -0,0 +1,91 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestChatHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	a := chat.NewChat("gpt-3.5-turbo", "You are a helpful assistant.", nil)
+	a.AddMessage(&chat.Message{Role: chat.User, Content: "Hello!"})
+	a.AddMessage(&chat.Message{Role: chat.Assistant, Content: "Hi!"})
+	chats.Store(a)
+
+	b := chat.NewChat("gpt-4", "", nil)
+	chats.Store(b)
+
+	svc := openai.NewService(chats, &conf.Config{})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/chats", ListChatsHandler(openai.ListChatsEndpoint(svc)))
+	r.GET("/chats/:id", FindChatHandler(openai.FindChatEndpoint(svc)))
+	r.GET("/chats/:id/messages", ListMessagesHandler(openai.ListMessagesEndpoint(svc)))
+	r.DELETE("/chats/:id", DeleteChatHandler(openai.DeleteChatEndpoint(svc)))
+
+	call := func(method string, target string, data any) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+		if data != nil {
+			var result struct {
+				Data json.RawMessage `json:"data"`
+			}
+
+			assert.NoError(json.Unmarshal(w.Body.Bytes(), &result))
+			assert.NoError(json.Unmarshal(result.Data, data))
+		}
+
+		return w.Code
+	}
+
+	var page chat.Page
+	assert.Equal(http.StatusOK, call(http.MethodGet, "/chats?limit=1", &page))
+	if assert.Len(page.Chats, 1) && assert.NotNil(page.Next) {
+		assert.Equal(a.ID, page.Chats[0].ID)
+		assert.Equal(a.ID, *page.Next)
+	}
+
+	page = chat.Page{}
+	assert.Equal(http.StatusOK, call(http.MethodGet, "/chats?model=gpt-4", &page))
+	if assert.Len(page.Chats, 1) {
+		assert.Equal(b.ID, page.Chats[0].ID)
+		assert.Nil(page.Next)
+	}
+
+	assert.Equal(http.StatusUnprocessableEntity, call(http.MethodGet, "/chats?cursor=invalid", nil))
+
+	var found chat.Chat
+	assert.Equal(http.StatusOK, call(http.MethodGet, "/chats/"+a.ID.String(), &found))
+	assert.Equal(a.ID, found.ID)
+	assert.Len(found.Messages, 3)
+
+	var messages chat.MessagePage
+	assert.Equal(http.StatusOK, call(http.MethodGet, "/chats/"+a.ID.String()+"/messages?cursor=1&limit=1", &messages))
+	if assert.Len(messages.Messages, 1) && assert.NotNil(messages.Next) {
+		assert.Equal("Hello!", messages.Messages[0].Content)
+		assert.Equal(2, *messages.Next)
+	}
+
+	assert.Equal(http.StatusBadRequest, call(http.MethodGet, "/chats/invalid", nil))
+
+	assert.Equal(http.StatusOK, call(http.MethodDelete, "/chats/"+a.ID.String(), nil))
+	assert.Equal(http.StatusNotFound, call(http.MethodGet, "/chats/"+a.ID.String(), nil))
+	assert.Equal(http.StatusNotFound, call(http.MethodGet, "/chats/"+a.ID.String()+"/messages", nil))
+	assert.Equal(http.StatusNotFound, call(http.MethodDelete, "/chats/"+a.ID.String(), nil))
+}
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+)
+
+// CompatRouter serves the endpoints of the OpenAI API,
+// so existing OpenAI clients only need a different base URL.
+func CompatRouter(route *gin.RouterGroup, endpoints *openai.ChatEndpoints) {
+	// POST /chat/completions
+	route.POST("/chat/completions", CompletionHandler(
+		endpoints.CreateCompletionEndpoint,
+		endpoints.CreateCompletionStreamEndpoint,
+	))
+
+	// GET /models
+	route.GET("/models", ListModelsHandler(endpoints.ListModelsEndpoint))
+}
+
+// ChatIDHeader names the stored chat a compatible request continues,
+// as does the chat_id key of its metadata.
+const ChatIDHeader = "X-Chat-ID"
+
+// chatID takes the chat of the request out of the metadata, which the
+// upstream does not know about, or else from the header.
+func chatID(ctx *gin.Context, body json.RawMessage) (chat.ChatID, json.RawMessage, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return chat.ChatID{}, nil, err
+	}
+
+	raw := ctx.GetHeader(ChatIDHeader)
+
+	var metadata map[string]json.RawMessage
+	if bs, ok := req["metadata"]; ok && json.Unmarshal(bs, &metadata) == nil {
+		if bs, ok := metadata["chat_id"]; ok {
+			if err := json.Unmarshal(bs, &raw); err != nil {
+				return chat.ChatID{}, nil, errors.New("metadata.chat_id must be a string")
+			}
+
+			delete(metadata, "chat_id")
+			if len(metadata) == 0 {
+				delete(req, "metadata")
+			} else {
+				req["metadata"], _ = json.Marshal(metadata)
+			}
+
+			bs, err := json.Marshal(req)
+			if err != nil {
+				return chat.ChatID{}, nil, err
+			}
+
+			body = bs
+		}
+	}
+
+	if raw == "" {
+		return chat.ChatID{}, body, nil
+	}
+
+	id, err := chat.ParseID(raw)
+	if err != nil {
+		return chat.ChatID{}, nil, err
+	}
+
+	return id, body, nil
+}
+
+// compatError writes the error the way the OpenAI API does,
+// relaying upstream errors as they are.
+func compatError(ctx *gin.Context, err error, fallback int) {
+	var upstream *openai.UpstreamError
+	if errors.As(err, &upstream) {
+		ctx.Data(upstream.StatusCode, "application/json", upstream.Body)
+		ctx.Abort()
+		return
+	}
+
+	status := errorStatus(err, fallback)
+
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "api_error"
+	}
+
+	ctx.AbortWithStatusJSON(status, gin.H{
+		"error": gin.H{
+			"message": err.Error(),
+			"type":    errType,
+			"code":    nil,
+		},
+	})
+}
+
+func CompletionHandler(completionEndpoint endpoint.Endpoint, completionStreamEndpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			compatError(ctx, err, http.StatusBadRequest)
+			return
+		}
+
+		var params struct {
+			Stream bool `json:"stream"`
+		}
+
+		if err := json.Unmarshal(body, &params); err != nil {
+			compatError(ctx, err, http.StatusBadRequest)
+			return
+		}
+
+		id, body, err := chatID(ctx, body)
+		if err != nil {
+			compatError(ctx, err, http.StatusBadRequest)
+			return
+		}
+
+		req := &openai.CompletionRequest{
+			Body:   body,
+			ChatID: id,
+			Stream: params.Stream,
+		}
+
+		if !req.Stream {
+			resp, err := completionEndpoint(ctx, req)
+			if err != nil {
+				compatError(ctx, err, http.StatusBadGateway)
+				return
+			}
+
+			data, ok := resp.(json.RawMessage)
+			if !ok {
+				compatError(ctx, errors.New("invalid response"), http.StatusInternalServerError)
+				return
+			}
+
+			ctx.Data(http.StatusOK, "application/json", data)
+			return
+		}
+
+		resp, err := completionStreamEndpoint(ctx, req)
+		if err != nil {
+			compatError(ctx, err, http.StatusBadGateway)
+			return
+		}
+
+		events, ok := resp.(<-chan json.RawMessage)
+		if !ok {
+			compatError(ctx, errors.New("invalid stream"), http.StatusInternalServerError)
+			return
+		}
+
+		w := ctx.Writer
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		done := ctx.Request.Context().Done()
+		for {
+			select {
+			case data, ok := <-events:
+				if !ok {
+					w.WriteString("data: [DONE]\n\n")
+					w.Flush()
+					return
+				}
+
+				w.WriteString("data: ")
+				w.Write(data)
+				w.WriteString("\n\n")
+				w.Flush()
+
+			case <-done:
+				// the client is gone: a stream without a chat ends with the
+				// request, one of a chat runs out to store the reply
+				go func() {
+					for range events {
+					}
+				}()
+				return
+			}
+		}
+	}
+}
+
+func ListModelsHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resp, err := endpoint(ctx, nil)
+		if err != nil {
+			compatError(ctx, err, http.StatusBadGateway)
+			return
+		}
+
+		data, ok := resp.(json.RawMessage)
+		if !ok {
+			compatError(ctx, errors.New("invalid response"), http.StatusInternalServerError)
+			return
+		}
+
+		ctx.Data(http.StatusOK, "application/json", data)
+	}
+}
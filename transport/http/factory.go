@@ -1,23 +1,56 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/sd"
 	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/dataset"
 	"github.com/mirror520/openai/model"
 )
 
 type MakeEndpoint func(baseURL string) endpoint.Endpoint
 
+// newClient traces the requests to the instance, see traced.
+func newClient(baseURL string) *resty.Client {
+	return resty.New().
+		SetBaseURL(baseURL).
+		SetTransport(otelhttp.NewTransport(http.DefaultTransport))
+}
+
+// traced carries the trace of ctx to the instance, but not its
+// cancellation, as streams outlive the calls of their endpoints. The
+// headers identifying the caller go along, see ForwardIdentity.
+func traced(ctx context.Context, client *resty.Client) *resty.Request {
+	req := client.R().
+		SetContext(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)))
+
+	for key, values := range forwarded(ctx) {
+		req.Header[key] = values
+	}
+
+	return req
+}
+
 func ChatFactory(makeEndpoint MakeEndpoint, scheme string) sd.Factory {
 	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
 		baseURL := fmt.Sprintf("%s://%s/openai/v1", scheme, instance)
@@ -26,15 +59,14 @@ func ChatFactory(makeEndpoint MakeEndpoint, scheme string) sd.Factory {
 }
 
 func CreateChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
 	return func(ctx context.Context, request any) (response any, err error) {
 		var result model.Result
 
-		client := resty.New().
-			SetBaseURL(baseURL)
-
-		resp, err := client.R().
+		resp, err := traced(ctx, client).
 			SetHeader("Content-Type", "application/json").
-			SetBody(&request).
+			SetBody(request).
 			SetResult(&result).
 			Post("/chats")
 
@@ -65,20 +97,19 @@ func CreateChatEndpoint(baseURL string) endpoint.Endpoint {
 }
 
 func UpdateChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
 	return func(ctx context.Context, request any) (response any, err error) {
 		var result model.Result
 
-		client := resty.New().
-			SetBaseURL(baseURL)
-
 		req, ok := request.(*openai.UpdateChatRequest)
 		if !ok {
 			return nil, errors.New("invalid request")
 		}
 
-		resp, err := client.R().
+		resp, err := traced(ctx, client).
 			SetHeader("Content-Type", "application/json").
-			SetBody(&request).
+			SetBody(request).
 			SetResult(&result).
 			Patch("/chats/" + req.ID.String())
 
@@ -99,15 +130,760 @@ func UpdateChatEndpoint(baseURL string) endpoint.Endpoint {
 }
 
 func ChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
 	return func(ctx context.Context, request any) (response any, err error) {
-		// TODO
-		return nil, nil
+		var failed model.Result
+
+		var answer string
+		result := model.Result{Data: &answer}
+
+		req, ok := request.(*openai.ChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetHeader("Content-Type", "application/json").
+			SetBody(req).
+			SetResult(&result).
+			SetError(&failed).
+			Post("/chats/" + req.ID.String() + "/messages")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return answer, nil
 	}
 }
 
 func ChatStreamEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*openai.ChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetHeader("Content-Type", "application/json").
+			SetHeader("Accept", "text/event-stream").
+			SetQueryParam("stream", "true").
+			SetBody(req).
+			SetDoNotParseResponse(true).
+			Post("/chats/" + req.ID.String() + "/messages")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return openStream(resp)
+	}
+}
+
+func RegenerateStreamEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
 	return func(ctx context.Context, request any) (response any, err error) {
-		// TODO
+		req, ok := request.(*openai.RegenerateRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetHeader("Accept", "text/event-stream").
+			SetDoNotParseResponse(true).
+			Post("/chats/" + req.ID.String() + "/regenerate")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return openStream(resp)
+	}
+}
+
+// openStream returns a streamed answer as a channel, closed at the end of
+// the body. The body is either chunked text, as written by ChatHandler, or
+// server-sent events. An answer failing once streaming ends with a chunk
+// carrying the error.
+func openStream(resp *resty.Response) (<-chan chat.Chunk, error) {
+	body := resp.RawBody()
+
+	if resp.StatusCode() != http.StatusOK {
+		defer body.Close()
+
+		var failed model.Result
+		json.NewDecoder(body).Decode(&failed)
+
+		return nil, responseError(resp, &failed)
+	}
+
+	read := readChunks
+	if strings.HasPrefix(resp.Header().Get("Content-Type"), "text/event-stream") {
+		read = readEvents
+	}
+
+	data := make(chan chat.Chunk, 1)
+
+	go func() {
+		defer body.Close()
+		defer close(data)
+
+		if err := read(body, data); err != nil {
+			data <- chat.Chunk{Err: err}
+		}
+	}()
+
+	return data, nil
+}
+
+// readChunks sends the text as it arrives, holding back a trailing
+// incomplete UTF-8 sequence until the rest of it is read.
+func readChunks(r io.Reader, data chan<- chat.Chunk) error {
+	buf := make([]byte, 4096)
+	pending := make([]byte, 0, utf8.UTFMax)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunk := append(pending, buf[:n]...)
+
+			cut := len(chunk)
+			for i := len(chunk) - 1; i >= 0 && i >= len(chunk)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(chunk[i]) {
+					if !utf8.FullRune(chunk[i:]) {
+						cut = i
+					}
+					break
+				}
+			}
+
+			if cut > 0 {
+				data <- chat.Chunk{Content: string(chunk[:cut])}
+			}
+
+			pending = append(pending[:0], chunk[cut:]...)
+		}
+
+		if err == io.EOF {
+			if len(pending) > 0 {
+				data <- chat.Chunk{Content: string(pending)}
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ErrStreamTruncated is returned by the answers whose events end before
+// [DONE].
+var ErrStreamTruncated = errors.New("stream ended before [DONE]")
+
+// readEvents sends the data of every event until [DONE], and fails on an
+// error event, as written by ChatHandler, or without [DONE].
+func readEvents(r io.Reader, data chan<- chat.Chunk) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	event := ""
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// the end of an event
+			if event == "error" {
+				var failed model.Result
+				if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &failed); err != nil || failed.Msg == "" {
+					return errors.New("stream failed")
+				}
+
+				return errors.New(failed.Msg)
+			}
+
+			if len(lines) > 0 {
+				data <- chat.Chunk{Content: strings.Join(lines, "\n")}
+			}
+
+			event = ""
+			lines = lines[:0]
+			continue
+		}
+
+		if strings.HasPrefix(line, "event:") {
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			continue
+		}
+
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		line = strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		if line == "[DONE]" && event == "" {
+			return nil
+		}
+
+		lines = append(lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return ErrStreamTruncated
+}
+
+func CancelChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.CancelChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetError(&failed).
+			Post("/chats/" + req.ID.String() + "/cancel")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
 		return nil, nil
 	}
 }
+
+// responseError converts a failed response into an error,
+// restoring domain errors from the status code where possible.
+func responseError(resp *resty.Response, failed *model.Result) error {
+	switch resp.StatusCode() {
+	case http.StatusUnauthorized:
+		return auth.ErrUnauthenticated
+	case http.StatusForbidden:
+		return auth.ErrForbidden
+	case http.StatusNotFound:
+		return chat.ErrChatNotFound
+	case http.StatusConflict:
+		return chat.ErrConflict
+	case http.StatusTooManyRequests:
+		return openai.ErrQueueFull
+	}
+
+	if failed.Status == model.FAILURE {
+		return errors.New(failed.Msg)
+	}
+
+	return errors.New(resp.Status())
+}
+
+func listParams(req *openai.ListChatsRequest) url.Values {
+	params := url.Values{}
+	if req.Cursor != "" {
+		params.Set("cursor", req.Cursor)
+	}
+	if req.Limit > 0 {
+		params.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.User != "" {
+		params.Set("user", req.User)
+	}
+	if req.Model != "" {
+		params.Set("model", req.Model)
+	}
+	if !req.Since.IsZero() {
+		params.Set("since", req.Since.Format(time.RFC3339))
+	}
+	if !req.Until.IsZero() {
+		params.Set("until", req.Until.Format(time.RFC3339))
+	}
+	if req.Text != "" {
+		params.Set("q", req.Text)
+	}
+
+	return params
+}
+
+func ListChatsEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		page := new(chat.Page)
+		result := model.Result{Data: page}
+
+		req, ok := request.(*openai.ListChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		params := listParams(req)
+
+		resp, err := traced(ctx, client).
+			SetQueryParamsFromValues(params).
+			SetResult(&result).
+			SetError(&failed).
+			Get("/chats")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return page, nil
+	}
+}
+
+func FindChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		c := new(chat.Chat)
+		result := model.Result{Data: c}
+
+		req, ok := request.(*openai.FindChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetResult(&result).
+			SetError(&failed).
+			Get("/chats/" + req.ID.String())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return c, nil
+	}
+}
+
+func ListMessagesEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		page := new(chat.MessagePage)
+		result := model.Result{Data: page}
+
+		req, ok := request.(*openai.ListMessagesRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetQueryParam("cursor", strconv.Itoa(req.Cursor)).
+			SetQueryParam("limit", strconv.Itoa(req.Limit)).
+			SetResult(&result).
+			SetError(&failed).
+			Get("/chats/" + req.ID.String() + "/messages")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return page, nil
+	}
+}
+
+func DeleteChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.DeleteChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetError(&failed).
+			Delete("/chats/" + req.ID.String())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return nil, nil
+	}
+}
+
+func ExportChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.ExportChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetQueryParam("format", string(req.Format)).
+			SetError(&failed).
+			Get("/chats/" + req.ID.String() + "/export")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return resp.Body(), nil
+	}
+}
+
+func ExportChatsEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.ExportChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		params := listParams(&req.ListChatsRequest)
+		params.Set("format", string(req.Format))
+
+		resp, err := traced(ctx, client).
+			SetQueryParamsFromValues(params).
+			SetError(&failed).
+			Get("/chats/export")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return resp.Body(), nil
+	}
+}
+
+func ImportChatsEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var (
+			ids    []chat.ChatID
+			failed model.Result
+		)
+
+		result := model.Result{Data: &ids}
+
+		req, ok := request.(*openai.ImportChatsRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetQueryParam("format", string(req.Format)).
+			SetQueryParam("model", req.Model).
+			SetBody(req.Data).
+			SetResult(&result).
+			SetError(&failed).
+			Post("/chats/import")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return ids, nil
+	}
+}
+
+func AnnotateChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.AnnotateChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		resp, err := traced(ctx, client).
+			SetHeader("Content-Type", "application/json").
+			SetBody(&req.Annotation).
+			SetError(&failed).
+			Put("/chats/" + req.ID.String() + "/annotation")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return nil, nil
+	}
+}
+
+func ShareChatEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		req, ok := request.(*openai.ShareChatRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		path := "/chats/" + req.ID.String() + "/members/" + url.PathEscape(req.Subject)
+
+		var resp *resty.Response
+		if req.Role == "" {
+			resp, err = traced(ctx, client).
+				SetError(&failed).
+				Delete(path)
+		} else {
+			resp, err = traced(ctx, client).
+				SetHeader("Content-Type", "application/json").
+				SetBody(req).
+				SetError(&failed).
+				Put(path)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return nil, nil
+	}
+}
+
+func BuildDatasetEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		var failed model.Result
+
+		ds := new(dataset.Dataset)
+		result := model.Result{Data: ds}
+
+		resp, err := traced(ctx, client).
+			SetHeader("Content-Type", "application/json").
+			SetBody(request).
+			SetResult(&result).
+			SetError(&failed).
+			Post("/datasets")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, responseError(resp, &failed)
+		}
+
+		return ds, nil
+	}
+}
+
+// CompatFactory builds endpoints against the OpenAI compatible routes of an instance.
+func CompatFactory(makeEndpoint MakeEndpoint, scheme string) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		baseURL := fmt.Sprintf("%s://%s/v1", scheme, instance)
+		return makeEndpoint(baseURL), nil, nil
+	}
+}
+
+func CreateCompletionEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*openai.CompletionRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		r := traced(ctx, client)
+		if req.ChatID != (chat.ChatID{}) {
+			r.SetHeader(ChatIDHeader, req.ChatID.String())
+		}
+
+		resp, err := r.
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(req.Body)).
+			Post("/chat/completions")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, &openai.UpstreamError{StatusCode: resp.StatusCode(), Body: resp.Body()}
+		}
+
+		return json.RawMessage(resp.Body()), nil
+	}
+}
+
+func CreateCompletionStreamEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		req, ok := request.(*openai.CompletionRequest)
+		if !ok {
+			return nil, errors.New("invalid request")
+		}
+
+		r := traced(ctx, client)
+		if req.ChatID != (chat.ChatID{}) {
+			r.SetHeader(ChatIDHeader, req.ChatID.String())
+		}
+
+		resp, err := r.
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(req.Body)).
+			SetDoNotParseResponse(true).
+			Post("/chat/completions")
+
+		if err != nil {
+			return nil, err
+		}
+
+		body := resp.RawBody()
+
+		if resp.StatusCode() != http.StatusOK {
+			defer body.Close()
+
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, &openai.UpstreamError{StatusCode: resp.StatusCode(), Body: data}
+		}
+
+		events := make(chan json.RawMessage, 1)
+
+		go func() {
+			defer body.Close()
+			defer close(events)
+
+			scanner := bufio.NewScanner(body)
+			scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+			for scanner.Scan() {
+				line := scanner.Bytes()
+				if !bytes.HasPrefix(line, []byte("data:")) {
+					continue
+				}
+
+				data := bytes.TrimSpace(line[len("data:"):])
+				if string(data) == "[DONE]" {
+					return
+				}
+
+				events <- append(json.RawMessage(nil), data...)
+			}
+		}()
+
+		return (<-chan json.RawMessage)(events), nil
+	}
+}
+
+func ListModelsEndpoint(baseURL string) endpoint.Endpoint {
+	client := newClient(baseURL)
+
+	return func(ctx context.Context, request any) (response any, err error) {
+		resp, err := traced(ctx, client).
+			Get("/models")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, &openai.UpstreamError{StatusCode: resp.StatusCode(), Body: resp.Body()}
+		}
+
+		return json.RawMessage(resp.Body()), nil
+	}
+}
+
+// ReadinessProbe asks an instance for GET /readyz.
+func ReadinessProbe(scheme string) func(ctx context.Context, instance string) error {
+	client := resty.New()
+
+	return func(ctx context.Context, instance string) error {
+		var failed model.Result
+
+		resp, err := client.R().
+			SetContext(ctx).
+			SetError(&failed).
+			Get(fmt.Sprintf("%s://%s/readyz", scheme, instance))
+
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			if checks, ok := failed.Data.(map[string]any); ok {
+				return fmt.Errorf("%s: %v", resp.Status(), checks)
+			}
+
+			return errors.New(resp.Status())
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,353 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/model"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestProxiedChat(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream":true`) {
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Grüße!"}}]}`))
+			return
+		}
+
+		for _, word := range []string{"Grü", "ße", "!"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\n", word)
+			w.(http.Flusher).Flush()
+		}
+
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	backend := openai.NewService(chats, &conf.Config{BaseURL: upstream.URL})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	Router(r.Group("/openai/v1"), &openai.ChatEndpoints{
+		ChatEndpoint:             openai.ChatEndpoint(backend),
+		ChatStreamEndpoint:       openai.ChatStreamEndpoint(backend),
+		RegenerateStreamEndpoint: openai.RegenerateStreamEndpoint(backend),
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	instance := strings.TrimPrefix(server.URL, "http://")
+	client := func(makeEndpoint MakeEndpoint) endpoint.Endpoint {
+		e, _, err := ChatFactory(makeEndpoint, "http")(instance)
+		assert.NoError(err)
+		return e
+	}
+
+	// the gateway side
+	svc := openai.ProxyingMiddleware(&openai.ChatEndpoints{
+		ChatEndpoint:             client(ChatEndpoint),
+		ChatStreamEndpoint:       client(ChatStreamEndpoint),
+		RegenerateStreamEndpoint: client(RegenerateStreamEndpoint),
+	})(nil)
+
+	id, err := backend.CreateChat(ctx, "gpt-4", "", nil, chat.Access{})
+	assert.NoError(err)
+
+	answer, err := svc.Chat(ctx, "Hallo", id)
+	assert.NoError(err)
+	assert.Equal("Grüße!", answer)
+
+	stream, err := svc.ChatStream(ctx, "Hallo", id)
+	assert.NoError(err)
+
+	var sb strings.Builder
+	for chunk := range stream {
+		assert.NoError(chunk.Err)
+		sb.WriteString(chunk.Content)
+	}
+	assert.Equal("Grüße!", sb.String())
+
+	stream, err = svc.RegenerateStream(ctx, id)
+	assert.NoError(err)
+	for range stream {
+	}
+
+	c, err := chats.Find(id)
+	assert.NoError(err)
+	assert.Len(c.Messages, 5)
+
+	// errors of the backend come back as domain errors
+	missing := chat.NewChat("gpt-4", "", nil).ID
+
+	_, err = svc.Chat(ctx, "Hallo", missing)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+
+	_, err = svc.ChatStream(ctx, "Hallo", missing)
+	assert.ErrorIs(err, chat.ErrChatNotFound)
+}
+
+func TestProxiedStreamFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+
+	// fails after the first word
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Grü\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[]}\n\n")
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	backend := openai.NewService(chats, &conf.Config{BaseURL: upstream.URL})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	Router(r.Group("/openai/v1"), &openai.ChatEndpoints{
+		ChatStreamEndpoint: openai.ChatStreamEndpoint(backend),
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	e, _, err := ChatFactory(ChatStreamEndpoint, "http")(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(err)
+
+	svc := openai.ProxyingMiddleware(&openai.ChatEndpoints{ChatStreamEndpoint: e})(nil)
+
+	id, err := backend.CreateChat(ctx, "gpt-4", "", nil, chat.Access{})
+	assert.NoError(err)
+
+	stream, err := svc.ChatStream(ctx, "Hallo", id)
+	assert.NoError(err)
+
+	chunks := make([]chat.Chunk, 0)
+	for chunk := range stream {
+		chunks = append(chunks, chunk)
+	}
+
+	// the failure of the instance ends the answer
+	assert.Len(chunks, 2)
+	assert.Equal("Grü", chunks[0].Content)
+	assert.EqualError(chunks[1].Err, "invalid choices")
+}
+
+func TestForwardIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	backend := openai.NewService(chats, &conf.Config{})
+
+	keys, err := auth.NewKeyStore("", &auth.APIKey{ID: "ci", Hash: auth.HashKey("sk-ci"), Subject: "ci-bot", Tenant: "acme"})
+	assert.NoError(err)
+
+	gin.SetMode(gin.TestMode)
+
+	// an instance trusting the identity headers, as behind a proxy
+	r := gin.New()
+	r.ContextWithFallback = true
+	r.Use(TrustedIdentity())
+	r.Use(Authenticate(keys))
+	Router(r.Group("/openai/v1"), openai.AuthorizedEndpoints(&openai.ChatEndpoints{
+		CreateChatEndpoint: openai.CreateChatEndpoint(backend),
+	}, chats))
+
+	instance := httptest.NewServer(r)
+	defer instance.Close()
+
+	e, _, err := ChatFactory(CreateChatEndpoint, "http")(strings.TrimPrefix(instance.URL, "http://"))
+	assert.NoError(err)
+
+	svc := openai.ProxyingMiddleware(&openai.ChatEndpoints{CreateChatEndpoint: e})(nil)
+
+	gateway := func(identify ...gin.HandlerFunc) *httptest.Server {
+		g := gin.New()
+		g.ContextWithFallback = true
+		g.Use(identify...)
+		g.Use(ForwardIdentity())
+		Router(g.Group("/openai/v1"), &openai.ChatEndpoints{
+			CreateChatEndpoint: openai.CreateChatEndpoint(svc),
+		})
+
+		return httptest.NewServer(g)
+	}
+
+	create := func(server *httptest.Server, header map[string]string) (chat.Access, bool) {
+		var result model.Result
+
+		resp, err := resty.New().R().
+			SetHeaders(header).
+			SetBody(map[string]any{"model": "gpt-4"}).
+			SetResult(&result).
+			SetError(&result).
+			Post(server.URL + "/openai/v1/chats")
+
+		assert.NoError(err)
+		if resp.StatusCode() != http.StatusOK {
+			return chat.Access{}, false
+		}
+
+		id, err := chat.ParseID(result.Data.(string))
+		assert.NoError(err)
+
+		c, err := chats.Find(id)
+		assert.NoError(err)
+
+		return c.Access, true
+	}
+
+	exposed := gateway()
+	defer exposed.Close()
+
+	_, ok := create(exposed, nil)
+	assert.False(ok)
+
+	// the identity headers of the callers are not passed on
+	_, ok = create(exposed, map[string]string{
+		SubjectHeader: "mallory",
+		TenantHeader:  "acme",
+		ScopesHeader:  auth.AdminScope,
+	})
+	assert.False(ok)
+
+	// their credentials are
+	access, ok := create(exposed, map[string]string{
+		APIKeyHeader:  "sk-ci",
+		SubjectHeader: "mallory",
+	})
+	assert.True(ok)
+	assert.Equal(chat.Access{Tenant: "acme", Owner: "ci-bot"}, access)
+
+	access, ok = create(exposed, map[string]string{"Authorization": "Bearer sk-ci"})
+	assert.True(ok)
+	assert.Equal("ci-bot", access.Owner)
+
+	// and so are the identities the gateway trusts itself
+	proxied := gateway(TrustedIdentity())
+	defer proxied.Close()
+
+	access, ok = create(proxied, map[string]string{
+		SubjectHeader: "alice",
+		TenantHeader:  "acme",
+	})
+	assert.True(ok)
+	assert.Equal(chat.Access{Tenant: "acme", Owner: "alice"}, access)
+}
+
+func TestGatewayAdminRouter(t *testing.T) {
+	assert := assert.New(t)
+
+	backends := func(ctx context.Context, request any) (any, error) {
+		return []string{"a:80"}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.ContextWithFallback = true
+
+	admin := r.Group("/openai/v1/admin")
+	admin.Use(TrustedIdentity())
+	GatewayAdminRouter(admin, auth.AdminMiddleware(backends))
+
+	list := func(subject string, scopes string) int {
+		req := httptest.NewRequest(http.MethodGet, "/openai/v1/admin/backends", nil)
+		if subject != "" {
+			req.Header.Set(SubjectHeader, subject)
+			req.Header.Set(ScopesHeader, scopes)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, list("", ""))
+	assert.Equal(http.StatusForbidden, list("alice", ""))
+	assert.Equal(http.StatusOK, list("root", auth.AdminScope))
+}
+
+func TestReadChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan chat.Chunk, 64)
+	err := readChunks(iotest.OneByteReader(strings.NewReader("Grüße, 世界")), data)
+	close(data)
+
+	assert.NoError(err)
+
+	chunks := make([]string, 0)
+	for chunk := range data {
+		chunks = append(chunks, chunk.Content)
+	}
+
+	// never a broken rune, whatever the reads
+	assert.Equal("Grüße, 世界", strings.Join(chunks, ""))
+	assert.Contains(chunks, "ü")
+	assert.Contains(chunks, "世")
+
+	data = make(chan chat.Chunk, 64)
+	err = readChunks(iotest.TimeoutReader(strings.NewReader("Hi")), data)
+	close(data)
+
+	assert.ErrorIs(err, iotest.ErrTimeout)
+}
+
+func TestReadEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan chat.Chunk, 64)
+	err := readEvents(strings.NewReader(": comment\n\ndata: Hel\n\ndata:lo\ndata: world\n\ndata: [DONE]\n\ndata: ignored\n\n"), data)
+	close(data)
+
+	assert.NoError(err)
+
+	events := make([]string, 0)
+	for event := range data {
+		events = append(events, event.Content)
+	}
+
+	assert.Equal([]string{"Hel", "lo\nworld"}, events)
+
+	data = make(chan chat.Chunk, 64)
+	err = readEvents(strings.NewReader("data: Hel\n\nevent: error\ndata: {\"status\":\"failure\",\"msg\":\"upstream failed\"}\n\n"), data)
+	close(data)
+
+	assert.EqualError(err, "upstream failed")
+	assert.Len(data, 1)
+
+	// an answer cut short is not done
+	data = make(chan chat.Chunk, 64)
+	err = readEvents(strings.NewReader("data: Hel\n\n"), data)
+	close(data)
+
+	assert.ErrorIs(err, ErrStreamTruncated)
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mirror520/openai/health"
+	"github.com/mirror520/openai/model"
+)
+
+// ReadyTimeout bounds the checks of GET /readyz.
+const ReadyTimeout = 10 * time.Second
+
+// HealthRouter serves the probes. Probes carry no credentials, so register
+// it ahead of the authenticating middlewares.
+func HealthRouter(route gin.IRoutes, checks ...health.Check) {
+	// GET /healthz
+	route.GET("/healthz", HealthzHandler())
+
+	// GET /readyz
+	route.GET("/readyz", ReadyzHandler(checks...))
+}
+
+// HealthzHandler answers as long as the process serves requests.
+func HealthzHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, model.SuccessResult("alive"))
+	}
+}
+
+func ReadyzHandler(checks ...health.Check) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c, cancel := context.WithTimeout(ctx, ReadyTimeout)
+		defer cancel()
+
+		report := health.Run(c, checks...)
+		if !report.Ready {
+			result := model.FailureResult(errors.New("not ready"))
+			result.Data = report.Checks
+			ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, result)
+			return
+		}
+
+		result := model.SuccessResult("ready")
+		result.Data = report.Checks
+		ctx.JSON(http.StatusOK, result)
+	}
+}
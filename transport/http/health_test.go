@@ -0,0 +1,68 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/openai/health"
+	"github.com/mirror520/openai/model"
+)
+
+func TestHealthRouter(t *testing.T) {
+	assert := assert.New(t)
+
+	var err error
+	repository := health.Check{
+		Name: "repository",
+		Func: func(ctx context.Context) error { return err },
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	HealthRouter(r, repository)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	get := func(path string) (int, model.Result) {
+		resp, err := http.Get(server.URL + path)
+		if !assert.NoError(err) {
+			return 0, model.Result{}
+		}
+		defer resp.Body.Close()
+
+		var result model.Result
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	status, _ := get("/healthz")
+	assert.Equal(http.StatusOK, status)
+
+	status, result := get("/readyz")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(map[string]any{"repository": "ok"}, result.Data)
+
+	probe := ReadinessProbe("http")
+	instance := server.Listener.Addr().String()
+	assert.NoError(probe(context.Background(), instance))
+
+	err = errors.New("connection refused")
+
+	status, result = get("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, status)
+	assert.Equal(map[string]any{"repository": "connection refused"}, result.Data)
+
+	// still alive
+	status, _ = get("/healthz")
+	assert.Equal(http.StatusOK, status)
+
+	assert.ErrorContains(probe(context.Background(), instance), "connection refused")
+}
@@ -0,0 +1,143 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/model"
+)
+
+const (
+	TenantHeader  = "X-Tenant-ID"
+	SubjectHeader = "X-User-ID"
+	ScopesHeader  = "X-Scopes" // comma separated
+)
+
+// TrustedIdentity takes the caller from the headers set by an authenticating
+// proxy in front of the service; never expose such a service directly.
+//
+// The identity is put on the request context, so the engine needs
+// ContextWithFallback for the endpoints to see it.
+func TrustedIdentity() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		subject := ctx.GetHeader(SubjectHeader)
+		if subject == "" {
+			ctx.Next()
+			return
+		}
+
+		id := &auth.Identity{
+			Subject: subject,
+			Tenant:  ctx.GetHeader(TenantHeader),
+		}
+
+		if scopes := ctx.GetHeader(ScopesHeader); scopes != "" {
+			for _, scope := range strings.Split(scopes, ",") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					id.Scopes = append(id.Scopes, scope)
+				}
+			}
+		}
+
+		ctx.Request = ctx.Request.WithContext(auth.NewContext(ctx.Request.Context(), id))
+		ctx.Next()
+	}
+}
+
+// APIKeyHeader is an alternative to the bearer token in Authorization.
+const APIKeyHeader = "X-API-Key"
+
+// Authenticate requires a token accepted by the authenticator, as a bearer
+// token, in the X-API-Key header or, from browsers opening the chat socket,
+// as a subprotocol, see TokenSubprotocol. An identity already taken from
+// trusted headers is kept.
+func Authenticate(authenticator auth.Authenticator) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if _, ok := auth.FromContext(ctx.Request.Context()); ok {
+			ctx.Next()
+			return
+		}
+
+		token := ctx.GetHeader(APIKeyHeader)
+		if header := ctx.GetHeader("Authorization"); token == "" && len(header) > 7 {
+			if strings.EqualFold(header[:7], "Bearer ") {
+				token = strings.TrimSpace(header[7:])
+			}
+		}
+
+		if token == "" {
+			token = socketToken(ctx.Request)
+		}
+
+		if token == "" {
+			result := model.FailureResult(auth.ErrUnauthenticated)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, result)
+			return
+		}
+
+		id, err := authenticator.Authenticate(token)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, result)
+			return
+		}
+
+		ctx.Request = ctx.Request.WithContext(auth.NewContext(ctx.Request.Context(), id))
+		ctx.Next()
+	}
+}
+
+// CredentialHeaders carry the credentials of the caller, passed on as they
+// are to the instances behind the gateway.
+var CredentialHeaders = []string{"Authorization", APIKeyHeader}
+
+type forwardedKey struct{}
+
+// ForwardIdentity keeps the CredentialHeaders of the caller on the request
+// context, for the proxy clients to pass them on to the instances, which
+// authenticate the caller themselves; a token of the chat socket is passed
+// on as a bearer token. The identity headers sent by the
+// caller are dropped: they are only set from an identity the gateway
+// verified itself, e.g. by TrustedIdentity behind an authenticating proxy.
+func ForwardIdentity() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		header := make(http.Header)
+		for _, key := range CredentialHeaders {
+			if value := ctx.GetHeader(key); value != "" {
+				header.Set(key, value)
+			}
+		}
+
+		if len(header) == 0 {
+			if token := socketToken(ctx.Request); token != "" {
+				header.Set("Authorization", "Bearer "+token)
+			}
+		}
+
+		for _, key := range []string{SubjectHeader, TenantHeader, ScopesHeader} {
+			ctx.Request.Header.Del(key)
+		}
+
+		if id, ok := auth.FromContext(ctx.Request.Context()); ok {
+			header.Set(SubjectHeader, id.Subject)
+			header.Set(TenantHeader, id.Tenant)
+			header.Set(ScopesHeader, strings.Join(id.Scopes, ","))
+		}
+
+		if len(header) > 0 {
+			c := context.WithValue(ctx.Request.Context(), forwardedKey{}, header)
+			ctx.Request = ctx.Request.WithContext(c)
+		}
+
+		ctx.Next()
+	}
+}
+
+func forwarded(ctx context.Context) http.Header {
+	header, _ := ctx.Value(forwardedKey{}).(http.Header)
+	return header
+}
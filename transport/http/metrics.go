@@ -0,0 +1,74 @@
+package http
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPMetrics are observed by Instrument.
+type HTTPMetrics struct {
+	Requests metrics.Counter   // route, method, code
+	Duration metrics.Histogram // route, method, code; seconds, until streams end
+	InFlight metrics.Gauge     // route
+}
+
+// NewPrometheusHTTPMetrics registers the metrics with the default registerer.
+func NewPrometheusHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		Requests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "openai",
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests served.",
+		}, []string{"route", "method", "code"}),
+		Duration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "openai",
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the HTTP requests, of streams until they end.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.005, 2, 15),
+		}, []string{"route", "method", "code"}),
+		InFlight: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "openai",
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "HTTP requests being served.",
+		}, []string{"route"}),
+	}
+}
+
+// Instrument observes the requests by route, rather than by path, to keep
+// chat IDs out of the labels.
+func Instrument(m *HTTPMetrics) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		inFlight := m.InFlight.With("route", route)
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		begin := time.Now()
+
+		ctx.Next()
+
+		code := strconv.Itoa(ctx.Writer.Status())
+		m.Requests.With("route", route, "method", ctx.Request.Method, "code", code).Add(1)
+		m.Duration.With("route", route, "method", ctx.Request.Method, "code", code).Observe(time.Since(begin).Seconds())
+	}
+}
+
+// MetricsRouter serves the metrics of the default registry. Scrapers carry
+// no credentials, so register it ahead of the authenticating middlewares.
+func MetricsRouter(route gin.IRoutes) {
+	// GET /metrics
+	route.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
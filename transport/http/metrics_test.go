@@ -0,0 +1,61 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrument(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"route", "method", "code"})
+	inFlight := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "in_flight"}, []string{"route"})
+
+	m := &HTTPMetrics{
+		Requests: kitprometheus.NewCounter(requests),
+		Duration: kitprometheus.NewHistogram(prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"route", "method", "code"})),
+		InFlight: kitprometheus.NewGauge(inFlight),
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Instrument(m))
+	MetricsRouter(r)
+
+	r.GET("/chats/:id", func(ctx *gin.Context) {
+		assert.Equal(float64(1), testutil.ToFloat64(inFlight.WithLabelValues("/chats/:id")))
+		ctx.Status(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	for _, path := range []string{"/chats/01H0", "/chats/01H1", "/nowhere"} {
+		resp, err := http.Get(server.URL + path)
+		if assert.NoError(err) {
+			resp.Body.Close()
+		}
+	}
+
+	// by route, not by path
+	assert.Equal(float64(2), testutil.ToFloat64(requests.WithLabelValues("/chats/:id", "GET", "404")))
+	assert.Equal(float64(1), testutil.ToFloat64(requests.WithLabelValues("unmatched", "GET", "404")))
+	assert.Equal(float64(0), testutil.ToFloat64(inFlight.WithLabelValues("/chats/:id")))
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if assert.NoError(err) {
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Contains(string(body), "go_goroutines")
+	}
+}
@@ -0,0 +1,322 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/websocket"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/model"
+)
+
+// Frame types of the chat socket.
+const (
+	// from the client
+	MessageFrame    = "message"    // content: the user message to answer
+	RegenerateFrame = "regenerate" // answer the last user message again
+	CancelFrame     = "cancel"     // stop the answer, keeping what was streamed
+	OptionsFrame    = "options"    // options: as in PATCH /chats/:id
+	PingFrame       = "ping"
+
+	// to the client
+	DeltaFrame   = "delta"   // content: the next part of the answer
+	DoneFrame    = "done"    // content: the whole answer, canceled if it was stopped
+	UpdatedFrame = "updated" // the options were updated
+	ErrorFrame   = "error"   // error and its HTTP status, also ending a failed answer
+	PongFrame    = "pong"
+)
+
+// ChatFrame is a JSON text message of the chat socket.
+type ChatFrame struct {
+	Type     string          `json:"type"`
+	Content  string          `json:"content,omitempty"`
+	Options  json.RawMessage `json:"options,omitempty"`
+	Canceled bool            `json:"canceled,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Status   int             `json:"status,omitempty"`
+}
+
+const (
+	socketReadLimit  = 1 << 20
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = socketPongWait * 9 / 10
+)
+
+// Browsers cannot set headers on the socket, so they pass the token as a
+// subprotocol along with ChatSubprotocol, e.g.
+//
+//	new WebSocket(url, ["openai.chat", "bearer." + token])
+//
+// The server only ever agrees to ChatSubprotocol, never echoing the token.
+const (
+	ChatSubprotocol  = "openai.chat"
+	TokenSubprotocol = "bearer." // followed by the token
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{ChatSubprotocol},
+
+	// requests are authenticated by token rather than by cookie,
+	// so any origin is allowed as with CORS on the other routes
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// socketToken returns the token passed as a subprotocol, if any.
+func socketToken(r *http.Request) string {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token := strings.TrimPrefix(protocol, TokenSubprotocol); token != protocol {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// ChatSocketHandler serves an interactive session on a chat, answering one
+// message at a time. The chat is checked before upgrading the connection,
+// every frame then goes through the endpoint of its operation.
+func ChatSocketHandler(endpoints *openai.ChatEndpoints) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		if _, err := endpoints.FindChatEndpoint(ctx, &openai.FindChatRequest{ID: id}); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			// the upgrader has replied already
+			return
+		}
+		defer conn.Close()
+
+		s := &chatSocket{
+			ctx:       ctx.Request.Context(),
+			id:        id,
+			endpoints: endpoints,
+			conn:      conn,
+		}
+
+		s.serve()
+	}
+}
+
+type chatSocket struct {
+	ctx       context.Context
+	id        chat.ChatID
+	endpoints *openai.ChatEndpoints
+	conn      *websocket.Conn
+	writing   sync.Mutex
+
+	busy     bool // an answer is being streamed
+	canceled bool
+	answers  sync.WaitGroup
+	sync.Mutex
+}
+
+func (s *chatSocket) serve() {
+	s.conn.SetReadLimit(socketReadLimit)
+	s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go s.keepalive(done)
+
+	for {
+		_, bs, err := s.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		var frame *ChatFrame
+		if err := json.Unmarshal(bs, &frame); err != nil || frame == nil {
+			s.fail(errors.New("invalid frame"), http.StatusBadRequest)
+			continue
+		}
+
+		switch frame.Type {
+		case MessageFrame:
+			s.answer(s.endpoints.ChatStreamEndpoint, &openai.ChatRequest{
+				ID:      s.id,
+				Content: frame.Content,
+			})
+
+		case RegenerateFrame:
+			s.answer(s.endpoints.RegenerateStreamEndpoint, &openai.RegenerateRequest{
+				ID: s.id,
+			})
+
+		case CancelFrame:
+			s.cancel()
+
+		case OptionsFrame:
+			req := &openai.UpdateChatRequest{
+				ID:      s.id,
+				Options: frame.Options,
+			}
+
+			if _, err := s.endpoints.UpdateChatEndpoint(s.ctx, req); err != nil {
+				s.fail(err, http.StatusUnprocessableEntity)
+				continue
+			}
+
+			s.write(&ChatFrame{Type: UpdatedFrame})
+
+		case PingFrame:
+			s.write(&ChatFrame{Type: PongFrame})
+
+		default:
+			s.fail(errors.New("unknown frame type: "+frame.Type), http.StatusBadRequest)
+		}
+	}
+
+	// the client is gone, there is nobody left to answer
+	s.cancel()
+	s.answers.Wait()
+}
+
+func (s *chatSocket) keepalive(done <-chan struct{}) {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(socketWriteWait)
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// answer streams the answer of the endpoint, unless one is being streamed.
+func (s *chatSocket) answer(endpoint endpoint.Endpoint, req any) {
+	if endpoint == nil {
+		s.fail(errors.New("not supported"), http.StatusNotImplemented)
+		return
+	}
+
+	s.Lock()
+	if s.busy {
+		s.Unlock()
+		s.fail(errors.New("an answer is being streamed"), http.StatusConflict)
+		return
+	}
+
+	s.busy = true
+	s.canceled = false
+	s.Unlock()
+
+	s.answers.Add(1)
+
+	go func() {
+		defer s.answers.Done()
+
+		idle := func() bool {
+			s.Lock()
+			defer s.Unlock()
+
+			s.busy = false
+			return s.canceled
+		}
+
+		resp, err := endpoint(s.ctx, req)
+		if err != nil {
+			idle()
+			s.fail(err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		stream, ok := resp.(<-chan chat.Chunk)
+		if !ok {
+			idle()
+			s.fail(errors.New("invalid stream"), http.StatusInternalServerError)
+			return
+		}
+
+		var answer strings.Builder
+		for chunk := range stream {
+			if chunk.Err != nil {
+				// the answer failed instead of being done
+				idle()
+				s.fail(chunk.Err, http.StatusBadGateway)
+				return
+			}
+
+			answer.WriteString(chunk.Content)
+			s.write(&ChatFrame{Type: DeltaFrame, Content: chunk.Content})
+		}
+
+		canceled := idle()
+		s.write(&ChatFrame{Type: DoneFrame, Content: answer.String(), Canceled: canceled})
+	}()
+}
+
+func (s *chatSocket) cancel() {
+	s.Lock()
+	if !s.busy || s.canceled {
+		s.Unlock()
+		return
+	}
+
+	s.canceled = true
+	s.Unlock()
+
+	req := &openai.CancelChatRequest{
+		ID: s.id,
+	}
+
+	if _, err := s.endpoints.CancelChatEndpoint(s.ctx, req); err != nil {
+		s.fail(err, http.StatusUnprocessableEntity)
+	}
+}
+
+func (s *chatSocket) fail(err error, fallback int) {
+	s.write(&ChatFrame{
+		Type:   ErrorFrame,
+		Error:  err.Error(),
+		Status: errorStatus(err, fallback),
+	})
+}
+
+// write sends a frame, errors are left to the reading loop to notice.
+func (s *chatSocket) write(frame *ChatFrame) {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	s.conn.WriteJSON(frame)
+}
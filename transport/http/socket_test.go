@@ -0,0 +1,226 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/sqlite"
+)
+
+type chatSocketTestSuite struct {
+	suite.Suite
+	upstream *httptest.Server
+	server   *httptest.Server
+	chats    chat.Repository
+	svc      openai.Service
+}
+
+// upstream streams "0 1 2 ... 19 ", one word every 10ms.
+func (suite *chatSocketTestSuite) SetupSuite() {
+	suite.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		for i := 0; i < 20; i++ {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%d \"}}]}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+
+	// append-only, the regenerated answers must be replaced explicitly
+	chats, err := sqlite.NewChatRepository(filepath.Join(suite.T().TempDir(), "chats.db"))
+	suite.Require().NoError(err)
+
+	suite.chats = chats
+	suite.svc = openai.NewService(suite.chats, &conf.Config{BaseURL: suite.upstream.URL})
+
+	endpoints := &openai.ChatEndpoints{
+		UpdateChatEndpoint:       openai.UpdateChatEndpoint(suite.svc),
+		ChatStreamEndpoint:       openai.ChatStreamEndpoint(suite.svc),
+		RegenerateStreamEndpoint: openai.RegenerateStreamEndpoint(suite.svc),
+		CancelChatEndpoint:       openai.CancelChatEndpoint(suite.svc),
+		FindChatEndpoint:         openai.FindChatEndpoint(suite.svc),
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/chats/:id/ws", ChatSocketHandler(endpoints))
+
+	suite.server = httptest.NewServer(r)
+}
+
+func (suite *chatSocketTestSuite) dial(id chat.ChatID) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(suite.server.URL, "http") + "/chats/" + id.String() + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	suite.Require().NoError(err)
+
+	return conn
+}
+
+func (suite *chatSocketTestSuite) newChat() chat.ChatID {
+	id, err := suite.svc.CreateChat(context.Background(), "gpt-3.5-turbo", "", nil, chat.Access{})
+	suite.Require().NoError(err)
+
+	return id
+}
+
+// next reads frames up to the first one of the type.
+func (suite *chatSocketTestSuite) next(conn *websocket.Conn, frameType string) *ChatFrame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		var frame *ChatFrame
+		suite.Require().NoError(conn.ReadJSON(&frame))
+
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+func (suite *chatSocketTestSuite) TestAnswer() {
+	id := suite.newChat()
+
+	conn := suite.dial(id)
+	defer conn.Close()
+
+	conn.WriteJSON(&ChatFrame{Type: PingFrame})
+	suite.next(conn, PongFrame)
+
+	conn.WriteJSON(&ChatFrame{Type: MessageFrame, Content: "count"})
+
+	delta := suite.next(conn, DeltaFrame)
+	suite.Equal("0 ", delta.Content)
+
+	// one answer at a time
+	conn.WriteJSON(&ChatFrame{Type: MessageFrame, Content: "again"})
+	failed := suite.next(conn, ErrorFrame)
+	suite.Equal(http.StatusConflict, failed.Status)
+
+	done := suite.next(conn, DoneFrame)
+	suite.False(done.Canceled)
+	suite.True(strings.HasSuffix(done.Content, "18 19 "))
+
+	c, err := suite.chats.Find(id)
+	suite.NoError(err)
+	suite.Len(c.Messages, 3)
+	suite.Equal(done.Content, c.Messages[2].Content)
+
+	conn.WriteJSON(&ChatFrame{Type: OptionsFrame, Options: []byte(`{"temperature":0.5}`)})
+	suite.next(conn, UpdatedFrame)
+
+	conn.WriteJSON(&ChatFrame{Type: "unknown"})
+	failed = suite.next(conn, ErrorFrame)
+	suite.Equal(http.StatusBadRequest, failed.Status)
+}
+
+func (suite *chatSocketTestSuite) TestCancelAndRegenerate() {
+	id := suite.newChat()
+
+	conn := suite.dial(id)
+	defer conn.Close()
+
+	conn.WriteJSON(&ChatFrame{Type: MessageFrame, Content: "count"})
+	suite.next(conn, DeltaFrame)
+
+	conn.WriteJSON(&ChatFrame{Type: CancelFrame})
+
+	done := suite.next(conn, DoneFrame)
+	suite.True(done.Canceled)
+	suite.False(strings.HasSuffix(done.Content, "19 "))
+
+	// what was streamed is kept
+	c, err := suite.chats.Find(id)
+	suite.NoError(err)
+	suite.Len(c.Messages, 3)
+	suite.Equal(done.Content, c.Messages[2].Content)
+
+	conn.WriteJSON(&ChatFrame{Type: RegenerateFrame})
+
+	done = suite.next(conn, DoneFrame)
+	suite.False(done.Canceled)
+
+	c, err = suite.chats.Find(id)
+	suite.NoError(err)
+	suite.Len(c.Messages, 3)
+	suite.True(strings.HasSuffix(c.Messages[2].Content, "19 "))
+}
+
+func (suite *chatSocketTestSuite) TestUnknownChat() {
+	url := "ws" + strings.TrimPrefix(suite.server.URL, "http") + "/chats/" + chat.NewChat("", "", nil).ID.String() + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	suite.Error(err)
+	suite.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *chatSocketTestSuite) TestSubprotocolToken() {
+	keys, err := auth.NewKeyStore("", &auth.APIKey{ID: "web", Hash: auth.HashKey("sk-web"), Subject: "alice"})
+	suite.Require().NoError(err)
+
+	r := gin.New()
+	r.ContextWithFallback = true
+	r.Use(Authenticate(keys))
+	r.GET("/chats/:id/ws", ChatSocketHandler(&openai.ChatEndpoints{
+		FindChatEndpoint: openai.FindChatEndpoint(suite.svc),
+	}))
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/chats/" + suite.newChat().String() + "/ws"
+
+	// browsers cannot set headers
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	suite.Error(err)
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	dialer := &websocket.Dialer{Subprotocols: []string{ChatSubprotocol, TokenSubprotocol + "sk-wrong"}}
+	_, resp, err = dialer.Dial(url, nil)
+	suite.Error(err)
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	dialer.Subprotocols = []string{ChatSubprotocol, TokenSubprotocol + "sk-web"}
+	conn, _, err := dialer.Dial(url, nil)
+	suite.Require().NoError(err)
+	defer conn.Close()
+
+	// the token is never echoed
+	suite.Equal(ChatSubprotocol, conn.Subprotocol())
+
+	conn.WriteJSON(&ChatFrame{Type: PingFrame})
+	suite.next(conn, PongFrame)
+}
+
+func (suite *chatSocketTestSuite) TearDownSuite() {
+	suite.server.Close()
+	suite.upstream.Close()
+	suite.chats.Close()
+}
+
+func TestChatSocketTestSuite(t *testing.T) {
+	suite.Run(t, new(chatSocketTestSuite))
+}
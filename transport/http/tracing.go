@@ -0,0 +1,12 @@
+package http
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// Trace spans the requests by route, continuing the traces of the callers,
+// e.g. of the gateway.
+func Trace(service string) gin.HandlerFunc {
+	return otelgin.Middleware(service)
+}
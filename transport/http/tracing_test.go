@@ -0,0 +1,112 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/conf"
+	"github.com/mirror520/openai/persistent/inmem"
+)
+
+func TestTracedProxiedChat(t *testing.T) {
+	assert := assert.New(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Grüße!"}}],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`))
+	}))
+	defer upstream.Close()
+
+	chats := inmem.NewChatRepository()
+	defer chats.Close()
+
+	backend := openai.NewService(chats, &conf.Config{BaseURL: upstream.URL})
+	backend = openai.TracingMiddleware()(backend)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.ContextWithFallback = true
+	r.Use(Trace("openai"))
+	Router(r.Group("/openai/v1"), openai.TracedEndpoints(&openai.ChatEndpoints{
+		ChatEndpoint: openai.ChatEndpoint(backend),
+	}))
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	instance := strings.TrimPrefix(server.URL, "http://")
+	e, _, err := ChatFactory(ChatEndpoint, "http")(instance)
+	assert.NoError(err)
+
+	// the gateway side
+	svc := openai.ProxyingMiddleware(&openai.ChatEndpoints{
+		ChatEndpoint: e,
+	})(nil)
+	svc = openai.TracingMiddleware()(svc)
+
+	id, err := backend.CreateChat(context.Background(), "gpt-4", "", nil, chat.Access{})
+	assert.NoError(err)
+
+	exporter.Reset()
+
+	answer, err := svc.Chat(context.Background(), "Hallo", id)
+	assert.NoError(err)
+	assert.Equal("Grüße!", answer)
+
+	spans := exporter.GetSpans()
+
+	var gateway, call, handler tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == "openai.Service/Chat" && !span.Parent.IsValid() {
+			gateway = span
+		}
+	}
+
+	names := make([]string, 0)
+	for _, span := range spans {
+		names = append(names, span.Name)
+
+		switch {
+		case span.SpanKind == trace.SpanKindServer:
+			handler = span
+		case span.Name == "HTTP POST" && span.Parent.SpanID() == gateway.SpanContext.SpanID():
+			call = span
+		}
+	}
+
+	assert.True(gateway.SpanContext.IsValid())
+	assert.Equal("/openai/v1/chats/:id/messages", handler.Name)
+
+	// propagated across the hop
+	assert.True(call.SpanContext.IsValid())
+	assert.Equal(call.SpanContext.SpanID(), handler.Parent.SpanID())
+
+	// one trace, from the gateway to the call upstream
+	for _, span := range spans {
+		assert.Equal(gateway.SpanContext.TraceID(), span.SpanContext.TraceID(), span.Name)
+	}
+
+	assert.Contains(names, "endpoint/Chat")
+	assert.Contains(names, "chat.Repository/Find")
+	assert.Contains(names, "HTTP POST")
+	assert.Len(names, 8) // gateway: service, call; svc: handler, endpoint, service, find, store, call
+}
@@ -1,15 +1,24 @@
 package http
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
 
 	"github.com/mirror520/openai"
+	"github.com/mirror520/openai/auth"
 	"github.com/mirror520/openai/chat"
+	"github.com/mirror520/openai/chat/transcript"
+	"github.com/mirror520/openai/dataset"
+	"github.com/mirror520/openai/discovery"
 	"github.com/mirror520/openai/model"
 )
 
@@ -25,6 +34,98 @@ func Router(route *gin.RouterGroup, endpoints *openai.ChatEndpoints) {
 		endpoints.ChatEndpoint,
 		endpoints.ChatStreamEndpoint,
 	))
+
+	// POST /chats/:id/regenerate
+	route.POST("/chats/:id/regenerate", RegenerateHandler(endpoints.RegenerateStreamEndpoint))
+
+	// POST /chats/:id/cancel
+	route.POST("/chats/:id/cancel", CancelChatHandler(endpoints.CancelChatEndpoint))
+
+	// GET /chats/:id/ws
+	route.GET("/chats/:id/ws", ChatSocketHandler(endpoints))
+
+	// GET /chats
+	route.GET("/chats", ListChatsHandler(endpoints.ListChatsEndpoint))
+
+	// GET /chats/:id
+	route.GET("/chats/:id", FindChatHandler(endpoints.FindChatEndpoint))
+
+	// GET /chats/:id/messages
+	route.GET("/chats/:id/messages", ListMessagesHandler(endpoints.ListMessagesEndpoint))
+
+	// DELETE /chats/:id
+	route.DELETE("/chats/:id", DeleteChatHandler(endpoints.DeleteChatEndpoint))
+
+	// GET /chats/export
+	route.GET("/chats/export", ExportChatsHandler(endpoints.ExportChatsEndpoint))
+
+	// POST /chats/import
+	route.POST("/chats/import", ImportChatsHandler(endpoints.ImportChatsEndpoint))
+
+	// GET /chats/:id/export
+	route.GET("/chats/:id/export", ExportChatHandler(endpoints.ExportChatEndpoint))
+
+	// PUT /chats/:id/annotation
+	route.PUT("/chats/:id/annotation", AnnotateChatHandler(endpoints.AnnotateChatEndpoint))
+
+	// PUT /chats/:id/members/:subject
+	route.PUT("/chats/:id/members/:subject", ShareChatHandler(endpoints.ShareChatEndpoint))
+
+	// DELETE /chats/:id/members/:subject
+	route.DELETE("/chats/:id/members/:subject", ShareChatHandler(endpoints.ShareChatEndpoint))
+
+	// POST /datasets
+	route.POST("/datasets", BuildDatasetHandler(endpoints.BuildDatasetEndpoint))
+}
+
+// MaxImportSize limits the request body of POST /chats/import.
+const MaxImportSize = 32 << 20
+
+// errorStatus maps domain errors to HTTP status codes,
+// falling back to the given status for anything else.
+func errorStatus(err error, fallback int) int {
+	if errors.Is(err, auth.ErrUnauthenticated) {
+		return http.StatusUnauthorized
+	}
+
+	if errors.Is(err, auth.ErrForbidden) {
+		return http.StatusForbidden
+	}
+
+	if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, auth.ErrKeyNotFound) {
+		return http.StatusNotFound
+	}
+
+	if errors.Is(err, chat.ErrConflict) {
+		return http.StatusConflict
+	}
+
+	if errors.Is(err, openai.ErrMultipleChoices) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, openai.ErrQueueFull) {
+		return http.StatusTooManyRequests
+	}
+
+	if errors.Is(err, openai.ErrQueueTimeout) {
+		return http.StatusServiceUnavailable
+	}
+
+	// nothing to answer, behind the gateway or upstream
+	if errors.Is(err, lb.ErrNoEndpoints) || discovery.Unreachable(err) {
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, discovery.ErrTimeout) {
+		return http.StatusGatewayTimeout
+	}
+
+	if errors.Is(err, discovery.ErrNotShared) {
+		return http.StatusNotImplemented
+	}
+
+	return fallback
 }
 
 func CreateChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
@@ -39,7 +140,7 @@ func CreateChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
 		resp, err := endpoint(ctx, req)
 		if err != nil {
 			result := model.FailureResult(err)
-			ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, result)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
 			return
 		}
 
@@ -70,7 +171,7 @@ func UpdateChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
 		resp, err := endpoint(ctx, req)
 		if err != nil {
 			result := model.FailureResult(err)
-			ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, result)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
 			return
 		}
 
@@ -110,7 +211,7 @@ func ChatHandler(chatEndpoint endpoint.Endpoint, chatStreamEndpoint endpoint.End
 			resp, err := chatEndpoint(ctx, req)
 			if err != nil {
 				result := model.FailureResult(err)
-				ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, result)
+				ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
 				return
 			}
 
@@ -122,11 +223,11 @@ func ChatHandler(chatEndpoint endpoint.Endpoint, chatStreamEndpoint endpoint.End
 			resp, err := chatStreamEndpoint(ctx, req)
 			if err != nil {
 				result := model.FailureResult(err)
-				ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, result)
+				ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
 				return
 			}
 
-			stream, ok := resp.(<-chan string)
+			stream, ok := resp.(<-chan chat.Chunk)
 			if !ok {
 				err := errors.New("invalid stream")
 				result := model.FailureResult(err)
@@ -134,13 +235,467 @@ func ChatHandler(chatEndpoint endpoint.Endpoint, chatStreamEndpoint endpoint.End
 				return
 			}
 
-			w := ctx.Writer
-			w.WriteHeader(http.StatusOK)
+			writeStream(ctx, stream)
+		}
+	}
+}
+
+// RegenerateHandler streams a new answer in place of the last one.
+func RegenerateHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req := &openai.RegenerateRequest{
+			ID: id,
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		stream, ok := resp.(<-chan chat.Chunk)
+		if !ok {
+			err := errors.New("invalid stream")
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, result)
+			return
+		}
+
+		writeStream(ctx, stream)
+	}
+}
+
+// writeStream writes the answer as chunked text, or as server-sent events
+// if the client accepts them: the content in data events, a failure in an
+// error event carrying the result, and [DONE] once answered. Chunked text
+// has no room for a failure, the answer only ends early.
+//
+// Every write carries the next delta of the answer; the clients append
+// them. Streams used to repeat the content accumulated so far, lagging a
+// chunk behind.
+func writeStream(ctx *gin.Context, stream <-chan chat.Chunk) {
+	w := ctx.Writer
+
+	events := strings.Contains(ctx.GetHeader("Accept"), "text/event-stream")
+	if events {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	failed := false
+	for chunk := range stream {
+		switch {
+		case !events:
+			w.WriteString(chunk.Content)
 
-			for content := range stream {
-				w.WriteString(content)
-				w.Flush()
+		case chunk.Err != nil:
+			failed = true
+
+			data, _ := json.Marshal(model.FailureResult(chunk.Err))
+			w.WriteString("event: error\ndata: ")
+			w.Write(data)
+			w.WriteString("\n\n")
+
+		default:
+			for _, line := range strings.Split(chunk.Content, "\n") {
+				w.WriteString("data: " + line + "\n")
 			}
+			w.WriteString("\n")
+		}
+
+		w.Flush()
+	}
+
+	if events && !failed {
+		w.WriteString("data: [DONE]\n\n")
+		w.Flush()
+	}
+}
+
+func CancelChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req := &openai.CancelChatRequest{
+			ID: id,
 		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chat canceled")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func ListChatsHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ListChatsRequest)
+		if err := ctx.ShouldBindQuery(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chats listed")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func FindChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req := &openai.FindChatRequest{
+			ID: id,
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chat found")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func ListMessagesHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ListMessagesRequest)
+		if err := ctx.ShouldBindQuery(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.ID = id
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("messages listed")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func DeleteChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req := &openai.DeleteChatRequest{
+			ID: id,
+		}
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chat deleted")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func ExportChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ExportChatRequest)
+		if err := ctx.ShouldBindQuery(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		format, err := transcript.ParseFormat(string(req.Format))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.ID = id
+		req.Format = format
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		data, ok := resp.([]byte)
+		if !ok {
+			err := errors.New("invalid export")
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, result)
+			return
+		}
+
+		ctx.Data(http.StatusOK, format.ContentType(), data)
+	}
+}
+
+func ExportChatsHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ExportChatsRequest)
+		if err := ctx.ShouldBindQuery(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		format, err := transcript.ParseFormat(string(req.Format))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.Format = format
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		data, ok := resp.([]byte)
+		if !ok {
+			err := errors.New("invalid export")
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, result)
+			return
+		}
+
+		ctx.Data(http.StatusOK, format.ContentType(), data)
+	}
+}
+
+func ImportChatsHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ImportChatsRequest)
+		if err := ctx.ShouldBindQuery(req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		format, err := transcript.ParseFormat(string(req.Format))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, MaxImportSize))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.Format = format
+		req.Data = data
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chats imported")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+func AnnotateChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req *openai.AnnotateChatRequest
+		if err := ctx.ShouldBind(&req); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.ID = id
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chat annotated")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+// ShareChatHandler grants the role in the body to the subject,
+// or revokes any role on DELETE.
+func ShareChatHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(openai.ShareChatRequest)
+		if ctx.Request.Method != http.MethodDelete {
+			if err := ctx.ShouldBind(req); err != nil {
+				result := model.FailureResult(err)
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+				return
+			}
+
+			if _, ok := chat.ParseMemberRole(string(req.Role)); !ok {
+				err := errors.New("invalid role: " + string(req.Role))
+				result := model.FailureResult(err)
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+				return
+			}
+		}
+
+		id, err := chat.ParseID(ctx.Param("id"))
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		req.ID = id
+		req.Subject = ctx.Param("subject")
+
+		resp, err := endpoint(ctx, req)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		result := model.SuccessResult("chat shared")
+		result.Data = resp
+		ctx.JSON(http.StatusOK, result)
+	}
+}
+
+// BuildDatasetHandler answers with the dataset and its stats,
+// or with the JSONL of a single split given ?split=train|validation.
+func BuildDatasetHandler(endpoint endpoint.Endpoint) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var spec *dataset.Spec
+		if err := ctx.ShouldBind(&spec); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		split := dataset.Split(ctx.Query("split"))
+		if split != "" && split != dataset.TrainSplit && split != dataset.ValidationSplit {
+			err := errors.New("invalid split: " + string(split))
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, result)
+			return
+		}
+
+		resp, err := endpoint(ctx, spec)
+		if err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(errorStatus(err, http.StatusUnprocessableEntity), result)
+			return
+		}
+
+		ds, ok := resp.(*dataset.Dataset)
+		if !ok {
+			err := errors.New("invalid dataset")
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, result)
+			return
+		}
+
+		if split == "" {
+			result := model.SuccessResult("dataset built")
+			result.Data = ds
+			ctx.JSON(http.StatusOK, result)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := ds.WriteJSONL(&buf, split); err != nil {
+			result := model.FailureResult(err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, result)
+			return
+		}
+
+		ctx.Data(http.StatusOK, transcript.FineTune.ContentType(), buf.Bytes())
 	}
 }